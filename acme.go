@@ -0,0 +1,122 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	eabCmd        = app.Command("acme-eab", "Create ACME External Account Binding credentials and the binding JWS for newAccount")
+	eabKid        = eabCmd.Flag("eab-kid", "Key identifier of existing EAB credentials; new ones are generated if omitted").String()
+	eabHMACKey    = eabCmd.Flag("eab-hmac-key", "Base64url MAC key of existing EAB credentials; visible to other users in the process list, prefer --eab-hmac-key-file").String()
+	eabHMACFile   = eabCmd.Flag("eab-hmac-key-file", "Read the base64url MAC key of existing EAB credentials from FILE").PlaceHolder("FILE").String()
+	eabAccountKey = eabCmd.Flag("account-key", "ACME account JWK to bind; the binding JWS is only output with one").String()
+	eabURL        = eabCmd.Flag("url", "newAccount URL of the ACME server, for the binding JWS").String()
+	eabFormat     = eabCmd.Flag("format", "Out JSON with format").Bool()
+)
+
+// ExternalAccountBinding holds EAB credentials in the encoding ACME servers
+// hand them out in (RFC 8555, section 7.3.4), and optionally the
+// externalAccountBinding member of a newAccount request made with them.
+type ExternalAccountBinding struct {
+	KeyID   string          `json:"kid"`
+	HMACKey string          `json:"hmac_key"`
+	JWS     json.RawMessage `json:"externalAccountBinding,omitempty"`
+}
+
+// signEAB makes the binding JWS: the account's public key, MACed with the
+// EAB key and naming its kid and the newAccount URL.
+func signEAB(hmacKey []byte, keyID, newAccountURL string, account *jose.JSONWebKey) ([]byte, error) {
+	payload, err := account.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	opts := (&jose.SignerOptions{}).WithHeader("kid", keyID).WithHeader("url", newAccountURL)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: hmacKey}, opts)
+	if err != nil {
+		return nil, err
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(jws.FullSerialize()), nil
+}
+
+func acmeEAB() {
+	hmacKeyB64 := *eabHMACKey
+	switch {
+	case *eabHMACKey != "" && *eabHMACFile != "":
+		app.FatalUsage("can't combine --eab-hmac-key and --eab-hmac-key-file")
+	case *eabHMACFile != "":
+		var err error
+		hmacKeyB64, err = readSecretFile(*eabHMACFile)
+		app.FatalIfError(err, "can't read EAB MAC key")
+	case *eabHMACKey != "":
+		warnArgvSecret("--eab-hmac-key", "--eab-hmac-key-file")
+	}
+	if (*eabKid == "") != (hmacKeyB64 == "") {
+		app.FatalUsage("--eab-kid and --eab-hmac-key or --eab-hmac-key-file must be given together")
+	}
+	if (*eabAccountKey == "") != (*eabURL == "") {
+		app.FatalUsage("--account-key and --url must be given together")
+	}
+
+	enc := base64.RawURLEncoding
+	eab := ExternalAccountBinding{KeyID: *eabKid, HMACKey: hmacKeyB64}
+	if eab.KeyID == "" {
+		id, err := keygen.RandomKey(128)
+		app.FatalIfError(err, "can't generate EAB key identifier")
+		key, err := keygen.RandomKey(256)
+		app.FatalIfError(err, "can't generate EAB MAC key")
+		eab.KeyID, eab.HMACKey = enc.EncodeToString(id), enc.EncodeToString(key)
+	}
+
+	if *eabAccountKey != "" {
+		hmacKey, err := enc.DecodeString(eab.HMACKey)
+		if err != nil || len(hmacKey) == 0 {
+			app.FatalUsage("the EAB MAC key must be unpadded base64url")
+		}
+		if u, err := url.Parse(*eabURL); err != nil || u.Scheme == "" || u.Host == "" {
+			app.FatalUsage("--url must be an absolute URL")
+		}
+		account, err := readJWK(*eabAccountKey)
+		app.FatalIfError(err, "can't read account key %s", *eabAccountKey)
+		// The payload must match the jwk header of the newAccount request,
+		// which clients send without kid, use or alg.
+		pub := jose.JSONWebKey{Key: account.Public().Key}
+		if pub.Key == nil {
+			app.Fatalf("%s is a symmetric key, ACME account keys are asymmetric", *eabAccountKey)
+		}
+		eab.JWS, err = signEAB(hmacKey, eab.KeyID, *eabURL, &pub)
+		app.FatalIfError(err, "can't sign external account binding")
+	}
+
+	out, err := json.Marshal(eab)
+	app.FatalIfError(err, "can't Marshal EAB credentials to JSON")
+	if *eabFormat {
+		out = formatJSON(out)
+	}
+	fmt.Println(string(out))
+}
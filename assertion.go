@@ -0,0 +1,83 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+var (
+	assertionCmd      = app.Command("client-assertion", "Mint an RFC 7523 private_key_jwt client assertion for OAuth 2.0 client authentication")
+	assertionKey      = assertionCmd.Flag("key", "Private JWK of the client").Required().String()
+	assertionClientID = assertionCmd.Flag("client-id", "OAuth client ID, used as iss and sub").Required().String()
+	assertionTokenURL = assertionCmd.Flag("token-url", "Token endpoint of the authorization server, used as aud").Required().String()
+	assertionAlg      = assertionCmd.Flag("alg", "Algorithm to sign with, if the key has no alg").String()
+	assertionLifetime = assertionCmd.Flag("lifetime", "How long the assertion is valid").Default("5m").Duration()
+	assertionForm     = assertionCmd.Flag("form", "Print the token request parameters, URL encoded, instead of the bare JWT").Bool()
+)
+
+// clientAssertionType is the client_assertion_type of JWT assertions.
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// ClientAssertion holds the claims RFC 7523, section 3 requires.
+type ClientAssertion struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	Audience string `json:"aud"`
+	ID       string `json:"jti"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+}
+
+func clientAssertion() {
+	key, alg, constraints, err := readSigningKey(*assertionKey, *assertionAlg)
+	app.FatalIfError(err, "can't use key %s", *assertionKey)
+	if u, err := url.Parse(*assertionTokenURL); err != nil || u.Scheme == "" || u.Host == "" {
+		app.FatalUsage("--token-url must be an absolute URL")
+	}
+	if *assertionLifetime <= 0 {
+		app.FatalUsage("--lifetime must be positive")
+	}
+
+	jti, err := newJTI()
+	app.FatalIfError(err, "can't generate jti")
+	now := timestamp()
+	claims := ClientAssertion{
+		Issuer:   *assertionClientID,
+		Subject:  *assertionClientID,
+		Audience: *assertionTokenURL,
+		ID:       jti,
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(*assertionLifetime).Unix(),
+	}
+	payload, err := json.Marshal(claims)
+	app.FatalIfError(err, "can't Marshal claims to JSON")
+	app.FatalIfError(constraints.check(payload), "refusing to sign with %s", *assertionKey)
+	token, err := signJWS(key, alg, "JWT", nil, payload)
+	app.FatalIfError(err, "can't sign client assertion")
+
+	if *assertionForm {
+		fmt.Println(url.Values{
+			"client_assertion_type": {clientAssertionType},
+			"client_assertion":      {token},
+		}.Encode())
+		return
+	}
+	fmt.Println(token)
+}
@@ -0,0 +1,245 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awsCredentials are read from the standard AWS_* environment variables
+// only, to keep them off the command line.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+func awsCredentialsFromEnv() (awsCredentials, error) {
+	c := awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return c, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return c, nil
+}
+
+// awsEscape percent-encodes everything but the unreserved characters, as
+// Signature Version 4 requires. Slashes are kept when path is set.
+func awsEscape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', path && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signAWS adds Signature Version 4 headers to req, whose body is payload.
+func signAWS(req *http.Request, payload []byte, service, region string, creds awsCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	sum := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(sum[:])
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method, path, strings.Join(params, "&"),
+		canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// s3Object addresses an object in S3 or an S3-compatible store.
+type s3Object struct {
+	Region   string
+	Endpoint string // path-style endpoint, for S3-compatible stores
+	Bucket   string
+	Key      string
+}
+
+// URL is where the object can be fetched from once it is public.
+func (o s3Object) URL() string {
+	if o.Endpoint != "" {
+		return strings.TrimSuffix(o.Endpoint, "/") + "/" + o.Bucket + "/" + awsEscape(o.Key, true)
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", o.Bucket, o.Region, awsEscape(o.Key, true))
+}
+
+// s3Request sends a signed request for an object, with data as its body,
+// and returns the response with its body read.
+func s3Request(method string, o s3Object, data []byte, header http.Header, creds awsCredentials) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, o.URL(), bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signAWS(req, data, "s3", o.Region, creds, time.Now())
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+// s3Put uploads data to an object.
+func s3Put(o s3Object, data []byte, contentType string, creds awsCredentials) error {
+	_, err := s3PutIf(o, data, contentType, nil, creds)
+	return err
+}
+
+// s3PutIf uploads data to an object if the preconditions in header hold,
+// reporting false if they don't.
+func s3PutIf(o s3Object, data []byte, contentType string, header http.Header, creds awsCredentials) (bool, error) {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", contentType)
+	resp, body, err := s3Request("PUT", o, data, header, creds)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPreconditionFailed, resp.StatusCode == http.StatusConflict:
+		// 409 is S3 telling of a conditional write racing another.
+		return false, nil
+	case resp.StatusCode/100 != 2:
+		return false, fmt.Errorf("PUT %s responded with %s: %s", o.URL(), resp.Status, bytes.TrimSpace(body))
+	}
+	return true, nil
+}
+
+// s3Store is the kvStore of the objects under an S3 prefix. Its
+// compare-and-set is a PUT conditional on the ETag get returned, or on
+// there being no object.
+type s3Store struct {
+	obj   func(key string) s3Object
+	creds awsCredentials
+}
+
+func (s *s3Store) get(key string) ([]byte, string, error) {
+	o := s.obj(key)
+	resp, body, err := s3Request("GET", o, nil, nil, s.creds)
+	if err != nil {
+		return nil, "", err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, "", nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, "", fmt.Errorf("GET %s responded with %s: %s", o.URL(), resp.Status, bytes.TrimSpace(body))
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return nil, "", fmt.Errorf("GET %s responded without an ETag", o.URL())
+	}
+	return body, etag, nil
+}
+
+func (s *s3Store) set(key string, value []byte, version string, ttl time.Duration) (bool, error) {
+	if ttl > 0 {
+		return false, errors.New("S3 objects can't expire, drop --ttl")
+	}
+	header := http.Header{}
+	if version == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", version)
+	}
+	return s3PutIf(s.obj(key), value, "application/json", header, s.creds)
+}
+
+func (s *s3Store) close() error {
+	return nil
+}
@@ -0,0 +1,116 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// The bindings are generate, convert and inspect as called from other
+// languages: from JavaScript when built for the browser, see wasm_js.go,
+// and from C when built as a shared library, see cshared.go.
+
+// bindingOptions are the options generate and convert take.
+type bindingOptions struct {
+	Use       string `json:"use"`
+	Alg       string `json:"alg"`
+	Bits      int    `json:"bits"`
+	Curve     string `json:"crv"`
+	KeyID     string `json:"kid"`
+	RandomKID bool   `json:"randomKid"`
+}
+
+// bindingKeys is what generate and convert return, the public key being
+// null for symmetric keys and the private one for public keys.
+type bindingKeys struct {
+	Private json.RawMessage `json:"private"`
+	Public  json.RawMessage `json:"public"`
+}
+
+func newBindingKeys(priv, pub jose.JSONWebKey) (bindingKeys, error) {
+	keys := bindingKeys{Private: json.RawMessage("null"), Public: json.RawMessage("null")}
+	var err error
+	if priv.Key != nil {
+		if keys.Private, err = marshalJWK(priv); err != nil {
+			return keys, err
+		}
+	}
+	if pub.Key != nil {
+		keys.Public, err = marshalJWK(pub)
+	}
+	return keys, err
+}
+
+func bindGenerate(o bindingOptions) (bindingKeys, error) {
+	priv, pub, err := keygen.Generate(keygen.Options{
+		Use:         o.Use,
+		Alg:         o.Alg,
+		Bits:        o.Bits,
+		Curve:       o.Curve,
+		KeyID:       o.KeyID,
+		RandomKeyID: o.RandomKID,
+	})
+	if err != nil {
+		return bindingKeys{}, err
+	}
+	return newBindingKeys(priv, pub)
+}
+
+// bindConvert takes a key as convert --in does. Bits, crv and randomKid
+// don't apply.
+func bindConvert(b []byte, o bindingOptions) (bindingKeys, error) {
+	if o.Use == "" {
+		return bindingKeys{}, errors.New("convert needs a use")
+	}
+	privKey, pubKey, err := parseKey(b, safeio.DefaultLimits)
+	if err != nil {
+		return bindingKeys{}, err
+	}
+	alg := o.Alg
+	if alg == "" {
+		if alg = defaultAlg(pubKey, o.Use); alg == "" {
+			return bindingKeys{}, errors.New("can't infer alg for this key, pass it explicitly")
+		}
+	}
+	if err := checkKeyAlg(pubKey, o.Use, alg); err != nil {
+		return bindingKeys{}, err
+	}
+	priv := jose.JSONWebKey{KeyID: o.KeyID, Algorithm: alg, Use: o.Use}
+	if privKey != nil {
+		priv.Key = privKey
+	}
+	pub := jose.JSONWebKey{Key: pubKey, KeyID: o.KeyID, Algorithm: alg, Use: o.Use}
+	return newBindingKeys(priv, pub)
+}
+
+// bindInspect takes a JWK or JWKS and returns what inspect --json prints.
+func bindInspect(b []byte) ([]KeyInfo, error) {
+	keys, err := safeio.ParseRawKeys(b, safeio.DefaultLimits)
+	if err != nil {
+		return nil, err
+	}
+	infos := []KeyInfo{}
+	for _, k := range keys {
+		infos = append(infos, describeKey("-", k))
+	}
+	return infos, nil
+}
@@ -0,0 +1,158 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	bls "github.com/kilic/bls12-381"
+	"gopkg.in/square/go-jose.v2/json"
+)
+
+// BLS12-381 curve names as used by draft-ietf-cose-bls-key-representations.
+// These are not registered JOSE algorithms, so the `alg` member is omitted
+// from the generated keys.
+const (
+	BLS12381G1 = "Bls12381G1"
+	BLS12381G2 = "Bls12381G2"
+)
+
+// okpJSONWebKey is the OKP encoding of BLS12-381 (draft) and X25519
+// (RFC 8037) keys, which go-jose does not know how to marshal.
+type okpJSONWebKey struct {
+	Use    string   `json:"use,omitempty"`
+	KeyOps []string `json:"key_ops,omitempty"`
+	Kty    string   `json:"kty"`
+	Kid    string   `json:"kid,omitempty"`
+	Crv    string   `json:"crv"`
+	Alg    string   `json:"alg,omitempty"`
+	X      string   `json:"x"`
+	D      string   `json:"d,omitempty"`
+}
+
+// KeygenBLS generates a BLS12-381 keypair with the public key in G1 or G2
+// (per `crv`), returning the compressed public point and the big-endian
+// secret scalar.
+func KeygenBLS(crv string) ([]byte, []byte, error) {
+	var sk *bls.Fr
+	for sk == nil || sk.IsZero() {
+		var err error
+		sk, err = bls.NewFr().Rand(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	switch crv {
+	case BLS12381G1:
+		g := bls.NewG1()
+		return g.ToCompressed(g.MulScalar(g.New(), g.One(), sk)), sk.ToBytes(), nil
+	case BLS12381G2:
+		g := bls.NewG2()
+		return g.ToCompressed(g.MulScalar(g.New(), g.One(), sk)), sk.ToBytes(), nil
+	default:
+		return nil, nil, errors.New("unknown BLS12-381 curve")
+	}
+}
+
+func runBLS() {
+	if !*experimental {
+		app.FatalUsage("--alg=%s is experimental, pass --experimental to enable it", *alg)
+	}
+	if *use != "sig" {
+		app.FatalUsage("BLS12-381 keys can only be generated for --use=sig")
+	}
+	if *bits != 0 {
+		app.FatalUsage("this `alg` does not support arbitrary key length")
+	}
+	if *pemOut || *pemBody || *pemOneLine || *derOut || *pkcs8Out || *coseOut {
+		app.FatalUsage("BLS12-381 keys have no PEM, DER or COSE encoding")
+	}
+	if *sqlOut != "" || *emitNotes {
+		app.FatalUsage("BLS12-381 keys can only be output as JWK and JWKS")
+	}
+
+	x, d, err := KeygenBLS(*alg)
+	app.FatalIfError(err, "unable to generate key")
+
+	enc := base64.RawURLEncoding
+	pub := okpJSONWebKey{Use: *use, Kty: "OKP", Kid: *kid, Crv: *alg, X: enc.EncodeToString(x)}
+	priv := pub
+	priv.D = enc.EncodeToString(d)
+	emitRawJWK(priv, pub)
+}
+
+// emitRawJWK outputs a keypair go-jose can't marshal as JWK, and JWKS and
+// COSE if asked for, staging its files like stageKeys does, and runs the
+// creation hooks.
+func emitRawJWK(priv, pub interface{}) {
+	pubJS, err := json.Marshal(pub)
+	app.FatalIfError(err, "can't Marshal public key to JSON")
+
+	render := func(v interface{}, jwks bool) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			if jwks {
+				v = map[string][]interface{}{"keys": {v}}
+			}
+			b, err := json.Marshal(v)
+			if err == nil && *format {
+				b = formatJSON(b)
+			}
+			return b, err
+		}
+	}
+	renderRawCOSE := func(v interface{}) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			return renderCOSE(b)
+		}
+	}
+	var outputs []keyOutput
+	add := func(name, file, ext, what string, pubRender, privRender func() ([]byte, error)) {
+		fname := fmt.Sprintf("%s_%s_%s_%s", file, *use, *alg, *kid)
+		outputs = append(outputs,
+			keyOutput{name + *alg + "-pub" + ext, fname + "-pub" + ext, 0444, "public key with " + what, pubRender, "", false},
+			keyOutput{name + *alg + ext, fname + ext, 0400, "private key with " + what, privRender, "", true})
+	}
+	add("jwk_", "jwk", ".json", "JWK", render(pub, false), render(priv, false))
+	if *jwks {
+		add("jwks_", "jwks", ".json", "JWKS", render(pub, true), render(priv, true))
+	}
+	if *coseOut {
+		add(cosePrefix(), strings.TrimSuffix(cosePrefix(), "_"), coseExt(), "COSE", renderRawCOSE(pub), renderRawCOSE(priv))
+	}
+
+	rendered := make([][]byte, len(outputs))
+	for i, o := range outputs {
+		rendered[i], err = o.render()
+		app.FatalIfError(err, "can't Marshal %s", o.what)
+		if o.printed() {
+			refusePrivateOutput(o, rendered[i])
+		}
+	}
+	for i, o := range outputs {
+		emitOutput(o, rendered[i])
+	}
+	app.FatalIfError(pending.commit(), "can't write keys")
+	runHooks(*onCreate, HookEvent{Event: "create", KeyID: *kid, Algorithm: *alg, Use: *use, PublicKey: pubJS})
+}
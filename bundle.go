@@ -0,0 +1,316 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	bundleCmd    = app.Command("bundle", "Compose one verification JWKS from key sets, JWKS URLs and PEM files")
+	bundleFrom   = bundleCmd.Flag("from", "JWK or JWKS file, http(s) JWKS URL, or PEM file of keys or certificates; globs are expanded (repeatable, - for stdin)").PlaceHolder("SOURCE").Required().Strings()
+	bundleFormat = bundleCmd.Flag("format", "Out JSON with format").Bool()
+	bundleIssuer = bundleCmd.Flag("issuer", "Scope the keys of a --from source to the issuer whose tokens they verify (repeatable)").PlaceHolder("SOURCE=ISS").StringMap()
+	bundleIssMap = bundleCmd.Flag("issuer-map", "Write the issuers of the keys to this sidecar map instead of into the keys as iss").PlaceHolder("FILE").String()
+)
+
+// sourcesMember is the private JWK member listing where a bundled key was
+// found.
+const sourcesMember = "x-sources"
+
+// thumbprintMembers are the members RFC 7638 thumbprints cover, by kty.
+var thumbprintMembers = map[string][]string{
+	"EC":  {"crv", "kty", "x", "y"},
+	"RSA": {"e", "kty", "n"},
+	"OKP": {"crv", "kty", "x"},
+}
+
+// rawThumbprint returns the RFC 7638 SHA-256 thumbprint of a public key.
+// It works on the raw members, so key types go-jose can't decode, such as
+// X25519, are covered too.
+func rawThumbprint(k safeio.RawKey) (string, error) {
+	members, ok := thumbprintMembers[k.Kty()]
+	if !ok {
+		return "", fmt.Errorf("can't take the thumbprint of kty %q", k.Kty())
+	}
+	var b bytes.Buffer
+	for i, m := range members {
+		v, ok := k[m]
+		if !ok {
+			return "", fmt.Errorf("%s key has no %q", k.Kty(), m)
+		}
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%q:", m)
+		if err := json.Compact(&b, v); err != nil {
+			return "", err
+		}
+	}
+	sum := sha256.Sum256([]byte("{" + b.String() + "}"))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// bundleSource is a source of keys and the issuer --issuer scopes them
+// to, if any.
+type bundleSource struct {
+	name   string
+	issuer string
+}
+
+// bundleSources expands the --from globs. URLs and stdin are kept as is.
+// --issuer applies to a glob as a whole or to the files it matches.
+func bundleSources() ([]bundleSource, error) {
+	used := map[string]bool{}
+	issuer := func(names ...string) string {
+		for _, name := range names {
+			if iss, ok := (*bundleIssuer)[name]; ok {
+				used[name] = true
+				return iss
+			}
+		}
+		return ""
+	}
+	var sources []bundleSource
+	for _, from := range *bundleFrom {
+		if from == "-" || strings.HasPrefix(from, "https://") || strings.HasPrefix(from, "http://") ||
+			!strings.ContainsAny(from, "*?[") {
+			sources = append(sources, bundleSource{from, issuer(from)})
+			continue
+		}
+		matches, err := filepath.Glob(from)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s matches no files", from)
+		}
+		for _, m := range matches {
+			sources = append(sources, bundleSource{m, issuer(m, from)})
+		}
+	}
+	for name := range *bundleIssuer {
+		if !used[name] {
+			return nil, fmt.Errorf("--issuer names %s, which is not a --from source", name)
+		}
+	}
+	return sources, nil
+}
+
+// fetchJWKS downloads a key set within the input limits.
+func fetchJWKS(url string) ([]byte, error) {
+	debugf("fetching %s", url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/jwk-set+json, application/json")
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+	return safeio.ReadAll(resp.Body, inputLimits())
+}
+
+// pemKeys turns the certificates and keys of a PEM file into public JWKs.
+// Certificates keep their certificate as x5c; private keys contribute their
+// public half.
+func pemKeys(b []byte) ([]safeio.RawKey, error) {
+	blocks, err := safeio.ParsePEM(b, inputLimits())
+	if err != nil {
+		return nil, err
+	}
+	var keys []safeio.RawKey
+	for _, block := range blocks {
+		jwk := jose.JSONWebKey{Use: "sig"}
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			jwk.Key, jwk.Certificates = cert.PublicKey, []*x509.Certificate{cert}
+		case "PUBLIC KEY", "RSA PUBLIC KEY":
+			if jwk.Key, err = parsePublicKey(block); err != nil {
+				return nil, err
+			}
+		default:
+			priv, err := parsePrivateKey(block)
+			if err != nil {
+				return nil, err
+			}
+			jwk.Key = priv.Public()
+		}
+		jwk.Algorithm = signingAlg(jwk.Key)
+		js, err := marshalJWK(jwk)
+		if err != nil {
+			return nil, err
+		}
+		var k safeio.RawKey
+		if err := json.Unmarshal(js, &k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys or certificates found")
+	}
+	return keys, nil
+}
+
+// readBundleSource loads the public keys of one --from source.
+func readBundleSource(source string) ([]safeio.RawKey, error) {
+	var b []byte
+	var err error
+	if strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://") {
+		b, err = fetchJWKS(source)
+	} else {
+		b, err = readInput(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		return pemKeys(b)
+	}
+	raw, err := safeio.ParseRawKeys(b, inputLimits())
+	if err != nil {
+		return nil, err
+	}
+	var keys []safeio.RawKey
+	for _, k := range raw {
+		pub, ok := k.Public()
+		if !ok {
+			fmt.Fprintf(logw, "jwk-keygen: warning: skipping symmetric key %q of %s\n", k.Kid(), source)
+			continue
+		}
+		keys = append(keys, pub)
+	}
+	return keys, nil
+}
+
+// bundledKey is a key of the bundle, the sources it was found in and the
+// issuer it is scoped to.
+type bundledKey struct {
+	key     safeio.RawKey
+	sources []string
+	issuer  string
+	tp      string
+}
+
+func composeBundle() {
+	sources, err := bundleSources()
+	app.FatalIfError(err, "can't use --from")
+
+	// The same key may verify the tokens of several issuers, and is then
+	// bundled once for each.
+	var bundled []*bundledKey
+	seen := map[string]*bundledKey{}
+	for _, source := range sources {
+		keys, err := readBundleSource(source.name)
+		app.FatalIfError(err, "can't read keys from %s", source.name)
+		for _, k := range keys {
+			tp, err := rawThumbprint(k)
+			app.FatalIfError(err, "can't bundle key %q of %s", k.Kid(), source.name)
+			iss := k.Member(issuerMember)
+			if source.issuer != "" && iss != "" && iss != source.issuer {
+				app.Fatalf("key %q of %s has iss %q, not %q", k.Kid(), source.name, iss, source.issuer)
+			}
+			if iss == "" {
+				iss = source.issuer
+			}
+			if b, ok := seen[iss+" "+tp]; ok {
+				if k.Kid() != "" && k.Kid() != b.key.Kid() {
+					fmt.Fprintf(logw, "jwk-keygen: warning: %s has key %q as %q too, keeping %q\n",
+						source.name, b.key.Kid(), k.Kid(), b.key.Kid())
+				}
+				if b.sources[len(b.sources)-1] != source.name {
+					b.sources = append(b.sources, source.name)
+				}
+				continue
+			}
+			if k.Kid() == "" {
+				// Without a kid the key could only be found by trying it,
+				// so name it after its thumbprint.
+				k["kid"], _ = json.Marshal(tp)
+			}
+			b := &bundledKey{key: k, sources: []string{source.name}, issuer: iss, tp: tp}
+			seen[iss+" "+tp] = b
+			bundled = append(bundled, b)
+		}
+	}
+
+	// A kid only has to be unique among the keys of its issuer.
+	kids := map[string][]string{}
+	issuerMap := map[string][]string{}
+	set := &safeio.RawKeySet{}
+	for _, b := range bundled {
+		kid := fmt.Sprintf("%q", b.key.Kid())
+		if b.issuer != "" {
+			kid += fmt.Sprintf(" of issuer %q", b.issuer)
+		}
+		kids[kid] = append(kids[kid], b.sources[0])
+		b.key[sourcesMember], err = json.Marshal(b.sources)
+		app.FatalIfError(err, "can't Marshal sources")
+		delete(b.key, issuerMember)
+		if b.issuer != "" && *bundleIssMap != "" {
+			issuerMap[b.issuer] = append(issuerMap[b.issuer], b.tp)
+		} else if b.issuer != "" {
+			b.key[issuerMember], _ = json.Marshal(b.issuer)
+		}
+		set.Keys = append(set.Keys, b.key)
+	}
+	var clashes []string
+	for kid, from := range kids {
+		if len(from) > 1 {
+			clashes = append(clashes, fmt.Sprintf("%s (%s)", kid, strings.Join(from, ", ")))
+		}
+	}
+	sort.Strings(clashes)
+	for _, c := range clashes {
+		fmt.Fprintf(logw, "jwk-keygen: warning: kid %s names different keys\n", c)
+	}
+	if *bundleIssMap != "" {
+		out, err := json.Marshal(issuerMap)
+		app.FatalIfError(err, "can't Marshal issuer map")
+		if *bundleFormat {
+			out = formatJSON(out)
+		}
+		// Keep stdout for the bundle alone.
+		pending.status = logw
+		app.FatalIfError(pending.add(*bundleIssMap, "issuer map", out, 0444), "can't write issuer map")
+		app.FatalIfError(pending.commit(), "can't write issuer map")
+	}
+	printRawJWKS(set, *bundleFormat)
+}
@@ -0,0 +1,210 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// cborDecoder decodes the subset of CBOR (RFC 8949) found in WebAuthn-style
+// attestation objects: integers, byte and text strings, arrays and maps of
+// definite length. Maps decode to map[interface{}]interface{}.
+type cborDecoder struct {
+	b     []byte
+	depth int
+}
+
+const cborMaxDepth = 16
+
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	d := &cborDecoder{b: b}
+	v, err := d.value()
+	return v, d.b, err
+}
+
+func (d *cborDecoder) header() (byte, uint64, error) {
+	if len(d.b) == 0 {
+		return 0, 0, errors.New("cbor: unexpected end of data")
+	}
+	major, info := d.b[0]>>5, d.b[0]&0x1f
+	d.b = d.b[1:]
+	var n int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		n = 1
+	case info == 25:
+		n = 2
+	case info == 26:
+		n = 4
+	case info == 27:
+		n = 8
+	default:
+		return 0, 0, fmt.Errorf("cbor: unsupported additional info %d", info)
+	}
+	if len(d.b) < n {
+		return 0, 0, errors.New("cbor: unexpected end of data")
+	}
+	buf := make([]byte, 8)
+	copy(buf[8-n:], d.b[:n])
+	d.b = d.b[n:]
+	return major, binary.BigEndian.Uint64(buf), nil
+}
+
+func (d *cborDecoder) value() (interface{}, error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > cborMaxDepth {
+		return nil, errors.New("cbor: nested too deeply")
+	}
+	major, arg, err := d.header()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0:
+		return int64(arg), nil
+	case 1:
+		return -1 - int64(arg), nil
+	case 2, 3:
+		if uint64(len(d.b)) < arg {
+			return nil, errors.New("cbor: string runs past the end of data")
+		}
+		s := d.b[:arg]
+		d.b = d.b[arg:]
+		if major == 3 {
+			return string(s), nil
+		}
+		return append([]byte{}, s...), nil
+	case 4:
+		if arg > uint64(len(d.b)) {
+			return nil, errors.New("cbor: array longer than the data")
+		}
+		a := make([]interface{}, arg)
+		for i := range a {
+			if a[i], err = d.value(); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case 5:
+		if arg > uint64(len(d.b)) {
+			return nil, errors.New("cbor: map longer than the data")
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, errors.New("cbor: unsupported map key type")
+			}
+			if m[k], err = d.value(); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case 7:
+		switch arg {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22:
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+// cborMap is a CBOR map with integer labels, as COSE uses.
+type cborMap map[int64]interface{}
+
+// encodeCBOR encodes integers, byte and text strings, arrays and cborMaps
+// with the core deterministic encoding of RFC 8949: shortest arguments,
+// and map keys in the bytewise order of their encodings.
+func encodeCBOR(v interface{}) ([]byte, error) {
+	return appendCBOR(nil, v)
+}
+
+func appendCBORHeader(b []byte, major byte, arg uint64) []byte {
+	var n int
+	switch {
+	case arg < 24:
+		return append(b, major<<5|byte(arg))
+	case arg <= 0xff:
+		b, n = append(b, major<<5|24), 1
+	case arg <= 0xffff:
+		b, n = append(b, major<<5|25), 2
+	case arg <= 0xffffffff:
+		b, n = append(b, major<<5|26), 4
+	default:
+		b, n = append(b, major<<5|27), 8
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, arg)
+	return append(b, buf[8-n:]...)
+}
+
+func appendCBOR(b []byte, v interface{}) ([]byte, error) {
+	var err error
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return appendCBORHeader(b, 1, uint64(-1-v)), nil
+		}
+		return appendCBORHeader(b, 0, uint64(v)), nil
+	case []byte:
+		return append(appendCBORHeader(b, 2, uint64(len(v))), v...), nil
+	case string:
+		return append(appendCBORHeader(b, 3, uint64(len(v))), v...), nil
+	case []interface{}:
+		b = appendCBORHeader(b, 4, uint64(len(v)))
+		for _, e := range v {
+			if b, err = appendCBOR(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case cborMap:
+		type entry struct{ key, value []byte }
+		entries := make([]entry, 0, len(v))
+		for k, e := range v {
+			key, _ := appendCBOR(nil, k)
+			value, err := appendCBOR(nil, e)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry{key, value})
+		}
+		sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].key, entries[j].key) < 0 })
+		b = appendCBORHeader(b, 5, uint64(len(v)))
+		for _, e := range entries {
+			b = append(append(b, e.key...), e.value...)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("cbor: can't encode %T", v)
+}
@@ -0,0 +1,200 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/json"
+)
+
+var (
+	selfSignedCert = generateCmd.Flag("self-signed-cert", "Issue a self-signed certificate for the key and embed it as x5c, x5t and x5t#S256").Bool()
+	certSubject    = generateCmd.Flag("cert-subject", "Subject of the certificate, e.g. CN=api,O=Example; CN=<kid> if unset").String()
+	certSANs       = generateCmd.Flag("cert-san", "Subject alternative name: DNS name, IP address, email or URI (repeatable)").Strings()
+	certValidity   = generateCmd.Flag("cert-validity", "How long the certificate is valid").Default("365d").String()
+	p12Out         = generateCmd.Flag("p12", "Generate a passphrase-protected PKCS #12 bundle of the private key and its certificate too").Bool()
+)
+
+// parseSubject parses a comma-separated list of RDNs, e.g.
+// "CN=api,O=Example,C=US".
+func parseSubject(s string) (pkix.Name, error) {
+	var name pkix.Name
+	for _, rdn := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(rdn), "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return name, fmt.Errorf("invalid RDN %q, want TYPE=VALUE", rdn)
+		}
+		v := parts[1]
+		switch strings.ToUpper(parts[0]) {
+		case "CN":
+			name.CommonName = v
+		case "O":
+			name.Organization = append(name.Organization, v)
+		case "OU":
+			name.OrganizationalUnit = append(name.OrganizationalUnit, v)
+		case "C":
+			name.Country = append(name.Country, v)
+		case "ST":
+			name.Province = append(name.Province, v)
+		case "L":
+			name.Locality = append(name.Locality, v)
+		default:
+			return name, fmt.Errorf("unsupported RDN type %q, use CN, O, OU, C, ST or L", parts[0])
+		}
+	}
+	return name, nil
+}
+
+// certTemplate builds the certificate the --cert-* flags describe.
+func certTemplate() (*x509.Certificate, error) {
+	subject := pkix.Name{CommonName: *kid}
+	if *certSubject != "" {
+		var err error
+		if subject, err = parseSubject(*certSubject); err != nil {
+			return nil, err
+		}
+	}
+	if subject.CommonName == "" {
+		subject.CommonName = "jwk-keygen"
+	}
+	validity, err := parseDuration(*certValidity)
+	if err != nil || validity <= 0 {
+		return nil, fmt.Errorf("invalid --cert-validity %q", *certValidity)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := timestamp()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	if *use == "enc" {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement
+	}
+	for _, san := range *certSANs {
+		if ip := net.ParseIP(san); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if strings.Contains(san, "://") {
+			u, err := url.Parse(san)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --cert-san %q: %s", san, err)
+			}
+			tmpl.URIs = append(tmpl.URIs, u)
+		} else if strings.Contains(san, "@") {
+			tmpl.EmailAddresses = append(tmpl.EmailAddresses, san)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, san)
+		}
+	}
+	return tmpl, nil
+}
+
+// attachSelfSignedCert issues a self-signed certificate for priv and puts
+// it in the x5c of both keys. crypto/x509 of Go 1.12 can't sign with
+// Ed25519 keys, so only RSA and EC keys can have one.
+func attachSelfSignedCert(priv, pub *jose.JSONWebKey) error {
+	var signer crypto.Signer
+	switch k := priv.Key.(type) {
+	case *rsa.PrivateKey:
+		signer = k
+	case *ecdsa.PrivateKey:
+		signer = k
+	default:
+		return errors.New("only RSA and EC keys can have a certificate")
+	}
+	tmpl, err := certTemplate()
+	if err != nil {
+		return err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, signer.Public(), signer)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	priv.Certificates = []*x509.Certificate{cert}
+	pub.Certificates = priv.Certificates
+	return nil
+}
+
+// marshalJWK marshals k, adding the x5t and x5t#S256 members for its
+// first certificate, the key_ops of --key-ops, the iss and aud of
+// --restrict-iss and --restrict-aud, and the --extra-claim members, which
+// go-jose leaves out.
+func marshalJWK(k jose.JSONWebKey) ([]byte, error) {
+	b, err := k.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	if len(k.Certificates) > 0 {
+		sum := sha1.Sum(k.Certificates[0].Raw)
+		members := fmt.Sprintf(`,"x5t":"%s","x5t#S256":"%s"}`,
+			base64.RawURLEncoding.EncodeToString(sum[:]), certThumbprint(k.Certificates[0]))
+		b = append(bytes.TrimSuffix(b, []byte("}")), members...)
+	}
+	privOps, ops := splitKeyOps()
+	if !k.IsPublic() {
+		ops = privOps
+		if b, err = withConstraints(b, generatedConstraints()); err != nil {
+			return nil, err
+		}
+	}
+	if b, err = withKeyOps(b, ops); err != nil {
+		return nil, err
+	}
+	return withExtraMembers(b)
+}
+
+// marshalJWKS marshals keys as a JWKS through marshalJWK.
+func marshalJWKS(keys []jose.JSONWebKey) ([]byte, error) {
+	set := struct {
+		Keys []json.RawMessage `json:"keys"`
+	}{Keys: make([]json.RawMessage, len(keys))}
+	for i, k := range keys {
+		b, err := marshalJWK(k)
+		if err != nil {
+			return nil, err
+		}
+		set.Keys[i] = b
+	}
+	return json.Marshal(set)
+}
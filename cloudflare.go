@@ -0,0 +1,78 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// cloudflareToken takes the API token from --cloudflare-token-file or
+// CLOUDFLARE_API_TOKEN; it is never accepted on the command line.
+func cloudflareToken() (string, error) {
+	if *publishCFTokenFile != "" {
+		return readSecretFile(*publishCFTokenFile)
+	}
+	if token := os.Getenv("CLOUDFLARE_API_TOKEN"); token != "" {
+		return token, nil
+	}
+	return "", errors.New("CLOUDFLARE_API_TOKEN or --cloudflare-token-file is required")
+}
+
+// publishToCloudflareKV writes value under a Workers KV key, given as
+// NAMESPACE_ID:KEY. Workers KV has no conditional writes, so the last of
+// two concurrent publishes wins.
+func publishToCloudflareKV(target string, value []byte) error {
+	i := strings.Index(target, ":")
+	if i <= 0 || i == len(target)-1 {
+		return fmt.Errorf("invalid Workers KV target %q, want NAMESPACE_ID:KEY", target)
+	}
+	namespace, key := target[:i], target[i+1:]
+	if *publishCFAccount == "" {
+		return errors.New("--cloudflare-account (or CLOUDFLARE_ACCOUNT_ID) is required")
+	}
+	token, err := cloudflareToken()
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/accounts/%s/storage/kv/namespaces/%s/values/%s",
+		strings.TrimSuffix(*publishCFAPI, "/"), url.PathEscape(*publishCFAccount),
+		url.PathEscape(namespace), url.PathEscape(key))
+	req, err := http.NewRequest("PUT", endpoint, bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Cloudflare responded with %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"github.com/nicksherron/jwk-keygen/pkg/keyset"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	cnfCmd    = app.Command("cnf", "Print the cnf claim that binds tokens to a key or its certificate (RFC 7800, RFC 8705)")
+	cnfKey    = cnfCmd.Flag("key", "JWK the tokens are bound to").String()
+	cnfCert   = cnfCmd.Flag("cert", "PEM client certificate the tokens are bound to").String()
+	cnfJKT    = cnfCmd.Flag("jkt", "Bind to the key's thumbprint even if it has a certificate").Bool()
+	cnfFormat = cnfCmd.Flag("format", "Out JSON with format").Bool()
+)
+
+// Confirmation is the value of a cnf claim: the SHA-256 thumbprint of an
+// mTLS client certificate (RFC 8705) or of a JWK (RFC 9449).
+type Confirmation struct {
+	X5tS256 string `json:"x5t#S256,omitempty"`
+	JKT     string `json:"jkt,omitempty"`
+}
+
+// certThumbprint returns the x5t#S256 of a certificate.
+func certThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// parseCertificate reads a certificate given as PEM or base64 DER, the
+// ways proxies usually pass on client certificates.
+func parseCertificate(s string) (*x509.Certificate, error) {
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		return x509.ParseCertificate(block.Bytes)
+	}
+	der, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("certificate is neither PEM nor base64 DER")
+	}
+	return x509.ParseCertificate(der)
+}
+
+// checkConfirmation checks the cnf claim of a JWT payload, if it has one,
+// against the certificate and key thumbprints the client presented.
+func checkConfirmation(payload []byte, presented Confirmation) error {
+	var claims struct {
+		Cnf *Confirmation `json:"cnf"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Cnf == nil {
+		return nil
+	}
+	cnf := claims.Cnf
+	if cnf.X5tS256 == "" && cnf.JKT == "" {
+		return errors.New("cnf claim has neither x5t#S256 nor jkt")
+	}
+	if cnf.X5tS256 != "" {
+		switch presented.X5tS256 {
+		case "":
+			return errors.New("token is bound to a client certificate, but none was presented")
+		case cnf.X5tS256:
+		default:
+			return errors.New("token is bound to a different client certificate")
+		}
+	}
+	if cnf.JKT != "" {
+		switch presented.JKT {
+		case "":
+			return errors.New("token is bound to a key, but no key thumbprint was presented")
+		case cnf.JKT:
+		default:
+			return errors.New("token is bound to a different key")
+		}
+	}
+	return nil
+}
+
+func confirmation() {
+	if *cnfKey == "" && *cnfCert == "" {
+		app.FatalUsage("--key or --cert is required")
+	}
+	var key *jose.JSONWebKey
+	var cert *x509.Certificate
+	if *cnfKey != "" {
+		var err error
+		key, err = readJWK(*cnfKey)
+		app.FatalIfError(err, "can't read key %s", *cnfKey)
+		if _, ok := key.Key.([]byte); ok {
+			app.Fatalf("%s is a symmetric key, tokens can only be bound to asymmetric keys", *cnfKey)
+		}
+		if len(key.Certificates) > 0 {
+			cert = key.Certificates[0]
+		}
+	}
+	if *cnfCert != "" {
+		certs, err := readCertificatesPEM(*cnfCert)
+		app.FatalIfError(err, "can't read certificate %s", *cnfCert)
+		if key != nil {
+			spki, err := keygen.MarshalPublicKeyPEM(key.Public().Key)
+			want := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: certs[0].RawSubjectPublicKeyInfo})
+			if err != nil || !bytes.Equal(spki, want) {
+				app.Fatalf("certificate %s is not for key %s", *cnfCert, *cnfKey)
+			}
+		}
+		cert = certs[0]
+	}
+	if *cnfJKT && key == nil {
+		app.FatalUsage("--jkt needs --key")
+	}
+
+	var cnf Confirmation
+	if cert != nil && !*cnfJKT {
+		cnf.X5tS256 = certThumbprint(cert)
+	} else {
+		jkt, err := keyset.Thumbprint(key, crypto.SHA256)
+		app.FatalIfError(err, "can't compute thumbprint of %s", *cnfKey)
+		cnf.JKT = jkt
+	}
+
+	out, err := json.Marshal(map[string]Confirmation{"cnf": cnf})
+	app.FatalIfError(err, "can't Marshal cnf claim to JSON")
+	if *cnfFormat {
+		out = formatJSON(out)
+	}
+	fmt.Println(string(out))
+}
@@ -0,0 +1,285 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	conformanceCmd    = app.Command("conformance", "Regenerate every output from fixed seeds and compare it with golden files")
+	conformanceGolden = conformanceCmd.Flag("golden", "Directory holding the golden files").Required().PlaceHolder("DIR").String()
+	conformanceUpdate = conformanceCmd.Flag("update", "Write the golden files instead of comparing against them").Bool()
+)
+
+// conformanceEpoch is the SOURCE_DATE_EPOCH of every conformance run, so
+// that the golden files don't depend on the environment they're checked in.
+const conformanceEpoch = "1500000000"
+
+// conformanceFixture is a key derived from a fixed seed. The seed is the
+// fixture name, which is also its kid and the golden subdirectory.
+type conformanceFixture struct {
+	name string
+	use  string
+	alg  string
+	bits int
+}
+
+var conformanceFixtures = []conformanceFixture{
+	{"rsa-sig", "sig", string(jose.RS256), 2048},
+	{"ec-p256", "sig", string(jose.ES256), 256},
+	{"ec-p384", "sig", string(jose.ES384), 384},
+	{"ec-p521", "sig", string(jose.ES512), 521},
+	{"ed25519", "sig", string(jose.EdDSA), 0},
+	{"hmac", "sig", string(jose.HS256), 256},
+	{"rsa-enc", "enc", string(jose.RSA_OAEP_256), 2048},
+	{"ecdh", "enc", string(jose.ECDH_ES), 256},
+}
+
+// seededRSAKey makes an RSA key with e = 65537 from r. rsa.GenerateKey
+// doesn't promise the same key for the same random stream, so the primes
+// are searched for here.
+func seededRSAKey(r io.Reader, bits int) (*rsa.PrivateKey, error) {
+	one := big.NewInt(1)
+	e := big.NewInt(65537)
+	prime := func() (*big.Int, error) {
+		b := make([]byte, bits/16)
+		for {
+			if _, err := io.ReadFull(r, b); err != nil {
+				return nil, err
+			}
+			// The top two bits make the modulus exactly bits long.
+			b[0] |= 0xc0
+			b[len(b)-1] |= 1
+			p := new(big.Int).SetBytes(b)
+			pm1 := new(big.Int).Sub(p, one)
+			if p.ProbablyPrime(20) && new(big.Int).GCD(nil, nil, e, pm1).Cmp(one) == 0 {
+				return p, nil
+			}
+		}
+	}
+	p, err := prime()
+	if err != nil {
+		return nil, err
+	}
+	q, err := prime()
+	if err != nil {
+		return nil, err
+	}
+	phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: new(big.Int).Mul(p, q), E: int(e.Int64())},
+		D:         new(big.Int).ModInverse(e, phi),
+		Primes:    []*big.Int{p, q},
+	}
+	key.Precompute()
+	return key, key.Validate()
+}
+
+// seededECKey makes an ECDSA key on curve from r.
+func seededECKey(r io.Reader, curve elliptic.Curve) (*ecdsa.PrivateKey, error) {
+	params := curve.Params()
+	b := make([]byte, (params.BitSize+7)/8+8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	// The extra bytes make the bias of reducing mod N negligible.
+	n1 := new(big.Int).Sub(params.N, big.NewInt(1))
+	d := new(big.Int).Mod(new(big.Int).SetBytes(b), n1)
+	d.Add(d, big.NewInt(1))
+	key := &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: curve}, D: d}
+	key.X, key.Y = curve.ScalarBaseMult(d.Bytes())
+	return key, nil
+}
+
+// key derives the fixture's private and public JWK from its seed.
+func (f conformanceFixture) key() (priv, pub jose.JSONWebKey, err error) {
+	r := &seededReader{seed: []byte("jwk-keygen conformance " + f.name)}
+	var privKey interface{}
+	switch f.alg {
+	case string(jose.RS256), string(jose.RSA_OAEP_256):
+		privKey, err = seededRSAKey(r, f.bits)
+	case string(jose.ES256), string(jose.ECDH_ES):
+		privKey, err = seededECKey(r, elliptic.P256())
+	case string(jose.ES384):
+		privKey, err = seededECKey(r, elliptic.P384())
+	case string(jose.ES512):
+		privKey, err = seededECKey(r, elliptic.P521())
+	case string(jose.EdDSA):
+		seed := make([]byte, ed25519.SeedSize)
+		_, err = io.ReadFull(r, seed)
+		privKey = ed25519.NewKeyFromSeed(seed)
+	case string(jose.HS256):
+		b := make([]byte, f.bits/8)
+		_, err = io.ReadFull(r, b)
+		privKey = b
+	default:
+		err = fmt.Errorf("no fixture key for %s", f.alg)
+	}
+	if err != nil {
+		return priv, pub, err
+	}
+	priv = jose.JSONWebKey{Key: privKey, KeyID: f.name, Algorithm: f.alg, Use: f.use}
+	pub = jose.JSONWebKey{KeyID: f.name, Algorithm: f.alg, Use: f.use}
+	if _, ok := privKey.([]byte); !ok {
+		pub = priv.Public()
+	}
+	return priv, pub, nil
+}
+
+// outputs lists what generate would write for the fixture with every
+// deterministic output asked for, plus a signed JWT for the algorithms
+// whose signatures don't take randomness. Outputs that are encrypted or
+// signed with fresh randomness each time can't have golden files.
+func (f conformanceFixture) outputs() ([]keyOutput, error) {
+	priv, pub, err := f.key()
+	if err != nil {
+		return nil, err
+	}
+	*use, *alg, *kid = f.use, f.alg, f.name
+	symmetric := pub.Key == nil
+	*jwks, *k8sSecretOut = true, "conformance/jwk-keygen"
+	*pemOut, *pemBody, *pemOneLine, *emitNotes = !symmetric, !symmetric, !symmetric, !symmetric
+	*derOut, *pkcs8Out = !symmetric, !symmetric
+	*coseOut, *coseSet, *coseHex = true, false, false
+	*sshOut = f.use == "sig" && !symmetric
+	*sqlOut = ""
+	if symmetric && f.use == "sig" {
+		*sqlOut = "pgjwt"
+	}
+	*rotateAfter = "90d"
+	outputs := keyOutputs(priv, pub)
+	if !symmetric {
+		outputs = append(outputs, keyOutput{file: fmt.Sprintf("sql-mysql_%s_%s_%s.sql", f.use, f.alg, f.name),
+			what: "public key with MySQL", render: func() ([]byte, error) {
+				*sqlOut = "mysql"
+				defer func() { *sqlOut = "" }()
+				return renderSQL(priv, pub)
+			}})
+	}
+	switch f.alg {
+	case string(jose.RS256), string(jose.EdDSA), string(jose.HS256):
+		outputs = append(outputs, keyOutput{file: fmt.Sprintf("jwt_%s_%s.jwt", f.alg, f.name),
+			what: "signed JWT", render: func() ([]byte, error) {
+				claims := map[string]interface{}{
+					"iss": "https://conformance.jwk-keygen.invalid",
+					"sub": f.name,
+					"iat": timestamp().Unix(),
+				}
+				token, err := signJWT(&priv, jose.SignatureAlgorithm(f.alg), "JWT", nil, claims)
+				return []byte(token), err
+			}})
+	}
+	return outputs, nil
+}
+
+// firstDifference describes where got first differs from want, by line.
+func firstDifference(got, want []byte) string {
+	gotLines := strings.Split(string(got), "\n")
+	wantLines := strings.Split(string(want), "\n")
+	for i := 0; i < len(gotLines) || i < len(wantLines); i++ {
+		var g, w string
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if g != w || i >= len(gotLines) || i >= len(wantLines) {
+			return fmt.Sprintf("line %d:\n  golden: %q\n  got:    %q", i+1, w, g)
+		}
+	}
+	return "identical"
+}
+
+func conformance() {
+	app.FatalIfError(os.Setenv("SOURCE_DATE_EPOCH", conformanceEpoch), "can't set SOURCE_DATE_EPOCH")
+	// None of the outputs depend on these, but be sure of it.
+	*format, *selfSignedCert, *vaultPath, *pubOut, *privOut = false, false, "", "", ""
+	outputPassphrase = ""
+
+	var failed, checked int
+	produced := map[string]bool{}
+	for _, f := range conformanceFixtures {
+		outputs, err := f.outputs()
+		app.FatalIfError(err, "can't derive fixture %s", f.name)
+		dir := filepath.Join(*conformanceGolden, f.name)
+		if *conformanceUpdate {
+			app.FatalIfError(os.MkdirAll(dir, 0755), "can't create %s", dir)
+		}
+		for _, o := range outputs {
+			data, err := o.render()
+			fatalIfStaged(err, "can't render %s of fixture %s", o.what, f.name)
+			file := filepath.Join(dir, o.file)
+			produced[file] = true
+			if *conformanceUpdate {
+				fatalIfStaged(pending.replace(file, "", data, 0644), "can't write %s", file)
+				continue
+			}
+			checked++
+			golden, err := ioutil.ReadFile(file)
+			switch {
+			case os.IsNotExist(err):
+				fmt.Printf("MISSING %s (%s)\n", file, o.what)
+				failed++
+			case err != nil:
+				app.FatalIfError(err, "can't read golden file")
+			case !bytes.Equal(data, golden):
+				fmt.Printf("DIFFERS %s (%s) at %s\n", file, o.what, firstDifference(data, golden))
+				failed++
+			}
+		}
+	}
+	if *conformanceUpdate {
+		app.FatalIfError(pending.commit(), "can't write golden files")
+		fmt.Printf("Written %d golden files to %s\n", len(produced), *conformanceGolden)
+		return
+	}
+
+	// A golden file nothing produces any more means an output went away.
+	var extra []string
+	filepath.Walk(*conformanceGolden, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !produced[path] {
+			extra = append(extra, path)
+		}
+		return nil
+	})
+	sort.Strings(extra)
+	for _, file := range extra {
+		fmt.Printf("UNEXPECTED %s\n", file)
+		failed++
+	}
+	if failed > 0 {
+		fmt.Fprintf(logw, "jwk-keygen: %d of %d outputs don't match the golden files in %s\n", failed, checked+len(extra), *conformanceGolden)
+		exit(1)
+	}
+	fmt.Printf("All %d outputs match the golden files in %s\n", checked, *conformanceGolden)
+}
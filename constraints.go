@@ -0,0 +1,139 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+var (
+	restrictIss = generateCmd.Flag("restrict-iss", "Only let sign and client-assertion mint tokens of this issuer with the private key").PlaceHolder("ISS").String()
+	restrictAud = generateCmd.Flag("restrict-aud", "Only let sign and client-assertion mint tokens for this audience with the private key (repeatable)").PlaceHolder("AUD").Strings()
+)
+
+// keyConstraints are the issuer and audiences a private key may sign
+// tokens for, kept in the private JWK as its iss and aud members.
+type keyConstraints struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Audiences []string `json:"aud,omitempty"`
+}
+
+// generatedConstraints returns the constraints of --restrict-iss and
+// --restrict-aud.
+func generatedConstraints() keyConstraints {
+	return keyConstraints{Issuer: *restrictIss, Audiences: *restrictAud}
+}
+
+// withConstraints adds the iss and aud members of c to the marshaled
+// private JWK b.
+func withConstraints(b []byte, c keyConstraints) ([]byte, error) {
+	if c.Issuer == "" && len(c.Audiences) == 0 {
+		return b, nil
+	}
+	js, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	b = append(bytes.TrimSuffix(b, []byte("}")), ',')
+	return append(b, js[1:]...), nil
+}
+
+// parseConstraints reads the iss and aud members of a private JWK. aud may
+// be a single string, as in tokens.
+func parseConstraints(b []byte) (keyConstraints, error) {
+	var members struct {
+		Issuer    string          `json:"iss"`
+		Audiences json.RawMessage `json:"aud"`
+	}
+	if err := json.Unmarshal(b, &members); err != nil {
+		return keyConstraints{}, fmt.Errorf("invalid iss or aud member: %s", err)
+	}
+	c := keyConstraints{Issuer: members.Issuer}
+	auds, err := audiences(members.Audiences)
+	if err != nil {
+		return keyConstraints{}, fmt.Errorf("invalid aud member: %s", err)
+	}
+	c.Audiences = auds
+	return c, nil
+}
+
+// audiences decodes an aud claim or member, a string or an array of them.
+func audiences(aud json.RawMessage) ([]string, error) {
+	if len(aud) == 0 {
+		return nil, nil
+	}
+	var one string
+	if json.Unmarshal(aud, &one) == nil {
+		return []string{one}, nil
+	}
+	var many []string
+	if err := json.Unmarshal(aud, &many); err != nil {
+		return nil, err
+	}
+	return many, nil
+}
+
+// check refuses a token payload whose iss isn't the key's issuer, or that
+// has an audience the key isn't for. A constrained key only signs JWTs
+// that carry the claims it is constrained on.
+func (c keyConstraints) check(payload []byte) error {
+	if c.Issuer == "" && len(c.Audiences) == 0 {
+		return nil
+	}
+	claims := claimsObject(payload)
+	if claims == nil {
+		return fmt.Errorf("key only signs JWTs, restricted to %s", c)
+	}
+	if c.Issuer != "" {
+		var iss string
+		json.Unmarshal(claims["iss"], &iss)
+		if iss != c.Issuer {
+			return fmt.Errorf("key only signs tokens of issuer %q, not %q", c.Issuer, iss)
+		}
+	}
+	if len(c.Audiences) > 0 {
+		auds, err := audiences(claims["aud"])
+		if err != nil {
+			return fmt.Errorf("invalid aud claim: %s", err)
+		}
+		if len(auds) == 0 {
+			return fmt.Errorf("key only signs tokens with an aud claim, for %q", c.Audiences)
+		}
+	next:
+		for _, aud := range auds {
+			for _, allowed := range c.Audiences {
+				if aud == allowed {
+					continue next
+				}
+			}
+			return fmt.Errorf("key doesn't sign tokens for audience %q, only for %q", aud, c.Audiences)
+		}
+	}
+	return nil
+}
+
+func (c keyConstraints) String() string {
+	switch {
+	case c.Issuer == "":
+		return fmt.Sprintf("audiences %q", c.Audiences)
+	case len(c.Audiences) == 0:
+		return fmt.Sprintf("issuer %q", c.Issuer)
+	}
+	return fmt.Sprintf("issuer %q and audiences %q", c.Issuer, c.Audiences)
+}
@@ -0,0 +1,181 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consulStore writes to the Consul KV HTTP API, using ModifyIndex for
+// check-and-set.
+type consulStore struct {
+	addr  string
+	token string
+}
+
+// dialConsul returns a store for a Consul agent, authenticating with
+// CONSUL_HTTP_TOKEN if set.
+func dialConsul(addr string) *consulStore {
+	return &consulStore{addr: strings.TrimSuffix(addr, "/"), token: os.Getenv("CONSUL_HTTP_TOKEN")}
+}
+
+func (s *consulStore) do(method, path string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequest(method, s.addr+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, b, err
+}
+
+func (s *consulStore) get(key string) ([]byte, string, error) {
+	status, b, err := s.do("GET", "/v1/kv/"+key, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if status == http.StatusNotFound {
+		// A check-and-set with index 0 only writes keys that don't exist.
+		return nil, "0", nil
+	}
+	if status != http.StatusOK {
+		return nil, "", fmt.Errorf("consul responded with %d: %s", status, bytes.TrimSpace(b))
+	}
+	var entries []struct {
+		Value       []byte
+		ModifyIndex uint64
+	}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, "", err
+	}
+	if len(entries) == 0 {
+		return nil, "0", nil
+	}
+	return entries[0].Value, strconv.FormatUint(entries[0].ModifyIndex, 10), nil
+}
+
+func (s *consulStore) set(key string, value []byte, version string, ttl time.Duration) (bool, error) {
+	if ttl > 0 {
+		return false, errors.New("consul KV entries can't expire, drop --ttl")
+	}
+	status, b, err := s.do("PUT", "/v1/kv/"+key+"?cas="+version, value)
+	if err != nil {
+		return false, err
+	}
+	if status != http.StatusOK {
+		return false, fmt.Errorf("consul responded with %d: %s", status, bytes.TrimSpace(b))
+	}
+	return strings.TrimSpace(string(b)) == "true", nil
+}
+
+func (s *consulStore) close() error {
+	return nil
+}
+
+// consulService is the agent service definition serve --consul registers,
+// as /v1/agent/service/register takes it.
+type consulService struct {
+	ID      string
+	Name    string
+	Address string `json:",omitempty"`
+	Port    int
+	Check   consulCheck
+}
+
+type consulCheck struct {
+	HTTP                           string
+	Interval                       string
+	Timeout                        string
+	TLSSkipVerify                  bool `json:",omitempty"`
+	DeregisterCriticalServiceAfter string
+}
+
+// jwksService is the registration of serve listening on listen. An
+// unspecified host is left for the agent to fill in with its own address
+// and is checked on loopback, where the agent runs.
+func jwksService(listen, scheme string, selfSigned bool) (consulService, error) {
+	host, p, err := net.SplitHostPort(listen)
+	if err != nil {
+		return consulService{}, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return consulService{}, err
+	}
+	svc := consulService{ID: "jwks-" + p, Name: "jwks", Address: host, Port: port}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		svc.Address = ""
+		host = "127.0.0.1"
+	} else {
+		svc.ID = "jwks-" + host + "-" + p
+	}
+	svc.Check = consulCheck{
+		HTTP:     scheme + "://" + net.JoinHostPort(host, p) + "/readyz",
+		Interval: "10s",
+		Timeout:  "5s",
+		// The certificate is issued for localhost, which the agent may
+		// not dial it as.
+		TLSSkipVerify:                  selfSigned,
+		DeregisterCriticalServiceAfter: "10m",
+	}
+	return svc, nil
+}
+
+// register adds svc to the services of the agent, replacing any registered
+// under its ID.
+func (s *consulStore) register(svc consulService) error {
+	b, err := json.Marshal(svc)
+	if err != nil {
+		return err
+	}
+	status, b, err := s.do("PUT", "/v1/agent/service/register", b)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("consul responded with %d: %s", status, bytes.TrimSpace(b))
+	}
+	return nil
+}
+
+func (s *consulStore) deregister(id string) error {
+	status, b, err := s.do("PUT", "/v1/agent/service/deregister/"+id, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("consul responded with %d: %s", status, bytes.TrimSpace(b))
+	}
+	return nil
+}
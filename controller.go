@@ -0,0 +1,679 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keyset"
+	"github.com/nicksherron/jwk-keygen/pkg/rotator"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	controllerCmd       = app.Command("controller", "Generate and rotate the keys of JWKKey resources into Secrets, as a Kubernetes controller")
+	controllerServer    = controllerCmd.Flag("api-server", "Kubernetes API server, e.g. of kubectl proxy; the pod's service account is used if unset").PlaceHolder("URL").String()
+	controllerNamespace = controllerCmd.Flag("namespace", "Namespace to watch; the pod's own if unset").String()
+	controllerAllNS     = controllerCmd.Flag("all-namespaces", "Watch JWKKeys in every namespace").Bool()
+	controllerResync    = controllerCmd.Flag("resync", "How often to check every JWKKey, changed or not").Default("5m").Duration()
+	controllerLease     = controllerCmd.Flag("lease", "Lease the replicas elect a leader with").Default("jwk-keygen-controller").String()
+	controllerPrintCRD  = controllerCmd.Flag("print-crd", "Print the JWKKey CustomResourceDefinition and exit").Bool()
+	controllerHealth    = controllerCmd.Flag("health-listen", "Address to serve /healthz, /readyz and gRPC health checks on").PlaceHolder("ADDR").String()
+)
+
+const (
+	jwkKeyGroup      = "jwk-keygen.io"
+	jwkKeyAPIVersion = jwkKeyGroup + "/v1alpha1"
+	// leaseDuration is how long a lease is good for without renewal.
+	leaseDuration = 15 * time.Second
+	// microTime is the format of Lease timestamps.
+	microTime = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// jwkKeyCRD registers the JWKKey resource.
+const jwkKeyCRD = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: jwkkeys.jwk-keygen.io
+spec:
+  group: jwk-keygen.io
+  names:
+    kind: JWKKey
+    listKind: JWKKeyList
+    plural: jwkkeys
+    singular: jwkkey
+  scope: Namespaced
+  versions:
+  - name: v1alpha1
+    served: true
+    storage: true
+    subresources:
+      status: {}
+    additionalPrinterColumns:
+    - name: Alg
+      type: string
+      jsonPath: .spec.alg
+    - name: Kid
+      type: string
+      jsonPath: .status.currentKeyID
+    - name: Rotated
+      type: date
+      jsonPath: .status.rotatedAt
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            required: [use, alg]
+            properties:
+              use:
+                type: string
+                enum: [sig, enc]
+              alg:
+                type: string
+              bits:
+                type: integer
+              crv:
+                type: string
+              rotateAfter:
+                type: string
+                default: 90d
+              grace:
+                type: string
+                default: 7d
+              maxAge:
+                type: string
+              secretName:
+                type: string
+              configMapName:
+                type: string
+          status:
+            type: object
+            properties:
+              currentKeyID:
+                type: string
+              rotatedAt:
+                type: string
+                format: date-time
+              error:
+                type: string
+`
+
+// jwkKey is a JWKKey resource: the key to keep in a Secret, and when to
+// rotate it.
+type jwkKey struct {
+	Metadata k8sMetadata `json:"metadata"`
+	Spec     struct {
+		Use  string `json:"use"`
+		Alg  string `json:"alg"`
+		Bits int    `json:"bits"`
+		Crv  string `json:"crv"`
+		// RotateAfter, Grace and MaxAge take days as in --rotate-after.
+		RotateAfter string `json:"rotateAfter"`
+		Grace       string `json:"grace"`
+		MaxAge      string `json:"maxAge"`
+		// SecretName defaults to the name of the JWKKey.
+		SecretName string `json:"secretName"`
+		// ConfigMapName, if set, also gets the public JWKS.
+		ConfigMapName string `json:"configMapName"`
+	} `json:"spec"`
+}
+
+func (k *jwkKey) path(ns string) string {
+	return fmt.Sprintf("/apis/%s/namespaces/%s/jwkkeys/%s", jwkKeyAPIVersion, ns, k.Metadata.Name)
+}
+
+// policy translates the spec for the Rotator.
+func (k *jwkKey) policy() (rotator.Policy, error) {
+	p := rotator.Policy{Use: k.Spec.Use, Alg: k.Spec.Alg, Bits: k.Spec.Bits, Curve: k.Spec.Crv}
+	durations := []struct {
+		name, value, def string
+		d                *time.Duration
+	}{
+		{"rotateAfter", k.Spec.RotateAfter, "90d", &p.RotateAfter},
+		{"grace", k.Spec.Grace, "7d", &p.Grace},
+		{"maxAge", k.Spec.MaxAge, "", &p.MaxAge},
+	}
+	for _, d := range durations {
+		v := d.value
+		if v == "" {
+			v = d.def
+		}
+		if v == "" {
+			continue
+		}
+		var err error
+		if *d.d, err = parseDuration(v); err != nil {
+			return p, fmt.Errorf("invalid %s: %s", d.name, err)
+		}
+	}
+	return p, nil
+}
+
+// owner makes the JWKKey own what the controller creates for it, so that
+// they are deleted with it.
+func (k *jwkKey) owner() []k8sOwnerRef {
+	return []k8sOwnerRef{{APIVersion: jwkKeyAPIVersion, Kind: "JWKKey", Name: k.Metadata.Name, UID: k.Metadata.UID, Controller: true}}
+}
+
+// secretStorage keeps a JWKKey's key set in its Secret: the history in
+// keyset.json, the newest key in jwk.json and the public keys in
+// jwks-pub.json, and, with configMapName, the public keys in a ConfigMap
+// too.
+type secretStorage struct {
+	kube *kubeClient
+	key  *jwkKey
+	// resourceVersion is the Secret's as loaded, so that a Secret changed
+	// in between isn't overwritten.
+	resourceVersion string
+}
+
+func (s *secretStorage) secretName() string {
+	if s.key.Spec.SecretName != "" {
+		return s.key.Spec.SecretName
+	}
+	return s.key.Metadata.Name
+}
+
+func (s *secretStorage) Load(ctx context.Context) ([]keyset.Entry, error) {
+	var secret k8sSecret
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", s.key.Metadata.Namespace, s.secretName())
+	err := s.kube.do(ctx, "GET", path, nil, &secret)
+	if kubeStatus(err, http.StatusNotFound) {
+		s.resourceVersion = ""
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.resourceVersion = secret.Metadata.ResourceVersion
+	b, err := base64.StdEncoding.DecodeString(secret.Data["keyset.json"])
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("Secret %s has no valid keyset.json", s.secretName())
+	}
+	var entries []keyset.Entry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("Secret %s: invalid keyset.json: %s", s.secretName(), err)
+	}
+	return entries, nil
+}
+
+func (s *secretStorage) Save(ctx context.Context, entries []keyset.Entry) error {
+	history, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	var newest jose.JSONWebKey
+	var public jose.JSONWebKeySet
+	for _, e := range entries {
+		if e.Retired.IsZero() {
+			newest = e.Key
+		}
+		if pub := e.Key.Public(); pub.Key != nil {
+			public.Keys = append(public.Keys, pub)
+		}
+	}
+	jwk, err := json.Marshal(newest)
+	if err != nil {
+		return err
+	}
+	jwks, err := json.Marshal(public)
+	if err != nil {
+		return err
+	}
+
+	enc := base64.StdEncoding
+	ns := s.key.Metadata.Namespace
+	secret := k8sSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata: k8sMetadata{
+			Name:            s.secretName(),
+			Namespace:       ns,
+			ResourceVersion: s.resourceVersion,
+			Labels:          map[string]string{"app.kubernetes.io/managed-by": "jwk-keygen"},
+			OwnerReferences: s.key.owner(),
+		},
+		Type: "Opaque",
+		Data: map[string]string{
+			"keyset.json":   enc.EncodeToString(history),
+			"jwk.json":      enc.EncodeToString(jwk),
+			"jwks-pub.json": enc.EncodeToString(jwks),
+		},
+	}
+	if s.resourceVersion == "" {
+		err = s.kube.do(ctx, "POST", fmt.Sprintf("/api/v1/namespaces/%s/secrets", ns), secret, nil)
+	} else {
+		err = s.kube.do(ctx, "PUT", fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", ns, secret.Metadata.Name), secret, nil)
+	}
+	if err != nil || s.key.Spec.ConfigMapName == "" {
+		return err
+	}
+	return s.saveConfigMap(ctx, jwks)
+}
+
+// saveConfigMap creates or replaces the ConfigMap holding the public
+// keys. Public keys can't be lost, so it is simply overwritten.
+func (s *secretStorage) saveConfigMap(ctx context.Context, jwks []byte) error {
+	ns, name := s.key.Metadata.Namespace, s.key.Spec.ConfigMapName
+	path := fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", ns, name)
+	cm := struct {
+		APIVersion string            `json:"apiVersion"`
+		Kind       string            `json:"kind"`
+		Metadata   k8sMetadata       `json:"metadata"`
+		Data       map[string]string `json:"data"`
+	}{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Metadata: k8sMetadata{
+			Name:            name,
+			Namespace:       ns,
+			Labels:          map[string]string{"app.kubernetes.io/managed-by": "jwk-keygen"},
+			OwnerReferences: s.key.owner(),
+		},
+		Data: map[string]string{"jwks.json": string(jwks)},
+	}
+	err := s.kube.do(ctx, "PUT", path, cm, nil)
+	if kubeStatus(err, http.StatusNotFound) {
+		err = s.kube.do(ctx, "POST", fmt.Sprintf("/api/v1/namespaces/%s/configmaps", ns), cm, nil)
+	}
+	return err
+}
+
+// keyController reconciles the JWKKeys of a namespace, or of every
+// namespace if ns is empty.
+type keyController struct {
+	kube *kubeClient
+	ns   string
+	// generations holds the generation each JWKKey was last reconciled
+	// at, so that the watch skips the events of status updates.
+	generations map[string]int64
+
+	mu sync.Mutex
+	// leading is set while this replica is the leader, and synced once it
+	// has listed the JWKKeys since.
+	leading, synced bool
+	// writable is the outcome of the last access review for Secrets,
+	// made at reviewed.
+	writable error
+	reviewed time.Time
+}
+
+// canWrite asks the API server whether the controller may create and
+// update Secrets, at most every 30 seconds.
+func (c *keyController) canWrite(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.reviewed) < 30*time.Second {
+		return c.writable
+	}
+	for _, verb := range []string{"create", "update"} {
+		review := map[string]interface{}{
+			"apiVersion": "authorization.k8s.io/v1",
+			"kind":       "SelfSubjectAccessReview",
+			"spec": map[string]interface{}{
+				"resourceAttributes": map[string]string{"namespace": c.ns, "verb": verb, "resource": "secrets"},
+			},
+		}
+		var res struct {
+			Status struct {
+				Allowed bool   `json:"allowed"`
+				Reason  string `json:"reason"`
+			} `json:"status"`
+		}
+		if err := c.kube.do(ctx, "POST", "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews", review, &res); err != nil {
+			// Not cached: the API server may just be busy.
+			return fmt.Errorf("can't review access to Secrets: %s", err)
+		}
+		c.writable = nil
+		if !res.Status.Allowed {
+			c.writable = fmt.Errorf("not allowed to %s Secrets: %s", verb, res.Status.Reason)
+			break
+		}
+	}
+	c.reviewed = time.Now()
+	return c.writable
+}
+
+// ready is the readiness check: the controller can write the Secrets
+// holding the keys and, if it is leading, has loaded the JWKKeys.
+func (c *keyController) ready(ctx context.Context) error {
+	if err := c.canWrite(ctx); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.leading && !c.synced {
+		return fmt.Errorf("JWKKeys not listed yet")
+	}
+	return nil
+}
+
+func (c *keyController) listPath() string {
+	if c.ns == "" {
+		return fmt.Sprintf("/apis/%s/jwkkeys", jwkKeyAPIVersion)
+	}
+	return fmt.Sprintf("/apis/%s/namespaces/%s/jwkkeys", jwkKeyAPIVersion, c.ns)
+}
+
+// reconcile prunes and, if due, rotates the keys of k, and records the
+// outcome in its status. It isn't canceled on shutdown, so that the
+// Secret, ConfigMap and status are never left out of step.
+func (c *keyController) reconcile(k *jwkKey) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	c.generations[k.Metadata.Namespace+"/"+k.Metadata.Name] = k.Metadata.Generation
+	status := map[string]interface{}{"error": nil}
+	policy, err := k.policy()
+	var r *rotator.Rotator
+	if err == nil {
+		r, err = rotator.New(&secretStorage{kube: c.kube, key: k}, policy)
+	}
+	if err == nil {
+		r.OnRotate = func(key jose.JSONWebKey) {
+			status["currentKeyID"] = key.KeyID
+			status["rotatedAt"] = time.Now().UTC().Format(time.RFC3339)
+			fmt.Fprintf(logw, "jwk-keygen: rotated %s/%s to %q\n", k.Metadata.Namespace, k.Metadata.Name, key.KeyID)
+		}
+		_, err = r.RotateOnce(ctx)
+	}
+	if err != nil {
+		fmt.Fprintf(logw, "jwk-keygen: warning: %s/%s: %s\n", k.Metadata.Namespace, k.Metadata.Name, err)
+		status["error"] = err.Error()
+	}
+	patch := map[string]interface{}{"status": status}
+	if err := c.kube.do(ctx, "PATCH", k.path(k.Metadata.Namespace)+"/status", patch, nil); err != nil {
+		fmt.Fprintf(logw, "jwk-keygen: warning: can't update the status of %s/%s: %s\n", k.Metadata.Namespace, k.Metadata.Name, err)
+	}
+}
+
+// reconcileAll reconciles every JWKKey and returns the resourceVersion
+// of the list, to watch from.
+func (c *keyController) reconcileAll(ctx context.Context) (string, error) {
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []jwkKey `json:"items"`
+	}
+	if err := c.kube.do(ctx, "GET", c.listPath(), nil, &list); err != nil {
+		return "", err
+	}
+	for i := range list.Items {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		c.reconcile(&list.Items[i])
+	}
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch reconciles JWKKeys as they are added or changed, from
+// resourceVersion on, until the API server ends the watch after --resync.
+func (c *keyController) watch(ctx context.Context, resourceVersion string) error {
+	q := url.Values{}
+	q.Set("watch", "1")
+	q.Set("resourceVersion", resourceVersion)
+	q.Set("timeoutSeconds", strconv.Itoa(int(controllerResync.Seconds())))
+	req, err := c.kube.request(ctx, "GET", c.listPath()+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.kube.watchClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &kubeError{Code: resp.StatusCode, Message: "can't watch JWKKeys"}
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev struct {
+			Type   string `json:"type"`
+			Object jwkKey `json:"object"`
+		}
+		if err := dec.Decode(&ev); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			m := ev.Object.Metadata
+			if g, ok := c.generations[m.Namespace+"/"+m.Name]; !ok || g != m.Generation {
+				c.reconcile(&ev.Object)
+			}
+		case "ERROR":
+			return fmt.Errorf("watch failed, resyncing")
+		}
+	}
+}
+
+// run reconciles every JWKKey every --resync, and the ones that change in
+// between as they do, until ctx is done.
+func (c *keyController) run(ctx context.Context) error {
+	c.mu.Lock()
+	c.leading, c.synced = true, false
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.leading = false
+		c.mu.Unlock()
+	}()
+	for ctx.Err() == nil {
+		rv, err := c.reconcileAll(ctx)
+		if err == nil {
+			c.mu.Lock()
+			c.synced = true
+			c.mu.Unlock()
+			err = c.watch(ctx, rv)
+		}
+		if err != nil && ctx.Err() == nil {
+			debugf("%s", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// k8sLease is a coordination.k8s.io Lease.
+type k8sLease struct {
+	APIVersion string      `json:"apiVersion"`
+	Kind       string      `json:"kind"`
+	Metadata   k8sMetadata `json:"metadata"`
+	Spec       struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// leaseLock is a rotator.Lock held by renewing a Lease.
+type leaseLock struct {
+	kube     *kubeClient
+	ns, name string
+	identity string
+	// renewed is closed when the renewal of the held lease stops.
+	renewed chan struct{}
+}
+
+func (l *leaseLock) path() string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", l.ns, l.name)
+}
+
+// take updates the lease to be held by l, unless someone else holds it and
+// renewed it recently. It reports whether l holds the lease.
+func (l *leaseLock) take(ctx context.Context) (bool, error) {
+	var lease k8sLease
+	err := l.kube.do(ctx, "GET", l.path(), nil, &lease)
+	now := time.Now().UTC()
+	if kubeStatus(err, http.StatusNotFound) {
+		lease = k8sLease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease", Metadata: k8sMetadata{Name: l.name, Namespace: l.ns}}
+	} else if err != nil {
+		return false, err
+	}
+	if lease.Spec.HolderIdentity != "" && lease.Spec.HolderIdentity != l.identity {
+		renewed, err := time.Parse(microTime, lease.Spec.RenewTime)
+		if err == nil && now.Before(renewed.Add(time.Duration(lease.Spec.LeaseDurationSeconds)*time.Second)) {
+			return false, nil
+		}
+	}
+	if lease.Spec.HolderIdentity != l.identity {
+		lease.Spec.HolderIdentity = l.identity
+		lease.Spec.AcquireTime = now.Format(microTime)
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.LeaseDurationSeconds = int(leaseDuration.Seconds())
+	lease.Spec.RenewTime = now.Format(microTime)
+	if lease.Metadata.ResourceVersion == "" {
+		err = l.kube.do(ctx, "POST", fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", l.ns), lease, nil)
+	} else {
+		err = l.kube.do(ctx, "PUT", l.path(), lease, nil)
+	}
+	if kubeStatus(err, http.StatusConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *leaseLock) Acquire(ctx context.Context) (context.Context, error) {
+	for {
+		ok, err := l.take(ctx)
+		if err != nil && ctx.Err() == nil {
+			debugf("can't take lease %s: %s", l.name, err)
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(leaseDuration / 5):
+		}
+	}
+	debugf("leading as %s", l.identity)
+	lead, cancel := context.WithCancel(ctx)
+	l.renewed = make(chan struct{})
+	go l.renew(lead, cancel)
+	return lead, nil
+}
+
+// renew renews the lease until lead is done, and cancels lead if it
+// couldn't renew it in time.
+func (l *leaseLock) renew(lead context.Context, cancel context.CancelFunc) {
+	defer close(l.renewed)
+	defer cancel()
+	ticker := time.NewTicker(leaseDuration / 3)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-lead.Done():
+			return
+		case <-ticker.C:
+		}
+		ok, err := l.take(lead)
+		if ok {
+			last = time.Now()
+			continue
+		}
+		if err == nil || time.Since(last) > leaseDuration*2/3 {
+			fmt.Fprintf(logw, "jwk-keygen: warning: lost lease %s\n", l.name)
+			return
+		}
+	}
+}
+
+func (l *leaseLock) Release(ctx context.Context) error {
+	<-l.renewed
+	var lease k8sLease
+	if err := l.kube.do(ctx, "GET", l.path(), nil, &lease); err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity != l.identity {
+		return nil
+	}
+	lease.Spec.HolderIdentity = ""
+	return l.kube.do(ctx, "PUT", l.path(), lease, nil)
+}
+
+// podNamespace returns the namespace of the pod the process runs in.
+func podNamespace() string {
+	b, err := ioutil.ReadFile(filepath.Join(k8sServiceAccount, "namespace"))
+	if err != nil || len(bytes.TrimSpace(b)) == 0 {
+		return "default"
+	}
+	return string(bytes.TrimSpace(b))
+}
+
+func controller() {
+	if *controllerPrintCRD {
+		fmt.Print(jwkKeyCRD)
+		return
+	}
+	kube, err := newKubeClient(*controllerServer)
+	app.FatalIfError(err, "can't connect to Kubernetes")
+
+	ns := *controllerNamespace
+	if ns == "" {
+		ns = podNamespace()
+	}
+	c := &keyController{kube: kube, ns: ns, generations: map[string]int64{}}
+	if *controllerAllNS {
+		c.ns = ""
+	}
+	identity, err := os.Hostname()
+	app.FatalIfError(err, "can't get the hostname")
+	lock := &leaseLock{kube: kube, ns: ns, name: *controllerLease, identity: identity}
+
+	ctx := signalContext()
+	if *controllerHealth != "" {
+		mux := http.NewServeMux()
+		(&healthChecker{ready: c.ready, done: ctx.Done()}).register(mux)
+		srv := &http.Server{Addr: *controllerHealth, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		allowH2C(srv)
+		go func() {
+			app.FatalIfError(serveUntil(ctx, srv), "can't serve health checks")
+		}()
+	}
+
+	// A reconcile in progress is finished before the lease is released.
+	err = rotator.WhileLeader(ctx, lock, debugf, c.run)
+	if err != context.Canceled {
+		app.FatalIfError(err, "controller failed")
+	}
+}
@@ -0,0 +1,456 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"golang.org/x/crypto/ed25519"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	convertCmd         = app.Command("convert", "Convert an existing key from another encoding into a JWK")
+	convertIn          = convertCmd.Flag("in", "PEM or DER private or public key (PKCS #1, PKCS #8, SEC 1 or SubjectPublicKeyInfo), or a passphrase-protected JWK").PlaceHolder("FILE").String()
+	convertUse         = convertCmd.Flag("use", "Desired key use, for --in").Enum("enc", "sig")
+	convertAlg         = convertCmd.Flag("alg", "Algorithm the key is for, for --in (inferred from the key by default)").String()
+	convertJWKS        = convertCmd.Flag("jwks", "Convert as JWKS too, for --in").Bool()
+	convertPEM         = convertCmd.Flag("pem", "Convert as PEM too, for --in").Bool()
+	convertCert        = convertCmd.Flag("cert", "PEM certificate chain of the key of --in, leaf first, to embed as x5c").PlaceHolder("FILE").String()
+	convertP12         = convertCmd.Flag("p12", "Convert as a passphrase-protected PKCS #12 bundle of the key and --cert too, for --in").Bool()
+	convertAttestation = convertCmd.Flag("from-attestation", "Android Keystore certificate chain, Apple App Attest attestation object or raw public key, as PEM, DER or base64").PlaceHolder("FILE").String()
+	convertKid         = convertCmd.Flag("kid", "Key ID; with --in the keys are written to files when set, with --from-attestation it defaults to the App Attest key ID").String()
+	convertFormat      = convertCmd.Flag("format", "Out JSON with format").Bool()
+)
+
+var (
+	// oidAndroidKeyDescription is the Android Keystore attestation extension.
+	oidAndroidKeyDescription = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 17}
+	// oidAppleNonce carries the App Attest nonce in the credential certificate.
+	oidAppleNonce = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 2}
+)
+
+// Attestation describes where an imported public key came from. It is
+// informational: the chain is checked for internal consistency, but
+// whether its root is Google's or Apple's is left to the caller.
+type Attestation struct {
+	Format                 string `json:"format"`
+	AttestationVersion     int    `json:"attestation_version,omitempty"`
+	SecurityLevel          string `json:"security_level,omitempty"`
+	KeymasterVersion       int    `json:"keymaster_version,omitempty"`
+	KeymasterSecurityLevel string `json:"keymaster_security_level,omitempty"`
+	Challenge              string `json:"challenge,omitempty"`
+	Environment            string `json:"environment,omitempty"`
+	RPIDHash               string `json:"rp_id_hash,omitempty"`
+	Nonce                  string `json:"nonce,omitempty"`
+	ChainLength            int    `json:"chain_length,omitempty"`
+	ChainVerified          bool   `json:"chain_verified"`
+	Issuer                 string `json:"issuer,omitempty"`
+}
+
+// AttestedKey is the output of convert --from-attestation.
+type AttestedKey struct {
+	JWK         json.RawMessage `json:"jwk"`
+	Attestation Attestation     `json:"attestation"`
+}
+
+// androidKeyDescription is the leading part of the KeyDescription
+// sequence; the authorization lists are kept raw.
+type androidKeyDescription struct {
+	AttestationVersion       int
+	AttestationSecurityLevel asn1.Enumerated
+	KeymasterVersion         int
+	KeymasterSecurityLevel   asn1.Enumerated
+	AttestationChallenge     []byte
+	UniqueID                 []byte
+	SoftwareEnforced         asn1.RawValue
+	TeeEnforced              asn1.RawValue
+}
+
+func androidSecurityLevel(l asn1.Enumerated) string {
+	switch l {
+	case 0:
+		return "Software"
+	case 1:
+		return "TrustedEnvironment"
+	case 2:
+		return "StrongBox"
+	default:
+		return fmt.Sprintf("Unknown(%d)", l)
+	}
+}
+
+// decodeAttestationInput turns PEM, base64 or binary input into either a
+// certificate chain or a single DER/CBOR blob.
+func decodeAttestationInput(b []byte) ([]*x509.Certificate, []byte, error) {
+	b = bytes.TrimSpace(b)
+	if bytes.HasPrefix(b, []byte("-----BEGIN")) {
+		var chain []*x509.Certificate
+		for {
+			var block *pem.Block
+			block, b = pem.Decode(b)
+			if block == nil {
+				break
+			}
+			switch block.Type {
+			case "CERTIFICATE":
+				c, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, nil, err
+				}
+				chain = append(chain, c)
+			case "PUBLIC KEY":
+				return nil, block.Bytes, nil
+			default:
+				return nil, nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+			}
+		}
+		if len(chain) == 0 {
+			return nil, nil, errors.New("no certificate found in PEM input")
+		}
+		return chain, nil, nil
+	}
+	text := strings.Join(strings.Fields(string(b)), "")
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if d, err := enc.DecodeString(text); err == nil {
+			b = d
+			break
+		}
+	}
+	if len(b) > 0 && b[0]>>5 != 5 {
+		if chain, err := x509.ParseCertificates(b); err == nil && len(chain) > 0 {
+			return chain, nil, nil
+		}
+	}
+	return nil, b, nil
+}
+
+// checkChain reports whether each certificate is signed by the next one.
+func checkChain(chain []*x509.Certificate) bool {
+	for i := 0; i+1 < len(chain); i++ {
+		if chain[i].CheckSignatureFrom(chain[i+1]) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func chainAttestation(format string, chain []*x509.Certificate) Attestation {
+	return Attestation{
+		Format:        format,
+		ChainLength:   len(chain),
+		ChainVerified: checkChain(chain),
+		Issuer:        chain[len(chain)-1].Issuer.String(),
+	}
+}
+
+// androidAttestation extracts the key and KeyDescription from an Android
+// Keystore attestation chain, leaf first.
+func androidAttestation(chain []*x509.Certificate) (interface{}, Attestation, error) {
+	att := chainAttestation("android-key", chain)
+	for _, ext := range chain[0].Extensions {
+		if !ext.Id.Equal(oidAndroidKeyDescription) {
+			continue
+		}
+		var desc androidKeyDescription
+		if _, err := asn1.Unmarshal(ext.Value, &desc); err != nil {
+			return nil, att, fmt.Errorf("invalid key description: %s", err)
+		}
+		att.AttestationVersion = desc.AttestationVersion
+		att.SecurityLevel = androidSecurityLevel(desc.AttestationSecurityLevel)
+		att.KeymasterVersion = desc.KeymasterVersion
+		att.KeymasterSecurityLevel = androidSecurityLevel(desc.KeymasterSecurityLevel)
+		att.Challenge = base64.RawURLEncoding.EncodeToString(desc.AttestationChallenge)
+		return chain[0].PublicKey, att, nil
+	}
+	return nil, att, errors.New("leaf certificate has no Android key attestation extension")
+}
+
+// appAttestation extracts the key from an Apple App Attest attestation
+// object, checking that the credential ID is the hash of the key.
+func appAttestation(b []byte) (interface{}, string, Attestation, error) {
+	v, _, err := decodeCBOR(b)
+	if err != nil {
+		return nil, "", Attestation{}, err
+	}
+	obj, _ := v.(map[interface{}]interface{})
+	if obj["fmt"] != "apple-appattest" {
+		return nil, "", Attestation{}, fmt.Errorf("unsupported attestation format %v", obj["fmt"])
+	}
+	stmt, _ := obj["attStmt"].(map[interface{}]interface{})
+	x5c, _ := stmt["x5c"].([]interface{})
+	var chain []*x509.Certificate
+	for _, der := range x5c {
+		raw, _ := der.([]byte)
+		c, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, "", Attestation{}, fmt.Errorf("invalid x5c certificate: %s", err)
+		}
+		chain = append(chain, c)
+	}
+	if len(chain) == 0 {
+		return nil, "", Attestation{}, errors.New("attestation statement has no x5c")
+	}
+	att := chainAttestation("apple-appattest", chain)
+
+	authData, _ := obj["authData"].([]byte)
+	// rpIdHash(32) flags(1) signCount(4) aaguid(16) credentialIdLength(2)
+	if len(authData) < 55 {
+		return nil, "", att, errors.New("authenticator data is too short")
+	}
+	att.RPIDHash = hex.EncodeToString(authData[:32])
+	switch string(bytes.TrimRight(authData[37:53], "\x00")) {
+	case "appattest":
+		att.Environment = "production"
+	case "appattestdevelop":
+		att.Environment = "development"
+	default:
+		return nil, "", att, errors.New("unknown App Attest AAGUID")
+	}
+	n := int(binary.BigEndian.Uint16(authData[53:55]))
+	if len(authData) < 55+n {
+		return nil, "", att, errors.New("authenticator data is too short")
+	}
+	credentialID := authData[55 : 55+n]
+
+	pub, ok := chain[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, "", att, errors.New("credential certificate does not hold an EC key")
+	}
+	keyID := sha256.Sum256(elliptic.Marshal(pub.Curve, pub.X, pub.Y))
+	if !bytes.Equal(keyID[:], credentialID) {
+		return nil, "", att, errors.New("credential ID does not match the attested key")
+	}
+	for _, ext := range chain[0].Extensions {
+		if ext.Id.Equal(oidAppleNonce) {
+			var nonce struct {
+				Value []byte `asn1:"explicit,tag:1"`
+			}
+			if _, err := asn1.Unmarshal(ext.Value, &nonce); err == nil {
+				att.Nonce = hex.EncodeToString(nonce.Value)
+			}
+		}
+	}
+	return pub, base64.StdEncoding.EncodeToString(keyID[:]), att, nil
+}
+
+// rawPublicKey parses a SubjectPublicKeyInfo or an uncompressed P-256
+// point as exported by SecKeyCopyExternalRepresentation.
+func rawPublicKey(b []byte) (interface{}, error) {
+	if k, err := x509.ParsePKIXPublicKey(b); err == nil {
+		return k, nil
+	}
+	if len(b) == 65 && b[0] == 4 {
+		x, y := elliptic.Unmarshal(elliptic.P256(), b)
+		if x != nil {
+			return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+		}
+	}
+	return nil, errors.New("not an attestation, certificate chain or public key")
+}
+
+// signingAlg picks the usual signature algorithm for an imported key.
+func signingAlg(k interface{}) string {
+	switch k := k.(type) {
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return string(jose.ES256)
+		case elliptic.P384():
+			return string(jose.ES384)
+		case elliptic.P521():
+			return string(jose.ES512)
+		}
+	case *rsa.PublicKey:
+		return string(jose.RS256)
+	case ed25519.PublicKey:
+		return string(jose.EdDSA)
+	}
+	return ""
+}
+
+// keyAlgs are the algorithms an imported key may be used for, by use.
+var keyAlgs = map[string]map[string]string{
+	"sig": {
+		string(jose.ES256): "P-256", string(jose.ES384): "P-384", string(jose.ES512): "P-521",
+		string(jose.RS256): "RSA", string(jose.RS384): "RSA", string(jose.RS512): "RSA",
+		string(jose.PS256): "RSA", string(jose.PS384): "RSA", string(jose.PS512): "RSA",
+		string(jose.EdDSA): "Ed25519",
+	},
+	"enc": {
+		string(jose.RSA1_5): "RSA", string(jose.RSA_OAEP): "RSA", string(jose.RSA_OAEP_256): "RSA",
+		string(jose.ECDH_ES): "EC", string(jose.ECDH_ES_A128KW): "EC",
+		string(jose.ECDH_ES_A192KW): "EC", string(jose.ECDH_ES_A256KW): "EC",
+	},
+}
+
+// checkKeyAlg makes sure an imported key can be used for alg.
+func checkKeyAlg(k interface{}, use, alg string) error {
+	want, ok := keyAlgs[use][alg]
+	if !ok {
+		return fmt.Errorf("unknown `alg` %q for `use` = `%s`", alg, use)
+	}
+	var have string
+	switch k := k.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return errors.New("too short key for RSA `alg`, 2048+ is required")
+		}
+		have = "RSA"
+	case *ecdsa.PublicKey:
+		have = k.Curve.Params().Name
+		if want == "EC" {
+			have = "EC"
+		}
+	case ed25519.PublicKey:
+		have = "Ed25519"
+	default:
+		return fmt.Errorf("unsupported key type %T", k)
+	}
+	if have != want {
+		return fmt.Errorf("`alg` %s needs a %s key, not %s", alg, want, have)
+	}
+	return nil
+}
+
+// defaultAlg picks the usual algorithm for an imported key and use.
+func defaultAlg(k interface{}, use string) string {
+	if use == "sig" {
+		return signingAlg(k)
+	}
+	switch k.(type) {
+	case *rsa.PublicKey:
+		return string(jose.RSA_OAEP)
+	case *ecdsa.PublicKey:
+		return string(jose.ECDH_ES)
+	}
+	return ""
+}
+
+// convertKey imports a PEM or DER key and emits it like generate would
+// have, as JWK and optionally JWKS and PEM.
+func convertKey() {
+	if *convertUse == "" {
+		app.FatalUsage("--in requires --use")
+	}
+	if *p12PassFile != "" && !*convertP12 {
+		app.FatalUsage("--p12-passphrase-file needs --p12")
+	}
+	if *convertP12 && (*convertCert == "" || *convertKid == "") {
+		app.FatalUsage("--p12 needs --cert, and --kid, as it is only written to a file")
+	}
+	privKey, pubKey, err := readKey(*convertIn)
+	app.FatalIfError(err, "can't read key from %s", *convertIn)
+	if *convertP12 && privKey == nil {
+		app.FatalUsage("--p12 needs a private key")
+	}
+
+	keyAlg := *convertAlg
+	if keyAlg == "" {
+		keyAlg = defaultAlg(pubKey, *convertUse)
+		if keyAlg == "" {
+			app.FatalUsage("can't infer --alg for this key, pass it explicitly")
+		}
+	}
+	app.FatalIfError(checkKeyAlg(pubKey, *convertUse, keyAlg), "can't convert key")
+
+	// The outputs are rendered by the same code as generate's, which reads
+	// the generate flags.
+	*use, *alg, *kid = *convertUse, keyAlg, *convertKid
+	*jwks, *pemOut, *p12Out, *format = *convertJWKS, *convertPEM, *convertP12, *convertFormat
+
+	priv := jose.JSONWebKey{KeyID: *kid, Algorithm: *alg, Use: *use}
+	if privKey != nil {
+		priv.Key = privKey
+	}
+	pub := jose.JSONWebKey{Key: pubKey, KeyID: *kid, Algorithm: *alg, Use: *use}
+	if *convertCert != "" {
+		chain, err := readCertificatesPEM(*convertCert)
+		app.FatalIfError(err, "can't read certificates from %s", *convertCert)
+		// crypto/x509 has its own Ed25519 type, so compare encodings.
+		spki, err := keygen.MarshalPublicKeyDER(pubKey)
+		if err != nil || !bytes.Equal(spki, chain[0].RawSubjectPublicKeyInfo) {
+			app.Fatalf("the certificate in %s is not for the key of %s", *convertCert, *convertIn)
+		}
+		priv.Certificates, pub.Certificates = chain, chain
+	}
+	if *p12Out {
+		app.FatalIfError(readP12Passphrase(), "can't read passphrase")
+	}
+	emitKeys(priv, pub)
+}
+
+func convert() {
+	switch {
+	case *convertIn != "" && *convertAttestation != "":
+		app.FatalUsage("can't combine --in and --from-attestation")
+	case *convertIn != "":
+		convertKey()
+		return
+	case *convertAttestation == "":
+		app.FatalUsage("nothing to convert, pass --in or --from-attestation")
+	}
+	b, err := readInput(*convertAttestation)
+	app.FatalIfError(err, "can't read %s", *convertAttestation)
+	chain, blob, err := decodeAttestationInput(b)
+	app.FatalIfError(err, "can't decode %s", *convertAttestation)
+
+	var key interface{}
+	var keyID string
+	var att Attestation
+	switch {
+	case chain != nil:
+		key, att, err = androidAttestation(chain)
+	case len(blob) > 0 && blob[0]>>5 == 5:
+		key, keyID, att, err = appAttestation(blob)
+	default:
+		key, err = rawPublicKey(blob)
+		att = Attestation{Format: "raw"}
+	}
+	app.FatalIfError(err, "can't import key from %s", *convertAttestation)
+	if *convertKid != "" {
+		keyID = *convertKid
+	}
+
+	jwk := jose.JSONWebKey{Key: key, KeyID: keyID, Algorithm: signingAlg(key), Use: "sig"}
+	if chain != nil {
+		jwk.Certificates = chain
+	}
+	js, err := jwk.MarshalJSON()
+	app.FatalIfError(err, "can't Marshal public key to JSON")
+	out, err := json.Marshal(AttestedKey{JWK: js, Attestation: att})
+	app.FatalIfError(err, "can't Marshal attested key to JSON")
+	if *convertFormat {
+		out = formatJSON(out)
+	}
+	fmt.Println(string(out))
+}
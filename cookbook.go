@@ -0,0 +1,205 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	cookbookCmd = app.Command("cookbook", "Emit a JOSE cookbook (RFC 7520 style) of JWS/JWE examples made with fresh keys")
+
+	cookbookSigAlgs = cookbookCmd.Flag("sig-alg", "Signature algorithm to include (repeatable)").Default(string(jose.ES256)).Enums(
+		string(jose.ES256), string(jose.ES384), string(jose.ES512), string(jose.EdDSA),
+		string(jose.RS256), string(jose.RS384), string(jose.RS512), string(jose.PS256), string(jose.PS384), string(jose.PS512),
+	)
+	cookbookEncAlgs = cookbookCmd.Flag("enc-alg", "Key management algorithm to include (repeatable)").Default(string(jose.RSA_OAEP)).Enums(
+		string(jose.RSA1_5), string(jose.RSA_OAEP), string(jose.RSA_OAEP_256),
+		string(jose.ECDH_ES), string(jose.ECDH_ES_A128KW), string(jose.ECDH_ES_A192KW), string(jose.ECDH_ES_A256KW),
+	)
+	cookbookEnc = cookbookCmd.Flag("enc", "Content encryption algorithm").Default(string(jose.A128GCM)).Enum(
+		string(jose.A128CBC_HS256), string(jose.A192CBC_HS384), string(jose.A256CBC_HS512),
+		string(jose.A128GCM), string(jose.A192GCM), string(jose.A256GCM),
+	)
+	cookbookPayload     = cookbookCmd.Flag("payload", "Payload to sign and encrypt").Default("It’s a dangerous business, Frodo, going out your door. You step onto the road, and if you don't keep your feet, there’s no knowing where you might be swept off to.").String()
+	cookbookPayloadFile = cookbookCmd.Flag("payload-file", "Read payload to sign and encrypt from file").ExistingFile()
+	cookbookFormat      = cookbookCmd.Flag("format", "Out JSON with format").Bool()
+)
+
+// Cookbook is a set of golden JOSE objects together with the keys needed
+// to verify or decrypt them.
+type Cookbook struct {
+	Keys     json.RawMessage   `json:"keys"`
+	Examples []CookbookExample `json:"examples"`
+}
+
+// CookbookExample mirrors the layout of the examples in RFC 7520.
+type CookbookExample struct {
+	Title  string         `json:"title"`
+	Input  CookbookInput  `json:"input"`
+	Output CookbookOutput `json:"output"`
+}
+
+// CookbookInput lists the parameters an example was produced with.
+type CookbookInput struct {
+	Payload string `json:"payload"`
+	Key     string `json:"key"`
+	Alg     string `json:"alg"`
+	Enc     string `json:"enc,omitempty"`
+}
+
+// CookbookOutput holds the same object in all three serializations.
+type CookbookOutput struct {
+	Compact  string          `json:"compact"`
+	JSON     json.RawMessage `json:"json"`
+	JSONFlat json.RawMessage `json:"json_flat"`
+}
+
+// generalJSON converts a flattened JSON serialization into the general one
+// by moving the per-signature or per-recipient members into `list`.
+func generalJSON(flat []byte, list string, members ...string) ([]byte, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(flat, &obj); err != nil {
+		return nil, err
+	}
+	entry := map[string]json.RawMessage{}
+	for _, m := range members {
+		if v, ok := obj[m]; ok {
+			entry[m] = v
+			delete(obj, m)
+		}
+	}
+	b, err := json.Marshal([]map[string]json.RawMessage{entry})
+	if err != nil {
+		return nil, err
+	}
+	obj[list] = b
+	return json.Marshal(obj)
+}
+
+func cookbookJWS(alg jose.SignatureAlgorithm, payload []byte, keys *jose.JSONWebKeySet) (CookbookExample, error) {
+	pubKey, privKey, err := keygen.Sig(alg, 0)
+	if err != nil {
+		return CookbookExample{}, err
+	}
+	kid := "cookbook-" + string(alg)
+	keys.Keys = append(keys.Keys, jose.JSONWebKey{Key: privKey, KeyID: kid, Algorithm: string(alg), Use: "sig"})
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: alg,
+		Key:       jose.JSONWebKey{Key: privKey, KeyID: kid},
+	}, nil)
+	if err != nil {
+		return CookbookExample{}, err
+	}
+	obj, err := signer.Sign(payload)
+	if err != nil {
+		return CookbookExample{}, err
+	}
+	if _, err := obj.Verify(pubKey); err != nil {
+		return CookbookExample{}, err
+	}
+
+	compact, err := obj.CompactSerialize()
+	if err != nil {
+		return CookbookExample{}, err
+	}
+	flat := []byte(obj.FullSerialize())
+	general, err := generalJSON(flat, "signatures", "protected", "header", "signature")
+	if err != nil {
+		return CookbookExample{}, err
+	}
+	return CookbookExample{
+		Title:  fmt.Sprintf("%s signature", alg),
+		Input:  CookbookInput{Payload: base64.RawURLEncoding.EncodeToString(payload), Key: kid, Alg: string(alg)},
+		Output: CookbookOutput{Compact: compact, JSON: general, JSONFlat: flat},
+	}, nil
+}
+
+func cookbookJWE(alg jose.KeyAlgorithm, enc jose.ContentEncryption, payload []byte, keys *jose.JSONWebKeySet) (CookbookExample, error) {
+	pubKey, privKey, err := keygen.Enc(alg, 0)
+	if err != nil {
+		return CookbookExample{}, err
+	}
+	kid := "cookbook-" + string(alg)
+	keys.Keys = append(keys.Keys, jose.JSONWebKey{Key: privKey, KeyID: kid, Algorithm: string(alg), Use: "enc"})
+
+	encrypter, err := jose.NewEncrypter(enc, jose.Recipient{Algorithm: alg, Key: pubKey, KeyID: kid}, nil)
+	if err != nil {
+		return CookbookExample{}, err
+	}
+	obj, err := encrypter.Encrypt(payload)
+	if err != nil {
+		return CookbookExample{}, err
+	}
+	if _, err := obj.Decrypt(privKey); err != nil {
+		return CookbookExample{}, err
+	}
+
+	compact, err := obj.CompactSerialize()
+	if err != nil {
+		return CookbookExample{}, err
+	}
+	flat := []byte(obj.FullSerialize())
+	general, err := generalJSON(flat, "recipients", "header", "encrypted_key")
+	if err != nil {
+		return CookbookExample{}, err
+	}
+	return CookbookExample{
+		Title:  fmt.Sprintf("%s key encryption using %s", alg, enc),
+		Input:  CookbookInput{Payload: base64.RawURLEncoding.EncodeToString(payload), Key: kid, Alg: string(alg), Enc: string(enc)},
+		Output: CookbookOutput{Compact: compact, JSON: general, JSONFlat: flat},
+	}, nil
+}
+
+func cookbook() {
+	payload := []byte(*cookbookPayload)
+	if *cookbookPayloadFile != "" {
+		var err error
+		payload, err = ioutil.ReadFile(*cookbookPayloadFile)
+		app.FatalIfError(err, "can't read payload")
+	}
+
+	var keys jose.JSONWebKeySet
+	var book Cookbook
+	for _, alg := range *cookbookSigAlgs {
+		ex, err := cookbookJWS(jose.SignatureAlgorithm(alg), payload, &keys)
+		app.FatalIfError(err, "can't create %s example", alg)
+		book.Examples = append(book.Examples, ex)
+	}
+	for _, alg := range *cookbookEncAlgs {
+		ex, err := cookbookJWE(jose.KeyAlgorithm(alg), jose.ContentEncryption(*cookbookEnc), payload, &keys)
+		app.FatalIfError(err, "can't create %s example", alg)
+		book.Examples = append(book.Examples, ex)
+	}
+
+	var err error
+	book.Keys, err = json.Marshal(keys)
+	app.FatalIfError(err, "can't Marshal keys with JWKS to JSON")
+	out, err := json.Marshal(book)
+	app.FatalIfError(err, "can't Marshal cookbook to JSON")
+	if *cookbookFormat {
+		out = formatJSON(out)
+	}
+	fmt.Println(string(out))
+}
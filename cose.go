@@ -0,0 +1,167 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// COSE (RFC 9052, 9053, 8230 and 8812) identifiers of the JWK members of
+// the keys jwk-keygen makes.
+var (
+	coseKeyTypes = map[string]int64{"OKP": 1, "EC": 2, "RSA": 3, "oct": 4}
+	coseCurves   = map[string]int64{
+		"P-256": 1, "P-384": 2, "P-521": 3,
+		"X25519": 4, "X448": 5, "Ed25519": 6, "Ed448": 7,
+		"secp256k1": 8,
+	}
+	// JOSE algorithms with a COSE equivalent. The ECDH-ES ones have none,
+	// as COSE derives with HKDF rather than the Concat KDF, so those keys
+	// go without alg.
+	coseAlgorithms = map[string]int64{
+		"ES256": -7, "ES384": -35, "ES512": -36, "ES256K": -47, "EdDSA": -8,
+		"PS256": -37, "PS384": -38, "PS512": -39,
+		"RS256": -257, "RS384": -258, "RS512": -259,
+		"HS256": 5, "HS384": 6, "HS512": 7,
+		"A128KW": -3, "A192KW": -4, "A256KW": -5,
+		"RSA-OAEP": -40, "RSA-OAEP-256": -41,
+		"A128GCM": 1, "A192GCM": 2, "A256GCM": 3,
+		"dir": -6,
+	}
+	coseKeyOps = map[string]int64{
+		"sign": 1, "verify": 2, "encrypt": 3, "decrypt": 4,
+		"wrapKey": 5, "unwrapKey": 6, "deriveKey": 7, "deriveBits": 8,
+	}
+	// Labels of the key type parameters, by kty.
+	coseParams = map[string]map[string]int64{
+		"OKP": {"crv": -1, "x": -2, "d": -4},
+		"EC":  {"crv": -1, "x": -2, "y": -3, "d": -4},
+		"RSA": {"n": -1, "e": -2, "d": -3, "p": -4, "q": -5, "dp": -6, "dq": -7, "qi": -8},
+		"oct": {"k": -1},
+	}
+)
+
+// coseKey converts a marshaled JWK to a COSE_Key. use has no COSE
+// equivalent and is left out, as are members COSE has no label for.
+func coseKey(jwk []byte) (cborMap, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal(jwk, &m); err != nil {
+		return nil, err
+	}
+	kty, _ := m["kty"].(string)
+	ktyLabel, ok := coseKeyTypes[kty]
+	if !ok {
+		return nil, fmt.Errorf("COSE has no key type %q", kty)
+	}
+	key := cborMap{1: ktyLabel}
+	if kid, _ := m["kid"].(string); kid != "" {
+		key[2] = []byte(kid)
+	}
+	if alg, _ := m["alg"].(string); alg != "" {
+		if label, ok := coseAlgorithms[alg]; ok {
+			key[3] = label
+		} else {
+			debugf("COSE has no alg %q, leaving it out", alg)
+		}
+	}
+	if ops, _ := m["key_ops"].([]interface{}); len(ops) > 0 {
+		var labels []interface{}
+		for _, op := range ops {
+			label, ok := coseKeyOps[fmt.Sprint(op)]
+			if !ok {
+				return nil, fmt.Errorf("COSE has no key_ops %q", op)
+			}
+			labels = append(labels, label)
+		}
+		key[4] = labels
+	}
+	for member, label := range coseParams[kty] {
+		v, ok := m[member].(string)
+		if !ok {
+			continue
+		}
+		if member == "crv" {
+			crv, ok := coseCurves[v]
+			if !ok {
+				return nil, fmt.Errorf("COSE has no curve %q", v)
+			}
+			key[label] = crv
+			continue
+		}
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", member, err)
+		}
+		key[label] = b
+	}
+	return key, nil
+}
+
+// renderCOSE encodes a marshaled JWK as a COSE_Key, or a COSE_KeySet with
+// --cose-set, hex encoded if coseHexOutput.
+func renderCOSE(jwk []byte) ([]byte, error) {
+	key, err := coseKey(jwk)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{} = key
+	if *coseSet {
+		v = []interface{}{key}
+	}
+	b, err := encodeCBOR(v)
+	if err != nil {
+		return nil, err
+	}
+	if coseHexOutput() {
+		return []byte(hex.EncodeToString(b)), nil
+	}
+	return b, nil
+}
+
+func renderCOSEKey(k jose.JSONWebKey) ([]byte, error) {
+	b, err := marshalJWK(k)
+	if err != nil {
+		return nil, err
+	}
+	return renderCOSE(b)
+}
+
+// coseHexOutput reports whether COSE output is hex: with --cose-hex, and
+// whenever it is printed rather than written to a file.
+func coseHexOutput() bool {
+	return *coseHex || *kid == "" || *toStdout
+}
+
+// cosePrefix and coseExt make the names of COSE outputs.
+func cosePrefix() string {
+	if *coseSet {
+		return "cose-set_"
+	}
+	return "cose_"
+}
+
+func coseExt() string {
+	if coseHexOutput() {
+		return ".hex"
+	}
+	return ".cbor"
+}
@@ -0,0 +1,110 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	count  = generateCmd.Flag("count", "Generate this many keys, e.g. for a rotation pool").Default("1").Int()
+	bundle = generateCmd.Flag("bundle", "With --count, output the keys as one JWKS instead of a file each").Bool()
+)
+
+// generateMany generates --count keys. Each gets its own kid: the --kid
+// with an index appended, or one of --kid-strategy, random by default.
+// Nothing is written unless every key could be staged.
+func generateMany(opts keygen.Options) {
+	base := *kid
+	if base == "" && *kidStrategy == "" {
+		*kidStrategy = "random"
+	}
+	ids, err := keyIDSource()
+	app.FatalIfError(err, "can't generate Key ID")
+	opts.IDs = ids
+	privs := make([]jose.JSONWebKey, *count)
+	pubs := make([]jose.JSONWebKey, *count)
+	for i := range privs {
+		if base != "" {
+			opts.KeyID = fmt.Sprintf("%s-%d", base, i+1)
+		}
+		opts.RandomKeyID = ids != nil
+		privs[i], pubs[i], err = keygen.Generate(opts)
+		app.FatalIfError(err, "unable to generate key %d", i+1)
+		app.FatalIfError(setThumbprintKeyID(&privs[i], &pubs[i]), "can't generate Key ID for key %d", i+1)
+		if *selfSignedCert {
+			err = attachSelfSignedCert(&privs[i], &pubs[i])
+			app.FatalIfError(err, "can't issue a certificate for key %d", i+1)
+		}
+	}
+
+	if *bundle {
+		stageBundle(privs, pubs)
+	} else {
+		for i := range privs {
+			*kid = privs[i].KeyID
+			stageKeys(privs[i], pubs[i])
+		}
+		*kid = base
+	}
+	fatalIfStaged(stageKidSequence(), "can't record the kid sequence")
+	app.FatalIfError(pending.commit(), "can't write keys")
+	for _, pub := range pubs {
+		runCreateHooks(pub)
+	}
+}
+
+// stageBundle outputs the keys as a private and a public JWKS, named after
+// the --kid, or printed when there is none.
+func stageBundle(privs, pubs []jose.JSONWebKey) {
+	render := func(keys []jose.JSONWebKey) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			b, err := marshalJWKS(keys)
+			if err == nil && *format {
+				b = formatJSON(b)
+			}
+			return b, err
+		}
+	}
+	fname := fmt.Sprintf("jwks_%s_%s_%s", *use, *alg, *kid)
+	var outputs []keyOutput
+	// Symmetric keys have no public half.
+	if pubs[0].Key != nil {
+		outputs = append(outputs, keyOutput{"jwks_" + *alg + "-pub.json", fname + "-pub.json", 0444, "public keys with JWKS", render(pubs), "", false})
+	}
+	o := keyOutput{"jwks_" + *alg + ".json", fname + ".json", 0400, "private keys with JWKS", render(privs), "", true}
+	if outputPassphrase != "" {
+		o = protectedOutput(o, "jwks")
+	}
+	outputs = append(outputs, o)
+
+	rendered := make([][]byte, len(outputs))
+	for i, o := range outputs {
+		var err error
+		rendered[i], err = o.render()
+		app.FatalIfError(err, "can't Marshal %s", o.what)
+		if o.printed() {
+			refusePrivateOutput(o, rendered[i])
+		}
+	}
+	for i, o := range outputs {
+		emitOutput(o, rendered[i])
+	}
+}
@@ -0,0 +1,102 @@
+//go:build cshared
+// +build cshared
+
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"unsafe"
+)
+
+// The C API, built with -tags cshared -buildmode=c-shared. Every function
+// returns a JSON document, {"result": ...} or {"error": "..."}, that the
+// caller owns and releases with free_result. Options are a JSON object
+// with the members of bindingOptions, or NULL. These signatures and the
+// JSON they take and return don't change; new functionality gets new
+// functions.
+
+//export generate_jwk
+func generate_jwk(options *C.char) *C.char {
+	return cResult(func() (interface{}, error) {
+		o, err := cOptions(options)
+		if err != nil {
+			return nil, err
+		}
+		return bindGenerate(o)
+	})
+}
+
+// convert_key takes the key as length bytes at input, as DER needn't be
+// NUL terminated.
+//
+//export convert_key
+func convert_key(input *C.char, length C.size_t, options *C.char) *C.char {
+	return cResult(func() (interface{}, error) {
+		o, err := cOptions(options)
+		if err != nil {
+			return nil, err
+		}
+		return bindConvert(C.GoBytes(unsafe.Pointer(input), C.int(length)), o)
+	})
+}
+
+//export free_result
+func free_result(result *C.char) {
+	C.free(unsafe.Pointer(result))
+}
+
+func cOptions(options *C.char) (bindingOptions, error) {
+	var o bindingOptions
+	if options == nil {
+		return o, nil
+	}
+	if err := json.Unmarshal([]byte(C.GoString(options)), &o); err != nil {
+		return o, fmt.Errorf("can't parse options: %s", err)
+	}
+	return o, nil
+}
+
+// cResult runs f and returns its result for C. A panic becomes an error,
+// as it would otherwise take the calling process down.
+func cResult(f func() (interface{}, error)) (result *C.char) {
+	var v interface{}
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("internal error: %v", r)
+			}
+		}()
+		v, err = f()
+	}()
+	var b []byte
+	if err == nil {
+		b, err = json.Marshal(map[string]interface{}{"result": v})
+	}
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+	return C.CString(string(b))
+}
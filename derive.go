@@ -0,0 +1,182 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	deriveCmd      = app.Command("derive-oct", "Derive a symmetric JWK from a password")
+	derivePassword = deriveCmd.Flag("password-file", "Read the password from FILE (prompted for otherwise)").PlaceHolder("FILE").String()
+	deriveKDF      = deriveCmd.Flag("kdf", "Key derivation function").Default("argon2id").Enum("argon2id", "scrypt")
+	deriveAlg      = deriveCmd.Flag("alg", "Algorithm the key is for").Default(string(jose.HS256)).Enum(deriveAlgs()...)
+	deriveKid      = deriveCmd.Flag("kid", "Key ID; the key and its parameters are written to files when set").String()
+	deriveSalt     = deriveCmd.Flag("salt", "Base64url salt of a previous derivation, to derive the same key again").String()
+	deriveParams   = deriveCmd.Flag("params", "KDF parameters file of a previous derivation, to derive the same key again").PlaceHolder("FILE").String()
+	deriveTime     = deriveCmd.Flag("argon2-time", "Argon2id passes over memory").Default("3").Uint32()
+	deriveMemory   = deriveCmd.Flag("argon2-memory", "Argon2id memory in KiB").Default("65536").Uint32()
+	deriveThreads  = deriveCmd.Flag("argon2-threads", "Argon2id parallelism").Default("4").Uint8()
+	deriveN        = deriveCmd.Flag("scrypt-n", "scrypt CPU/memory cost, a power of two").Default("32768").Int()
+	deriveR        = deriveCmd.Flag("scrypt-r", "scrypt block size").Default("8").Int()
+	deriveP        = deriveCmd.Flag("scrypt-p", "scrypt parallelism").Default("1").Int()
+	deriveFormat   = deriveCmd.Flag("format", "Out JSON with format").Bool()
+)
+
+// deriveKeyLengths are the key sizes, in bytes, of the algorithms a
+// password-derived key can be used for.
+var deriveKeyLengths = map[string]int{
+	string(jose.HS256):     32,
+	string(jose.HS384):     48,
+	string(jose.HS512):     64,
+	string(jose.A128KW):    16,
+	string(jose.A192KW):    24,
+	string(jose.A256KW):    32,
+	string(jose.A128GCMKW): 16,
+	string(jose.A192GCMKW): 24,
+	string(jose.A256GCMKW): 32,
+}
+
+func deriveAlgs() []string {
+	return []string{
+		string(jose.HS256), string(jose.HS384), string(jose.HS512),
+		string(jose.A128KW), string(jose.A192KW), string(jose.A256KW),
+		string(jose.A128GCMKW), string(jose.A192GCMKW), string(jose.A256GCMKW),
+	}
+}
+
+// KDFParams records everything besides the password needed to derive the
+// same key again.
+type KDFParams struct {
+	KeyID     string `json:"kid,omitempty"`
+	Algorithm string `json:"alg"`
+	KDF       string `json:"kdf"`
+	Salt      string `json:"salt"`
+	KeyLength int    `json:"key_length"`
+	Time      uint32 `json:"time,omitempty"`
+	Memory    uint32 `json:"memory,omitempty"`
+	Threads   uint8  `json:"threads,omitempty"`
+	N         int    `json:"n,omitempty"`
+	R         int    `json:"r,omitempty"`
+	P         int    `json:"p,omitempty"`
+}
+
+// deriveKey runs the KDF described by p over password.
+func deriveKey(password []byte, p KDFParams) ([]byte, error) {
+	salt, err := base64.RawURLEncoding.DecodeString(p.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %s", err)
+	}
+	if len(salt) < 16 {
+		return nil, fmt.Errorf("salt must be at least 16 bytes")
+	}
+	switch p.KDF {
+	case "argon2id":
+		if p.Time < 1 || p.Threads < 1 || p.Memory < 8*uint32(p.Threads) {
+			return nil, fmt.Errorf("invalid argon2id parameters")
+		}
+		return argon2.IDKey(password, salt, p.Time, p.Memory, p.Threads, uint32(p.KeyLength)), nil
+	case "scrypt":
+		return scrypt.Key(password, salt, p.N, p.R, p.P, p.KeyLength)
+	default:
+		return nil, fmt.Errorf("unknown kdf %q", p.KDF)
+	}
+}
+
+func deriveOct() {
+	var password string
+	var err error
+	if *derivePassword != "" {
+		password, err = readSecretFile(*derivePassword)
+	} else {
+		password, err = promptSecret("Password")
+	}
+	app.FatalIfError(err, "can't read password")
+	if password == "" {
+		app.FatalUsage("no password given, pass --password-file")
+	}
+
+	var params KDFParams
+	if *deriveParams != "" {
+		b, err := readInput(*deriveParams)
+		app.FatalIfError(err, "can't read %s", *deriveParams)
+		app.FatalIfError(json.Unmarshal(b, &params), "can't parse %s", *deriveParams)
+		if params.KeyLength != deriveKeyLengths[params.Algorithm] {
+			app.Fatalf("%s: key_length %d doesn't fit alg %q", *deriveParams, params.KeyLength, params.Algorithm)
+		}
+		if *deriveKid != "" {
+			params.KeyID = *deriveKid
+		}
+	} else {
+		params = KDFParams{
+			KeyID:     *deriveKid,
+			Algorithm: *deriveAlg,
+			KDF:       *deriveKDF,
+			Salt:      *deriveSalt,
+			KeyLength: deriveKeyLengths[*deriveAlg],
+		}
+		if params.KDF == "argon2id" {
+			params.Time, params.Memory, params.Threads = *deriveTime, *deriveMemory, *deriveThreads
+		} else {
+			params.N, params.R, params.P = *deriveN, *deriveR, *deriveP
+		}
+	}
+	if params.Salt == "" {
+		salt := make([]byte, 16)
+		_, err := rand.Read(salt)
+		app.FatalIfError(err, "can't generate salt")
+		params.Salt = base64.RawURLEncoding.EncodeToString(salt)
+	}
+
+	debugf("deriving %d byte key with %s", params.KeyLength, params.KDF)
+	key, err := deriveKey([]byte(password), params)
+	app.FatalIfError(err, "unable to derive key")
+
+	keyUse := "enc"
+	if strings.HasPrefix(params.Algorithm, "HS") {
+		keyUse = "sig"
+	}
+	jwk := jose.JSONWebKey{Key: key, KeyID: params.KeyID, Algorithm: params.Algorithm, Use: keyUse}
+	keyJS, err := jwk.MarshalJSON()
+	app.FatalIfError(err, "can't Marshal key to JSON")
+	paramsJS, err := json.Marshal(params)
+	app.FatalIfError(err, "can't Marshal KDF parameters to JSON")
+	if *deriveFormat {
+		keyJS = formatJSON(keyJS)
+		paramsJS = formatJSON(paramsJS)
+	}
+
+	if params.KeyID == "" {
+		fmt.Printf("==> jwk_%s.json <==\n", params.Algorithm)
+		fmt.Println(string(keyJS))
+		fmt.Printf("==> kdf_%s.json <==\n", params.Algorithm)
+		fmt.Println(string(paramsJS))
+		return
+	}
+	fname := fmt.Sprintf("%s_%s_%s.json", keyUse, params.Algorithm, params.KeyID)
+	fatalIfStaged(pending.add("jwk_"+fname, "symmetric key with JWK", keyJS, 0400), "can't write jwk_%s", fname)
+	fatalIfStaged(pending.add("kdf_"+fname, "KDF parameters", paramsJS, 0444), "can't write kdf_%s", fname)
+	app.FatalIfError(pending.commit(), "can't write keys")
+}
@@ -0,0 +1,112 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keyset"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	dpopCmd         = app.Command("dpop", "Create an RFC 9449 DPoP proof for an HTTP request")
+	dpopKey         = dpopCmd.Flag("key", "Private JWK the proof is made with").Required().String()
+	dpopMethod      = dpopCmd.Flag("method", "HTTP method of the request, used as htm").Default("POST").String()
+	dpopURL         = dpopCmd.Flag("url", "URL of the request, used as htu").String()
+	dpopAlg         = dpopCmd.Flag("alg", "Algorithm to sign with, if the key has no alg").String()
+	dpopAccessToken = dpopCmd.Flag("access-token", "Access token the proof is bound to, hashed into ath; visible to other users in the process list, prefer --access-token-file").String()
+	dpopTokenFile   = dpopCmd.Flag("access-token-file", "Read the access token the proof is bound to from FILE").PlaceHolder("FILE").String()
+	dpopNonce       = dpopCmd.Flag("nonce", "Server-provided DPoP-Nonce to include").String()
+	dpopJKT         = dpopCmd.Flag("jkt", "Print the JWK thumbprint of the key, as used for dpop_jkt and cnf.jkt, instead of a proof").Bool()
+)
+
+// DPoPProof holds the claims of a DPoP proof (RFC 9449, section 4.2).
+type DPoPProof struct {
+	ID              string `json:"jti"`
+	Method          string `json:"htm"`
+	URL             string `json:"htu"`
+	IssuedAt        int64  `json:"iat"`
+	AccessTokenHash string `json:"ath,omitempty"`
+	Nonce           string `json:"nonce,omitempty"`
+}
+
+func dpopProof() {
+	key, alg, constraints, err := readSigningKey(*dpopKey, *dpopAlg)
+	app.FatalIfError(err, "can't use key %s", *dpopKey)
+	if constraints.Issuer != "" || len(constraints.Audiences) > 0 {
+		app.Fatalf("refusing to sign with %s: key is restricted to %s, DPoP proofs have neither", *dpopKey, constraints)
+	}
+	if _, ok := key.Key.([]byte); ok {
+		app.Fatalf("DPoP proofs need an asymmetric key, %s is a symmetric key", *dpopKey)
+	}
+	// Only the public key goes in the header, without kid, use or alg.
+	pub := jose.JSONWebKey{Key: key.Public().Key}
+
+	if *dpopJKT {
+		jkt, err := keyset.Thumbprint(&pub, crypto.SHA256)
+		app.FatalIfError(err, "can't compute thumbprint of %s", *dpopKey)
+		fmt.Println(jkt)
+		return
+	}
+
+	if *dpopURL == "" {
+		app.FatalUsage("--url is required")
+	}
+	u, err := url.Parse(*dpopURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		app.FatalUsage("--url must be an absolute URL")
+	}
+	// htu is the URL without its query and fragment.
+	u.RawQuery, u.Fragment = "", ""
+
+	jti, err := newJTI()
+	app.FatalIfError(err, "can't generate jti")
+	claims := DPoPProof{
+		ID:       jti,
+		Method:   strings.ToUpper(*dpopMethod),
+		URL:      u.String(),
+		IssuedAt: timestamp().Unix(),
+		Nonce:    *dpopNonce,
+	}
+	accessToken := *dpopAccessToken
+	switch {
+	case *dpopAccessToken != "" && *dpopTokenFile != "":
+		app.FatalUsage("can't combine --access-token and --access-token-file")
+	case *dpopTokenFile != "":
+		accessToken, err = readSecretFile(*dpopTokenFile)
+		app.FatalIfError(err, "can't read access token")
+	case *dpopAccessToken != "":
+		warnArgvSecret("--access-token", "--access-token-file")
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims.AccessTokenHash = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+
+	signer := *key
+	signer.KeyID, signer.Use, signer.Algorithm = "", "", ""
+	headers := map[jose.HeaderKey]interface{}{"jwk": pub}
+	token, err := signJWT(&signer, alg, "dpop+jwt", headers, claims)
+	app.FatalIfError(err, "can't sign DPoP proof")
+	fmt.Println(token)
+}
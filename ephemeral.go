@@ -0,0 +1,82 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	ephemeral    = generateCmd.Flag("ephemeral", "Keep the private key only this long, in a private directory on tmpfs, and stay running until it is deleted").PlaceHolder("DURATION").Duration()
+	ephemeralDir = generateCmd.Flag("ephemeral-dir", "tmpfs directory for --ephemeral keys; $XDG_RUNTIME_DIR or /dev/shm if not given").PlaceHolder("DIR").String()
+)
+
+// privateDir is where the private outputs go instead of --out-dir, set
+// for --ephemeral.
+var privateDir string
+
+// makeEphemeralDir creates the private 0700 directory --ephemeral keys are
+// written to, under --ephemeral-dir or else a memory-backed directory of
+// the system.
+func makeEphemeralDir() (string, error) {
+	base := *ephemeralDir
+	if base == "" {
+		base = os.Getenv("XDG_RUNTIME_DIR")
+	}
+	if base == "" {
+		if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+			base = "/dev/shm"
+		}
+	}
+	if base == "" {
+		return "", errors.New("no tmpfs found, pass --ephemeral-dir")
+	}
+	return ioutil.TempDir(base, "jwk-keygen-")
+}
+
+// holdEphemeral waits until --ephemeral is over, or SIGINT or SIGTERM
+// arrives, then shreds the private key files and their directory.
+func holdEphemeral() {
+	release := holdSignals()
+	defer release()
+	ctx := signalContext()
+	expires := time.Now().Add(*ephemeral)
+	fmt.Fprintf(logw, "Holding the private key in %s until %s\n", privateDir, expires.Format(time.RFC3339))
+	timer := time.NewTimer(*ephemeral)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+	}
+	files, _ := filepath.Glob(filepath.Join(privateDir, "*"))
+	for _, f := range files {
+		if err := shredFile(f); err != nil {
+			fmt.Fprintf(logw, "jwk-keygen: warning: can't shred %s: %s\n", f, err)
+		}
+	}
+	if err := os.Remove(privateDir); err != nil {
+		fmt.Fprintf(logw, "jwk-keygen: warning: can't remove %s: %s\n", privateDir, err)
+		exit(1)
+		return
+	}
+	fmt.Fprintf(logw, "Deleted the private key in %s\n", privateDir)
+}
@@ -0,0 +1,40 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// timestamp returns the time to embed in what is generated: certificate
+// validity, token iat, note and manifest dates. It is SOURCE_DATE_EPOCH
+// when set, as in reproducible builds and golden-file tests, and the
+// current time otherwise. Times compared against, such as expiry checks,
+// always use the current time.
+func timestamp() time.Time {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return time.Now()
+	}
+	secs, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil || secs < 0 {
+		app.Fatalf("invalid SOURCE_DATE_EPOCH %q, want seconds since 1970", epoch)
+	}
+	return time.Unix(secs, 0).UTC()
+}
@@ -0,0 +1,50 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+)
+
+// ecJSONWebKey is the EC encoding of secp256k1 keys (RFC 8812), whose
+// curve go-jose does not know.
+type ecJSONWebKey struct {
+	Use    string   `json:"use,omitempty"`
+	KeyOps []string `json:"key_ops,omitempty"`
+	Kty    string   `json:"kty"`
+	Kid    string   `json:"kid,omitempty"`
+	Crv    string   `json:"crv"`
+	Alg    string   `json:"alg,omitempty"`
+	X      string   `json:"x"`
+	Y      string   `json:"y"`
+	D      string   `json:"d,omitempty"`
+}
+
+func runES256K() {
+	x, y, d, err := keygen.Secp256k1()
+	app.FatalIfError(err, "unable to generate key")
+
+	enc := base64.RawURLEncoding
+	pub := ecJSONWebKey{Use: *use, Kty: "EC", Kid: *kid, Crv: "secp256k1", Alg: *alg,
+		X: enc.EncodeToString(x), Y: enc.EncodeToString(y)}
+	priv := pub
+	priv.D = enc.EncodeToString(d)
+	priv.KeyOps, pub.KeyOps = splitKeyOps()
+	emitRawJWK(priv, pub)
+}
@@ -0,0 +1,132 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// etcdStore talks to the etcd v3 gRPC gateway, which takes JSON with
+// base64 keys and values and 64-bit numbers as strings.
+type etcdStore struct {
+	endpoint string
+	token    string
+}
+
+// dialEtcd returns a store for an http(s):// etcd endpoint, authenticating
+// with ETCD_USERNAME and ETCD_PASSWORD if set.
+func dialEtcd(endpoint string) (*etcdStore, error) {
+	s := &etcdStore{endpoint: strings.TrimSuffix(endpoint, "/")}
+	if user := os.Getenv("ETCD_USERNAME"); user != "" {
+		var resp struct {
+			Token string `json:"token"`
+		}
+		err := s.call("/v3/auth/authenticate", map[string]string{"name": user, "password": os.Getenv("ETCD_PASSWORD")}, &resp)
+		if err != nil {
+			return nil, err
+		}
+		s.token = resp.Token
+	}
+	return s, nil
+}
+
+func (s *etcdStore) call(path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", s.token)
+	}
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("etcd responded with %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	return json.Unmarshal(b, out)
+}
+
+func (s *etcdStore) get(key string) ([]byte, string, error) {
+	var resp struct {
+		Kvs []struct {
+			Value       []byte `json:"value"`
+			ModRevision string `json:"mod_revision"`
+		} `json:"kvs"`
+	}
+	if err := s.call("/v3/kv/range", map[string][]byte{"key": []byte(key)}, &resp); err != nil {
+		return nil, "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, "", nil
+	}
+	return resp.Kvs[0].Value, resp.Kvs[0].ModRevision, nil
+}
+
+func (s *etcdStore) set(key string, value []byte, version string, ttl time.Duration) (bool, error) {
+	put := map[string]interface{}{"key": []byte(key), "value": value}
+	if ttl > 0 {
+		var lease struct {
+			ID string `json:"ID"`
+		}
+		secs := int64(ttl / time.Second)
+		if secs < 1 {
+			secs = 1
+		}
+		if err := s.call("/v3/lease/grant", map[string]string{"TTL": strconv.FormatInt(secs, 10)}, &lease); err != nil {
+			return false, err
+		}
+		put["lease"] = lease.ID
+	}
+	// An unset key has create revision 0; a set one must still be at the
+	// revision get saw.
+	compare := map[string]interface{}{"key": []byte(key), "result": "EQUAL", "target": "CREATE", "create_revision": "0"}
+	if version != "" {
+		compare = map[string]interface{}{"key": []byte(key), "result": "EQUAL", "target": "MOD", "mod_revision": version}
+	}
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	err := s.call("/v3/kv/txn", map[string]interface{}{
+		"compare": []interface{}{compare},
+		"success": []interface{}{map[string]interface{}{"request_put": put}},
+	}, &resp)
+	return resp.Succeeded, err
+}
+
+func (s *etcdStore) close() error {
+	return nil
+}
@@ -0,0 +1,167 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/ed25519"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/json"
+)
+
+// frostCiphersuite is the RFC 9591 ciphersuite the shares are meant for.
+const frostCiphersuite = "FROST-ED25519-SHA512-v1"
+
+// FROSTShare is a single participant's key share as produced by a
+// trusted dealer (RFC 9591, Appendix C).
+type FROSTShare struct {
+	Ciphersuite    string   `json:"ciphersuite"`
+	KeyID          string   `json:"kid,omitempty"`
+	Identifier     int      `json:"identifier"`
+	MinSigners     int      `json:"min_signers"`
+	MaxSigners     int      `json:"max_signers"`
+	SigningShare   string   `json:"signing_share"`
+	VerifyingShare string   `json:"verifying_share"`
+	VerifyingKey   string   `json:"verifying_key"`
+	VSSCommitment  []string `json:"vss_commitment"`
+}
+
+// KeygenFROST splits a freshly generated Ed25519 group key into `shares`
+// shares of which any `threshold` can produce a signature. The group
+// secret itself is discarded once the shares are computed.
+func KeygenFROST(threshold, shares int) (ed25519.PublicKey, []FROSTShare, error) {
+	if threshold < 2 || threshold > shares {
+		return nil, nil, errors.New("FROST requires 2 <= threshold <= shares")
+	}
+	if shares > 255 {
+		return nil, nil, errors.New("FROST supports at most 255 shares")
+	}
+
+	// coefficients[0] is the group secret, the rest define the polynomial.
+	coefficients := make([]*edwards25519.Scalar, threshold)
+	commitment := make([]string, threshold)
+	for i := range coefficients {
+		s, err := randomScalar()
+		if err != nil {
+			return nil, nil, err
+		}
+		coefficients[i] = s
+		commitment[i] = hex.EncodeToString(new(edwards25519.Point).ScalarBaseMult(s).Bytes())
+	}
+	groupKey := new(edwards25519.Point).ScalarBaseMult(coefficients[0]).Bytes()
+
+	out := make([]FROSTShare, shares)
+	for i := range out {
+		id := i + 1
+		x, err := scalarFromInt(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Horner's method: f(x) = a0 + x*(a1 + x*(a2 + ...)).
+		y := edwards25519.NewScalar()
+		for j := len(coefficients) - 1; j >= 0; j-- {
+			y.MultiplyAdd(y, x, coefficients[j])
+		}
+		out[i] = FROSTShare{
+			Ciphersuite:    frostCiphersuite,
+			Identifier:     id,
+			MinSigners:     threshold,
+			MaxSigners:     shares,
+			SigningShare:   hex.EncodeToString(y.Bytes()),
+			VerifyingShare: hex.EncodeToString(new(edwards25519.Point).ScalarBaseMult(y).Bytes()),
+			VerifyingKey:   hex.EncodeToString(groupKey),
+			VSSCommitment:  commitment,
+		}
+	}
+	return ed25519.PublicKey(groupKey), out, nil
+}
+
+func randomScalar() (*edwards25519.Scalar, error) {
+	b := make([]byte, 64)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return edwards25519.NewScalar().SetUniformBytes(b)
+}
+
+func scalarFromInt(n int) (*edwards25519.Scalar, error) {
+	b := make([]byte, 32)
+	b[0] = byte(n)
+	return edwards25519.NewScalar().SetCanonicalBytes(b)
+}
+
+func runFROST() {
+	if !*experimental {
+		app.FatalUsage("--shares is experimental, pass --experimental to enable it")
+	}
+	if *use != "sig" || *alg != string(jose.EdDSA) {
+		app.FatalUsage("FROST shares can only be generated for --use=sig --alg=EdDSA")
+	}
+	if *jwks || *pemOut || *pemBody || *pemOneLine || *derOut || *pkcs8Out || *coseOut || *sqlOut != "" || *emitNotes {
+		app.FatalUsage("FROST shares can only be output as JWK and JSON")
+	}
+
+	groupKey, keyShares, err := KeygenFROST(*threshold, *shares)
+	app.FatalIfError(err, "unable to generate FROST shares")
+
+	pub := jose.JSONWebKey{Key: groupKey, KeyID: *kid, Algorithm: *alg, Use: *use}
+	pubJS, err := pub.MarshalJSON()
+	app.FatalIfError(err, "can't Marshal group public key to JSON")
+
+	sharesJS := make([][]byte, len(keyShares))
+	for i := range keyShares {
+		keyShares[i].KeyID = *kid
+		sharesJS[i], err = json.Marshal(keyShares[i])
+		app.FatalIfError(err, "can't Marshal FROST share to JSON")
+	}
+
+	render := func(b []byte) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			if *format {
+				return formatJSON(b), nil
+			}
+			return b, nil
+		}
+	}
+	fname := fmt.Sprintf("frost_%s_%s_%s", *use, *alg, *kid)
+	outputs := []keyOutput{{"frost_" + *alg + "-pub.json", fname + "-pub.json", 0444, "group public key with JWK", render(pubJS), "", false}}
+	for i, js := range sharesJS {
+		id := keyShares[i].Identifier
+		outputs = append(outputs, keyOutput{fmt.Sprintf("frost_%s-share-%d.json", *alg, id),
+			fmt.Sprintf("%s-share-%d.json", fname, id), 0400, "FROST share", render(js), "", true})
+	}
+
+	// Like emitRawJWK: no share is written unless all of them can be.
+	rendered := make([][]byte, len(outputs))
+	for i, o := range outputs {
+		rendered[i], err = o.render()
+		app.FatalIfError(err, "can't Marshal %s", o.what)
+		if o.printed() {
+			refusePrivateOutput(o, rendered[i])
+		}
+	}
+	for i, o := range outputs {
+		emitOutput(o, rendered[i])
+	}
+	app.FatalIfError(pending.commit(), "can't write keys")
+	runHooks(*onCreate, HookEvent{Event: "create", KeyID: *kid, Algorithm: *alg, Use: *use, PublicKey: pubJS})
+}
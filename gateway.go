@@ -0,0 +1,327 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/template"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+)
+
+var (
+	gatewayCmd    = app.Command("gateway-config", "Render public keys into the JWT validation config of an API gateway")
+	gatewayTarget = gatewayCmd.Flag("target", "Gateway: kong, apisix, istio or nginx-njs").Required().Enum("kong", "apisix", "istio", "nginx-njs")
+	gatewayKey    = gatewayCmd.Flag("key", "JWK or JWKS holding the keys (- for stdin); private members are dropped").String()
+	gatewayIssuer = gatewayCmd.Flag("issuer", "Token issuer (iss); required for istio, and used instead of kid to pick kong/apisix credentials").String()
+	gatewayName   = gatewayCmd.Flag("name", "Name of the consumer or resource").Default("jwk-keygen").String()
+	gatewayFormat = gatewayCmd.Flag("format", "Out JSON with format").Bool()
+
+	gatewayAudiences = gatewayCmd.Flag("audience", "Accepted token audience, for istio (repeatable)").Strings()
+	gatewayJWKSURI   = gatewayCmd.Flag("jwks-uri", "Have istio fetch the key set from this URI instead of inlining --key").String()
+	gatewayNamespace = gatewayCmd.Flag("namespace", "Namespace of the istio resources").String()
+	gatewaySelector  = gatewayCmd.Flag("selector", "Workload label the istio resources apply to, e.g. app=api (repeatable)").StringMap()
+)
+
+// gatewayKeys reads the public keys to configure, in their raw form for
+// JWKS-based gateways along with the decoded keys for PEM-based ones.
+func gatewayKeys(filename string) (*safeio.RawKeySet, []safeio.RawKey, error) {
+	b, err := readInput(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, err := safeio.ParseRawKeys(b, inputLimits())
+	if err != nil {
+		return nil, nil, err
+	}
+	set := &safeio.RawKeySet{}
+	for _, k := range keys {
+		if pub, ok := k.Public(); ok && k.Use() != "enc" {
+			set.Keys = append(set.Keys, pub)
+		}
+	}
+	if len(set.Keys) == 0 {
+		return nil, nil, errors.New("no public signing keys found")
+	}
+	return set, set.Keys, nil
+}
+
+// credentialKeys returns, for gateways matching one credential per token
+// claim, the claim name and the value each key is registered under.
+func credentialKeys(keys []safeio.RawKey) (string, []string, error) {
+	if *gatewayIssuer != "" {
+		if len(keys) > 1 {
+			return "", nil, errors.New("--issuer can name one key only, as credentials are matched on it")
+		}
+		return "iss", []string{*gatewayIssuer}, nil
+	}
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		if k.Kid() == "" {
+			return "", nil, errors.New("keys need a kid, or pass --issuer")
+		}
+		values[i] = k.Kid()
+	}
+	return "kid", values, nil
+}
+
+// publicPEM decodes a key to the PEM gateways like Kong and APISIX expect,
+// along with its alg.
+func publicPEM(k safeio.RawKey) (string, string, error) {
+	if k.Alg() == "" {
+		return "", "", fmt.Errorf("key %q has no alg", k.Kid())
+	}
+	jwk, err := k.Decode()
+	if err != nil {
+		return "", "", err
+	}
+	b, err := keygen.MarshalPublicKeyPEM(jwk.Key)
+	if err != nil {
+		return "", "", fmt.Errorf("key %q: %s", k.Kid(), err)
+	}
+	return string(b), k.Alg(), nil
+}
+
+func kongConfig(keys []safeio.RawKey) (interface{}, error) {
+	claim, values, err := credentialKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	var secrets []map[string]string
+	for i, k := range keys {
+		pem, alg, err := publicPEM(k)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, map[string]string{"key": values[i], "algorithm": alg, "rsa_public_key": pem})
+	}
+	return map[string]interface{}{
+		"_format_version": "3.0",
+		"consumers": []interface{}{
+			map[string]interface{}{"username": *gatewayName, "jwt_secrets": secrets},
+		},
+		"plugins": []interface{}{
+			map[string]interface{}{
+				"name": "jwt",
+				"config": map[string]interface{}{
+					"key_claim_name":   claim,
+					"claims_to_verify": []string{"exp"},
+				},
+			},
+		},
+	}, nil
+}
+
+func apisixConfig(keys []safeio.RawKey) (interface{}, error) {
+	_, values, err := credentialKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	// APISIX consumers hold a single jwt-auth key each.
+	var consumers []interface{}
+	for i, k := range keys {
+		pem, alg, err := publicPEM(k)
+		if err != nil {
+			return nil, err
+		}
+		name := *gatewayName
+		if len(keys) > 1 {
+			name = fmt.Sprintf("%s_%d", name, i+1)
+		}
+		consumers = append(consumers, map[string]interface{}{
+			"username": name,
+			"plugins": map[string]interface{}{
+				"jwt-auth": map[string]string{"key": values[i], "public_key": pem, "algorithm": alg},
+			},
+		})
+	}
+	return map[string]interface{}{"consumers": consumers}, nil
+}
+
+// istioConfig returns a RequestAuthentication validating tokens from the
+// issuer, and an AuthorizationPolicy that only lets requests with such a
+// token (and one of the audiences, if given) through. Both come in a List
+// so that one `kubectl apply` creates them.
+func istioConfig(set *safeio.RawKeySet) (interface{}, error) {
+	if *gatewayIssuer == "" {
+		return nil, errors.New("istio needs --issuer")
+	}
+	rule := map[string]interface{}{"issuer": *gatewayIssuer}
+	if *gatewayJWKSURI != "" {
+		rule["jwksUri"] = *gatewayJWKSURI
+	} else {
+		jwks, err := json.Marshal(set)
+		if err != nil {
+			return nil, err
+		}
+		rule["jwks"] = string(jwks)
+	}
+	if len(*gatewayAudiences) > 0 {
+		rule["audiences"] = *gatewayAudiences
+	}
+
+	metadata := map[string]string{"name": *gatewayName}
+	if *gatewayNamespace != "" {
+		metadata["namespace"] = *gatewayNamespace
+	}
+	authn := map[string]interface{}{"jwtRules": []interface{}{rule}}
+	authz := map[string]interface{}{"action": "ALLOW"}
+	if len(*gatewaySelector) > 0 {
+		selector := map[string]interface{}{"matchLabels": *gatewaySelector}
+		authn["selector"] = selector
+		authz["selector"] = selector
+	}
+
+	allow := map[string]interface{}{
+		"from": []interface{}{
+			map[string]interface{}{
+				"source": map[string]interface{}{"requestPrincipals": []string{*gatewayIssuer + "/*"}},
+			},
+		},
+	}
+	if len(*gatewayAudiences) > 0 {
+		allow["when"] = []interface{}{
+			map[string]interface{}{"key": "request.auth.audiences", "values": *gatewayAudiences},
+		}
+	}
+	authz["rules"] = []interface{}{allow}
+
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "List",
+		"items": []interface{}{
+			map[string]interface{}{
+				"apiVersion": "security.istio.io/v1",
+				"kind":       "RequestAuthentication",
+				"metadata":   metadata,
+				"spec":       authn,
+			},
+			map[string]interface{}{
+				"apiVersion": "security.istio.io/v1",
+				"kind":       "AuthorizationPolicy",
+				"metadata":   metadata,
+				"spec":       authz,
+			},
+		},
+	}, nil
+}
+
+var njsTemplate = template.Must(template.New("njs").Parse(`// JWT validation for nginx with njs. In nginx.conf:
+//
+//   js_import jwt from conf.d/jwt.js;
+//
+//   location / {
+//       auth_request /_jwt;
+//   }
+//   location = /_jwt {
+//       internal;
+//       js_content jwt.verify;
+//   }
+
+const JWKS = {{.JWKS}};
+const ISSUER = {{.Issuer}};
+
+function importParams(jwk) {
+  switch (jwk.kty) {
+  case 'EC':
+    return { name: 'ECDSA', namedCurve: jwk.crv };
+  case 'RSA':
+    const hash = 'SHA-' + jwk.alg.slice(2);
+    return jwk.alg.startsWith('PS') ? { name: 'RSA-PSS', hash } : { name: 'RSASSA-PKCS1-v1_5', hash };
+  }
+}
+
+function verifyParams(jwk) {
+  switch (jwk.alg.slice(0, 2)) {
+  case 'ES':
+    return { name: 'ECDSA', hash: 'SHA-' + jwk.alg.slice(2) };
+  case 'PS':
+    return { name: 'RSA-PSS', saltLength: Number(jwk.alg.slice(2)) / 8 };
+  default:
+    return { name: 'RSASSA-PKCS1-v1_5' };
+  }
+}
+
+async function verify(r) {
+  try {
+    const auth = r.headersIn['Authorization'] || '';
+    const parts = auth.replace(/^Bearer /, '').split('.');
+    if (parts.length !== 3) {
+      throw new Error('not a compact JWS');
+    }
+    const header = JSON.parse(Buffer.from(parts[0], 'base64url').toString());
+    const jwk = JWKS.keys.find(k => k.kid === header.kid && k.alg === header.alg);
+    if (!jwk) {
+      throw new Error('unknown key');
+    }
+    const key = await crypto.subtle.importKey('jwk', jwk, importParams(jwk), false, ['verify']);
+    const ok = await crypto.subtle.verify(verifyParams(jwk), key,
+      Buffer.from(parts[2], 'base64url'), Buffer.from(parts[0] + '.' + parts[1]));
+    const claims = JSON.parse(Buffer.from(parts[1], 'base64url').toString());
+    if (!ok || (claims.exp && claims.exp < Date.now() / 1000) || (ISSUER && claims.iss !== ISSUER)) {
+      throw new Error('invalid token');
+    }
+    r.return(204);
+  } catch (e) {
+    r.return(401);
+  }
+}
+
+export default { verify };
+`))
+
+func gatewayConfig() {
+	var set *safeio.RawKeySet
+	var keys []safeio.RawKey
+	var err error
+	switch {
+	case *gatewayKey != "":
+		set, keys, err = gatewayKeys(*gatewayKey)
+		app.FatalIfError(err, "can't read keys")
+	case *gatewayTarget != "istio" || *gatewayJWKSURI == "":
+		app.FatalUsage("--key is required unless the istio target fetches keys from --jwks-uri")
+	}
+
+	var cfg interface{}
+	switch *gatewayTarget {
+	case "kong":
+		cfg, err = kongConfig(keys)
+	case "apisix":
+		cfg, err = apisixConfig(keys)
+	case "istio":
+		cfg, err = istioConfig(set)
+	case "nginx-njs":
+		jwks, err := json.Marshal(set)
+		app.FatalIfError(err, "can't Marshal key set to JSON")
+		issuer, _ := json.Marshal(*gatewayIssuer)
+		err = njsTemplate.Execute(os.Stdout, map[string]string{"JWKS": string(jwks), "Issuer": string(issuer)})
+		app.FatalIfError(err, "can't render nginx njs module")
+		return
+	}
+	app.FatalIfError(err, "can't build %s config", *gatewayTarget)
+
+	out, err := json.Marshal(cfg)
+	app.FatalIfError(err, "can't Marshal config to JSON")
+	if *gatewayFormat {
+		out = formatJSON(out)
+	}
+	fmt.Println(string(out))
+}
@@ -0,0 +1,108 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	githubCmd            = app.Command("github-app-jwt", "Mint the JWT a GitHub App authenticates as itself with, and optionally an installation token")
+	githubKey            = githubCmd.Flag("key", "App private key, as the PEM file GitHub hands out or a JWK").Required().String()
+	githubAppID          = githubCmd.Flag("app-id", "App ID or client ID, used as iss").Required().String()
+	githubLifetime       = githubCmd.Flag("lifetime", "How long the JWT is valid, at most 10 minutes").Default("10m").Duration()
+	githubInstallationID = githubCmd.Flag("installation-id", "Exchange the JWT for an access token of this installation and print the response").String()
+	githubAPI            = githubCmd.Flag("api-url", "GitHub API base URL, for GitHub Enterprise Server").Default("https://api.github.com").String()
+)
+
+const (
+	// githubMaxLifetime is the longest a GitHub App JWT may be valid.
+	githubMaxLifetime = 10 * time.Minute
+	// githubClockSkew backdates iat, as GitHub recommends, so that a
+	// slightly fast GitHub clock doesn't reject the JWT.
+	githubClockSkew = 60 * time.Second
+)
+
+// GitHubAppClaims holds the claims of a GitHub App JWT.
+type GitHubAppClaims struct {
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+	Issuer   string `json:"iss"`
+}
+
+// githubInstallationToken exchanges an app JWT for an installation access
+// token and returns GitHub's response.
+func githubInstallationToken(jwt, installationID string) ([]byte, error) {
+	endpoint := fmt.Sprintf("%s/app/installations/%s/access_tokens",
+		strings.TrimSuffix(*githubAPI, "/"), installationID)
+	req, err := http.NewRequest("POST", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("GitHub responded with %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return bytes.TrimSpace(body), nil
+}
+
+func githubAppJWT() {
+	if *githubLifetime <= 0 || *githubLifetime > githubMaxLifetime {
+		app.FatalUsage("--lifetime must be positive and at most 10 minutes")
+	}
+	priv, _, err := readKey(*githubKey)
+	app.FatalIfError(err, "can't read key %s", *githubKey)
+	rsaKey, ok := priv.(*rsa.PrivateKey)
+	if !ok {
+		app.Fatalf("%s is not an RSA private key, GitHub App keys are RS256", *githubKey)
+	}
+
+	now := timestamp()
+	claims := GitHubAppClaims{
+		IssuedAt: now.Add(-githubClockSkew).Unix(),
+		Expiry:   now.Add(*githubLifetime).Unix(),
+		Issuer:   *githubAppID,
+	}
+	token, err := signJWT(&jose.JSONWebKey{Key: rsaKey}, jose.RS256, "JWT", nil, claims)
+	app.FatalIfError(err, "can't sign app JWT")
+
+	if *githubInstallationID == "" {
+		fmt.Println(token)
+		return
+	}
+	resp, err := githubInstallationToken(token, *githubInstallationID)
+	app.FatalIfError(err, "can't get installation token")
+	fmt.Println(string(resp))
+}
@@ -3,10 +3,15 @@ module github.com/nicksherron/jwk-keygen
 go 1.12
 
 require (
+	filippo.io/edwards25519 v1.0.0
 	github.com/alecthomas/template v0.0.0-20160405071501-a0175ee3bccc // indirect
 	github.com/alecthomas/units v0.0.0-20151022065526-2efee857e7cf // indirect
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1
+	github.com/kilic/bls12-381 v0.1.0
 	github.com/stretchr/testify v1.7.0 // indirect
 	golang.org/x/crypto v0.0.0-20190513172903-22d7a77e9e5f
+	golang.org/x/sys v0.10.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 	gopkg.in/square/go-jose.v2 v2.3.1
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,223 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+)
+
+// keyChain parses the x5c certificates of a key, leaf first. Broken chains
+// are reported by keyExpiry, so they are just left out here.
+func keyChain(k safeio.RawKey) []*x509.Certificate {
+	var chain []string
+	if v, ok := k["x5c"]; !ok || json.Unmarshal(v, &chain) != nil {
+		return nil
+	}
+	var certs []*x509.Certificate
+	for _, c := range chain {
+		der, err := base64.StdEncoding.DecodeString(c)
+		if err != nil {
+			return certs
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return certs
+		}
+		certs = append(certs, cert)
+	}
+	return certs
+}
+
+type graphNode struct {
+	id    string
+	kind  string // "endpoint", "source", "key" or "cert"
+	lines []string
+	class string // the key status, for keys
+}
+
+type graphEdge struct {
+	from, to, label string
+}
+
+// keyGraph is the key topology: the endpoints key files are published to,
+// the keys in each file and the certificates that vouch for them.
+type keyGraph struct {
+	nodes []graphNode
+	edges []graphEdge
+}
+
+func buildKeyGraph(entries []ReportEntry, publishedAt map[string]string) keyGraph {
+	var g keyGraph
+	sources := map[string]string{}
+	certs := map[[32]byte]string{}
+	add := func(kind string, class string, lines ...string) string {
+		id := fmt.Sprintf("%s%d", kind, len(g.nodes))
+		g.nodes = append(g.nodes, graphNode{id, kind, lines, class})
+		return id
+	}
+	certNode := func(c *x509.Certificate) (string, bool) {
+		fp := sha256.Sum256(c.Raw)
+		if id, ok := certs[fp]; ok {
+			return id, false
+		}
+		id := add("cert", "", c.Subject.String(), "until "+c.NotAfter.UTC().Format("2006-01-02"))
+		certs[fp] = id
+		return id, true
+	}
+
+	for _, e := range entries {
+		src, ok := sources[e.Source]
+		if !ok {
+			src = add("source", "", e.Source)
+			sources[e.Source] = src
+		}
+		status := e.Status
+		if !e.Expires.IsZero() {
+			status += " " + formatExpiry(e.Expires)
+		}
+		key := add("key", strings.Replace(e.Status, " ", "_", -1), dash(e.KeyID),
+			strings.TrimSpace(strings.Join([]string{e.KeyType, e.Algorithm, e.Use}, " ")), status)
+		g.edges = append(g.edges, graphEdge{src, key, ""})
+
+		from, label := key, "x5c"
+		for _, c := range e.chain {
+			id, isNew := certNode(c)
+			g.edges = append(g.edges, graphEdge{from, id, label})
+			if !isNew {
+				break
+			}
+			from, label = id, "issued by"
+		}
+	}
+
+	files := make([]string, 0, len(publishedAt))
+	for f := range publishedAt {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	endpoints := map[string]string{}
+	for _, f := range files {
+		src, ok := sources[f]
+		if !ok {
+			continue
+		}
+		u := publishedAt[f]
+		ep, ok := endpoints[u]
+		if !ok {
+			ep = add("endpoint", "", u)
+			endpoints[u] = ep
+		}
+		g.edges = append(g.edges, graphEdge{ep, src, "serves"})
+	}
+	return g
+}
+
+// statusColors are the fill colors of keys by status.
+var statusColors = map[string]string{
+	"ok":        "#c8e6c9",
+	"expiring":  "#ffe0b2",
+	"expired":   "#ffcdd2",
+	"no_expiry": "#eeeeee",
+}
+
+func renderDOT(g keyGraph) []byte {
+	shapes := map[string]string{"endpoint": "ellipse", "source": "folder", "key": "box", "cert": "note"}
+	esc := func(s string) string {
+		return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("digraph keys {\n\trankdir=LR;\n")
+	for _, n := range g.nodes {
+		lines := make([]string, len(n.lines))
+		for i, l := range n.lines {
+			lines[i] = esc(l)
+		}
+		fmt.Fprintf(&buf, "\t%s [shape=%s, label=\"%s\"", n.id, shapes[n.kind], strings.Join(lines, `\n`))
+		if c, ok := statusColors[n.class]; ok {
+			fmt.Fprintf(&buf, ", style=filled, fillcolor=\"%s\"", c)
+		}
+		buf.WriteString("];\n")
+	}
+	for _, e := range g.edges {
+		fmt.Fprintf(&buf, "\t%s -> %s", e.from, e.to)
+		if e.label != "" {
+			fmt.Fprintf(&buf, " [label=\"%s\"]", esc(e.label))
+		}
+		buf.WriteString(";\n")
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func renderMermaid(g keyGraph) []byte {
+	shapes := map[string][2]string{"endpoint": {"([", "])"}, "source": {"[(", ")]"}, "key": {"[", "]"}, "cert": {"[/", "/]"}}
+	esc := func(s string) string {
+		return strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;").Replace(s)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("flowchart LR\n")
+	for _, n := range g.nodes {
+		lines := make([]string, len(n.lines))
+		for i, l := range n.lines {
+			lines[i] = esc(l)
+		}
+		s := shapes[n.kind]
+		fmt.Fprintf(&buf, "    %s%s\"%s\"%s\n", n.id, s[0], strings.Join(lines, "<br/>"), s[1])
+	}
+	for _, e := range g.edges {
+		if e.label != "" {
+			fmt.Fprintf(&buf, "    %s -->|%s| %s\n", e.from, esc(e.label), e.to)
+		} else {
+			fmt.Fprintf(&buf, "    %s --> %s\n", e.from, e.to)
+		}
+	}
+	classes := make([]string, 0, len(statusColors))
+	for c := range statusColors {
+		classes = append(classes, c)
+	}
+	sort.Strings(classes)
+	for _, c := range classes {
+		var ids []string
+		for _, n := range g.nodes {
+			if n.class == c {
+				ids = append(ids, n.id)
+			}
+		}
+		if len(ids) > 0 {
+			fmt.Fprintf(&buf, "    classDef %s fill:%s\n    class %s %s\n", c, statusColors[c], strings.Join(ids, ","), c)
+		}
+	}
+	return buf.Bytes()
+}
+
+// reportGraph renders the report as a Graphviz or Mermaid diagram.
+func reportGraph(entries []ReportEntry, format string, publishedAt map[string]string) []byte {
+	g := buildKeyGraph(entries, publishedAt)
+	if format == "mermaid" {
+		return renderMermaid(g)
+	}
+	return renderDOT(g)
+}
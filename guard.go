@@ -0,0 +1,173 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+)
+
+var (
+	profile         = app.Flag("profile", "Safety preset: prod implies --no-private-stdout").Default("dev").Enum("dev", "prod")
+	noPrivateStdout = app.Flag("no-private-stdout", "Fail rather than print private key material to stdout").Bool()
+)
+
+// privateMembers are the names of the private members of JWKs, FROST
+// shares and ACME EAB credentials, as a regexp alternation. Both the
+// stdout guard and the log redaction go by it.
+const privateMembers = `d|p|q|dp|dq|qi|oth|k|signing_share|hmac_key`
+
+// privateMarker matches the private members, the armor of private PEM
+// blocks, whether multi-line or one-line, and NATS nkey seeds.
+var privateMarker = regexp.MustCompile(`"(` + privateMembers + `)"\s*:|PRIVATE KEY-----|\bS[OAU][A-Z2-7]{56}\b`)
+
+// k8sDataLine matches a `key: base64` entry of a Kubernetes Secret.
+var k8sDataLine = regexp.MustCompile(`^\s+[-._a-zA-Z0-9]+:\s+([A-Za-z0-9+/]+=*)\s*$`)
+
+// isPrivate reports whether a line of output carries private key material.
+// Bare base64 lines are decoded to catch --pem-body output, which has no
+// armor to match on, and so are the data entries of --k8s-secret.
+func isPrivate(line []byte) bool {
+	if privateMarker.Match(line) {
+		return true
+	}
+	if m := k8sDataLine.FindSubmatch(line); m != nil {
+		if b, err := base64.StdEncoding.DecodeString(string(m[1])); err == nil && privateMarker.Match(b) {
+			return true
+		}
+	}
+	der, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(line)))
+	if err != nil || len(der) == 0 {
+		return false
+	}
+	if _, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return true
+	}
+	if _, err := x509.ParseECPrivateKey(der); err == nil {
+		return true
+	}
+	if k, _ := keygen.ParseEd25519PrivateKey(der); k != nil {
+		return true
+	}
+	_, err = x509.ParsePKCS8PrivateKey(der)
+	return err == nil
+}
+
+// guardingStdout reports whether private key material must not be printed.
+func guardingStdout() bool {
+	return *noPrivateStdout || *profile == "prod"
+}
+
+// refusePrivateStdout fails if data, about to be printed, carries private
+// key material. It runs before the output is printed, and so before
+// anything is committed or any hook runs; the pipe of guardStdout is only
+// a backstop for what is printed some other way.
+func refusePrivateStdout(data []byte) {
+	if !guardingStdout() {
+		return
+	}
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if isPrivate(line) {
+			pending.abort()
+			app.Fatalf("refusing to print private key material to stdout (--no-private-stdout)")
+		}
+	}
+}
+
+// refusePrivateOutput fails if o, about to be printed, is a private key
+// output, whatever its encoding. Other outputs still go through
+// refusePrivateStdout, in case they carry private key material anyway.
+func refusePrivateOutput(o keyOutput, data []byte) {
+	if o.private && guardingStdout() {
+		pending.abort()
+		app.Fatalf("refusing to print the %s to stdout (--no-private-stdout)", o.what)
+	}
+	refusePrivateStdout(data)
+}
+
+// guardStdout replaces os.Stdout with a pipe that passes output through
+// line by line and terminates the process on the first line carrying
+// private key material. Every command prints through os.Stdout, so this
+// covers them all without each having to check. The returned function
+// flushes the pipe and must run before the process exits.
+func guardStdout() func() {
+	if !guardingStdout() {
+		return func() {}
+	}
+	r, w, err := os.Pipe()
+	app.FatalIfError(err, "can't guard stdout")
+	stdout := os.Stdout
+	os.Stdout = w
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadBytes('\n')
+			if isPrivate(line) {
+				stopPrivateStdout()
+			}
+			stdout.Write(line)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "jwk-keygen: error: can't read guarded stdout:", err)
+				os.Exit(1)
+			}
+		}
+	}()
+
+	var once bool
+	return func() {
+		if once {
+			return
+		}
+		once = true
+		w.Close()
+		<-done
+		os.Stdout = stdout
+	}
+}
+
+// stopPrivateStdout removes the staged files and exits once the backstop
+// caught private key material. Like stopNow, it lets a step holding
+// signals, such as a commit, finish first, and leaves signals locked so
+// that no other starts.
+func stopPrivateStdout() {
+	for {
+		signals.Lock()
+		if signals.held == 0 {
+			break
+		}
+		signals.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	pending.abort()
+	fmt.Fprintln(os.Stderr, "jwk-keygen: error: refusing to print private key material to stdout (--no-private-stdout)")
+	os.Exit(1)
+}
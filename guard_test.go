@@ -0,0 +1,124 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+)
+
+// refused reports whether refusePrivateOutput stops o from being printed.
+func refused(o keyOutput, data []byte) (stopped bool) {
+	defer func() {
+		if recover() != nil {
+			stopped = true
+		}
+	}()
+	app.Terminate(func(int) { panic("terminated") })
+	app.ErrorWriter(ioutil.Discard)
+	defer func() {
+		app.Terminate(os.Exit)
+		app.ErrorWriter(os.Stderr)
+	}()
+	refusePrivateOutput(o, data)
+	return false
+}
+
+func TestRefusePrivateOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwk-keygen-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldGuard, oldCOSE, oldPub, oldPriv := *noPrivateStdout, *coseOut, *pubOut, *privOut
+	oldUse, oldAlg, oldKid := *use, *alg, *kid
+	defer func() {
+		*noPrivateStdout, *coseOut, *pubOut, *privOut = oldGuard, oldCOSE, oldPub, oldPriv
+		*use, *alg, *kid = oldUse, oldAlg, oldKid
+	}()
+	// The JWKs go to files, so only the COSE_Keys are printed, as hex
+	// that no pattern of private JWK members matches.
+	*noPrivateStdout, *coseOut = true, true
+	*pubOut, *privOut = filepath.Join(dir, "pub.json"), filepath.Join(dir, "priv.json")
+	*use, *alg, *kid = "sig", "ES256", ""
+
+	priv, pub, err := keygen.Generate(keygen.Options{Use: *use, Alg: *alg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		refused bool
+	}{
+		{"cose_ES256-pub.hex", false},
+		{"cose_ES256.hex", true},
+	}
+	outputs := map[string]keyOutput{}
+	for _, o := range keyOutputs(priv, pub) {
+		if o.printed() {
+			outputs[o.name] = o
+		}
+	}
+	if len(outputs) != len(tests) {
+		t.Fatalf("got %d printed outputs, want %d", len(outputs), len(tests))
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, ok := outputs[tt.name]
+			if !ok {
+				t.Fatalf("%s is not printed", tt.name)
+			}
+			data, err := o.render()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isPrivate(data) {
+				t.Fatal("the pattern backstop catches the output, so the test proves nothing")
+			}
+			if got := refused(o, data); got != tt.refused {
+				t.Errorf("refused = %v, want %v", got, tt.refused)
+			}
+		})
+	}
+}
+
+// TestRedactPrivateMembers checks that the log redacts every member the
+// stdout guard refuses to print.
+func TestRedactPrivateMembers(t *testing.T) {
+	for _, member := range strings.Split(privateMembers, "|") {
+		line := `{"kty":"x","` + member + `":"c2VjcmV0"}`
+		if !isPrivate([]byte(line)) {
+			t.Errorf("guard doesn't catch %s", line)
+		}
+		for _, logged := range []string{
+			line,
+			`{"kty":"x","` + member + `":[{"r":"c2VjcmV0","d":"c2VjcmV0"}]}`,
+			fmt.Sprintf("%q", line),
+		} {
+			if got := redact([]byte(logged)); bytes.Contains(got, []byte("c2VjcmV0")) {
+				t.Errorf("redact(%s) = %s", logged, got)
+			}
+		}
+	}
+}
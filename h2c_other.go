@@ -0,0 +1,26 @@
+//go:build !go1.24
+// +build !go1.24
+
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import "net/http"
+
+// allowH2C is a no-op before Go 1.24, whose net/http can't speak HTTP/2
+// without TLS. gRPC health checks then fail; /readyz still works.
+func allowH2C(srv *http.Server) {}
@@ -0,0 +1,216 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Serving statuses of grpc.health.v1.HealthCheckResponse.
+const (
+	grpcServing        = 1
+	grpcNotServing     = 2
+	grpcServiceUnknown = 3
+)
+
+// healthService is the gRPC service name, besides "" for the whole
+// server, that health checks answer for.
+const healthService = "jwk-keygen"
+
+// healthChecker answers liveness, readiness and gRPC health checks for
+// the long-running commands. ready returns why the command can't take
+// traffic, nil once it can.
+type healthChecker struct {
+	ready func(ctx context.Context) error
+	// done ends Watch calls when the server shuts down.
+	done <-chan struct{}
+}
+
+// register adds /healthz, /readyz and the grpc.health.v1.Health methods to
+// mux. The gRPC methods need the server to speak HTTP/2, see allowH2C.
+func (h *healthChecker) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+	mux.HandleFunc("/readyz", h.handleReady)
+	mux.HandleFunc("/grpc.health.v1.Health/Check", h.handleCheck)
+	mux.HandleFunc("/grpc.health.v1.Health/Watch", h.handleWatch)
+}
+
+func (h *healthChecker) check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return h.ready(ctx)
+}
+
+func (h *healthChecker) handleReady(w http.ResponseWriter, r *http.Request) {
+	if err := h.check(r.Context()); err != nil {
+		http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+func isGRPC(r *http.Request) bool {
+	return r.Method == "POST" && r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcRequest reads the single message of a gRPC request, and returns its
+// service field as a HealthCheckRequest.
+func grpcRequest(r *http.Request) (string, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+	if len(b) < 5 || b[0] != 0 || int(binary.BigEndian.Uint32(b[1:5])) != len(b)-5 {
+		return "", errors.New("malformed or compressed gRPC message")
+	}
+	return healthCheckService(b[5:])
+}
+
+// healthCheckService decodes the service field, number 1, of a
+// HealthCheckRequest protobuf, skipping unknown fields.
+func healthCheckService(msg []byte) (string, error) {
+	service := ""
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return "", errors.New("malformed HealthCheckRequest")
+		}
+		msg = msg[n:]
+		switch tag & 7 {
+		case 0:
+			if _, n = binary.Uvarint(msg); n <= 0 {
+				return "", errors.New("malformed HealthCheckRequest")
+			}
+		case 1:
+			n = 8
+		case 5:
+			n = 4
+		case 2:
+			l, m := binary.Uvarint(msg)
+			if m <= 0 || l > uint64(len(msg)-m) {
+				return "", errors.New("malformed HealthCheckRequest")
+			}
+			if tag>>3 == 1 {
+				service = string(msg[m : m+int(l)])
+			}
+			n = m + int(l)
+		default:
+			return "", errors.New("malformed HealthCheckRequest")
+		}
+		if n > len(msg) {
+			return "", errors.New("malformed HealthCheckRequest")
+		}
+		msg = msg[n:]
+	}
+	return service, nil
+}
+
+// grpcError ends a gRPC call that hasn't sent anything yet with status
+// code, in a response with no body.
+func grpcError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", fmt.Sprint(code))
+	w.Header().Set("Grpc-Message", message)
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeHealthResponse sends a HealthCheckResponse with status.
+func writeHealthResponse(w http.ResponseWriter, status int) {
+	w.Write([]byte{0, 0, 0, 0, 2, 0x08, byte(status)})
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// status returns the serving status of service.
+func (h *healthChecker) status(ctx context.Context, service string) int {
+	if service != "" && service != healthService {
+		return grpcServiceUnknown
+	}
+	if err := h.check(ctx); err != nil {
+		debugf("not ready: %s", err)
+		return grpcNotServing
+	}
+	return grpcServing
+}
+
+// handleCheck is grpc.health.v1.Health/Check.
+func (h *healthChecker) handleCheck(w http.ResponseWriter, r *http.Request) {
+	if !isGRPC(r) {
+		http.Error(w, "gRPC over HTTP/2 only", http.StatusUnsupportedMediaType)
+		return
+	}
+	service, err := grpcRequest(r)
+	if err != nil {
+		grpcError(w, 3, err.Error()) // INVALID_ARGUMENT
+		return
+	}
+	status := h.status(r.Context(), service)
+	if status == grpcServiceUnknown {
+		grpcError(w, 5, "unknown service") // NOT_FOUND
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status")
+	writeHealthResponse(w, status)
+	w.Header().Set("Grpc-Status", "0")
+}
+
+// handleWatch is grpc.health.v1.Health/Watch: the status is sent at once
+// and then every time it changes, until the client goes away.
+func (h *healthChecker) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if !isGRPC(r) {
+		http.Error(w, "gRPC over HTTP/2 only", http.StatusUnsupportedMediaType)
+		return
+	}
+	service, err := grpcRequest(r)
+	if err != nil {
+		grpcError(w, 3, err.Error()) // INVALID_ARGUMENT
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status")
+	ctx := r.Context()
+	last := h.status(ctx, service)
+	writeHealthResponse(w, last)
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.done:
+			w.Header().Set("Grpc-Status", "14") // UNAVAILABLE
+			return
+		case <-tick.C:
+		}
+		if status := h.status(ctx, service); status != last {
+			writeHealthResponse(w, status)
+			last = status
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// HookEvent is what lifecycle hooks receive, as JSON on stdin for commands
+// and as the request body for URLs. It never carries private key material.
+type HookEvent struct {
+	Event     string          `json:"event"`
+	KeyID     string          `json:"kid,omitempty"`
+	Algorithm string          `json:"alg"`
+	Use       string          `json:"use"`
+	PublicKey json.RawMessage `json:"public_key"`
+	Time      time.Time       `json:"time"`
+}
+
+var hookClient = &http.Client{Timeout: 30 * time.Second}
+
+// runHook POSTs ev to hook if it is an http(s) URL, and otherwise runs hook
+// with `sh -c`, passing ev on stdin and its main fields in JWK_* variables.
+func runHook(hook string, ev HookEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	debugf("running %s hook %q with %s", ev.Event, hook, body)
+
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		resp, err := hookClient.Post(hook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("%s responded with %s", hook, resp.Status)
+		}
+		return nil
+	}
+
+	cmd := exec.Command("sh", "-c", hook)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = logw
+	cmd.Stderr = logw
+	cmd.Env = append(os.Environ(),
+		"JWK_EVENT="+ev.Event,
+		"JWK_KID="+ev.KeyID,
+		"JWK_ALG="+ev.Algorithm,
+		"JWK_USE="+ev.Use,
+	)
+	return cmd.Run()
+}
+
+// keyEvent describes event for the key pub, which is only carried along
+// if it has a public half. The kid, alg and use are those of pub, not of
+// the command line, which may have been for several keys.
+func keyEvent(event string, pub jose.JSONWebKey) HookEvent {
+	ev := HookEvent{Event: event, KeyID: pub.KeyID, Algorithm: pub.Algorithm, Use: pub.Use}
+	if pub.Key != nil {
+		var err error
+		ev.PublicKey, err = renderJWK(pub)
+		app.FatalIfError(err, "can't Marshal public key to JSON")
+	}
+	return ev
+}
+
+// runHooks fires every hook for a lifecycle event, in order, and aborts on
+// the first failure. Keys are already written at this point, so a failing
+// hook is reported but doesn't undo anything.
+func runHooks(hooks []string, ev HookEvent) {
+	ev.Time = time.Now().UTC()
+	for _, hook := range hooks {
+		app.FatalIfError(runHook(hook, ev), "%s hook %q failed", ev.Event, hook)
+	}
+}
@@ -0,0 +1,252 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"github.com/nicksherron/jwk-keygen/pkg/keyset"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	initCmd       = app.Command("initcontainer", "Generate a key into a Secret or volume unless it already holds one, as a pod init container")
+	initUse       = initCmd.Flag("use", "Desrired key use").Required().Enum("enc", "sig")
+	initAlg       = initCmd.Flag("alg", "Generate key to be used for ALG").Required().String()
+	initBits      = initCmd.Flag("bits", "Key size in bits").Int()
+	initSecret    = initCmd.Flag("secret", "Secret to keep the key in, in the pod's namespace unless given").PlaceHolder("NAME[/NAMESPACE]").String()
+	initDir       = initCmd.Flag("dir", "Directory, e.g. a volume mount, to keep the key in").String()
+	initAPIServer = initCmd.Flag("api-server", "Kubernetes API server, e.g. of kubectl proxy; the pod's service account is used if unset").PlaceHolder("URL").String()
+	initAttempts  = initCmd.Flag("attempts", "How many times to try reaching the Secret or volume").Default("6").Int()
+	initBackoff   = initCmd.Flag("backoff", "Wait before the first retry, doubling after each").Default("1s").Duration()
+)
+
+// The exit codes of initcontainer. A pod can tell from them whether
+// restarting the init container can help.
+const (
+	// exitInitInvalid means the flags or the target are wrong; retrying
+	// won't help.
+	exitInitInvalid = 2
+	// exitInitUnavailable means the target couldn't be reached in
+	// --attempts tries.
+	exitInitUnavailable = 3
+	// exitInitDenied means access to the Secret or directory was denied.
+	exitInitDenied = 4
+)
+
+// initError is a failure of initcontainer with the exit code it maps to.
+type initError struct {
+	code int
+	err  error
+}
+
+func (e *initError) Error() string { return e.err.Error() }
+
+// initKey generates the key the flags describe and renders the files both
+// targets hold: the private JWK and the public JWKS, named as for
+// --k8s-secret, and the rotation history controller picks up.
+func initKey() (map[string][]byte, string, error) {
+	priv, pub, err := keygen.Generate(keygen.Options{Use: *initUse, Alg: *initAlg, Bits: *initBits, RandomKeyID: true})
+	if err != nil {
+		return nil, "", &initError{exitInitInvalid, err}
+	}
+	set := &keyset.Set{Clock: keygen.ClockFunc(timestamp)}
+	if err := set.Add(priv); err != nil {
+		return nil, "", err
+	}
+	files := map[string][]byte{}
+	if files["jwk.json"], err = priv.MarshalJSON(); err != nil {
+		return nil, "", err
+	}
+	var public jose.JSONWebKeySet
+	if pub.Key != nil {
+		public.Keys = append(public.Keys, pub)
+	}
+	if files["jwks-pub.json"], err = json.Marshal(public); err != nil {
+		return nil, "", err
+	}
+	if files["keyset.json"], err = json.Marshal(set.Entries()); err != nil {
+		return nil, "", err
+	}
+	return files, priv.KeyID, nil
+}
+
+// initDirectory writes the key into --dir unless jwk.json is there. The
+// files are staged so that a crash can't leave half of them, and a
+// concurrent writer that got there first counts as success.
+func initDirectory() (bool, error) {
+	if _, err := os.Stat(filepath.Join(*initDir, "jwk.json")); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	files, kid, err := initKey()
+	if err != nil {
+		return false, err
+	}
+	perms := map[string]os.FileMode{"jwk.json": 0400, "jwks-pub.json": 0444, "keyset.json": 0400}
+	// jwk.json, which says the key is there, goes into place last.
+	for _, name := range []string{"jwks-pub.json", "keyset.json", "jwk.json"} {
+		if err := pending.add(filepath.Join(*initDir, name), "", files[name], perms[name]); err != nil {
+			pending.abort()
+			return false, err
+		}
+	}
+	if err := pending.commit(); err != nil {
+		if _, serr := os.Stat(filepath.Join(*initDir, "jwk.json")); serr == nil {
+			return false, nil
+		}
+		return false, err
+	}
+	fmt.Fprintf(logw, "jwk-keygen: generated key %q in %s\n", kid, *initDir)
+	return true, nil
+}
+
+// initK8sSecret adds the key to --secret unless it already holds
+// jwk.json, creating the Secret if need be and keeping what else it holds,
+// e.g. when a chart created it empty.
+func initK8sSecret(ctx context.Context, kube *kubeClient, name, ns string) (bool, error) {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", ns, name)
+	var secret k8sSecret
+	err := kube.do(ctx, "GET", path, nil, &secret)
+	exists := err == nil
+	if kubeStatus(err, http.StatusNotFound) {
+		err = nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, ok := secret.Data["jwk.json"]; ok {
+		return false, nil
+	}
+
+	files, kid, err := initKey()
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		secret = k8sSecret{
+			APIVersion: "v1",
+			Kind:       "Secret",
+			Metadata: k8sMetadata{
+				Name:      name,
+				Namespace: ns,
+				Labels:    map[string]string{"app.kubernetes.io/managed-by": "jwk-keygen"},
+			},
+			Type: "Opaque",
+		}
+	}
+	if secret.Data == nil {
+		secret.Data = map[string]string{}
+	}
+	for name, b := range files {
+		secret.Data[name] = base64.StdEncoding.EncodeToString(b)
+	}
+	if exists {
+		err = kube.do(ctx, "PUT", path, secret, nil)
+	} else {
+		err = kube.do(ctx, "POST", fmt.Sprintf("/api/v1/namespaces/%s/secrets", ns), secret, nil)
+	}
+	if kubeStatus(err, http.StatusConflict) {
+		// Another pod got there first; look again.
+		return initK8sSecret(ctx, kube, name, ns)
+	}
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(logw, "jwk-keygen: generated key %q in Secret %s/%s\n", kid, ns, name)
+	return true, nil
+}
+
+// permanent reports whether retrying err can't help.
+func permanent(err error) bool {
+	if _, ok := err.(*initError); ok {
+		return true
+	}
+	if e, ok := err.(*kubeError); ok {
+		return e.Code/100 == 4 && e.Code != http.StatusTooManyRequests && e.Code != http.StatusConflict
+	}
+	return false
+}
+
+func initContainer() {
+	invalid := func(format string, args ...interface{}) {
+		fmt.Fprintf(logw, "jwk-keygen: error: "+format+"\n", args...)
+		exit(exitInitInvalid)
+	}
+	if (*initSecret == "") == (*initDir == "") {
+		invalid("initcontainer needs one of --secret or --dir")
+	}
+	if *initAttempts < 1 {
+		invalid("--attempts must be at least 1")
+	}
+	if err := (keygen.Spec{Use: *initUse, Alg: *initAlg, Bits: *initBits}).Validate(); err != nil {
+		invalid("%s", err)
+	}
+
+	attempt := initDirectory
+	if *initSecret != "" {
+		name, ns, err := parseK8sSecretName(*initSecret)
+		if err != nil {
+			invalid("--secret: %s", err)
+		}
+		if ns == "" {
+			ns = podNamespace()
+		}
+		kube, err := newKubeClient(*initAPIServer)
+		if err != nil {
+			invalid("%s", err)
+		}
+		attempt = func() (bool, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			return initK8sSecret(ctx, kube, name, ns)
+		}
+	}
+
+	wait := *initBackoff
+	for i := 1; ; i++ {
+		created, err := attempt()
+		if err == nil {
+			if !created {
+				fmt.Fprintln(logw, "jwk-keygen: key already present, nothing to do")
+			}
+			return
+		}
+		fmt.Fprintf(logw, "jwk-keygen: attempt %d of %d failed: %s\n", i, *initAttempts, err)
+		switch {
+		case kubeStatus(err, http.StatusUnauthorized) || kubeStatus(err, http.StatusForbidden) || os.IsPermission(err):
+			exit(exitInitDenied)
+		case permanent(err):
+			exit(exitInitInvalid)
+		case i == *initAttempts:
+			exit(exitInitUnavailable)
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > 30*time.Second {
+			wait = 30 * time.Second
+		}
+	}
+}
@@ -0,0 +1,222 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	maxInputSize = app.Flag("max-input-size", "Refuse to read key, keyset or token inputs larger than this many bytes").Default("1048576").Int64()
+	maxJSONDepth = app.Flag("max-json-depth", "Refuse JSON inputs nested deeper than this").Default("32").Int()
+	maxKeys      = app.Flag("max-keys", "Refuse key sets or PEM files holding more keys than this").Default("100").Int()
+)
+
+func inputLimits() safeio.Limits {
+	return safeio.Limits{MaxSize: *maxInputSize, MaxDepth: *maxJSONDepth, MaxKeys: *maxKeys}
+}
+
+// readInput reads a whole file, or stdin when filename is "-", within the
+// configured size limit. Passphrase-protected keys are decrypted.
+func readInput(filename string) ([]byte, error) {
+	b, err := readFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return unprotectKey(b, filename)
+}
+
+// readFile is readInput for data that isn't a key, such as payloads and
+// ciphertexts, which is returned as read.
+func readFile(filename string) ([]byte, error) {
+	debugf("reading %s", filename)
+	if filename == "-" {
+		return safeio.ReadAll(os.Stdin, inputLimits())
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return safeio.ReadAll(f, inputLimits())
+}
+
+// readJWK loads a single JSON Web Key from a file or stdin.
+func readJWK(filename string) (*jose.JSONWebKey, error) {
+	b, err := readInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	return safeio.ParseJWK(b, inputLimits())
+}
+
+// readPEM loads the PEM blocks of a file or stdin.
+func readPEM(filename string) ([]*pem.Block, error) {
+	b, err := readInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	return safeio.ParsePEM(b, inputLimits())
+}
+
+// parsePrivateKey decodes a PKCS #1, SEC 1 or PKCS #8 private key block.
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		if k, err := keygen.ParseEd25519PrivateKey(block.Bytes); k != nil || err != nil {
+			return k, err
+		}
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := k.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", k)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+}
+
+// parsePublicKey decodes a SubjectPublicKeyInfo or PKCS #1 public key block.
+func parsePublicKey(block *pem.Block) (crypto.PublicKey, error) {
+	switch block.Type {
+	case "PUBLIC KEY":
+		if k, err := keygen.ParseEd25519PublicKey(block.Bytes); k != nil || err != nil {
+			return k, err
+		}
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+}
+
+// readKey loads the first key of a PEM file, a DER encoded key or a JWK,
+// which may be private or public. The private key is nil for public keys.
+func readKey(filename string) (crypto.Signer, crypto.PublicKey, error) {
+	b, err := readInput(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseKey(b, inputLimits())
+}
+
+// parseKey is readKey for a key already read.
+func parseKey(b []byte, limits safeio.Limits) (crypto.Signer, crypto.PublicKey, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		jwk, err := safeio.ParseJWK(b, limits)
+		if err != nil {
+			return nil, nil, err
+		}
+		if jwk.IsPublic() {
+			return nil, jwk.Key, nil
+		}
+		if k, ok := jwk.Key.(crypto.Signer); ok {
+			return k, k.Public(), nil
+		}
+		return nil, nil, errors.New("only asymmetric JWKs can be converted")
+	}
+	if !bytes.Contains(b, []byte("-----BEGIN")) {
+		// Not PEM, so try every DER encoding in turn.
+		for _, typ := range []string{"PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY"} {
+			if k, err := parsePrivateKey(&pem.Block{Type: typ, Bytes: b}); err == nil {
+				return k, k.Public(), nil
+			}
+		}
+		for _, typ := range []string{"PUBLIC KEY", "RSA PUBLIC KEY"} {
+			if k, err := parsePublicKey(&pem.Block{Type: typ, Bytes: b}); err == nil {
+				return nil, k, nil
+			}
+		}
+		return nil, nil, errors.New("no PEM or DER encoded key found")
+	}
+	blocks, err := safeio.ParsePEM(b, limits)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			continue
+		case "PUBLIC KEY", "RSA PUBLIC KEY":
+			k, err := parsePublicKey(block)
+			return nil, k, err
+		default:
+			k, err := parsePrivateKey(block)
+			if err != nil {
+				return nil, nil, err
+			}
+			return k, k.Public(), nil
+		}
+	}
+	return nil, nil, errors.New("no key found")
+}
+
+// readPrivateKeyPEM loads the first private key of a PEM file.
+func readPrivateKeyPEM(filename string) (crypto.Signer, error) {
+	blocks, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range blocks {
+		if block.Type != "CERTIFICATE" && block.Type != "PUBLIC KEY" {
+			return parsePrivateKey(block)
+		}
+	}
+	return nil, errors.New("no private key found")
+}
+
+// readCertificatesPEM loads every certificate of a PEM file, in order.
+func readCertificatesPEM(filename string) ([]*x509.Certificate, error) {
+	blocks, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for _, block := range blocks {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return certs, nil
+}
@@ -0,0 +1,211 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"golang.org/x/crypto/ed25519"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+	"github.com/nicksherron/jwk-keygen/pkg/keyset"
+)
+
+var (
+	inspectCmd  = app.Command("inspect", "Describe the keys in a JWK or JWKS")
+	inspectIn   = inspectCmd.Arg("keys", "JWKs or JWKSs to describe (- for stdin)").Required().Strings()
+	inspectJSON = inspectCmd.Flag("json", "Print the descriptions as JSON").Bool()
+)
+
+// KeyInfo describes a key without revealing any of its key material.
+type KeyInfo struct {
+	Source     string `json:"source"`
+	KeyID      string `json:"kid,omitempty"`
+	Kty        string `json:"kty"`
+	Size       string `json:"size,omitempty"`
+	Algorithm  string `json:"alg,omitempty"`
+	Use        string `json:"use,omitempty"`
+	Private    bool   `json:"private"`
+	Thumbprint string `json:"thumbprint,omitempty"`
+	// ThumbprintSHA1 is the SHA-1 thumbprint some older consumers use as kid.
+	ThumbprintSHA1 string `json:"thumbprint_sha1,omitempty"`
+	// Problems are the checks the key fails.
+	Problems []string `json:"problems,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// algKeys is the key type and use each JOSE algorithm needs.
+var algKeys = map[string]struct{ kty, use string }{
+	"RS256": {"RSA", "sig"}, "RS384": {"RSA", "sig"}, "RS512": {"RSA", "sig"},
+	"PS256": {"RSA", "sig"}, "PS384": {"RSA", "sig"}, "PS512": {"RSA", "sig"},
+	"ES256": {"EC", "sig"}, "ES384": {"EC", "sig"}, "ES512": {"EC", "sig"}, "EdDSA": {"OKP", "sig"}, "ES256K": {"EC", "sig"},
+	"HS256": {"oct", "sig"}, "HS384": {"oct", "sig"}, "HS512": {"oct", "sig"},
+	"RSA1_5": {"RSA", "enc"}, "RSA-OAEP": {"RSA", "enc"}, "RSA-OAEP-256": {"RSA", "enc"},
+	"ECDH-ES": {"EC", "enc"}, "ECDH-ES+A128KW": {"EC", "enc"}, "ECDH-ES+A192KW": {"EC", "enc"}, "ECDH-ES+A256KW": {"EC", "enc"},
+	"A128KW": {"oct", "enc"}, "A192KW": {"oct", "enc"}, "A256KW": {"oct", "enc"},
+	"A128GCMKW": {"oct", "enc"}, "A256GCMKW": {"oct", "enc"}, "dir": {"oct", "enc"},
+}
+
+// octBits is how long oct keys for an algorithm must be, at least.
+var octBits = map[string]int{
+	"HS256": 256, "HS384": 384, "HS512": 512,
+	"A128KW": 128, "A192KW": 192, "A256KW": 256, "A128GCMKW": 128, "A256GCMKW": 256,
+}
+
+// keyProblems checks a parsed key against its own `alg` and `use`.
+func keyProblems(k safeio.RawKey, key *jose.JSONWebKey) []string {
+	var problems []string
+	// go-jose considers no oct key valid.
+	if _, oct := key.Key.([]byte); !oct && !key.Valid() {
+		problems = append(problems, "invalid key material")
+	}
+	alg, use, kty := k.Alg(), k.Use(), k.Kty()
+	if k.Kid() == "" {
+		problems = append(problems, "no kid")
+	}
+	if use != "" && use != "sig" && use != "enc" {
+		problems = append(problems, fmt.Sprintf("unknown use %q", use))
+	}
+	if alg != "" {
+		want, ok := algKeys[alg]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("unknown alg %q", alg))
+		case want.kty != kty:
+			problems = append(problems, fmt.Sprintf("alg %s needs a %s key, not %s", alg, want.kty, kty))
+		}
+		if ok && use != "" && use != want.use {
+			problems = append(problems, fmt.Sprintf("alg %s doesn't fit use %s", alg, use))
+		}
+	}
+	switch pub := key.Public().Key.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			problems = append(problems, "RSA key shorter than 2048 bits")
+		}
+	case *ecdsa.PublicKey:
+		if crv, ok := ecdsaCurves[alg]; ok && crv != pub.Curve.Params().Name {
+			problems = append(problems, fmt.Sprintf("alg %s needs curve %s", alg, crv))
+		}
+	}
+	if b, ok := key.Key.([]byte); ok && len(b)*8 < octBits[alg] {
+		problems = append(problems, fmt.Sprintf("alg %s needs a key of %d+ bits", alg, octBits[alg]))
+	}
+	return problems
+}
+
+// describeKey fills in a KeyInfo for k. Keys go-jose can't parse are
+// still described from their members, with the parse error.
+func describeKey(source string, k safeio.RawKey) KeyInfo {
+	_, private := k["d"]
+	info := KeyInfo{
+		Source:    source,
+		KeyID:     k.Kid(),
+		Kty:       k.Kty(),
+		Size:      k.Member("crv"),
+		Algorithm: k.Alg(),
+		Use:       k.Use(),
+		Private:   private,
+	}
+	key, err := k.Decode()
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	switch pub := key.Public().Key.(type) {
+	case *rsa.PublicKey:
+		info.Size = strconv.Itoa(pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		info.Size = pub.Curve.Params().Name
+	case ed25519.PublicKey:
+		info.Size = "Ed25519"
+	}
+	if b, ok := key.Key.([]byte); ok {
+		info.Size = strconv.Itoa(len(b) * 8)
+		info.Private = true
+	}
+	info.Problems = keyProblems(k, key)
+	if info.Thumbprint, err = keyset.Thumbprint(key, crypto.SHA256); err != nil {
+		info.Error = err.Error()
+	}
+	if info.ThumbprintSHA1, err = keyset.Thumbprint(key, crypto.SHA1); err != nil {
+		info.Error = err.Error()
+	}
+	return info
+}
+
+func inspect() {
+	var infos []KeyInfo
+	for _, in := range *inspectIn {
+		b, err := readInput(in)
+		app.FatalIfError(err, "can't read %s", in)
+		keys, err := safeio.ParseRawKeys(b, inputLimits())
+		app.FatalIfError(err, "can't parse %s", in)
+		for _, k := range keys {
+			infos = append(infos, describeKey(in, k))
+		}
+	}
+
+	if *inspectJSON {
+		out, err := json.Marshal(infos)
+		app.FatalIfError(err, "can't Marshal key descriptions to JSON")
+		fmt.Println(string(formatJSON(out)))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tKID\tKTY\tSIZE\tALG\tUSE\tPRIVATE\tTHUMBPRINT\tSHA-1 THUMBPRINT\tCHECKS")
+	for _, i := range infos {
+		checks := "ok"
+		switch {
+		case i.Error != "":
+			checks = "error"
+		case len(i.Problems) == 1:
+			checks = "1 problem"
+		case len(i.Problems) > 1:
+			checks = fmt.Sprintf("%d problems", len(i.Problems))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%t\t%s\t%s\t%s\n",
+			i.Source, dash(i.KeyID), i.Kty, dash(i.Size), dash(i.Algorithm), dash(i.Use), i.Private,
+			dash(i.Thumbprint), dash(i.ThumbprintSHA1), checks)
+	}
+	w.Flush()
+	for _, i := range infos {
+		for _, p := range i.Problems {
+			fmt.Fprintf(logw, "%s: %s: %s\n", i.Source, dash(i.KeyID), p)
+		}
+		if i.Error != "" {
+			fmt.Fprintf(logw, "%s: %s: %s\n", i.Source, dash(i.KeyID), i.Error)
+		}
+	}
+}
+
+// dash stands in for empty table cells.
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
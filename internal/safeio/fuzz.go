@@ -0,0 +1,59 @@
+//go:build gofuzz
+// +build gofuzz
+
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package safeio
+
+// The Fuzz* functions are entry points for go-fuzz, e.g.
+//
+//	go-fuzz-build -func FuzzJWKS ./internal/safeio
+//	go-fuzz -bin safeio-fuzz.zip -workdir testdata/fuzz/jwks
+//
+// Seed corpora live in testdata/fuzz/<name>/corpus.
+
+// FuzzJWK exercises ParseJWK.
+func FuzzJWK(data []byte) int {
+	if _, err := ParseJWK(data, DefaultLimits); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzJWKS exercises ParseJWKS.
+func FuzzJWKS(data []byte) int {
+	if _, err := ParseJWKS(data, DefaultLimits); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzPEM exercises ParsePEM.
+func FuzzPEM(data []byte) int {
+	if _, err := ParsePEM(data, DefaultLimits); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzJWS exercises ParseJWS.
+func FuzzJWS(data []byte) int {
+	if _, err := ParseJWS(data, DefaultLimits); err != nil {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,184 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package safeio
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// knownMembers are the JWK members defined by RFC 7517 and RFC 7518.
+var knownMembers = map[string]bool{
+	"kty": true, "use": true, "key_ops": true, "alg": true, "kid": true,
+	"x5u": true, "x5c": true, "x5t": true, "x5t#S256": true,
+	"crv": true, "x": true, "y": true, "n": true, "e": true,
+	"d": true, "p": true, "q": true, "dp": true, "dq": true, "qi": true, "oth": true,
+	"k": true,
+}
+
+// privateMembers hold secret key material in any of the registered key types.
+var privateMembers = []string{"d", "p", "q", "dp", "dq", "qi", "oth", "k"}
+
+// RawKey is a JWK kept as its individual JSON members, so that keys go-jose
+// does not understand survive a parse/serialize round trip unchanged.
+type RawKey map[string]json.RawMessage
+
+func (k RawKey) str(member string) string {
+	var s string
+	if v, ok := k[member]; ok {
+		json.Unmarshal(v, &s)
+	}
+	return s
+}
+
+// Kty returns the key type, or "" if it is missing.
+func (k RawKey) Kty() string { return k.str("kty") }
+
+// Kid returns the key ID, or "" if it is missing.
+func (k RawKey) Kid() string { return k.str("kid") }
+
+// Alg returns the intended algorithm, or "" if it is missing.
+func (k RawKey) Alg() string { return k.str("alg") }
+
+// Use returns the intended use, or "" if it is missing.
+func (k RawKey) Use() string { return k.str("use") }
+
+// Member returns a string member, or "" if it is missing or not a string.
+func (k RawKey) Member(name string) string { return k.str(name) }
+
+// Decode parses the key with go-jose.
+func (k RawKey) Decode() (*jose.JSONWebKey, error) {
+	b, err := json.Marshal(map[string]json.RawMessage(k))
+	if err != nil {
+		return nil, err
+	}
+	var key jose.JSONWebKey
+	if err := key.UnmarshalJSON(b); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// Unknown lists the members of k that are not registered JWK members.
+func (k RawKey) Unknown() []string {
+	var names []string
+	for name := range k {
+		if !knownMembers[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Strict fails if go-jose can't decode k or k carries unregistered members.
+func (k RawKey) Strict() error {
+	if _, err := k.Decode(); err != nil {
+		return fmt.Errorf("key %q: %v", k.Kid(), err)
+	}
+	if names := k.Unknown(); len(names) > 0 {
+		return fmt.Errorf("key %q: unknown members %v", k.Kid(), names)
+	}
+	return nil
+}
+
+// Public returns a copy of k without private members, and false if nothing
+// would be left to publish (symmetric keys).
+func (k RawKey) Public() (RawKey, bool) {
+	if k.Kty() == "oct" {
+		return nil, false
+	}
+	pub := RawKey{}
+	for name, v := range k {
+		pub[name] = v
+	}
+	for _, name := range privateMembers {
+		delete(pub, name)
+	}
+	return pub, true
+}
+
+// RawKeySet is a JWKS that keeps unknown keys and top level members.
+type RawKeySet struct {
+	Keys  []RawKey
+	Extra map[string]json.RawMessage
+}
+
+// MarshalJSON serializes the set with `keys` next to any extra members.
+func (s RawKeySet) MarshalJSON() ([]byte, error) {
+	out := map[string]interface{}{}
+	for name, v := range s.Extra {
+		out[name] = v
+	}
+	keys := s.Keys
+	if keys == nil {
+		keys = []RawKey{}
+	}
+	out["keys"] = keys
+	return json.Marshal(out)
+}
+
+// ParseRawJWKS parses a key set without interpreting its keys.
+func ParseRawJWKS(b []byte, l Limits) (*RawKeySet, error) {
+	if err := checkSize(b, l); err != nil {
+		return nil, err
+	}
+	if err := CheckDepth(b, l); err != nil {
+		return nil, err
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(b, &members); err != nil {
+		return nil, err
+	}
+	rawKeys, ok := members["keys"]
+	if !ok {
+		return nil, errors.New("not a key set: missing `keys` member")
+	}
+	delete(members, "keys")
+	set := &RawKeySet{Extra: members}
+	if err := json.Unmarshal(rawKeys, &set.Keys); err != nil {
+		return nil, err
+	}
+	if l.MaxKeys > 0 && len(set.Keys) > l.MaxKeys {
+		return nil, fmt.Errorf("key set holds more than %d keys", l.MaxKeys)
+	}
+	return set, nil
+}
+
+// ParseRawKeys parses either a single JWK or a JWKS and returns its keys.
+func ParseRawKeys(b []byte, l Limits) ([]RawKey, error) {
+	if err := checkSize(b, l); err != nil {
+		return nil, err
+	}
+	if err := CheckDepth(b, l); err != nil {
+		return nil, err
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(b, &members); err != nil {
+		return nil, err
+	}
+	if _, ok := members["keys"]; !ok {
+		return []RawKey{RawKey(members)}, nil
+	}
+	set, err := ParseRawJWKS(b, l)
+	if err != nil {
+		return nil, err
+	}
+	return set.Keys, nil
+}
@@ -0,0 +1,181 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package safeio reads and parses untrusted key material (JWK, JWKS, PEM
+// and JWS) while enforcing limits on input size, JSON nesting depth and
+// the number of keys, so that a hostile file or stdin can't exhaust memory.
+package safeio
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/json"
+)
+
+// Limits bounds the resources a single parse may consume. A zero value for
+// any field disables that particular check.
+type Limits struct {
+	MaxSize  int64
+	MaxDepth int
+	MaxKeys  int
+}
+
+// DefaultLimits are generous for real key material and small enough for
+// untrusted input.
+var DefaultLimits = Limits{
+	MaxSize:  1 << 20,
+	MaxDepth: 32,
+	MaxKeys:  100,
+}
+
+// ReadAll reads r until EOF, failing once more than l.MaxSize bytes are read.
+func ReadAll(r io.Reader, l Limits) ([]byte, error) {
+	if l.MaxSize <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, l.MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > l.MaxSize {
+		return nil, fmt.Errorf("input exceeds %d bytes", l.MaxSize)
+	}
+	return b, nil
+}
+
+// CheckDepth fails if b nests JSON objects or arrays deeper than
+// l.MaxDepth. It does not validate b otherwise.
+func CheckDepth(b []byte, l Limits) error {
+	if l.MaxDepth <= 0 {
+		return nil
+	}
+	depth := 0
+	inString, escaped := false, false
+	for _, c := range b {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{' || c == '[':
+			depth++
+			if depth > l.MaxDepth {
+				return fmt.Errorf("JSON nested deeper than %d levels", l.MaxDepth)
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return nil
+}
+
+func checkSize(b []byte, l Limits) error {
+	if l.MaxSize > 0 && int64(len(b)) > l.MaxSize {
+		return fmt.Errorf("input exceeds %d bytes", l.MaxSize)
+	}
+	return nil
+}
+
+// ParseJWK parses a single JSON Web Key.
+func ParseJWK(b []byte, l Limits) (*jose.JSONWebKey, error) {
+	if err := checkSize(b, l); err != nil {
+		return nil, err
+	}
+	if err := CheckDepth(b, l); err != nil {
+		return nil, err
+	}
+	var key jose.JSONWebKey
+	if err := key.UnmarshalJSON(b); err != nil {
+		return nil, err
+	}
+	// go-jose never considers `oct` keys valid, so just require a secret.
+	if k, ok := key.Key.([]byte); ok {
+		if len(k) == 0 {
+			return nil, errors.New("invalid key")
+		}
+	} else if !key.Valid() {
+		return nil, errors.New("invalid key")
+	}
+	return &key, nil
+}
+
+// ParseJWKS parses a JSON Web Key Set holding at most l.MaxKeys keys.
+func ParseJWKS(b []byte, l Limits) (*jose.JSONWebKeySet, error) {
+	if err := checkSize(b, l); err != nil {
+		return nil, err
+	}
+	if err := CheckDepth(b, l); err != nil {
+		return nil, err
+	}
+	// Count the keys before go-jose does the expensive per-key parsing.
+	var raw struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	if l.MaxKeys > 0 && len(raw.Keys) > l.MaxKeys {
+		return nil, fmt.Errorf("key set holds more than %d keys", l.MaxKeys)
+	}
+	var set jose.JSONWebKeySet
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	return &set, nil
+}
+
+// ParsePEM decodes up to l.MaxKeys consecutive PEM blocks. Data that is not
+// PEM encoded is an error.
+func ParsePEM(b []byte, l Limits) ([]*pem.Block, error) {
+	if err := checkSize(b, l); err != nil {
+		return nil, err
+	}
+	var blocks []*pem.Block
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if l.MaxKeys > 0 && len(blocks) == l.MaxKeys {
+			return nil, fmt.Errorf("input holds more than %d PEM blocks", l.MaxKeys)
+		}
+		blocks = append(blocks, block)
+	}
+	if len(blocks) == 0 {
+		return nil, errors.New("no PEM data found")
+	}
+	return blocks, nil
+}
+
+// ParseJWS parses a JWS in compact or JSON serialization.
+func ParseJWS(b []byte, l Limits) (*jose.JSONWebSignature, error) {
+	if err := checkSize(b, l); err != nil {
+		return nil, err
+	}
+	if err := CheckDepth(b, l); err != nil {
+		return nil, err
+	}
+	return jose.ParseSigned(string(b))
+}
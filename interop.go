@@ -0,0 +1,186 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+)
+
+var (
+	interopCmd     = app.Command("interop", "Check that keys import cleanly into other JOSE implementations found on this machine")
+	interopIn      = interopCmd.Arg("keys", "JWK or JWKS to check").Required().String()
+	interopTimeout = interopCmd.Flag("timeout", "Time limit for each import").Default("30s").Duration()
+)
+
+// interopHelper imports a JWK read from stdin with another implementation
+// and compares what it exports against the input. Helpers exit with
+// interopUnavailable when their library isn't installed.
+type interopHelper struct {
+	Name   string
+	Binary string
+	Args   []string
+}
+
+const interopUnavailable = 3
+
+// nodeInterop uses node's built-in crypto (node 16 or later).
+const nodeInterop = `
+const crypto = require('crypto');
+const jwk = JSON.parse(require('fs').readFileSync(0, 'utf8'));
+if (parseInt(process.versions.node, 10) < 16) process.exit(3);
+const members = {RSA: ['n', 'e', 'd', 'p', 'q', 'dp', 'dq', 'qi'], EC: ['crv', 'x', 'y', 'd'], OKP: ['crv', 'x', 'd'], oct: ['k']};
+try {
+  let key;
+  if (jwk.kty === 'oct') key = crypto.createSecretKey(Buffer.from(jwk.k, 'base64url'));
+  else if (jwk.d) key = crypto.createPrivateKey({key: jwk, format: 'jwk'});
+  else key = crypto.createPublicKey({key: jwk, format: 'jwk'});
+  const out = key.export({format: 'jwk'});
+  for (const m of members[jwk.kty] || []) {
+    if (jwk[m] !== undefined && out[m] !== jwk[m]) throw new Error('member "' + m + '" changed on export');
+  }
+} catch (e) {
+  console.error(e.message);
+  process.exit(1);
+}
+`
+
+// pythonInterop uses jwcrypto.
+const pythonInterop = `
+import json, sys
+try:
+    from jwcrypto import jwk
+except ImportError:
+    sys.exit(3)
+members = {'RSA': 'n e d p q dp dq qi', 'EC': 'crv x y d', 'OKP': 'crv x d', 'oct': 'k'}
+try:
+    src = json.load(sys.stdin)
+    key = jwk.JWK(**src)
+    out = key.export(private_key=key.has_private, as_dict=True)
+    for m in members.get(src['kty'], '').split():
+        if m in src and out.get(m) != src[m]:
+            raise ValueError('member "%s" changed on export' % m)
+except Exception as e:
+    print(e, file=sys.stderr)
+    sys.exit(1)
+`
+
+var interopHelpers = []interopHelper{
+	{Name: "node", Binary: "node", Args: []string{"-e", nodeInterop}},
+	{Name: "python-jwcrypto", Binary: "python3", Args: []string{"-c", pythonInterop}},
+}
+
+// errUnavailable marks a helper that can't run here.
+var errUnavailable = errors.New("n/a")
+
+// runInterop imports key with one helper, returning errUnavailable if the
+// helper or its library is missing. The key is passed on stdin and the
+// helper's error output is redacted before it is shown.
+func runInterop(h interopHelper, key []byte) error {
+	path, err := exec.LookPath(h.Binary)
+	if err != nil {
+		return errUnavailable
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *interopTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, h.Args...)
+	cmd.Stdin = bytes.NewReader(key)
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == interopUnavailable {
+		return errUnavailable
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("timed out after %s", *interopTimeout)
+	}
+	if err != nil {
+		msg := strings.TrimSpace(string(redact(stderr.Bytes())))
+		if i := strings.IndexByte(msg, '\n'); i >= 0 {
+			msg = msg[:i]
+		}
+		if msg == "" {
+			msg = err.Error()
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+func interop() {
+	b, err := readInput(*interopIn)
+	app.FatalIfError(err, "can't read %s", *interopIn)
+	keys, err := safeio.ParseRawKeys(b, inputLimits())
+	app.FatalIfError(err, "can't parse %s", *interopIn)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprint(w, "KEY\tKTY\tALG")
+	for _, h := range interopHelpers {
+		fmt.Fprintf(w, "\t%s", strings.ToUpper(h.Name))
+	}
+	fmt.Fprintln(w)
+
+	var failures []string
+	ran := false
+	for i, k := range keys {
+		name := k.Kid()
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		js, err := json.Marshal(k)
+		app.FatalIfError(err, "can't Marshal key to JSON")
+		fmt.Fprintf(w, "%s\t%s\t%s", name, k.Kty(), k.Alg())
+		for _, h := range interopHelpers {
+			start := time.Now()
+			err := runInterop(h, js)
+			debugf("%s imported %s in %s", h.Name, name, time.Since(start))
+			switch {
+			case err == errUnavailable:
+				fmt.Fprint(w, "\tn/a")
+			case err != nil:
+				ran = true
+				fmt.Fprint(w, "\tFAIL")
+				failures = append(failures, fmt.Sprintf("%s: %s: %s", name, h.Name, err))
+			default:
+				ran = true
+				fmt.Fprint(w, "\tok")
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+
+	for _, f := range failures {
+		fmt.Fprintln(logw, f)
+	}
+	if !ran {
+		app.Fatalf("no interop helper is available, install node or python3 with jwcrypto")
+	}
+	if len(failures) > 0 {
+		app.Fatalf("%d imports failed", len(failures))
+	}
+}
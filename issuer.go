@@ -0,0 +1,137 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+	"github.com/nicksherron/jwk-keygen/pkg/keyset"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/yaml.v2"
+)
+
+// issuerMember is the private-use JWK member naming the issuer whose
+// tokens a key may verify.
+const issuerMember = "iss"
+
+// readIssuerMap reads a sidecar map of issuers to the kids or RFC 7638
+// thumbprints of their keys, as YAML or JSON.
+func readIssuerMap(filename string) (map[string][]string, error) {
+	b, err := readFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string][]string
+	if err := yaml.UnmarshalStrict(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// keyIssuer returns the issuer of a key: its `iss` member, or the issuer
+// issuerMap lists its thumbprint or, failing that, its kid under.
+func keyIssuer(r safeio.RawKey, k *jose.JSONWebKey, issuerMap map[string][]string) (string, error) {
+	iss := r.Member(issuerMember)
+	tp, err := keyset.Thumbprint(k, crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	var byThumbprint, byKid []string
+	for mapped, entries := range issuerMap {
+		for _, e := range entries {
+			switch e {
+			case tp:
+				byThumbprint = append(byThumbprint, mapped)
+			case k.KeyID:
+				byKid = append(byKid, mapped)
+			}
+		}
+	}
+	mapped := byThumbprint
+	if len(mapped) == 0 {
+		mapped = byKid
+	}
+	switch {
+	case len(mapped) > 1:
+		return "", fmt.Errorf("issuer map gives the key issuers %q and %q", mapped[0], mapped[1])
+	case len(mapped) == 0:
+		return iss, nil
+	case iss != "" && iss != mapped[0]:
+		return "", fmt.Errorf("key has iss %q but the issuer map gives %q", iss, mapped[0])
+	}
+	return mapped[0], nil
+}
+
+// loadIssuerKeys reads a JWK or JWKS and keeps the public half of every
+// key go-jose understands, and symmetric keys if symmetric is set. It
+// returns every key and, if any key is scoped to an issuer, the keys by
+// their issuer, "" holding the unscoped ones. A kid only has to be unique
+// within its issuer; of keys of several issuers sharing a kid, the first
+// stands for it among every key.
+func loadIssuerKeys(filename string, issuerMap map[string][]string, symmetric bool) (*keyset.Set, map[string]*keyset.Set, error) {
+	b, err := readInput(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := safeio.ParseRawKeys(b, inputLimits())
+	if err != nil {
+		return nil, nil, err
+	}
+	all := &keyset.Set{}
+	sets := map[string]*keyset.Set{"": {}}
+	scoped := false
+	for _, r := range raw {
+		pub, ok := publicKey(r, symmetric)
+		if !ok {
+			continue
+		}
+		iss, err := keyIssuer(r, &pub, issuerMap)
+		if err != nil {
+			return nil, nil, fmt.Errorf("key %q: %s", r.Kid(), err)
+		}
+		scoped = scoped || iss != ""
+		if sets[iss] == nil {
+			sets[iss] = &keyset.Set{}
+		}
+		if err := sets[iss].Add(pub); err != nil {
+			fmt.Fprintf(logw, "jwk-keygen: warning: skipping key %q of issuer %q: %s\n", r.Kid(), iss, err)
+			continue
+		}
+		// A kid shared with an earlier issuer's key is left to that one.
+		_ = all.Add(pub)
+	}
+	if len(all.Current()) == 0 {
+		return nil, nil, fmt.Errorf("%s holds no public keys", filename)
+	}
+	if !scoped {
+		return all, nil, nil
+	}
+	return all, sets, nil
+}
+
+// tokenIssuer returns the iss claim of a JWS payload, without verifying
+// it, so that the keys of its issuer can be picked to verify it with.
+func tokenIssuer(jws *jose.JSONWebSignature) string {
+	var claims struct {
+		Iss string `json:"iss"`
+	}
+	json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &claims)
+	return claims.Iss
+}
@@ -0,0 +1,210 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// busyJournal is the error of recoverJournal for the journal of a process
+// that is still running.
+type busyJournal struct {
+	pid  int
+	file string
+}
+
+func (e *busyJournal) Error() string {
+	return fmt.Sprintf("another jwk-keygen (pid %d) is writing files, see %s", e.pid, e.file)
+}
+
+// journalEntry is a staged file as recorded in the journal.
+type journalEntry struct {
+	Tmp     string `json:"tmp"`
+	File    string `json:"file"`
+	Replace bool   `json:"replace,omitempty"`
+}
+
+// journal is the intent log of a commit moving several files into place.
+// It is written before the first file is moved and removed after the
+// last, so a journal left behind means the process died in between.
+type journal struct {
+	PID     int            `json:"pid"`
+	Started time.Time      `json:"started"`
+	Files   []journalEntry `json:"files"`
+}
+
+func journalDir() string {
+	if *stateDir != "" {
+		return *stateDir
+	}
+	return ".jwk-keygen"
+}
+
+func journalFile() string {
+	return filepath.Join(journalDir(), "journal.json")
+}
+
+// processAlive reports whether a process with the given PID is running.
+// Where that can't be told, as on Windows, it reports false.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+// openJournal records files as about to be moved into place, recovering
+// a commit that was interrupted first. The returned function removes the
+// journal again, and must be called before the temporary files are.
+func openJournal(files []stagedFile) (func(), error) {
+	j := journal{PID: os.Getpid(), Started: time.Now().UTC()}
+	for _, f := range files {
+		tmp, err := filepath.Abs(f.tmp)
+		if err != nil {
+			return nil, err
+		}
+		file, err := filepath.Abs(f.file)
+		if err != nil {
+			return nil, err
+		}
+		j.Files = append(j.Files, journalEntry{Tmp: tmp, File: file, Replace: f.replace})
+	}
+	b, err := json.Marshal(j)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := journalDir()
+	_, err = os.Stat(dir)
+	created := os.IsNotExist(err)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	name := journalFile()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		if err := recoverJournal(); err != nil {
+			return nil, err
+		}
+		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+	debugf("journaled %d files in %s", len(files), name)
+	return func() {
+		os.Remove(name)
+		if created {
+			// Only goes if it is still empty.
+			os.Remove(dir)
+		}
+	}, nil
+}
+
+// recoverJournal finishes or undoes the commit recorded in a journal left
+// behind by a process that died. If every new file was linked into place,
+// the remaining replacements are renamed too; otherwise the files already
+// linked are removed. Either way a key set is never left referring to a
+// key whose file wasn't written.
+func recoverJournal() error {
+	name := journalFile()
+	b, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var j journal
+	if err := json.Unmarshal(b, &j); err != nil {
+		// The journal is synced before anything is moved, so nothing was.
+		fmt.Fprintf(logw, "jwk-keygen: warning: removing unreadable journal %s: %s\n", name, err)
+		return os.Remove(name)
+	}
+	if j.PID != os.Getpid() && processAlive(j.PID) {
+		return &busyJournal{j.PID, name}
+	}
+
+	exists := func(file string) bool {
+		_, err := os.Lstat(file)
+		return err == nil
+	}
+	// Temporary files are only removed after the journal, so a new file
+	// is in place iff it is the same file as its temporary one, and a
+	// replacement iff its temporary file is gone.
+	linked := func(e journalEntry) bool {
+		tmp, err1 := os.Lstat(e.Tmp)
+		file, err2 := os.Lstat(e.File)
+		return err1 == nil && err2 == nil && os.SameFile(tmp, file)
+	}
+	forward := true
+	for _, e := range j.Files {
+		if !e.Replace && !linked(e) {
+			forward = false
+		}
+	}
+	for _, e := range j.Files {
+		switch {
+		case forward && e.Replace && exists(e.Tmp):
+			if err := os.Rename(e.Tmp, e.File); err != nil {
+				return err
+			}
+		case !forward && !e.Replace && linked(e):
+			if err := os.Remove(e.File); err != nil {
+				return err
+			}
+		}
+	}
+	for _, e := range j.Files {
+		if err := os.Remove(e.Tmp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if e.Replace {
+			// The replaced file, which only the commit itself restores.
+			os.Remove(backupName(e.Tmp))
+		}
+		if tmpDir := filepath.Dir(e.Tmp); strings.HasPrefix(filepath.Base(tmpDir), stagingDirPrefix) {
+			// Emptied by the last of its files.
+			os.Remove(tmpDir)
+		}
+	}
+	if forward {
+		fmt.Fprintf(logw, "jwk-keygen: finished writing the %d files of an interrupted run from %s\n", len(j.Files), j.Started.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(logw, "jwk-keygen: rolled back the %d files of an interrupted run from %s\n", len(j.Files), j.Started.Format(time.RFC3339))
+	}
+	return os.Remove(name)
+}
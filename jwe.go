@@ -0,0 +1,169 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	encryptCmd  = app.Command("encrypt", "Encrypt a plaintext to a JWK as a compact or JSON JWE")
+	encryptKey  = encryptCmd.Flag("key", "JWK or JWKS to encrypt to; only the public half of a private key is used").Required().String()
+	encryptKid  = encryptCmd.Flag("kid", "Key to use when --key holds several encryption keys").String()
+	encryptIn   = encryptCmd.Flag("in", "File holding the plaintext, - for stdin").Default("-").String()
+	encryptAlg  = encryptCmd.Flag("alg", "Key management algorithm, if the key has no alg").String()
+	encryptEnc  = encryptCmd.Flag("enc", "Content encryption algorithm").Default(string(jose.A256GCM)).Enum(contentEncryptions()...)
+	encryptCty  = encryptCmd.Flag("cty", "cty header, the media type of the plaintext").String()
+	encryptJSON = encryptCmd.Flag("json", "Use the JWE JSON serialization instead of the compact one").Bool()
+
+	decryptCmd = app.Command("decrypt", "Decrypt a compact or JSON JWE with a private JWK or JWKS")
+	decryptKey = decryptCmd.Flag("key", "Private JWK or JWKS to decrypt with").Required().String()
+	decryptIn  = decryptCmd.Flag("in", "File holding the JWE, - for stdin").Default("-").String()
+)
+
+func contentEncryptions() []string {
+	return []string{
+		string(jose.A128CBC_HS256), string(jose.A192CBC_HS384), string(jose.A256CBC_HS512),
+		string(jose.A128GCM), string(jose.A192GCM), string(jose.A256GCM),
+	}
+}
+
+// encryptionKeys loads the keys of a JWK or JWKS that aren't for signing.
+// Keys that can't be decoded are skipped with a warning.
+func encryptionKeys(filename string) ([]jose.JSONWebKey, error) {
+	b, err := readInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := safeio.ParseRawKeys(b, inputLimits())
+	if err != nil {
+		return nil, err
+	}
+	var keys []jose.JSONWebKey
+	for _, r := range raw {
+		if r.Use() == "sig" {
+			continue
+		}
+		k, err := r.Decode()
+		if err != nil {
+			fmt.Fprintf(logw, "jwk-keygen: warning: skipping key %q: %s\n", r.Kid(), err)
+			continue
+		}
+		keys = append(keys, *k)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s holds no encryption keys", filename)
+	}
+	return keys, nil
+}
+
+func encrypt() {
+	if *encryptKey == "-" && *encryptIn == "-" {
+		app.FatalUsage("only one of --key and --in can be read from stdin")
+	}
+	keys, err := encryptionKeys(*encryptKey)
+	app.FatalIfError(err, "can't use key %s", *encryptKey)
+	var key *jose.JSONWebKey
+	for i := range keys {
+		if *encryptKid == "" || keys[i].KeyID == *encryptKid {
+			if key != nil {
+				app.FatalUsage("%s holds several encryption keys, pick one with --kid", *encryptKey)
+			}
+			key = &keys[i]
+		}
+	}
+	if key == nil {
+		app.Fatalf("%s holds no encryption key with kid %q", *encryptKey, *encryptKid)
+	}
+
+	alg := *encryptAlg
+	switch {
+	case key.Algorithm != "" && alg != "" && key.Algorithm != alg:
+		app.Fatalf("key is for alg %s, not %s", key.Algorithm, alg)
+	case key.Algorithm != "":
+		alg = key.Algorithm
+	case alg == "":
+		app.FatalUsage("can't tell which alg to encrypt with, pass --alg")
+	}
+	recipient := jose.Recipient{Algorithm: jose.KeyAlgorithm(alg), Key: key.Key, KeyID: key.KeyID}
+	if _, ok := key.Key.([]byte); !ok {
+		recipient.Key = key.Public().Key
+	}
+
+	plaintext, err := readFile(*encryptIn)
+	app.FatalIfError(err, "can't read plaintext")
+	opts := &jose.EncrypterOptions{}
+	if *encryptCty != "" {
+		opts = opts.WithContentType(jose.ContentType(*encryptCty))
+	}
+	encrypter, err := jose.NewEncrypter(jose.ContentEncryption(*encryptEnc), recipient, opts)
+	app.FatalIfError(err, "can't encrypt to key %s", *encryptKey)
+	obj, err := encrypter.Encrypt(plaintext)
+	app.FatalIfError(err, "can't encrypt plaintext")
+
+	if *encryptJSON {
+		fmt.Println(obj.FullSerialize())
+		return
+	}
+	compact, err := obj.CompactSerialize()
+	app.FatalIfError(err, "can't serialize JWE")
+	fmt.Println(compact)
+}
+
+func decrypt() {
+	if *decryptKey == "-" && *decryptIn == "-" {
+		app.FatalUsage("the JWE is read from stdin, so --key can't be")
+	}
+	keys, err := encryptionKeys(*decryptKey)
+	app.FatalIfError(err, "can't use key %s", *decryptKey)
+	data, err := readFile(*decryptIn)
+	app.FatalIfError(err, "can't read JWE")
+	obj, err := jose.ParseEncrypted(string(bytes.TrimSpace(data)))
+	app.FatalIfError(err, "can't parse JWE")
+
+	// Only try the keys the header could mean: a key for another alg, or
+	// with another kid, isn't used even if it would decrypt.
+	alg, kid := obj.Header.Algorithm, obj.Header.KeyID
+	tried := 0
+	for _, key := range keys {
+		if key.IsPublic() {
+			continue
+		}
+		if (key.Algorithm != "" && alg != "" && key.Algorithm != alg) ||
+			(key.KeyID != "" && kid != "" && key.KeyID != kid) {
+			continue
+		}
+		tried++
+		_, _, plaintext, err := obj.DecryptMulti(key.Key)
+		if err != nil {
+			debugf("key %q can't decrypt: %s", key.KeyID, err)
+			continue
+		}
+		_, err = os.Stdout.Write(plaintext)
+		app.FatalIfError(err, "can't write plaintext")
+		return
+	}
+	if tried == 0 {
+		app.Fatalf("%s holds no private key for alg %s and kid %q", *decryptKey, alg, kid)
+	}
+	app.Fatalf("can't decrypt JWE with %s", *decryptKey)
+}
@@ -0,0 +1,112 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// readSigningKey loads a private JWK and settles the algorithm to sign
+// with: the key's own `alg`, else alg, else the usual one for the key. It
+// also returns the issuer and audiences the key is restricted to, which
+// the tokens it signs must be checked against.
+func readSigningKey(filename, alg string) (*jose.JSONWebKey, jose.SignatureAlgorithm, keyConstraints, error) {
+	var none keyConstraints
+	b, err := readInput(filename)
+	if err != nil {
+		return nil, "", none, err
+	}
+	key, err := safeio.ParseJWK(b, inputLimits())
+	if err != nil {
+		return nil, "", none, err
+	}
+	if key.IsPublic() {
+		return nil, "", none, errors.New("a private key is needed to sign")
+	}
+	if key.Use != "" && key.Use != "sig" {
+		return nil, "", none, fmt.Errorf("key is for use %q, not signing", key.Use)
+	}
+	constraints, err := parseConstraints(b)
+	if err != nil {
+		return nil, "", none, err
+	}
+	switch {
+	case key.Algorithm != "" && alg != "" && key.Algorithm != alg:
+		return nil, "", none, fmt.Errorf("key is for alg %s, not %s", key.Algorithm, alg)
+	case key.Algorithm != "":
+		alg = key.Algorithm
+	case alg == "":
+		if _, ok := key.Key.([]byte); !ok {
+			alg = signingAlg(key.Public().Key)
+		}
+	}
+	if alg == "" {
+		return nil, "", none, errors.New("can't tell which alg to sign with, pass --alg")
+	}
+	return key, jose.SignatureAlgorithm(alg), constraints, nil
+}
+
+// signJWT signs claims as a compact JWT with the given `typ`, if any, and
+// any extra protected headers. The key's kid, if any, goes in the header
+// too.
+func signJWT(key *jose.JSONWebKey, alg jose.SignatureAlgorithm, typ string, headers map[jose.HeaderKey]interface{}, claims interface{}) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	return signJWS(key, alg, typ, headers, payload)
+}
+
+// signJWS signs payload as a compact JWS, with headers as for signJWT.
+func signJWS(key *jose.JSONWebKey, alg jose.SignatureAlgorithm, typ string, headers map[jose.HeaderKey]interface{}, payload []byte) (string, error) {
+	opts := &jose.SignerOptions{}
+	if typ != "" {
+		opts = opts.WithType(jose.ContentType(typ))
+	}
+	for k, v := range headers {
+		opts = opts.WithHeader(k, v)
+	}
+	// go-jose only adds the kid of asymmetric keys by itself.
+	if _, ok := key.Key.([]byte); ok && key.KeyID != "" {
+		opts = opts.WithHeader("kid", key.KeyID)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: *key}, opts)
+	if err != nil {
+		return "", err
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return jws.CompactSerialize()
+}
+
+// newJTI returns a random JWT ID.
+func newJTI() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
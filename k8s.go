@@ -0,0 +1,254 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// k8sName is a DNS subdomain, what Secret names must be.
+	k8sName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+	// k8sNamespace is a DNS label, what namespaces must be.
+	k8sNamespace = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+)
+
+// k8sSecret is a Kubernetes Secret manifest.
+type k8sSecret struct {
+	APIVersion string            `yaml:"apiVersion" json:"apiVersion"`
+	Kind       string            `yaml:"kind" json:"kind"`
+	Metadata   k8sMetadata       `yaml:"metadata" json:"metadata"`
+	Type       string            `yaml:"type,omitempty" json:"type,omitempty"`
+	Data       map[string]string `yaml:"data" json:"data"`
+}
+
+type k8sMetadata struct {
+	Name            string            `yaml:"name" json:"name"`
+	Namespace       string            `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	UID             string            `yaml:"uid,omitempty" json:"uid,omitempty"`
+	ResourceVersion string            `yaml:"resourceVersion,omitempty" json:"resourceVersion,omitempty"`
+	Generation      int64             `yaml:"-" json:"generation,omitempty"`
+	Labels          map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	OwnerReferences []k8sOwnerRef     `yaml:"ownerReferences,omitempty" json:"ownerReferences,omitempty"`
+}
+
+type k8sOwnerRef struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	UID        string `json:"uid"`
+	Controller bool   `json:"controller"`
+}
+
+// k8sServiceAccount is where pods find their API credentials.
+const k8sServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient talks to the Kubernetes API server, with the pod's service
+// account when running in a cluster, or through `kubectl proxy`.
+type kubeClient struct {
+	server string
+	// tokenFile is read on every request, as the kubelet rotates it.
+	tokenFile string
+	client    *http.Client
+	// watchClient has no timeout, for watches.
+	watchClient *http.Client
+}
+
+// kubeError is an unsuccessful API response.
+type kubeError struct {
+	Code    int
+	Message string
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("kubernetes API responded with %d: %s", e.Code, e.Message)
+}
+
+// kubeStatus reports whether err is a kubeError with the given code.
+func kubeStatus(err error, code int) bool {
+	e, ok := err.(*kubeError)
+	return ok && e.Code == code
+}
+
+// newKubeClient returns a client for server, or for the cluster the
+// process runs in if server is empty.
+func newKubeClient(server string) (*kubeClient, error) {
+	if server != "" {
+		return &kubeClient{
+			server:      strings.TrimSuffix(server, "/"),
+			client:      hookClient,
+			watchClient: &http.Client{},
+		}, nil
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster, pass --api-server")
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(k8sServiceAccount, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in the service account's ca.crt")
+	}
+	transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return &kubeClient{
+		server:      "https://" + net.JoinHostPort(host, port),
+		tokenFile:   filepath.Join(k8sServiceAccount, "token"),
+		client:      &http.Client{Timeout: 30 * time.Second, Transport: transport},
+		watchClient: &http.Client{Transport: transport},
+	}, nil
+}
+
+func (c *kubeClient) request(ctx context.Context, method, path string, in interface{}) (*http.Request, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, c.server+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if method == "PATCH" {
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	} else if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.tokenFile != "" {
+		token, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	return req, nil
+}
+
+// do sends in as JSON and decodes the response into out, if not nil.
+func (c *kubeClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	req, err := c.request(ctx, method, path, in)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, *maxInputSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(b, &status) != nil || status.Message == "" {
+			status.Message = string(bytes.TrimSpace(b))
+		}
+		return &kubeError{Code: resp.StatusCode, Message: status.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// parseK8sSecretName splits NAME[/NAMESPACE] and checks both parts.
+func parseK8sSecretName(s string) (name, namespace string, err error) {
+	parts := strings.SplitN(s, "/", 2)
+	name = parts[0]
+	if len(parts) == 2 {
+		namespace = parts[1]
+	}
+	if len(name) > 253 || !k8sName.MatchString(name) {
+		return "", "", fmt.Errorf("invalid Secret name %q", name)
+	}
+	if namespace != "" && (len(namespace) > 63 || !k8sNamespace.MatchString(namespace)) {
+		return "", "", fmt.Errorf("invalid namespace %q", namespace)
+	}
+	return name, namespace, nil
+}
+
+// renderK8sSecret wraps the private JWK, and the public JWKS with --jwks,
+// in a Secret named by --k8s-secret. The private JWK is passphrase
+// protected like every other private output.
+func renderK8sSecret(priv, pub jose.JSONWebKey) ([]byte, error) {
+	name, namespace, err := parseK8sSecretName(*k8sSecretOut)
+	if err != nil {
+		return nil, err
+	}
+	secret := k8sSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata: k8sMetadata{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "jwk-keygen"},
+		},
+		Type: "Opaque",
+		Data: map[string]string{},
+	}
+	enc := base64.StdEncoding
+	if priv.Key != nil {
+		b, err := renderJWK(priv)
+		if err != nil {
+			return nil, err
+		}
+		key := "jwk.json"
+		if outputPassphrase != "" {
+			if b, err = protectKey(b, "jwk+json", outputPassphrase); err != nil {
+				return nil, err
+			}
+			key = "jwk.jwe"
+		}
+		secret.Data[key] = enc.EncodeToString(b)
+	}
+	if *jwks && pub.Key != nil {
+		b, err := renderJWKS(pub)
+		if err != nil {
+			return nil, err
+		}
+		secret.Data["jwks-pub.json"] = enc.EncodeToString(b)
+	}
+	return yaml.Marshal(secret)
+}
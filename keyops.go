@@ -0,0 +1,84 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+)
+
+var keyOperations = generateCmd.Flag("key-ops", "Comma-separated key_ops, e.g. sign,verify; each goes to the private or public JWK that can perform it").PlaceHolder("OPS").String()
+
+// parseKeyOps splits --key-ops and checks every operation is registered,
+// listed once and fits --use.
+func parseKeyOps() ([]string, error) {
+	if *keyOperations == "" {
+		return nil, nil
+	}
+	var ops []string
+	seen := map[string]bool{}
+	for _, op := range strings.Split(*keyOperations, ",") {
+		op = strings.TrimSpace(op)
+		opUse, ok := keyOps[op]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("unknown key operation %q", op)
+		case seen[op]:
+			return nil, fmt.Errorf("key operation %q is listed twice", op)
+		case opUse != *use:
+			return nil, fmt.Errorf("key operation %q is not for use %q", op, *use)
+		}
+		seen[op] = true
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// splitKeyOps returns the key_ops of the private and of the public JWK:
+// operations needing the private key go to the private JWK, the others to
+// the public one. A symmetric key is both, and gets them all.
+func splitKeyOps() (priv, pub []string) {
+	ops, _ := parseKeyOps()
+	if keygen.IsSymmetric(*alg) {
+		return ops, ops
+	}
+	for _, op := range ops {
+		if privateOps[op] {
+			priv = append(priv, op)
+		} else {
+			pub = append(pub, op)
+		}
+	}
+	return priv, pub
+}
+
+// withKeyOps adds a key_ops member to the marshaled JWK b.
+func withKeyOps(b []byte, ops []string) ([]byte, error) {
+	if len(ops) == 0 {
+		return b, nil
+	}
+	js, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	b = append(bytes.TrimSuffix(b, []byte("}")), `,"key_ops":`...)
+	return append(append(b, js...), '}'), nil
+}
@@ -0,0 +1,165 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	jwksCmd = app.Command("jwks", "Manage key sets")
+
+	stripCmd    = jwksCmd.Command("strip", "Remove private key material from a JWKS")
+	stripIn     = stripCmd.Arg("jwks", "Key set to strip (- for stdin)").Required().String()
+	stripStrict = stripCmd.Flag("strict", "Fail on keys with an unknown kty or unregistered members instead of passing them through").Bool()
+	stripFormat = stripCmd.Flag("format", "Out JSON with format").Bool()
+
+	mergeCmd    = jwksCmd.Command("merge", "Merge several JWKS into one, dropping exact duplicates")
+	mergeIn     = mergeCmd.Arg("jwks", "Key sets to merge (- for stdin)").Required().Strings()
+	mergeStrict = mergeCmd.Flag("strict", "Fail on keys with an unknown kty or unregistered members instead of passing them through").Bool()
+	mergeFormat = mergeCmd.Flag("format", "Out JSON with format").Bool()
+)
+
+func readRawJWKS(filename string, strict bool) (*safeio.RawKeySet, error) {
+	b, err := readInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	set, err := safeio.ParseRawJWKS(b, inputLimits())
+	if err != nil {
+		return nil, err
+	}
+	if strict {
+		for _, k := range set.Keys {
+			if err := k.Strict(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return set, nil
+}
+
+func printRawJWKS(set *safeio.RawKeySet, pretty bool) {
+	out, err := json.Marshal(set)
+	app.FatalIfError(err, "can't Marshal key set to JSON")
+	if pretty {
+		out = formatJSON(out)
+	}
+	fmt.Println(string(out))
+}
+
+func strip() {
+	set, err := readRawJWKS(*stripIn, *stripStrict)
+	app.FatalIfError(err, "can't read key set %s", *stripIn)
+
+	keys := set.Keys[:0]
+	for _, k := range set.Keys {
+		if pub, ok := k.Public(); ok {
+			keys = append(keys, pub)
+		}
+	}
+	set.Keys = keys
+	printRawJWKS(set, *stripFormat)
+}
+
+func merge() {
+	var merged *safeio.RawKeySet
+	var seen [][]byte
+	for _, filename := range *mergeIn {
+		set, err := readRawJWKS(filename, *mergeStrict)
+		app.FatalIfError(err, "can't read key set %s", filename)
+		if merged == nil {
+			merged = &safeio.RawKeySet{Extra: set.Extra}
+		}
+	next:
+		for _, k := range set.Keys {
+			// encoding/json sorts map keys, so equal keys marshal equally.
+			b, err := json.Marshal(k)
+			app.FatalIfError(err, "can't Marshal key to JSON")
+			for _, s := range seen {
+				if bytes.Equal(s, b) {
+					continue next
+				}
+			}
+			seen = append(seen, b)
+			merged.Keys = append(merged.Keys, k)
+		}
+	}
+	printRawJWKS(merged, *mergeFormat)
+}
+
+// appendToJWKS adds the public key pub to the key set in filename, which is
+// created if it doesn't exist. The old set is kept as filename.bak, and
+// both files only change once every other output has been staged.
+func appendToJWKS(filename string, pub jose.JSONWebKey) error {
+	js, err := marshalJWK(pub)
+	if err != nil {
+		return err
+	}
+	var key safeio.RawKey
+	if err := json.Unmarshal(js, &key); err != nil {
+		return err
+	}
+
+	set := &safeio.RawKeySet{}
+	perm := os.FileMode(0444)
+	fi, err := os.Stat(filename)
+	switch {
+	case err == nil:
+		old, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		if set, err = readRawJWKS(filename, false); err != nil {
+			return err
+		}
+		for _, k := range set.Keys {
+			if pub.KeyID != "" && k.Kid() == pub.KeyID {
+				return fmt.Errorf("kid %q is already used in %s", pub.KeyID, filename)
+			}
+			if p, ok := k.Public(); ok && sameKeyMaterial(key, p) {
+				return fmt.Errorf("key is already in %s as %q", filename, k.Kid())
+			}
+		}
+		perm = fi.Mode().Perm()
+		if err := pending.replace(filename+".bak", "", old, perm); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	set.Keys = append(set.Keys, key)
+	out, err := json.Marshal(set)
+	if err != nil {
+		return err
+	}
+	if *format {
+		out = formatJSON(out)
+	}
+	if fi == nil {
+		return pending.add(filename, "key set", out, perm)
+	}
+	return pending.replace(filename, "key set", out, perm)
+}
@@ -0,0 +1,152 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"github.com/nicksherron/jwk-keygen/pkg/keyset"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// kidSequence is the IDSource of --kid-strategy sequence, whose next number
+// is kept in the --state-dir.
+var kidSequence *keygen.SequenceIDs
+
+func kidSequencePath() string {
+	return filepath.Join(*stateDir, "kid-sequence")
+}
+
+// keyIDSource returns the IDSource of --kid-strategy, prefixed with
+// --kid-prefix, or nil for thumbprint, which is only known once the key is:
+// see setThumbprintKeyID.
+func keyIDSource() (keygen.IDSource, error) {
+	var ids keygen.IDSource
+	switch *kidStrategy {
+	case "random":
+		ids = keygen.RandomIDs
+	case "uuid":
+		ids = keygen.UUIDs
+	case "ulid":
+		ids = keygen.ULIDs(keygen.ClockFunc(timestamp))
+	case "timestamp":
+		ids = keygen.Timestamps(keygen.ClockFunc(timestamp))
+	case "sequence":
+		if err := lockKidSequence(); err != nil {
+			return nil, err
+		}
+		next := uint64(1)
+		b, err := ioutil.ReadFile(kidSequencePath())
+		if err == nil {
+			next, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("can't parse %s: %s", kidSequencePath(), err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		kidSequence = &keygen.SequenceIDs{Next: next}
+		ids = kidSequence
+	default:
+		return nil, nil
+	}
+	return keygen.IDFunc(func() (string, error) {
+		id, err := ids.NewID()
+		return *kidPrefix + id, err
+	}), nil
+}
+
+// lockKidSequence keeps other runs from reading the --kid-strategy
+// sequence until this one has written the next number back: the lock file
+// is created exclusively and only removed by pending.abort, which commit
+// calls when it is done. A lock left behind by a process that died is
+// taken over, as its journal would be.
+func lockKidSequence() error {
+	if err := os.MkdirAll(*stateDir, 0700); err != nil {
+		return err
+	}
+	name := kidSequencePath() + ".lock"
+	for {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+			if err1 := f.Close(); err == nil {
+				err = err1
+			}
+			if err != nil {
+				os.Remove(name)
+				return err
+			}
+			pending.locks = append(pending.locks, name)
+			return nil
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		b, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// A lock without a PID may still be being written.
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil || processAlive(pid) {
+			return fmt.Errorf("another jwk-keygen is numbering keys, remove %s if none is running", name)
+		}
+		debugf("taking over %s from pid %d", name, pid)
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+}
+
+// stageKidSequence stages the next number of --kid-strategy sequence, so
+// that it only advances if the keys numbered are written.
+func stageKidSequence() error {
+	if kidSequence == nil {
+		return nil
+	}
+	if err := os.MkdirAll(*stateDir, 0700); err != nil {
+		return err
+	}
+	next := strconv.FormatUint(kidSequence.Next, 10) + "\n"
+	return pending.replace(kidSequencePath(), "", []byte(next), 0600)
+}
+
+// setThumbprintKeyID gives the keys of --kid-strategy thumbprint the
+// RFC 7638 SHA-256 thumbprint of the public key as kid.
+func setThumbprintKeyID(priv, pub *jose.JSONWebKey) error {
+	if *kidStrategy != "thumbprint" {
+		return nil
+	}
+	tp, err := keyset.Thumbprint(pub, crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	priv.KeyID = *kidPrefix + tp
+	pub.KeyID = priv.KeyID
+	return nil
+}
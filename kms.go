@@ -0,0 +1,286 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	kmsKey      = generateCmd.Flag("kms", "Create the key in a KMS instead, as aws:ALIAS; only the public key is output, with the key ARN as kid").PlaceHolder("aws:ALIAS").String()
+	kmsImport   = generateCmd.Flag("kms-import", "Generate the key here and import it into the KMS, rather than have the KMS generate it").Bool()
+	kmsRegion   = generateCmd.Flag("kms-region", "AWS region of the KMS").Envar("AWS_REGION").String()
+	kmsEndpoint = generateCmd.Flag("kms-endpoint", "KMS endpoint, for VPC endpoints and KMS-compatible services").PlaceHolder("URL").String()
+)
+
+// kmsKeySpec returns the KMS KeySpec and KeyUsage of --alg and --bits.
+func kmsKeySpec() (spec, usage string, err error) {
+	switch *alg {
+	case "ES256":
+		return "ECC_NIST_P256", "SIGN_VERIFY", nil
+	case "ES384":
+		return "ECC_NIST_P384", "SIGN_VERIFY", nil
+	case "ES512":
+		return "ECC_NIST_P521", "SIGN_VERIFY", nil
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+		usage = "SIGN_VERIFY"
+	case string(jose.RSA_OAEP), string(jose.RSA_OAEP_256):
+		usage = "ENCRYPT_DECRYPT"
+	default:
+		return "", "", fmt.Errorf("AWS KMS has no keys for %s", *alg)
+	}
+	n := *bits
+	if n == 0 {
+		n = 2048
+	}
+	if n != 2048 && n != 3072 && n != 4096 {
+		return "", "", fmt.Errorf("AWS KMS RSA keys have 2048, 3072 or 4096 bits, not %d", n)
+	}
+	return fmt.Sprintf("RSA_%d", n), usage, nil
+}
+
+// kmsClient calls the AWS KMS JSON API.
+type kmsClient struct {
+	endpoint string
+	region   string
+	creds    awsCredentials
+}
+
+// kmsError is an error response of KMS.
+type kmsError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (e *kmsError) Error() string {
+	return e.Type[strings.LastIndex(e.Type, "#")+1:] + ": " + e.Message
+}
+
+func (c *kmsClient) call(action string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	signAWS(req, body, "kms", c.region, c.creds, time.Now())
+	debugf("calling KMS %s", action)
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		e := &kmsError{}
+		if json.Unmarshal(b, e) != nil || e.Type == "" {
+			return fmt.Errorf("KMS %s responded with %s: %s", action, resp.Status, bytes.TrimSpace(b))
+		}
+		return e
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// kmsKeyMetadata is the part of KMS KeyMetadata that is used.
+type kmsKeyMetadata struct {
+	KeyID string `json:"KeyId"`
+	Arn   string `json:"Arn"`
+}
+
+// aesKeyWrapPad wraps plaintext with kek as in RFC 5649, which KMS calls
+// the second half of RSA_AES_KEY_WRAP_SHA_256.
+func aesKeyWrapPad(kek, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	a := []byte{0xa6, 0x59, 0x59, 0xa6, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(a[4:], uint32(len(plaintext)))
+	r := make([]byte, (len(plaintext)+7)/8*8)
+	copy(r, plaintext)
+	if len(r) == 8 {
+		b := append(a, r...)
+		block.Encrypt(b, b)
+		return b, nil
+	}
+	n := len(r) / 8
+	buf := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 0; i < n; i++ {
+			copy(buf, a)
+			copy(buf[8:], r[i*8:(i+1)*8])
+			block.Encrypt(buf, buf)
+			t := uint64(n*j + i + 1)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(buf[:8])^t)
+			copy(r[i*8:], buf[8:])
+		}
+	}
+	return append(a, r...), nil
+}
+
+// importKeyMaterial wraps the private key of priv for, and imports it
+// into, the KMS key keyID, which was created with Origin EXTERNAL.
+func (c *kmsClient) importKeyMaterial(keyID string, priv jose.JSONWebKey) error {
+	var params struct {
+		ImportToken []byte `json:"ImportToken"`
+		PublicKey   []byte `json:"PublicKey"`
+	}
+	err := c.call("GetParametersForImport", map[string]string{
+		"KeyId":             keyID,
+		"WrappingAlgorithm": "RSA_AES_KEY_WRAP_SHA_256",
+		"WrappingKeySpec":   "RSA_4096",
+	}, &params)
+	if err != nil {
+		return err
+	}
+	wrapping, err := x509.ParsePKIXPublicKey(params.PublicKey)
+	if err != nil {
+		return fmt.Errorf("can't parse KMS wrapping key: %s", err)
+	}
+	rsaWrapping, ok := wrapping.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("KMS wrapping key is not RSA")
+	}
+
+	material, err := x509.MarshalPKCS8PrivateKey(priv.Key)
+	if err != nil {
+		return err
+	}
+	aesKey := make([]byte, 32)
+	if _, err := rand.Read(aesKey); err != nil {
+		return err
+	}
+	encKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaWrapping, aesKey, nil)
+	if err != nil {
+		return err
+	}
+	wrapped, err := aesKeyWrapPad(aesKey, material)
+	if err != nil {
+		return err
+	}
+	return c.call("ImportKeyMaterial", map[string]interface{}{
+		"KeyId":                keyID,
+		"ImportToken":          params.ImportToken,
+		"EncryptedKeyMaterial": append(encKey, wrapped...),
+		"ExpirationModel":      "KEY_MATERIAL_DOES_NOT_EXPIRE",
+	}, nil)
+}
+
+// sameThumbprint reports whether public keys a and b are the same key.
+func sameThumbprint(a, b interface{}) bool {
+	ta, err := (&jose.JSONWebKey{Key: a}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return false
+	}
+	tb, err := (&jose.JSONWebKey{Key: b}).Thumbprint(crypto.SHA256)
+	return err == nil && bytes.Equal(ta, tb)
+}
+
+// runKMS creates the key in AWS KMS, or generates it and imports it there
+// with --kms-import, names it with the alias of --kms, and emits its
+// public half with the key ARN as kid. The private key is never written.
+func runKMS() {
+	alias := strings.TrimPrefix(*kmsKey, "aws:")
+	spec, usage, err := kmsKeySpec()
+	app.FatalIfError(err, "can't use --kms")
+	creds, err := awsCredentialsFromEnv()
+	app.FatalIfError(err, "can't use --kms")
+	c := &kmsClient{endpoint: *kmsEndpoint, region: *kmsRegion, creds: creds}
+	if c.endpoint == "" {
+		c.endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com/", c.region)
+	}
+
+	var priv, pub jose.JSONWebKey
+	if *kmsImport {
+		priv, pub, err = keygen.Generate(keygen.Options{Use: *use, Alg: *alg, Bits: *bits})
+		app.FatalIfError(err, "unable to generate key")
+	}
+	create := map[string]interface{}{
+		"KeySpec":     spec,
+		"KeyUsage":    usage,
+		"Description": fmt.Sprintf("%s key for %s, made by jwk-keygen", *use, *alg),
+	}
+	if *kmsImport {
+		create["Origin"] = "EXTERNAL"
+	}
+	var created struct {
+		KeyMetadata kmsKeyMetadata `json:"KeyMetadata"`
+	}
+	app.FatalIfError(c.call("CreateKey", create, &created), "can't create KMS key")
+	key := created.KeyMetadata
+
+	// A key that didn't get its material or alias is of no use to anyone.
+	err = nil
+	if *kmsImport {
+		err = c.importKeyMaterial(key.KeyID, priv)
+	}
+	if err == nil {
+		err = c.call("CreateAlias", map[string]string{"AliasName": "alias/" + alias, "TargetKeyId": key.KeyID}, nil)
+	}
+	var public struct {
+		PublicKey []byte `json:"PublicKey"`
+	}
+	if err == nil {
+		err = c.call("GetPublicKey", map[string]string{"KeyId": key.KeyID}, &public)
+	}
+	if err == nil {
+		var pubKey interface{}
+		pubKey, err = x509.ParsePKIXPublicKey(public.PublicKey)
+		if err == nil && *kmsImport && !sameThumbprint(pubKey, pub.Key) {
+			err = errors.New("KMS holds a different public key than was imported")
+		}
+		pub = jose.JSONWebKey{Key: pubKey, KeyID: key.Arn, Algorithm: *alg, Use: *use}
+	}
+	if err != nil {
+		fmt.Fprintf(logw, "jwk-keygen: scheduling deletion of KMS key %s\n", key.Arn)
+		if err := c.call("ScheduleKeyDeletion", map[string]interface{}{"KeyId": key.KeyID, "PendingWindowInDays": 7}, nil); err != nil {
+			fmt.Fprintf(logw, "jwk-keygen: warning: can't schedule deletion of KMS key %s: %s\n", key.Arn, err)
+		}
+		app.FatalIfError(err, "can't set up KMS key")
+	}
+	fmt.Fprintf(logw, "Created KMS key %s as alias/%s\n", key.Arn, alias)
+
+	// The private key, if it was here at all, stays out of every output.
+	emitKeys(jose.JSONWebKey{}, pub)
+}
@@ -0,0 +1,248 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+)
+
+// kvStore is a key-value store supporting compare-and-set, which is what
+// keeps concurrent rotation jobs from overwriting each other's key sets.
+type kvStore interface {
+	// get returns the current value of key (nil if unset) and a version to
+	// pass to set.
+	get(key string) ([]byte, string, error)
+	// set writes value unless key changed since get returned version, in
+	// which case it returns false.
+	set(key string, value []byte, version string, ttl time.Duration) (bool, error)
+	close() error
+}
+
+// kvAttempts bounds the compare-and-set retries when other writers keep
+// winning.
+const kvAttempts = 5
+
+// mergeKeySets returns next, followed by the keys of the published set
+// whose kid next doesn't have.
+func mergeKeySets(published []byte, next *safeio.RawKeySet) (*safeio.RawKeySet, error) {
+	if len(published) == 0 {
+		return next, nil
+	}
+	old, err := safeio.ParseRawJWKS(published, inputLimits())
+	if err != nil {
+		return nil, fmt.Errorf("can't parse the published key set: %s", err)
+	}
+	kids := map[string]bool{}
+	for _, k := range next.Keys {
+		kids[k.Kid()] = true
+	}
+	merged := &safeio.RawKeySet{Keys: append([]safeio.RawKey{}, next.Keys...), Extra: old.Extra}
+	for _, k := range old.Keys {
+		if k.Kid() == "" || !kids[k.Kid()] {
+			merged.Keys = append(merged.Keys, k)
+		}
+	}
+	return merged, nil
+}
+
+// publishToKV writes the key set under key, merging it into what is there
+// if merge is set, and retrying if another writer got in between.
+func publishToKV(store kvStore, key string, set *safeio.RawKeySet, merge bool, ttl time.Duration) error {
+	defer store.close()
+	for i := 0; i < kvAttempts; i++ {
+		published, version, err := store.get(key)
+		if err != nil {
+			return err
+		}
+		next := set
+		if merge {
+			if next, err = mergeKeySets(published, set); err != nil {
+				return err
+			}
+		}
+		value, err := json.Marshal(next)
+		if err != nil {
+			return err
+		}
+		ok, err := store.set(key, value, version, ttl)
+		if err != nil || ok {
+			return err
+		}
+		debugf("%s changed while publishing, retrying", key)
+	}
+	return fmt.Errorf("%s kept changing, gave up after %d attempts", key, kvAttempts)
+}
+
+// redisStore speaks just enough RESP for WATCH/MULTI/EXEC.
+type redisStore struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialRedis connects to a redis:// or rediss:// URL, authenticating with
+// the URL's password or REDIS_PASSWORD and selecting the database in its
+// path. Errors never quote the URL, as it may hold the password.
+func dialRedis(rawurl string) (*redisStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.New("invalid Redis URL, want redis://[:PASSWORD@]HOST[:PORT][/DB]")
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	switch u.Scheme {
+	case "redis":
+		conn, err = dialer.Dial("tcp", host)
+	case "rediss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("invalid Redis URL scheme %q, want redis:// or rediss://", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	s := &redisStore{conn: conn, r: bufio.NewReader(conn)}
+
+	password, hasPassword := u.User.Password()
+	if !hasPassword {
+		password = os.Getenv("REDIS_PASSWORD")
+	}
+	if password != "" {
+		args := []string{"AUTH", password}
+		if user := u.User.Username(); user != "" {
+			args = []string{"AUTH", user, password}
+		}
+		if _, err := s.do(args...); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err := s.do("SELECT", db); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *redisStore) do(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(s.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return s.read()
+}
+
+func (s *redisStore) read() (interface{}, error) {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply from Redis")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(s.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = s.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected reply from Redis: %q", line)
+	}
+}
+
+func (s *redisStore) get(key string) ([]byte, string, error) {
+	if _, err := s.do("WATCH", key); err != nil {
+		return nil, "", err
+	}
+	v, err := s.do("GET", key)
+	if err != nil {
+		return nil, "", err
+	}
+	b, _ := v.([]byte)
+	return b, "", nil
+}
+
+func (s *redisStore) set(key string, value []byte, _ string, ttl time.Duration) (bool, error) {
+	if _, err := s.do("MULTI"); err != nil {
+		return false, err
+	}
+	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	}
+	if _, err := s.do(args...); err != nil {
+		return false, err
+	}
+	// EXEC replies with a nil array when a WATCHed key changed.
+	v, err := s.do("EXEC")
+	if err != nil {
+		return false, err
+	}
+	return v != nil, nil
+}
+
+func (s *redisStore) close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,78 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+)
+
+var verbose = app.Flag("verbose", "Log progress to stderr (private key members are redacted)").Short('v').Bool()
+
+var (
+	// secretMember matches private members with string values, or the
+	// array of oth, also when the JSON was itself quoted into a string (as
+	// %q does).
+	secretMember = regexp.MustCompile(`((\\*)"(?:` + privateMembers + `)\\*"\s*:\s*)(?:\\*"[^"\\]*\\*"|\[[^\]]*\])`)
+	// secretPEM matches private PEM blocks, with real or escaped newlines.
+	secretPEM = regexp.MustCompile(`(?s)-----BEGIN ([A-Z ]*)PRIVATE KEY-----.*?-----END ([A-Z ]*)PRIVATE KEY-----`)
+)
+
+// redact replaces private key material in b with placeholders.
+func redact(b []byte) []byte {
+	b = secretMember.ReplaceAllFunc(b, func(m []byte) []byte {
+		sub := secretMember.FindSubmatch(m)
+		quote := append(append([]byte{}, sub[2]...), '"')
+		out := append([]byte{}, sub[1]...)
+		out = append(out, quote...)
+		out = append(out, "REDACTED"...)
+		return append(out, quote...)
+	})
+	return secretPEM.ReplaceAll(b, []byte("-----BEGIN ${1}PRIVATE KEY-----REDACTED-----END ${2}PRIVATE KEY-----"))
+}
+
+// redactingWriter redacts each write before passing it on. A secret split
+// across two writes is not caught, so callers write whole messages.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := r.w.Write(redact(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logw is where diagnostics go: debug logging, kingpin's errors and the
+// output of hook commands.
+var logw io.Writer = redactingWriter{os.Stderr}
+
+// debugf logs a message when --verbose is given.
+func debugf(format string, args ...interface{}) {
+	if !*verbose {
+		return
+	}
+	msg := fmt.Sprintf("jwk-keygen: "+format, args...)
+	if !bytes.HasSuffix([]byte(msg), []byte("\n")) {
+		msg += "\n"
+	}
+	io.WriteString(logw, msg)
+}
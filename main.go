@@ -18,21 +18,13 @@ package main
 
 import (
 	"bytes"
-	"crypto"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/base32"
-	"encoding/pem"
-	"errors"
-	"fmt"
-	"golang.org/x/crypto/ed25519"
 	"io"
 	"os"
 	"regexp"
+	"runtime/debug"
+	"strings"
 
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/json"
@@ -41,130 +33,60 @@ import (
 var (
 	app = kingpin.New("jwk-keygen", "A command-line utility to generate public/pirvate keypairs in JWK format.")
 
-	use = app.Flag("use", "Desrired key use").Required().Enum("enc", "sig")
-	alg = app.Flag("alg", "Generate key to be used for ALG").Required().Enum(
+	generateCmd = app.Command("generate", "Generate a keypair (default)").Default()
+
+	use = generateCmd.Flag("use", "Desrired key use").Required().Enum("enc", "sig")
+	alg = generateCmd.Flag("alg", "Generate key to be used for ALG").Required().Enum(
 		// `sig`
 		string(jose.ES256), string(jose.ES384), string(jose.ES512), string(jose.EdDSA),
 		string(jose.RS256), string(jose.RS384), string(jose.RS512), string(jose.PS256), string(jose.PS384), string(jose.PS512),
+		string(jose.HS256), string(jose.HS384), string(jose.HS512),
 		// `enc`
 		string(jose.RSA1_5), string(jose.RSA_OAEP), string(jose.RSA_OAEP_256),
 		string(jose.ECDH_ES), string(jose.ECDH_ES_A128KW), string(jose.ECDH_ES_A192KW), string(jose.ECDH_ES_A256KW),
+		string(jose.A128KW), string(jose.A192KW), string(jose.A256KW), string(jose.A128GCMKW), string(jose.A256GCMKW),
+		string(jose.DIRECT),
+		keygen.ES256K,
+		// `sig`, experimental
+		BLS12381G1, BLS12381G2,
 	)
-	bits       = app.Flag("bits", "Key size in bits").Int()
-	kid        = app.Flag("kid", "Key ID").String()
-	kidRand    = app.Flag("kid-rand", "Generate random Key ID").Bool()
-	jwks       = app.Flag("jwks", "Generate as JWKS too").Bool()
-	pemOut     = app.Flag("pem", "Generate as PEM too").Bool()
-	pemBody    = app.Flag("pem-body", "Generate as PEM body too").Bool()
-	pemOneLine = app.Flag("pem-one-line", "Generate as PEM with one-line too").Bool()
-	format     = app.Flag("format", "Out JSON with format").Bool()
+	bits         = generateCmd.Flag("bits", "Key size in bits").Int()
+	crv          = generateCmd.Flag("crv", "Curve of ECDH-ES keys, instead of picking a P-curve with --bits").Enum("P-256", "P-384", "P-521", X25519)
+	kid          = generateCmd.Flag("kid", "Key ID").String()
+	kidRand      = generateCmd.Flag("kid-rand", "Generate random Key ID, as --kid-strategy random").Hidden().Bool()
+	kidStrategy  = generateCmd.Flag("kid-strategy", "Generate the Key ID: random, uuid, ulid, timestamp, thumbprint or sequence").Enum("random", "uuid", "ulid", "timestamp", "thumbprint", "sequence")
+	kidPrefix    = generateCmd.Flag("kid-prefix", "Start generated Key IDs with this, e.g. prod-").String()
+	jwks         = generateCmd.Flag("jwks", "Generate as JWKS too").Bool()
+	pemOut       = generateCmd.Flag("pem", "Generate as PEM too").Bool()
+	pemBody      = generateCmd.Flag("pem-body", "Generate as PEM body too").Bool()
+	pemOneLine   = generateCmd.Flag("pem-one-line", "Generate as PEM with one-line too").Bool()
+	derOut       = generateCmd.Flag("der", "Generate as binary DER too: PKCS #8 private and SubjectPublicKeyInfo public key").Bool()
+	pkcs8Out     = generateCmd.Flag("pkcs8", "Generate the private key alone as a PKCS #8 .p8 file too, PEM or with --der DER").Bool()
+	coseOut      = generateCmd.Flag("cose", "Generate as CBOR COSE_Key (RFC 9052) too").Bool()
+	coseSet      = generateCmd.Flag("cose-set", "Generate a COSE_KeySet instead of a COSE_Key for --cose").Bool()
+	coseHex      = generateCmd.Flag("cose-hex", "Write --cose output in hex rather than binary; it is always hex when printed").Bool()
+	format       = generateCmd.Flag("format", "Out JSON with format").Bool()
+	k8sSecretOut = generateCmd.Flag("k8s-secret", "Generate a Kubernetes Secret manifest holding the private JWK, and the public JWKS with --jwks, too").PlaceHolder("NAME[/NAMESPACE]").String()
+	sqlOut       = generateCmd.Flag("sql", "Generate SQL loading the key too: pgjwt (PostgreSQL, HMAC keys) or mysql (public keys)").Enum("pgjwt", "mysql")
+	lowMemory    = generateCmd.Flag("low-memory", "Render and emit outputs one at a time to keep peak memory low").Bool()
+	emitNotes    = generateCmd.Flag("emit-notes", "Also write a Markdown and a JSON note describing the key").Bool()
+	audience     = generateCmd.Flag("audience", "Intended audience of the key, for --emit-notes").String()
+	rotateAfter  = generateCmd.Flag("rotate-after", "When the key should be rotated, for --emit-notes").Default("90d").String()
+	selinux      = generateCmd.Flag("selinux-label", "SELinux context to give written files, e.g. system_u:object_r:cert_t:s0").PlaceHolder("CONTEXT").String()
+	requestID    = generateCmd.Flag("request-id", "Idempotency key: repeating a request ID returns the key generated for it the first time").String()
+	stateDir     = generateCmd.Flag("state-dir", "Directory for request ID records, the --kid-strategy sequence and the journal of interrupted runs").Default(".jwk-keygen").String()
+	outDir       = generateCmd.Flag("out-dir", "Directory to write key files to").Default(".").String()
+	pubOut       = generateCmd.Flag("pub-out", "Write the public JWK to FILE instead, - for stdout").PlaceHolder("FILE").String()
+	privOut      = generateCmd.Flag("priv-out", "Write the private JWK to FILE instead, - for stdout").PlaceHolder("FILE").String()
+	toStdout     = generateCmd.Flag("stdout", "Print keys to stdout even when a Key ID is given").Bool()
+	jwksAppend   = generateCmd.Flag("jwks-append", "Add the public key to this key set too, keeping the old one as FILE.bak").PlaceHolder("FILE").String()
+	onCreate     = generateCmd.Flag("on-create", "Run a command, or POST to an http(s) URL, with the public key once it is created (repeatable)").Strings()
+
+	experimental = generateCmd.Flag("experimental", "Enable experimental key types and modes").Bool()
+	threshold    = generateCmd.Flag("threshold", "Minimum number of FROST shares needed to sign (experimental)").Int()
+	shares       = generateCmd.Flag("shares", "Split an EdDSA key into this many FROST shares (experimental)").Int()
 )
 
-// KeygenSig generates keypair for corresponding SignatureAlgorithm.
-func KeygenSig(alg jose.SignatureAlgorithm, bits int) (crypto.PublicKey, crypto.PrivateKey, error) {
-	switch alg {
-	case jose.ES256, jose.ES384, jose.ES512, jose.EdDSA:
-		keylen := map[jose.SignatureAlgorithm]int{
-			jose.ES256: 256,
-			jose.ES384: 384,
-			jose.ES512: 521, // sic!
-			jose.EdDSA: 256,
-		}
-		if bits != 0 && bits != keylen[alg] {
-			return nil, nil, errors.New("this `alg` does not support arbitrary key length")
-		}
-	case jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512:
-		if bits == 0 {
-			bits = 2048
-		}
-		if bits < 2048 {
-			return nil, nil, errors.New("too short key for RSA `alg`, 2048+ is required")
-		}
-	}
-	switch alg {
-	case jose.ES256:
-		// The cryptographic operations are implemented using constant-time algorithms.
-		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-		return key.Public(), key, err
-	case jose.ES384:
-		// NB: The cryptographic operations do not use constant-time algorithms.
-		key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
-		return key.Public(), key, err
-	case jose.ES512:
-		// NB: The cryptographic operations do not use constant-time algorithms.
-		key, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
-		return key.Public(), key, err
-	case jose.EdDSA:
-		pub, key, err := ed25519.GenerateKey(rand.Reader)
-		return pub, key, err
-	case jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512:
-		key, err := rsa.GenerateKey(rand.Reader, bits)
-		return key.Public(), key, err
-	default:
-		return nil, nil, errors.New("unknown `alg` for `use` = `sig`")
-	}
-}
-
-// KeygenEnc generates keypair for corresponding KeyAlgorithm.
-func KeygenEnc(alg jose.KeyAlgorithm, bits int) (crypto.PublicKey, crypto.PrivateKey, error) {
-	switch alg {
-	case jose.RSA1_5, jose.RSA_OAEP, jose.RSA_OAEP_256:
-		if bits == 0 {
-			bits = 2048
-		}
-		if bits < 2048 {
-			return nil, nil, errors.New("too short key for RSA `alg`, 2048+ is required")
-		}
-		key, err := rsa.GenerateKey(rand.Reader, bits)
-		return key.Public(), key, err
-	case jose.ECDH_ES, jose.ECDH_ES_A128KW, jose.ECDH_ES_A192KW, jose.ECDH_ES_A256KW:
-		var crv elliptic.Curve
-		switch bits {
-		case 0, 256:
-			crv = elliptic.P256()
-		case 384:
-			crv = elliptic.P384()
-		case 521:
-			crv = elliptic.P521()
-		default:
-			return nil, nil, errors.New("unknown elliptic curve bit length, use one of 256, 384, 521")
-		}
-		key, err := ecdsa.GenerateKey(crv, rand.Reader)
-		return key.Public(), key, err
-	default:
-		return nil, nil, errors.New("unknown `alg` for `use` = `enc`")
-	}
-}
-
-func pemBlockForKey(priv crypto.PrivateKey) ([]byte, error) {
-	var pemBlock *pem.Block
-	switch k := priv.(type) {
-	case *rsa.PrivateKey:
-		pemBlock = &pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(k),
-		}
-	case *ecdsa.PrivateKey:
-		b, err := x509.MarshalECPrivateKey(k)
-		if err != nil {
-			return nil, err
-		}
-		pemBlock = &pem.Block{
-			Type:  "EC PRIVATE KEY",
-			Bytes: b,
-		}
-	default:
-		fmt.Println(k)
-		return nil, errors.New("Uknown private key type")
-	}
-	var buf bytes.Buffer
-	err := pem.Encode(&buf, pemBlock)
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
 func toBody(b []byte) []byte {
 	s := string(b)
 	rep := regexp.MustCompile("(?m)^\\-{5}.*\\-{5}$")
@@ -179,38 +101,6 @@ func toOneLine(b []byte) []byte {
 	return []byte(rep.ReplaceAllString(s, "\\n"))
 }
 
-func pemBlockForPublicKey(pubKey crypto.PublicKey) ([]byte, error) {
-	var pemBlock *pem.Block
-	switch k := pubKey.(type) {
-	case *rsa.PublicKey:
-		asn1Bytes, err := x509.MarshalPKIXPublicKey(k)
-		if err != nil {
-			return nil, err
-		}
-		pemBlock = &pem.Block{
-			Type:  "PUBLIC KEY",
-			Bytes: asn1Bytes,
-		}
-	case *ecdsa.PublicKey:
-		asn1Bytes, err := x509.MarshalPKIXPublicKey(k)
-		if err != nil {
-			return nil, err
-		}
-		pemBlock = &pem.Block{
-			Type:  "PUBLIC KEY",
-			Bytes: asn1Bytes,
-		}
-	default:
-		return nil, errors.New("Uknown public key type")
-	}
-	var buf bytes.Buffer
-	err := pem.Encode(&buf, pemBlock)
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
 func formatJSON(b []byte) []byte {
 	var buf bytes.Buffer
 	err := json.Indent(&buf, b, "", "    ")
@@ -220,159 +110,445 @@ func formatJSON(b []byte) []byte {
 	return buf.Bytes()
 }
 
+// exit ends the process with code once main has set up stdout, for the
+// commands whose exit codes mean more than success or failure.
+var exit = os.Exit
+
 func main() {
+	// Only returns outside of a browser.
+	serveJS()
 	app.Version("v2")
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	app.ErrorWriter(logw)
+	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
+	flush := guardStdout()
+	defer flush()
+	exit = func(code int) {
+		// Drop whatever a failed command staged, and its locks.
+		pending.abort()
+		flush()
+		os.Exit(code)
+	}
+	app.Terminate(exit)
+	// The servers shut down by themselves.
+	if cmd != serveCmd.FullCommand() && cmd != controllerCmd.FullCommand() {
+		stopOnSignal()
+		// A journal still in use is for the commit of that run to deal with.
+		if err := recoverJournal(); err != nil {
+			if _, busy := err.(*busyJournal); !busy {
+				app.FatalIfError(err, "can't recover interrupted run")
+			}
+		}
+	}
+	switch cmd {
+	case generateCmd.FullCommand():
+		generate()
+	case vectorsCmd.FullCommand():
+		vectors()
+	case cookbookCmd.FullCommand():
+		cookbook()
+	case stripCmd.FullCommand():
+		strip()
+	case mergeCmd.FullCommand():
+		merge()
+	case bundleCmd.FullCommand():
+		composeBundle()
+	case rotateCmd.FullCommand():
+		rotate()
+	case reportCmd.FullCommand():
+		report()
+	case snippetCmd.FullCommand():
+		snippet()
+	case gatewayCmd.FullCommand():
+		gatewayConfig()
+	case publishCmd.FullCommand():
+		publish()
+	case messagingCmd.FullCommand():
+		messagingConfig()
+	case provisionCmd.FullCommand():
+		provision()
+	case convertCmd.FullCommand():
+		convert()
+	case validateCmd.FullCommand():
+		validate()
+	case interopCmd.FullCommand():
+		interop()
+	case deriveCmd.FullCommand():
+		deriveOct()
+	case promoteCmd.FullCommand():
+		promote()
+	case purgeCmd.FullCommand():
+		purge()
+	case serveCmd.FullCommand():
+		serve()
+	case assertionCmd.FullCommand():
+		clientAssertion()
+	case dpopCmd.FullCommand():
+		dpopProof()
+	case inspectCmd.FullCommand():
+		inspect()
+	case cnfCmd.FullCommand():
+		confirmation()
+	case eabCmd.FullCommand():
+		acmeEAB()
+	case siwaCmd.FullCommand():
+		siwaSecret()
+	case githubCmd.FullCommand():
+		githubAppJWT()
+	case simulateCmd.FullCommand():
+		simulateRotation()
+	case controllerCmd.FullCommand():
+		controller()
+	case initCmd.FullCommand():
+		initContainer()
+	case signCmd.FullCommand():
+		sign()
+	case verifyCmd.FullCommand():
+		verifyJWS()
+	case conformanceCmd.FullCommand():
+		conformance()
+	case encryptCmd.FullCommand():
+		encrypt()
+	case decryptCmd.FullCommand():
+		decrypt()
+	}
+}
 
+func generate() {
 	if *kidRand {
-		if *kid == "" {
-			b := make([]byte, 5)
-			_, err := rand.Read(b)
-			app.FatalIfError(err, "can't Read() crypto/rand")
-			*kid = base32.StdEncoding.EncodeToString(b)
-		} else {
-			app.FatalUsage("can't combine --kid and --kid-rand")
+		if *kidStrategy != "" && *kidStrategy != "random" {
+			app.FatalUsage("can't combine --kid-rand and --kid-strategy")
 		}
+		*kidStrategy, *kidRand = "random", false
 	}
-
-	var privKey crypto.PublicKey
-	var pubKey crypto.PrivateKey
-	var err error
-	switch *use {
-	case "sig":
-		pubKey, privKey, err = KeygenSig(jose.SignatureAlgorithm(*alg), *bits)
-	case "enc":
-		pubKey, privKey, err = KeygenEnc(jose.KeyAlgorithm(*alg), *bits)
+	if *pubOut == "-" || *privOut == "-" {
+		// Keep stdout for the key alone, so it can be piped, replayed or
+		// not.
+		pending.status = logw
 	}
-	app.FatalIfError(err, "unable to generate key")
-
-	priv := jose.JSONWebKey{Key: privKey, KeyID: *kid, Algorithm: *alg, Use: *use}
-	pub := jose.JSONWebKey{Key: pubKey, KeyID: *kid, Algorithm: *alg, Use: *use}
-
-	if priv.IsPublic() || !pub.IsPublic() || !priv.Valid() || !pub.Valid() {
-		app.Fatalf("invalid keys were generated")
+	if *requestID != "" {
+		if *shares > 0 || *alg == BLS12381G1 || *alg == BLS12381G2 {
+			app.FatalUsage("--request-id is not supported for experimental keys")
+		}
+		switch *kidStrategy {
+		case "sequence", "uuid", "ulid", "timestamp":
+			app.FatalUsage("--request-id can't be combined with --kid-strategy %s, whose kids a retry wouldn't reproduce", *kidStrategy)
+		}
+		rec, err := loadRequest(*requestID)
+		app.FatalIfError(err, "can't read request ID record")
+		if rec != nil {
+			replayRequest(rec)
+			return
+		}
 	}
 
-	privJS, err := priv.MarshalJSON()
-	app.FatalIfError(err, "can't Marshal private key to JSON")
-	pubJS, err := pub.MarshalJSON()
-	app.FatalIfError(err, "can't Marshal public key to JSON")
-
-	if *format {
-		pubJS = formatJSON(pubJS)
-		privJS = formatJSON(privJS)
+	debugf("generating %s key for use %q", *alg, *use)
+	if *toStdout && *outDir != "." {
+		app.FatalUsage("can't combine --stdout and --out-dir")
+	}
+	if *pubOut != "" && *pubOut == *privOut {
+		app.FatalUsage("--pub-out and --priv-out must differ")
+	}
+	if *pubOut != "" && keygen.IsSymmetric(*alg) {
+		app.FatalUsage("symmetric keys have no public half for --pub-out")
+	}
+	if *count < 1 {
+		app.FatalUsage("--count must be at least 1")
+	}
+	if *bundle && *count == 1 {
+		app.FatalUsage("--bundle only applies with --count")
+	}
+	if *count > 1 {
+		if *shares > 0 || *alg == BLS12381G1 || *alg == BLS12381G2 || rawJWK() {
+			app.FatalUsage("--count is not supported for experimental, X25519 or ES256K keys")
+		}
+		if *requestID != "" || *jwksAppend != "" || *pubOut != "" || *privOut != "" || *k8sSecretOut != "" {
+			app.FatalUsage("--count can't be combined with --request-id, --jwks-append, --pub-out, --priv-out or --k8s-secret")
+		}
+		if *kidStrategy == "timestamp" {
+			app.FatalUsage("--kid-strategy timestamp would give every key of a --count the same kid")
+		}
+		if *bundle && (*jwks || *pemOut || *pemBody || *pemOneLine || *derOut || *pkcs8Out || *p12Out || *coseOut || *sshOut || *sqlOut != "" || *emitNotes) {
+			app.FatalUsage("--bundle only outputs one JWKS")
+		}
+	}
+	if *kidStrategy != "" && *kid != "" {
+		app.FatalUsage("can't combine --kid and --kid-strategy")
+	}
+	if *kidPrefix != "" && *kidStrategy == "" {
+		app.FatalUsage("--kid-prefix needs --kid-strategy")
+	}
+	if *threshold != 0 && *shares == 0 {
+		app.FatalUsage("--threshold needs --shares")
+	}
+	if (*kidStrategy == "thumbprint" || *kidStrategy == "sequence") && (*shares > 0 || *alg == BLS12381G1 || *alg == BLS12381G2 || rawJWK()) {
+		app.FatalUsage("--kid-strategy %s is not supported for experimental, X25519 or ES256K keys", *kidStrategy)
+	}
+	if *kidStrategy == "thumbprint" && keygen.IsSymmetric(*alg) {
+		app.FatalUsage("--kid-strategy thumbprint would publish a hash of the secret key")
+	}
+	if *count == 1 && *kidStrategy != "" && *kidStrategy != "thumbprint" {
+		ids, err := keyIDSource()
+		app.FatalIfError(err, "can't generate Key ID")
+		*kid, err = ids.NewID()
+		app.FatalIfError(err, "can't generate Key ID")
 	}
 
-	var pubJSJWKS []byte
-	var privJSJWKS []byte
-
-	if *jwks {
-		privJWKS := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{priv}}
-		pubJWKS := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{pub}}
-
-		privJSJWKS, err = json.Marshal(privJWKS)
-		app.FatalIfError(err, "can't Marshal private key with JWKS to JSON")
-		pubJSJWKS, err = json.Marshal(pubJWKS)
-		app.FatalIfError(err, "can't Marshal public key with JWKS to JSON")
-
-		if *format {
-			pubJSJWKS = formatJSON(pubJSJWKS)
-			privJSJWKS = formatJSON(privJSJWKS)
+	if (*coseSet || *coseHex) && !*coseOut {
+		app.FatalUsage("--cose-set and --cose-hex need --cose")
+	}
+	if *derOut && (*kid == "" && *count == 1 && *kidStrategy == "" || *toStdout) {
+		app.FatalUsage("--der output is binary, so it is only written to files: pass --kid or --kid-strategy, and not --stdout")
+	}
+	if *p12PassFile != "" && !*p12Out {
+		app.FatalUsage("--p12-passphrase-file needs --p12")
+	}
+	if *p12Out {
+		if !*selfSignedCert {
+			app.FatalUsage("--p12 bundles the key with its certificate, pass --self-signed-cert")
 		}
+		if *kid == "" && *count == 1 && *kidStrategy == "" || *toStdout {
+			app.FatalUsage("--p12 output is binary, so it is only written to files: pass --kid or --kid-strategy, and not --stdout")
+		}
+	}
+	if (*shares > 0 || *alg == BLS12381G1 || *alg == BLS12381G2) && (*passphrase != "" || *passphraseFile != "") {
+		app.FatalUsage("--passphrase is not supported for experimental keys")
+	}
+	if (*shares > 0 || *alg == BLS12381G1 || *alg == BLS12381G2) && *jwksAppend != "" {
+		app.FatalUsage("--jwks-append is not supported for experimental keys")
+	}
+	if (*shares > 0 || *alg == BLS12381G1 || *alg == BLS12381G2 || rawJWK()) && (*pubOut != "" || *privOut != "") {
+		app.FatalUsage("--pub-out and --priv-out are not supported for experimental, X25519 or ES256K keys")
+	}
+	if !*selfSignedCert && (*certSubject != "" || len(*certSANs) > 0) {
+		app.FatalUsage("--cert-subject and --cert-san need --self-signed-cert")
+	}
+	if *selfSignedCert && (*shares > 0 || *alg == BLS12381G1 || *alg == BLS12381G2 || rawJWK() || keygen.IsSymmetric(*alg) || *alg == string(jose.EdDSA)) {
+		app.FatalUsage("--self-signed-cert is only supported for RSA and EC keys")
+	}
+	if *sshOut && (*use != "sig" || *shares > 0 || *alg == BLS12381G1 || *alg == BLS12381G2 || rawJWK() || keygen.IsSymmetric(*alg)) {
+		app.FatalUsage("--ssh is only supported for RSA, ECDSA and EdDSA signing keys")
+	}
+	if *vaultPath != "" {
+		if *shares > 0 || *alg == BLS12381G1 || *alg == BLS12381G2 || rawJWK() || *count > 1 {
+			app.FatalUsage("--vault-path is not supported for experimental, X25519 or ES256K keys, or with --count")
+		}
+		if *passphrase != "" || *passphraseFile != "" || *privOut != "" || *requestID != "" {
+			app.FatalUsage("--vault-path can't be combined with --passphrase, --priv-out or --request-id")
+		}
+		if *pemBody || *pemOneLine || *pkcs8Out || *p12Out || *coseOut || *sshOut || *k8sSecretOut != "" {
+			app.FatalUsage("--vault-path only stores the private key as JWK, JWKS and --pem")
+		}
+	}
+	if *kmsKey != "" {
+		if !strings.HasPrefix(*kmsKey, "aws:") || len(*kmsKey) == len("aws:") {
+			app.FatalUsage("--kms takes aws:ALIAS")
+		}
+		if *shares > 0 || *alg == BLS12381G1 || *alg == BLS12381G2 || rawJWK() || *count > 1 || keygen.IsSymmetric(*alg) || *alg == string(jose.EdDSA) {
+			app.FatalUsage("--kms is only supported for single RSA and NIST EC keys")
+		}
+		if *kid != "" || *kidStrategy != "" || *requestID != "" || *selfSignedCert {
+			app.FatalUsage("--kms can't be combined with --kid, --kid-strategy, --request-id or --self-signed-cert")
+		}
+		if *passphrase != "" || *passphraseFile != "" || *privOut != "" || *vaultPath != "" || *k8sSecretOut != "" {
+			app.FatalUsage("--kms never outputs the private key")
+		}
+		if *kmsRegion == "" && *kmsEndpoint == "" {
+			app.FatalUsage("--kms needs --kms-region or AWS_REGION")
+		}
+	} else if *kmsImport {
+		app.FatalUsage("--kms-import needs --kms")
+	}
+	if *sqlOut == "pgjwt" {
+		if *use != "sig" || !keygen.IsSymmetric(*alg) {
+			app.FatalUsage("--sql pgjwt sets the HMAC key of the database, so it needs --use sig and an HS256, HS384 or HS512 key; use --sql mysql for public keys")
+		}
+		if *count > 1 || *vaultPath != "" || *passphrase != "" || *passphraseFile != "" {
+			app.FatalUsage("--sql pgjwt can't be combined with --count, --vault-path or --passphrase")
+		}
+	}
+	if *k8sSecretOut != "" {
+		if *shares > 0 || *alg == BLS12381G1 || *alg == BLS12381G2 || rawJWK() {
+			app.FatalUsage("--k8s-secret is not supported for experimental, X25519 or ES256K keys")
+		}
+		if _, _, err := parseK8sSecretName(*k8sSecretOut); err != nil {
+			app.FatalUsage("--k8s-secret: %s", err)
+		}
+	}
+	if len(*extraClaims) > 0 {
+		if *shares > 0 || *alg == BLS12381G1 || *alg == BLS12381G2 || rawJWK() {
+			app.FatalUsage("--extra-claim is not supported for experimental, X25519 or ES256K keys")
+		}
+		if _, err := parseExtraClaims(); err != nil {
+			app.FatalUsage("--extra-claim: %s", err)
+		}
+	}
+	if *ephemeral < 0 {
+		app.FatalUsage("--ephemeral must be positive")
+	}
+	if *ephemeral > 0 {
+		if *shares > 0 || *alg == BLS12381G1 || *alg == BLS12381G2 || rawJWK() || *count > 1 || keygen.IsSymmetric(*alg) {
+			app.FatalUsage("--ephemeral is only supported for single RSA, EC and EdDSA keys")
+		}
+		if *privOut != "" || *vaultPath != "" || *kmsKey != "" || *k8sSecretOut != "" || *requestID != "" {
+			app.FatalUsage("--ephemeral can't be combined with --priv-out, --vault-path, --kms, --k8s-secret or --request-id")
+		}
+	} else if *ephemeralDir != "" {
+		app.FatalUsage("--ephemeral-dir needs --ephemeral")
+	}
+	if *restrictIss != "" || len(*restrictAud) > 0 {
+		if *use != "sig" || *shares > 0 || *alg == BLS12381G1 || *alg == BLS12381G2 || rawJWK() {
+			app.FatalUsage("--restrict-iss and --restrict-aud are only supported for signing keys, not experimental or ES256K ones")
+		}
+	}
+	if *keyOperations != "" {
+		if *shares > 0 || *alg == BLS12381G1 || *alg == BLS12381G2 {
+			app.FatalUsage("--key-ops is not supported for experimental keys")
+		}
+		if _, err := parseKeyOps(); err != nil {
+			app.FatalUsage("--key-ops: %s", err)
+		}
+	}
+	spec := keygen.Spec{Use: *use, Alg: *alg, Bits: *bits, Curve: *crv}
+	if *crv != "" || rawJWK() {
+		if err := spec.Validate(); err != nil {
+			app.FatalUsage("%s", err)
+		}
+	}
+	if rawJWK() {
+		if *passphrase != "" || *passphraseFile != "" || *jwksAppend != "" || *requestID != "" {
+			app.FatalUsage("--passphrase, --jwks-append and --request-id are not supported for X25519 or ES256K keys")
+		}
+		if *pemOut || *pemBody || *pemOneLine || *derOut || *pkcs8Out || *sqlOut != "" || *emitNotes {
+			app.FatalUsage("X25519 and ES256K keys can only be output as JWK, JWKS and COSE")
+		}
+		if *alg == keygen.ES256K {
+			runES256K()
+		} else {
+			runX25519()
+		}
+		return
+	}
+	if *shares > 0 {
+		runFROST()
+		return
+	}
+	if *alg == BLS12381G1 || *alg == BLS12381G2 {
+		runBLS()
+		return
+	}
+	if keygen.IsSymmetric(*alg) && (*pemOut || *pemBody || *pemOneLine || *derOut || *pkcs8Out || *sqlOut == "mysql" || *emitNotes || *jwksAppend != "") {
+		app.FatalUsage("symmetric keys can only be output as JWK, JWKS and --sql pgjwt")
+	}
+	if *passphrase != "" || *passphraseFile != "" {
+		if *pemOut || *pemBody || *pemOneLine || *derOut || *pkcs8Out || *coseOut || *sshOut {
+			app.FatalUsage("--passphrase only protects JWK and JWKS output, not PEM, DER, COSE or OpenSSH")
+		}
+		pass, err := readPassphrase()
+		app.FatalIfError(err, "can't read passphrase")
+		if pass == "" {
+			app.FatalUsage("empty passphrase")
+		}
+		outputPassphrase = pass
+	}
+	if *p12Out {
+		app.FatalIfError(readP12Passphrase(), "can't read passphrase")
 	}
 
-	var privPEM []byte
-	var pubPEM []byte
+	if *kmsKey != "" {
+		runKMS()
+		return
+	}
+	opts := keygen.Options{Use: *use, Alg: *alg, Bits: *bits, Curve: *crv, KeyID: *kid}
+	if *count > 1 {
+		generateMany(opts)
+		return
+	}
+	priv, pub, err := keygen.Generate(opts)
+	app.FatalIfError(err, "unable to generate key")
+	if *kidStrategy == "thumbprint" {
+		app.FatalIfError(setThumbprintKeyID(&priv, &pub), "can't generate Key ID")
+		*kid = priv.KeyID
+	}
+	if *selfSignedCert {
+		app.FatalIfError(attachSelfSignedCert(&priv, &pub), "can't issue a certificate")
+	}
 
-	if *pemOut || *pemBody || *pemOneLine {
-		privPEM, err = pemBlockForKey(privKey)
-		app.FatalIfError(err, "can't Marshal private key with to PEM")
-		pubPEM, err = pemBlockForPublicKey(pubKey)
-		app.FatalIfError(err, "can't Marshal public key to PEM")
+	if *ephemeral > 0 {
+		privateDir, err = makeEphemeralDir()
+		app.FatalIfError(err, "can't use --ephemeral")
+		emitKeys(priv, pub)
+		holdEphemeral()
+		return
 	}
+	emitKeys(priv, pub)
+}
 
-	if *kid == "" {
-		fmt.Printf("==> jwk_%s-pub.json <==\n", *alg)
-		fmt.Println(string(pubJS))
-		fmt.Printf("==> jwk_%s.json <==\n", *alg)
-		fmt.Println(string(privJS))
+// emitKeys outputs priv and pub in every encoding asked for, records the
+// request ID and runs the creation hooks. priv.Key is nil for public keys
+// being converted, pub.Key for symmetric keys.
+func emitKeys(priv, pub jose.JSONWebKey) {
+	stageKeys(priv, pub)
 
-		if *jwks {
-			fmt.Printf("==> jwks_%s-pub.json <==\n", *alg)
-			fmt.Println(string(pubJSJWKS))
-			fmt.Printf("==> jwks_%s.json <==\n", *alg)
-			fmt.Println(string(privJSJWKS))
-		}
+	if *vaultPath != "" && priv.Key != nil {
+		fatalIfStaged(writeToVault(priv), "can't write private key to Vault")
+	}
+	if *jwksAppend != "" {
+		fatalIfStaged(appendToJWKS(*jwksAppend, pub), "can't append key to %s", *jwksAppend)
+	}
+	if *requestID != "" {
+		fatalIfStaged(saveRequest(*requestID), "can't record request ID")
+	}
+	fatalIfStaged(stageKidSequence(), "can't record the kid sequence")
+	// Nothing is written until every output, and the request record, could
+	// be staged.
+	app.FatalIfError(pending.commit(), "can't write keys")
+	runCreateHooks(pub)
+}
 
-		if *pemOut {
-			fmt.Printf("==> pem_%s-pub.pem <==\n", *alg)
-			fmt.Println(string(pubPEM))
-			fmt.Printf("==> pem_%s.pem <==\n", *alg)
-			fmt.Println(string(privPEM))
-		}
+// runCreateHooks runs the --on-create hooks for a new key. Hooks never see
+// private key material, so they only learn the kid and alg of a symmetric
+// key.
+func runCreateHooks(pub jose.JSONWebKey) {
+	runHooks(*onCreate, keyEvent("create", pub))
+}
 
-		if *pemBody {
-			fmt.Printf("==> pem-body-%s-pub.pem <==\n", *alg)
-			fmt.Println(string(toBody(pubPEM)))
-			fmt.Printf("==> pem-body-%s.pem <==\n", *alg)
-			fmt.Println(string(toBody(privPEM)))
+// stageKeys renders every output of priv and pub, printing those that go
+// to stdout and staging the others for pending.commit.
+func stageKeys(priv, pub jose.JSONWebKey) {
+	var err error
+	outputs := keyOutputs(priv, pub)
+	if *requestID != "" {
+		// The record would keep a printed private key in plaintext.
+		for _, o := range outputs {
+			if o.private && o.printed() {
+				pending.abort()
+				app.FatalUsage("--request-id can't be combined with printing the %s; write it to a file with --kid or --priv-out, or protect it with --passphrase-file", o.what)
+			}
 		}
-
-		if *pemOneLine {
-			fmt.Printf("==> pem-one-line-%s-pub.pem <==\n", *alg)
-			fmt.Println(string(toOneLine(pubPEM)))
-			fmt.Printf("==> pem-one-line-%s.pem <==\n", *alg)
-			fmt.Println(string(toOneLine(privPEM)))
+	}
+	if *lowMemory {
+		// Render, emit and drop one output at a time instead of holding
+		// every encoding of the key at once. Outputs printed before one
+		// refused by --no-private-stdout are public.
+		debug.SetGCPercent(20)
+		for _, o := range outputs {
+			data, err := o.render()
+			fatalIfStaged(err, "can't Marshal %s", o.what)
+			emitOutput(o, data)
 		}
 	} else {
-		// JWK Thumbprint (RFC7638) is not used for key id because of
-		// lack of canonical representation.
-		fname := fmt.Sprintf("jwk_%s_%s_%s", *use, *alg, *kid)
-		err = writeNewFile(fname+"-pub.json", pubJS, 0444)
-		app.FatalIfError(err, "can't write public key with JWK to file %s-pub.json", fname)
-		fmt.Printf("Written public key with JWK to %s-pub.json\n", fname)
-		err = writeNewFile(fname+".json", privJS, 0400)
-		app.FatalIfError(err, "cant' write private key with JWK to file %s.json", fname)
-		fmt.Printf("Written private key with JWK to %s.json\n", fname)
-
-		if *jwks {
-			fname := fmt.Sprintf("jwks_%s_%s_%s", *use, *alg, *kid)
-			err = writeNewFile(fname+"-pub.json", pubJSJWKS, 0444)
-			app.FatalIfError(err, "can't write public key with JWKS to file %s-pub.json", fname)
-			fmt.Printf("Written public key with JWKS to %s-pub.json\n", fname)
-			err = writeNewFile(fname+".json", privJSJWKS, 0400)
-			app.FatalIfError(err, "cant' write private key with JWKS to file %s.json", fname)
-			fmt.Printf("Written private key with JWKS to %s.json\n", fname)
-		}
-
-		if *pemOut {
-			fname = fmt.Sprintf("pem_%s_%s_%s", *use, *alg, *kid)
-			err = writeNewFile(fname+"-pub.pem", pubPEM, 0444)
-			app.FatalIfError(err, "can't write public key with PEM to file %s-pub.pem", fname)
-			fmt.Printf("Written public key with PEM to %s-pub.pem\n", fname)
-			err = writeNewFile(fname+".pem", privPEM, 0400)
-			app.FatalIfError(err, "cant' write private key with PEM to file %s.pem", fname)
-			fmt.Printf("Written private key to %s.pem\n", fname)
-		}
-
-		if *pemBody {
-			fname = fmt.Sprintf("pem-body_%s_%s_%s", *use, *alg, *kid)
-			err = writeNewFile(fname+"-pub.pem", toBody(pubPEM), 0444)
-			app.FatalIfError(err, "can't write public key with PEM to file %s-pub.pem", fname)
-			fmt.Printf("Written public key with PEM to %s-pub.pem\n", fname)
-			err = writeNewFile(fname+".pem", toBody(privPEM), 0400)
-			app.FatalIfError(err, "cant' write private key with PEM to file %s.pem", fname)
-			fmt.Printf("Written private key to %s.pem\n", fname)
+		// Render everything up front so that an encoding error can't leave
+		// a partial set of files behind.
+		rendered := make([][]byte, len(outputs))
+		for i, o := range outputs {
+			rendered[i], err = o.render()
+			fatalIfStaged(err, "can't Marshal %s", o.what)
+			if o.printed() {
+				refusePrivateOutput(o, rendered[i])
+			}
 		}
-
-		if *pemOneLine {
-			fname = fmt.Sprintf("pem-one-line_%s_%s_%s", *use, *alg, *kid)
-			err = writeNewFile(fname+"-pub.pem", toOneLine(pubPEM), 0444)
-			app.FatalIfError(err, "can't write public key with PEM to file %s-pub.pem", fname)
-			fmt.Printf("Written public key with PEM to %s-pub.pem\n", fname)
-			err = writeNewFile(fname+".pem", toOneLine(privPEM), 0400)
-			app.FatalIfError(err, "cant' write private key with PEM to file %s.pem", fname)
-			fmt.Printf("Written private key to %s.pem\n", fname)
+		for i, o := range outputs {
+			emitOutput(o, rendered[i])
 		}
 	}
 }
@@ -391,5 +567,16 @@ func writeNewFile(filename string, data []byte, perm os.FileMode) error {
 	if err1 := f.Close(); err == nil {
 		err = err1
 	}
+	if err == nil {
+		err = labelFile(filename)
+	}
 	return err
 }
+
+// labelFile applies the --selinux-label context, if any, to a new file.
+func labelFile(filename string) error {
+	if *selinux == "" {
+		return nil
+	}
+	return setSELinuxLabel(filename, *selinux)
+}
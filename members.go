@@ -0,0 +1,95 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+var extraClaims = generateCmd.Flag("extra-claim", "Add a member to the JWKs, e.g. exp=1767225600 or x-team=payments; values that parse as JSON are used as such (repeatable)").PlaceHolder("NAME=VALUE").Strings()
+
+// registeredMembers are the JWK members RFC 7517 and RFC 7518 define, which
+// --extra-claim can't set since they describe the key itself.
+var registeredMembers = map[string]bool{
+	"kty": true, "use": true, "key_ops": true, "alg": true, "kid": true,
+	"x5u": true, "x5c": true, "x5t": true, "x5t#S256": true,
+	"crv": true, "x": true, "y": true, "n": true, "e": true,
+	"d": true, "p": true, "q": true, "dp": true, "dq": true, "qi": true, "oth": true,
+	"k": true,
+}
+
+// extraMember is a member added with --extra-claim.
+type extraMember struct {
+	name  string
+	value json.RawMessage
+}
+
+// parseExtraClaims parses --extra-claim, in the order given. A value that
+// isn't valid JSON is taken as a string.
+func parseExtraClaims() ([]extraMember, error) {
+	var members []extraMember
+	seen := map[string]bool{}
+	for _, claim := range *extraClaims {
+		i := strings.Index(claim, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q is not NAME=VALUE", claim)
+		}
+		name, value := claim[:i], claim[i+1:]
+		switch {
+		case registeredMembers[name]:
+			return nil, fmt.Errorf("%q is a registered JWK member", name)
+		case seen[name]:
+			return nil, fmt.Errorf("%q is given twice", name)
+		}
+		seen[name] = true
+		raw := json.RawMessage(value)
+		if !json.Valid(raw) {
+			raw, _ = json.Marshal(value)
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, raw); err != nil {
+			return nil, err
+		}
+		members = append(members, extraMember{name, compact.Bytes()})
+	}
+	return members, nil
+}
+
+// withExtraMembers adds the --extra-claim members to the marshaled JWK b,
+// refusing any b already has.
+func withExtraMembers(b []byte) ([]byte, error) {
+	members, err := parseExtraClaims()
+	if err != nil || len(members) == 0 {
+		return b, err
+	}
+	var have map[string]json.RawMessage
+	if err := json.Unmarshal(b, &have); err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSuffix(b, []byte("}"))
+	for _, m := range members {
+		if _, ok := have[m.name]; ok {
+			return nil, fmt.Errorf("JWK already has a %q member", m.name)
+		}
+		name, _ := json.Marshal(m.name)
+		b = append(append(append(append(b, ','), name...), ':'), m.value...)
+	}
+	return append(b, '}'), nil
+}
@@ -0,0 +1,130 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	messagingCmd       = app.Command("messaging-config", "Export keys for NATS or render Kafka OAuth listener config")
+	messagingTarget    = messagingCmd.Flag("target", "Platform: nats (nkeys) or kafka (OAUTHBEARER listener properties)").Required().Enum("nats", "kafka")
+	messagingKey       = messagingCmd.Flag("key", "EdDSA JWK to export as an nkey, for nats (- for stdin)").String()
+	messagingNKeyType  = messagingCmd.Flag("nkey-type", "Kind of NATS entity the key identifies").Default("account").Enum("operator", "account", "user")
+	messagingJWKSURI   = messagingCmd.Flag("jwks-uri", "Where brokers load the key set from, for kafka (https:// or file://)").Default("file:///etc/kafka/jwks.json").String()
+	messagingIssuer    = messagingCmd.Flag("issuer", "Expected token issuer, for kafka").String()
+	messagingAudience  = messagingCmd.Flag("audience", "Expected token audience, for kafka").String()
+	messagingListener  = messagingCmd.Flag("listener", "Kafka listener name to configure").Default("SASL_SSL").String()
+	messagingClaimName = messagingCmd.Flag("principal-claim", "Token claim Kafka uses as the principal").Default("sub").String()
+)
+
+// nkey prefix bytes, see github.com/nats-io/nkeys.
+var nkeyPrefixes = map[string]byte{
+	"operator": 14 << 3, // O
+	"account":  0,       // A
+	"user":     20 << 3, // U
+}
+
+const nkeySeedPrefix = 18 << 3 // S
+
+var nkeyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// crc16 is CRC-16/XMODEM, the checksum nkeys end with.
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func nkeyEncode(prefix []byte, key []byte) string {
+	raw := append(append([]byte{}, prefix...), key...)
+	sum := make([]byte, 2)
+	binary.LittleEndian.PutUint16(sum, crc16(raw))
+	return nkeyEncoding.EncodeToString(append(raw, sum...))
+}
+
+// nkeyPublic encodes an Ed25519 public key as an nkey of the given type.
+func nkeyPublic(typ string, pub ed25519.PublicKey) string {
+	return nkeyEncode([]byte{nkeyPrefixes[typ]}, pub)
+}
+
+// nkeySeed encodes an Ed25519 private key as the seed NATS tools store in
+// .nk files.
+func nkeySeed(typ string, priv ed25519.PrivateKey) string {
+	p := nkeyPrefixes[typ]
+	return nkeyEncode([]byte{nkeySeedPrefix | p>>5, (p & 31) << 3}, priv[:ed25519.SeedSize])
+}
+
+func natsConfig() {
+	if *messagingKey == "" {
+		app.FatalUsage("--key is required for nats")
+	}
+	k, err := readJWK(*messagingKey)
+	app.FatalIfError(err, "can't read key")
+
+	switch key := k.Key.(type) {
+	case ed25519.PrivateKey:
+		fmt.Printf("==> %s.nk <==\n", nkeyPublic(*messagingNKeyType, key.Public().(ed25519.PublicKey)))
+		fmt.Println(nkeySeed(*messagingNKeyType, key))
+	case ed25519.PublicKey:
+		fmt.Println(nkeyPublic(*messagingNKeyType, key))
+	default:
+		app.FatalIfError(errors.New("NATS nkeys are Ed25519, generate the key with --alg EdDSA"), "can't export key")
+	}
+}
+
+func kafkaConfig() {
+	p := "listener.name." + strings.ToLower(*messagingListener) + ".oauthbearer."
+	lines := []string{
+		"sasl.enabled.mechanisms=OAUTHBEARER",
+		p + "sasl.server.callback.handler.class=org.apache.kafka.common.security.oauthbearer.OAuthBearerValidatorCallbackHandler",
+		p + "sasl.jaas.config=org.apache.kafka.common.security.oauthbearer.OAuthBearerLoginModule required ;",
+		"sasl.oauthbearer.jwks.endpoint.url=" + *messagingJWKSURI,
+		"sasl.oauthbearer.sub.claim.name=" + *messagingClaimName,
+	}
+	if *messagingIssuer != "" {
+		lines = append(lines, "sasl.oauthbearer.expected.issuer="+*messagingIssuer)
+	}
+	if *messagingAudience != "" {
+		lines = append(lines, "sasl.oauthbearer.expected.audience="+*messagingAudience)
+	}
+	fmt.Println(strings.Join(lines, "\n"))
+}
+
+func messagingConfig() {
+	switch *messagingTarget {
+	case "nats":
+		natsConfig()
+	case "kafka":
+		kafkaConfig()
+	}
+}
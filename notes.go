@@ -0,0 +1,147 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"text/template"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// KeyNote is the metadata --emit-notes writes next to a key.
+type KeyNote struct {
+	KeyID         string    `json:"kid,omitempty"`
+	Algorithm     string    `json:"alg"`
+	Use           string    `json:"use"`
+	KeyType       string    `json:"kty"`
+	Audience      string    `json:"audience,omitempty"`
+	Created       time.Time `json:"created"`
+	RotateBy      time.Time `json:"rotate_by"`
+	PublicKeyFile string    `json:"public_key_file"`
+}
+
+var noteTemplate = template.Must(template.New("note").Parse(`# Key {{or .KeyID "(no kid)"}}
+
+| Property  | Value |
+|-----------|-------|
+| Algorithm | {{.Algorithm}} |
+| Use       | {{.Use}} |
+| Key type  | {{.KeyType}} |
+| Audience  | {{or .Audience "unspecified"}} |
+| Created   | {{.Created.Format "2006-01-02"}} |
+| Rotate by | {{.RotateBy.Format "2006-01-02"}} |
+
+Share {{.PublicKeyFile}} with the parties that {{if eq .Use "sig"}}verify tokens signed with it{{else}}encrypt to this key{{end}}.
+Keep the private key with its owner only.
+
+## Example
+
+{{if eq .Use "sig"}}Verifying a compact JWS with go-jose:
+
+    b, _ := ioutil.ReadFile("{{.PublicKeyFile}}")
+    var key jose.JSONWebKey
+    if err := key.UnmarshalJSON(b); err != nil {
+        return err
+    }
+    jws, err := jose.ParseSigned(token)
+    if err != nil {
+        return err
+    }
+    payload, err := jws.Verify(&key)
+{{else}}Encrypting to the key with go-jose:
+
+    b, _ := ioutil.ReadFile("{{.PublicKeyFile}}")
+    var key jose.JSONWebKey
+    if err := key.UnmarshalJSON(b); err != nil {
+        return err
+    }
+    enc, err := jose.NewEncrypter(jose.A256GCM,
+        jose.Recipient{Algorithm: jose.KeyAlgorithm("{{.Algorithm}}"), Key: &key}, nil)
+    if err != nil {
+        return err
+    }
+    jwe, err := enc.Encrypt(plaintext)
+{{end}}`))
+
+// keyType returns the JWK "kty" for a public key.
+func keyType(k interface{}) string {
+	switch k.(type) {
+	case *rsa.PublicKey:
+		return "RSA"
+	case *ecdsa.PublicKey:
+		return "EC"
+	case ed25519.PublicKey:
+		return "OKP"
+	default:
+		return ""
+	}
+}
+
+func keyNote(pub jose.JSONWebKey, created time.Time) (KeyNote, error) {
+	rotate, err := parseDuration(*rotateAfter)
+	if err != nil {
+		return KeyNote{}, fmt.Errorf("invalid --rotate-after: %s", err)
+	}
+	pubFile := fmt.Sprintf("jwk_%s_%s_%s-pub.json", *use, *alg, *kid)
+	if *kid == "" {
+		pubFile = fmt.Sprintf("jwk_%s-pub.json", *alg)
+	}
+	return KeyNote{
+		KeyID:         pub.KeyID,
+		Algorithm:     pub.Algorithm,
+		Use:           pub.Use,
+		KeyType:       keyType(pub.Key),
+		Audience:      *audience,
+		Created:       created,
+		RotateBy:      created.Add(rotate),
+		PublicKeyFile: pubFile,
+	}, nil
+}
+
+func renderNoteMarkdown(pub jose.JSONWebKey, created time.Time) ([]byte, error) {
+	n, err := keyNote(pub, created)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := noteTemplate.Execute(&buf, n); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func renderNoteJSON(pub jose.JSONWebKey, created time.Time) ([]byte, error) {
+	n, err := keyNote(pub, created)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+	if *format {
+		b = formatJSON(b)
+	}
+	return b, nil
+}
@@ -0,0 +1,251 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// keyOutput is one encoding of a generated key: printed under `name` when
+// no Key ID is given, written to `file` in --out-dir otherwise. A `dest`
+// overrides both: a file to write to, or - to print the bare output.
+// `private` marks outputs holding private key material, which are never
+// printed under --no-private-stdout, whatever their encoding.
+type keyOutput struct {
+	name    string
+	file    string
+	perm    os.FileMode
+	what    string
+	render  func() ([]byte, error)
+	dest    string
+	private bool
+}
+
+func renderJWK(k jose.JSONWebKey) ([]byte, error) {
+	b, err := marshalJWK(k)
+	if err != nil {
+		return nil, err
+	}
+	if *format {
+		b = formatJSON(b)
+	}
+	return b, nil
+}
+
+func renderJWKS(k jose.JSONWebKey) ([]byte, error) {
+	b, err := marshalJWKS([]jose.JSONWebKey{k})
+	if err != nil {
+		return nil, err
+	}
+	if *format {
+		b = formatJSON(b)
+	}
+	return b, nil
+}
+
+// protectedOutput turns a private JWK or JWKS output into a JWE encrypted
+// with outputPassphrase.
+func protectedOutput(o keyOutput, file string) keyOutput {
+	cty := "jwk+json"
+	if file == "jwks" {
+		cty = "jwk-set+json"
+	}
+	render := o.render
+	o.name = strings.TrimSuffix(o.name, ".json") + ".jwe"
+	o.file = strings.TrimSuffix(o.file, ".json") + ".jwe"
+	o.what = "passphrase-protected " + o.what
+	// Encrypted, the key may be printed even under --no-private-stdout.
+	o.private = false
+	o.render = func() ([]byte, error) {
+		b, err := render()
+		if err != nil {
+			return nil, err
+		}
+		return protectKey(b, cty, outputPassphrase)
+	}
+	return o
+}
+
+// keyOutputs lists every output requested on the command line, public half
+// first, in the order they are emitted. Either half is left out if its Key
+// is nil, and the private half with --vault-path, which stores it instead.
+func keyOutputs(priv, pub jose.JSONWebKey) []keyOutput {
+	var outputs []keyOutput
+	add := func(name, file, ext, pubWhat, privWhat string, pubRender, privRender func() ([]byte, error)) {
+		fname := fmt.Sprintf("%s_%s_%s_%s", file, *use, *alg, *kid)
+		// Symmetric keys have no public half to output, and converted
+		// public keys no private one.
+		if pub.Key != nil {
+			o := keyOutput{name + *alg + "-pub" + ext, fname + "-pub" + ext, 0444, pubWhat, pubRender, "", false}
+			if file == "jwk" {
+				o.dest = *pubOut
+			}
+			outputs = append(outputs, o)
+		}
+		if priv.Key != nil && *vaultPath == "" {
+			o := keyOutput{name + *alg + ext, fname + ext, 0400, privWhat, privRender, "", true}
+			if outputPassphrase != "" {
+				o = protectedOutput(o, file)
+			}
+			if file == "jwk" {
+				o.dest = *privOut
+			}
+			if privateDir != "" {
+				o.dest = filepath.Join(privateDir, o.file)
+			}
+			outputs = append(outputs, o)
+		}
+	}
+	pubPEM := func() ([]byte, error) { return keygen.MarshalPublicKeyPEM(pub.Key) }
+	privPEM := func() ([]byte, error) { return keygen.MarshalPrivateKeyPEM(priv.Key) }
+
+	add("jwk_", "jwk", ".json", "public key with JWK", "private key with JWK",
+		func() ([]byte, error) { return renderJWK(pub) },
+		func() ([]byte, error) { return renderJWK(priv) })
+	if *jwks {
+		add("jwks_", "jwks", ".json", "public key with JWKS", "private key with JWKS",
+			func() ([]byte, error) { return renderJWKS(pub) },
+			func() ([]byte, error) { return renderJWKS(priv) })
+	}
+	if *pemOut {
+		add("pem_", "pem", ".pem", "public key with PEM", "private key", pubPEM, privPEM)
+	}
+	if *pemBody {
+		add("pem-body-", "pem-body", ".pem", "public key with PEM", "private key",
+			func() ([]byte, error) { b, err := pubPEM(); return toBody(b), err },
+			func() ([]byte, error) { b, err := privPEM(); return toBody(b), err })
+	}
+	if *pemOneLine {
+		add("pem-one-line-", "pem-one-line", ".pem", "public key with PEM", "private key",
+			func() ([]byte, error) { b, err := pubPEM(); return toOneLine(b), err },
+			func() ([]byte, error) { b, err := privPEM(); return toOneLine(b), err })
+	}
+	if *derOut {
+		add("der_", "der", ".der", "public key with DER", "private key with DER",
+			func() ([]byte, error) { return keygen.MarshalPublicKeyDER(pub.Key) },
+			func() ([]byte, error) { return keygen.MarshalPrivateKeyDER(priv.Key) })
+	}
+	if *p12Out && priv.Key != nil && *vaultPath == "" {
+		o := keyOutput{"p12_" + *alg + ".p12",
+			fmt.Sprintf("p12_%s_%s_%s.p12", *use, *alg, *kid), 0400, "private key with PKCS #12",
+			func() ([]byte, error) { return encodePKCS12(priv.Key, priv.Certificates, *kid, p12Passphrase) }, "", true}
+		if privateDir != "" {
+			o.dest = filepath.Join(privateDir, o.file)
+		}
+		outputs = append(outputs, o)
+	}
+	if *coseOut {
+		file := strings.TrimSuffix(cosePrefix(), "_")
+		add(cosePrefix(), file, coseExt(), "public key with COSE", "private key with COSE",
+			func() ([]byte, error) { return renderCOSEKey(pub) },
+			func() ([]byte, error) { return renderCOSEKey(priv) })
+	}
+	if *pkcs8Out && priv.Key != nil && *vaultPath == "" {
+		privP8 := privPEM
+		if *derOut {
+			privP8 = func() ([]byte, error) { return keygen.MarshalPrivateKeyDER(priv.Key) }
+		}
+		o := keyOutput{"pkcs8_" + *alg + ".p8",
+			fmt.Sprintf("pkcs8_%s_%s_%s.p8", *use, *alg, *kid), 0400, "private key with PKCS #8", privP8, "", true}
+		if privateDir != "" {
+			o.dest = filepath.Join(privateDir, o.file)
+		}
+		outputs = append(outputs, o)
+	}
+	if *sshOut {
+		add("ssh_", "ssh", "", "public key with authorized_keys", "private key with OpenSSH",
+			func() ([]byte, error) { return marshalSSHPublicKey(pub.Key, *kid) },
+			func() ([]byte, error) { return marshalSSHPrivateKey(priv.Key, *kid) })
+	}
+	switch {
+	case *sqlOut == "pgjwt" && priv.Key != nil && *vaultPath == "":
+		// The HMAC key is a secret, and is written like one.
+		o := keyOutput{"sql_" + *alg + ".sql",
+			fmt.Sprintf("sql_%s_%s_%s.sql", *use, *alg, *kid), 0400, "private key with SQL",
+			func() ([]byte, error) { return renderSQL(priv, pub) }, "", true}
+		if privateDir != "" {
+			o.dest = filepath.Join(privateDir, o.file)
+		}
+		outputs = append(outputs, o)
+	case *sqlOut == "mysql":
+		outputs = append(outputs, keyOutput{"sql_" + *alg + ".sql",
+			fmt.Sprintf("sql_%s_%s_%s.sql", *use, *alg, *kid), 0444, "public key with SQL",
+			func() ([]byte, error) { return renderSQL(priv, pub) }, "", false})
+	}
+	if *k8sSecretOut != "" {
+		outputs = append(outputs, keyOutput{"k8s-secret_" + *alg + ".yaml",
+			fmt.Sprintf("k8s-secret_%s_%s_%s.yaml", *use, *alg, *kid), 0400, "private key with Kubernetes Secret",
+			func() ([]byte, error) { return renderK8sSecret(priv, pub) }, "", priv.Key != nil})
+	}
+	if *emitNotes {
+		// Notes are public and named after the kid alone, as they are for
+		// people rather than programs.
+		created := timestamp().UTC().Truncate(time.Second)
+		outputs = append(outputs,
+			keyOutput{"notes_" + *alg + ".md", *kid + ".md", 0444, "key notes",
+				func() ([]byte, error) { return renderNoteMarkdown(pub, created) }, "", false},
+			keyOutput{"notes_" + *alg + ".json", *kid + ".json", 0444, "key notes with JSON",
+				func() ([]byte, error) { return renderNoteJSON(pub, created) }, "", false},
+		)
+	}
+	return outputs
+}
+
+// printed reports whether emitOutput prints o rather than staging it.
+func (o keyOutput) printed() bool {
+	return o.dest == "-" || o.dest == "" && (*kid == "" || *toStdout)
+}
+
+// emitOutput prints an output to stdout when no Key ID is given, or
+// --stdout is, and stages it for its own file otherwise. Staged files only
+// appear once pending.commit is called.
+func emitOutput(o keyOutput, data []byte) {
+	if o.printed() {
+		refusePrivateOutput(o, data)
+	}
+	if o.dest == "-" {
+		fmt.Println(string(data))
+		if *requestID != "" {
+			emitted = append(emitted, recordedOutput{Name: o.name, What: o.what, Data: data, Bare: true})
+		}
+		return
+	}
+	if o.dest == "" && (*kid == "" || *toStdout) {
+		fmt.Printf("==> %s <==\n", o.name)
+		fmt.Println(string(data))
+		if *requestID != "" {
+			emitted = append(emitted, recordedOutput{Name: o.name, What: o.what, Data: data})
+		}
+		return
+	}
+	file := o.dest
+	if file == "" {
+		file = filepath.Join(*outDir, o.file)
+	}
+	err := pending.add(file, o.what, data, o.perm)
+	fatalIfStaged(err, "can't write %s to file %s", o.what, file)
+	if *requestID != "" {
+		emitted = append(emitted, recordedOutput{Name: o.name, File: file, What: o.what})
+	}
+}
@@ -0,0 +1,336 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"unicode/utf16"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// PKCS #12 (RFC 7292) bundles are written the way OpenSSL 3 writes them by
+// default: the private key encrypted with PBES2 (PBKDF2 with HMAC-SHA-256
+// and AES-256-CBC) and the whole authenticated with HMAC-SHA-256. The
+// certificates are public and left unencrypted, as Java keystores do.
+var (
+	oidData                = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS8ShroudedKeyBag = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBES2               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256      = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidSHA256              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+)
+
+// pkcs12Iterations is the PBKDF2 and MAC iteration count, that of Java's
+// keytool.
+const pkcs12Iterations = 10000
+
+// encoding/asn1 takes RawValues as they are, ignoring field tags, so the
+// RawValues here carry their own: explicitly tagged [0] for content, and
+// SET for attribute values.
+type pkcs12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type pkcs12Attribute struct {
+	ID     asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type pkcs12SafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set,omitempty"`
+}
+
+type pkcs12CertBag struct {
+	ID   asn1.ObjectIdentifier
+	Cert []byte `asn1:"tag:0,explicit"`
+}
+
+type pkcs12AlgorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type pkcs12PBKDF2Params struct {
+	Salt       []byte
+	Iterations int
+	PRF        pkcs12AlgorithmIdentifier
+}
+
+type pkcs12PBES2Params struct {
+	KDF    pkcs12AlgorithmIdentifier
+	Scheme pkcs12AlgorithmIdentifier
+}
+
+type pkcs12EncryptedPrivateKeyInfo struct {
+	Algorithm     pkcs12AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pkcs12DigestInfo struct {
+	Algorithm pkcs12AlgorithmIdentifier
+	Digest    []byte
+}
+
+type pkcs12MacData struct {
+	Mac        pkcs12DigestInfo
+	Salt       []byte
+	Iterations int
+}
+
+type pkcs12PFX struct {
+	Version  int
+	AuthSafe pkcs12ContentInfo
+	MacData  pkcs12MacData
+}
+
+// encodePKCS12 bundles key with its certificate chain, leaf first, into a
+// PKCS #12 file protected by password. The key and leaf certificate are
+// named friendlyName.
+func encodePKCS12(key interface{}, chain []*x509.Certificate, friendlyName, password string) ([]byte, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("PKCS #12 needs a certificate")
+	}
+	random := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		_, err := rand.Read(b)
+		return b, err
+	}
+	localKeyID := sha1.Sum(chain[0].Raw)
+	attrs, err := pkcs12Attributes(localKeyID[:], friendlyName)
+	if err != nil {
+		return nil, err
+	}
+
+	var certBags []pkcs12SafeBag
+	for i, cert := range chain {
+		bag, err := asn1.Marshal(pkcs12CertBag{ID: oidX509Certificate, Cert: cert.Raw})
+		if err != nil {
+			return nil, err
+		}
+		safeBag := pkcs12SafeBag{ID: oidCertBag, Value: explicitContent(bag)}
+		if i == 0 {
+			safeBag.Attributes = attrs
+		}
+		certBags = append(certBags, safeBag)
+	}
+
+	pkcs8, err := keygen.MarshalPrivateKeyDER(key)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := random(16)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := random(aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(password), salt, pkcs12Iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(pkcs8)%aes.BlockSize
+	for i := 0; i < padding; i++ {
+		pkcs8 = append(pkcs8, byte(padding))
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(pkcs8, pkcs8)
+
+	nullParams := asn1.RawValue{FullBytes: asn1.NullBytes}
+	kdfParams, err := asn1.Marshal(pkcs12PBKDF2Params{salt, pkcs12Iterations, pkcs12AlgorithmIdentifier{oidHMACWithSHA256, nullParams}})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	pbes2Params, err := asn1.Marshal(pkcs12PBES2Params{
+		KDF:    pkcs12AlgorithmIdentifier{oidPBKDF2, asn1.RawValue{FullBytes: kdfParams}},
+		Scheme: pkcs12AlgorithmIdentifier{oidAES256CBC, asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	shrouded, err := asn1.Marshal(pkcs12EncryptedPrivateKeyInfo{
+		Algorithm:     pkcs12AlgorithmIdentifier{oidPBES2, asn1.RawValue{FullBytes: pbes2Params}},
+		EncryptedData: pkcs8,
+	})
+	if err != nil {
+		return nil, err
+	}
+	keyBags := []pkcs12SafeBag{{ID: oidPKCS8ShroudedKeyBag, Value: explicitContent(shrouded), Attributes: attrs}}
+
+	var authSafe []pkcs12ContentInfo
+	for _, bags := range [][]pkcs12SafeBag{certBags, keyBags} {
+		contents, err := asn1.Marshal(bags)
+		if err != nil {
+			return nil, err
+		}
+		info, err := pkcs12Data(contents)
+		if err != nil {
+			return nil, err
+		}
+		authSafe = append(authSafe, info)
+	}
+	authSafeDER, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+	pfx := pkcs12PFX{Version: 3}
+	if pfx.AuthSafe, err = pkcs12Data(authSafeDER); err != nil {
+		return nil, err
+	}
+
+	macSalt, err := random(16)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, pkcs12KDF(pkcs12Password(password), macSalt, 3, pkcs12Iterations, 32))
+	mac.Write(authSafeDER)
+	pfx.MacData = pkcs12MacData{
+		Mac:        pkcs12DigestInfo{pkcs12AlgorithmIdentifier{oidSHA256, nullParams}, mac.Sum(nil)},
+		Salt:       macSalt,
+		Iterations: pkcs12Iterations,
+	}
+	return asn1.Marshal(pfx)
+}
+
+// pkcs12Data wraps b in a ContentInfo of type data.
+func pkcs12Data(b []byte) (pkcs12ContentInfo, error) {
+	octets, err := asn1.Marshal(b)
+	if err != nil {
+		return pkcs12ContentInfo{}, err
+	}
+	return pkcs12ContentInfo{ContentType: oidData, Content: explicitContent(octets)}, nil
+}
+
+// explicitContent tags the encoded value b as [0] EXPLICIT.
+func explicitContent(b []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: b}
+}
+
+// attributeValues makes the SET of an attribute holding the encoded value b.
+func attributeValues(b []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: b}
+}
+
+// pkcs12Attributes are the localKeyId pairing the key with its
+// certificate, and the friendlyName keystores list them by, if any.
+func pkcs12Attributes(localKeyID []byte, friendlyName string) ([]pkcs12Attribute, error) {
+	id, err := asn1.Marshal(localKeyID)
+	if err != nil {
+		return nil, err
+	}
+	attrs := []pkcs12Attribute{{ID: oidLocalKeyID, Values: attributeValues(id)}}
+	if friendlyName != "" {
+		// encoding/asn1 has no BMPString, the encoding PKCS #12 wants.
+		name, err := asn1.Marshal(asn1.RawValue{Tag: 30, Bytes: bmpString(friendlyName)})
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, pkcs12Attribute{ID: oidFriendlyName, Values: attributeValues(name)})
+	}
+	return attrs, nil
+}
+
+// bmpString encodes s as big-endian UTF-16.
+func bmpString(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return b
+}
+
+// pkcs12Password is the encoding of password the PKCS #12 KDF takes: a
+// NUL-terminated BMPString.
+func pkcs12Password(password string) []byte {
+	return append(bmpString(password), 0, 0)
+}
+
+// pkcs12KDF is the key derivation of RFC 7292 appendix B.2 with SHA-256,
+// which PKCS #12 still uses for the MAC key; id 3 derives MAC keys.
+func pkcs12KDF(password, salt []byte, id byte, iterations, size int) []byte {
+	// v is the block size of SHA-256.
+	const v = 64
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	D := make([]byte, v)
+	for i := range D {
+		D[i] = id
+	}
+	I := append(fill(salt), fill(password)...)
+	one := big.NewInt(1)
+	var out []byte
+	for len(out) < size {
+		h := sha256.New()
+		h.Write(D)
+		h.Write(I)
+		A := h.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			sum := sha256.Sum256(A)
+			A = sum[:]
+		}
+		out = append(out, A...)
+		// I_j = (I_j + B + 1) mod 2^(8v) for each v-byte block of I.
+		B := new(big.Int).SetBytes(fill(A)[:v])
+		B.Add(B, one)
+		for j := 0; j < len(I); j += v {
+			Ij := new(big.Int).SetBytes(I[j : j+v])
+			Ij.Add(Ij, B)
+			b := Ij.Bytes()
+			if len(b) > v {
+				b = b[len(b)-v:]
+			}
+			block := I[j : j+v]
+			for k := range block {
+				block[k] = 0
+			}
+			copy(block[v-len(b):], b)
+		}
+	}
+	return out[:size]
+}
@@ -0,0 +1,224 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package keygen generates JSON Web Keys. It is the library behind the
+// jwk-keygen command: Generate makes a private and public JWK pair for a
+// `use` and `alg`, Sig and Enc make the raw keys, and MarshalPrivateKeyPEM
+// and MarshalPublicKeyPEM encode them as PKCS #8 and SubjectPublicKeyInfo.
+package keygen
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base32"
+	"errors"
+
+	"golang.org/x/crypto/ed25519"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Options describe the key to generate.
+type Options struct {
+	// Use is "sig" or "enc".
+	Use string
+	// Alg is the JWS algorithm for "sig" keys, or the JWE key management
+	// algorithm for "enc" keys.
+	Alg string
+	// Bits is the key size, see Sig and Enc. 0 picks the default.
+	Bits int
+	// Curve picks the curve of ECDH-ES keys, see Spec. X25519 keys can't
+	// be held by go-jose, so they are made by X25519 instead.
+	Curve string
+	// KeyID is the kid of the keys, if any.
+	KeyID string
+	// RandomKeyID gives the keys a kid from IDs. It can't be combined
+	// with KeyID.
+	RandomKeyID bool
+	// IDs makes the kid for RandomKeyID, RandomIDs if nil.
+	IDs IDSource
+}
+
+// Generate makes a private and public JWK for opts. For symmetric
+// algorithms, which have no public half, pub.Key is nil.
+func Generate(opts Options) (priv, pub jose.JSONWebKey, err error) {
+	kid := opts.KeyID
+	if opts.RandomKeyID {
+		if kid != "" {
+			return priv, pub, errors.New("can't combine KeyID and RandomKeyID")
+		}
+		ids := opts.IDs
+		if ids == nil {
+			ids = RandomIDs
+		}
+		if kid, err = ids.NewID(); err != nil {
+			return priv, pub, err
+		}
+	}
+
+	spec := Spec{Use: opts.Use, Alg: opts.Alg, Bits: opts.Bits, Curve: opts.Curve}
+	if err := spec.Validate(); err != nil {
+		return priv, pub, err
+	}
+	if spec.Alg == ES256K {
+		return priv, pub, specError(ErrCurveUnsupported, "go-jose can't hold secp256k1 keys, use Secp256k1 instead")
+	}
+	switch spec.Curve {
+	case "X25519":
+		return priv, pub, specError(ErrCurveUnsupported, "go-jose can't hold X25519 keys, use X25519 instead")
+	case "P-256", "P-384", "P-521":
+		spec.Bits = ecdhCurveBits[spec.Curve]
+	}
+
+	var pubKey crypto.PublicKey
+	var privKey crypto.PrivateKey
+	if spec.Use == "sig" {
+		pubKey, privKey, err = Sig(jose.SignatureAlgorithm(spec.Alg), spec.Bits)
+	} else {
+		pubKey, privKey, err = Enc(jose.KeyAlgorithm(spec.Alg), spec.Bits)
+	}
+	if err != nil {
+		return priv, pub, err
+	}
+
+	priv = jose.JSONWebKey{Key: privKey, KeyID: kid, Algorithm: opts.Alg, Use: opts.Use}
+	pub = jose.JSONWebKey{KeyID: kid, Algorithm: opts.Alg, Use: opts.Use}
+	if IsSymmetric(opts.Alg) {
+		// go-jose considers no `oct` key valid, so only check it's one.
+		if _, ok := privKey.([]byte); !ok || pubKey != nil {
+			return priv, pub, errors.New("invalid keys were generated")
+		}
+		return priv, pub, nil
+	}
+	pub.Key = pubKey
+	if priv.IsPublic() || !pub.IsPublic() || !priv.Valid() || !pub.Valid() {
+		return priv, pub, errors.New("invalid keys were generated")
+	}
+	return priv, pub, nil
+}
+
+// RandomKeyID returns a random kid: 40 random bits, base32 encoded.
+func RandomKeyID() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(b), nil
+}
+
+// Sig generates a keypair for the given signature algorithm. The public
+// key is nil for HMAC algorithms, whose keys are symmetric. bits is only
+// used for RSA and HMAC keys; 0 picks the default size.
+func Sig(alg jose.SignatureAlgorithm, bits int) (crypto.PublicKey, crypto.PrivateKey, error) {
+	if err := (Spec{Use: "sig", Alg: string(alg), Bits: bits}).Validate(); err != nil {
+		return nil, nil, err
+	}
+	switch alg {
+	case jose.ES256:
+		// The cryptographic operations are implemented using constant-time algorithms.
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		return key.Public(), key, err
+	case jose.ES384:
+		// NB: The cryptographic operations do not use constant-time algorithms.
+		key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		return key.Public(), key, err
+	case jose.ES512:
+		// NB: The cryptographic operations do not use constant-time algorithms.
+		key, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		return key.Public(), key, err
+	case jose.EdDSA:
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		return pub, key, err
+	case ES256K:
+		return nil, nil, specError(ErrCurveUnsupported, "go-jose can't hold secp256k1 keys, use Secp256k1 instead")
+	case jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512:
+		if bits == 0 {
+			bits = 2048
+		}
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		return key.Public(), key, err
+	default:
+		// HMAC keys are as long as the hash unless asked for more.
+		if bits == 0 {
+			bits = map[jose.SignatureAlgorithm]int{jose.HS256: 256, jose.HS384: 384, jose.HS512: 512}[alg]
+		}
+		// Symmetric keys have no public half.
+		key, err := RandomKey(bits)
+		return nil, key, err
+	}
+}
+
+// wrapKeyBits is the key length of each AES key wrap algorithm.
+var wrapKeyBits = map[jose.KeyAlgorithm]int{
+	jose.A128KW:    128,
+	jose.A192KW:    192,
+	jose.A256KW:    256,
+	jose.A128GCMKW: 128,
+	jose.A256GCMKW: 256,
+}
+
+// Enc generates a keypair for the given key management algorithm. The
+// public key is nil for AES key wrap and dir, whose keys are symmetric.
+// bits is only used for RSA and dir keys and to pick the ECDH-ES curve; 0
+// picks the default.
+func Enc(alg jose.KeyAlgorithm, bits int) (crypto.PublicKey, crypto.PrivateKey, error) {
+	if err := (Spec{Use: "enc", Alg: string(alg), Bits: bits}).Validate(); err != nil {
+		return nil, nil, err
+	}
+	switch alg {
+	case jose.RSA1_5, jose.RSA_OAEP, jose.RSA_OAEP_256:
+		if bits == 0 {
+			bits = 2048
+		}
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		return key.Public(), key, err
+	case jose.ECDH_ES, jose.ECDH_ES_A128KW, jose.ECDH_ES_A192KW, jose.ECDH_ES_A256KW:
+		crv := map[int]elliptic.Curve{0: elliptic.P256(), 256: elliptic.P256(), 384: elliptic.P384(), 521: elliptic.P521()}[bits]
+		key, err := ecdsa.GenerateKey(crv, rand.Reader)
+		return key.Public(), key, err
+	case jose.A128KW, jose.A192KW, jose.A256KW, jose.A128GCMKW, jose.A256GCMKW:
+		key, err := RandomKey(wrapKeyBits[alg])
+		return nil, key, err
+	default:
+		// The dir key is the content encryption key: 256 bits suit A256GCM
+		// and A128CBC-HS256.
+		if bits == 0 {
+			bits = 256
+		}
+		key, err := RandomKey(bits)
+		return nil, key, err
+	}
+}
+
+// RandomKey returns a random symmetric key of the given length.
+func RandomKey(bits int) ([]byte, error) {
+	key := make([]byte, bits/8)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// IsSymmetric reports whether alg uses an `oct` key.
+func IsSymmetric(alg string) bool {
+	switch alg {
+	case string(jose.HS256), string(jose.HS384), string(jose.HS512),
+		string(jose.A128KW), string(jose.A192KW), string(jose.A256KW),
+		string(jose.A128GCMKW), string(jose.A256GCMKW), string(jose.DIRECT):
+		return true
+	}
+	return false
+}
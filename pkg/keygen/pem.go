@@ -0,0 +1,85 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keygen
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// MarshalPrivateKeyDER encodes an RSA, ECDSA or Ed25519 private key as
+// PKCS #8 DER.
+func MarshalPrivateKeyDER(priv crypto.PrivateKey) ([]byte, error) {
+	switch k := priv.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		return x509.MarshalPKCS8PrivateKey(k)
+	case ed25519.PrivateKey:
+		return MarshalEd25519PrivateKey(k)
+	default:
+		return nil, errors.New("Uknown private key type")
+	}
+}
+
+// MarshalPublicKeyDER encodes an RSA, ECDSA or Ed25519 public key as
+// SubjectPublicKeyInfo DER.
+func MarshalPublicKeyDER(pubKey crypto.PublicKey) ([]byte, error) {
+	switch k := pubKey.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return x509.MarshalPKIXPublicKey(k)
+	case ed25519.PublicKey:
+		return MarshalEd25519PublicKey(k)
+	default:
+		return nil, errors.New("Uknown public key type")
+	}
+}
+
+// MarshalPrivateKeyPEM encodes an RSA, ECDSA or Ed25519 private key as a
+// PKCS #8 PEM block.
+func MarshalPrivateKeyPEM(priv crypto.PrivateKey) ([]byte, error) {
+	der, err := MarshalPrivateKeyDER(priv)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = pem.Encode(&buf, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalPublicKeyPEM encodes an RSA, ECDSA or Ed25519 public key as a
+// SubjectPublicKeyInfo PEM block.
+func MarshalPublicKeyPEM(pubKey crypto.PublicKey) ([]byte, error) {
+	der, err := MarshalPublicKeyDER(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = pem.Encode(&buf, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
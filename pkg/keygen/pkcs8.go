@@ -0,0 +1,92 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keygen
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// oidEd25519 identifies Ed25519 keys in PKCS #8 and SubjectPublicKeyInfo
+// (RFC 8410). crypto/x509 only learned about them in Go 1.13, and then
+// returns crypto/ed25519 keys, which go-jose doesn't take, so they are
+// handled here.
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+type pkcs8Key struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+type publicKeyInfo struct {
+	Algo      pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// MarshalEd25519PrivateKey encodes an Ed25519 key as PKCS #8 (RFC 8410).
+func MarshalEd25519PrivateKey(k ed25519.PrivateKey) ([]byte, error) {
+	seed, err := asn1.Marshal(k.Seed())
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pkcs8Key{
+		Algo:       pkix.AlgorithmIdentifier{Algorithm: oidEd25519},
+		PrivateKey: seed,
+	})
+}
+
+// MarshalEd25519PublicKey encodes an Ed25519 key as SubjectPublicKeyInfo.
+func MarshalEd25519PublicKey(k ed25519.PublicKey) ([]byte, error) {
+	return asn1.Marshal(publicKeyInfo{
+		Algo:      pkix.AlgorithmIdentifier{Algorithm: oidEd25519},
+		PublicKey: asn1.BitString{Bytes: k, BitLength: 8 * len(k)},
+	})
+}
+
+// ParseEd25519PrivateKey decodes a PKCS #8 Ed25519 key. It returns nil
+// without an error if der holds another kind of key.
+func ParseEd25519PrivateKey(der []byte) (ed25519.PrivateKey, error) {
+	var k pkcs8Key
+	if _, err := asn1.Unmarshal(der, &k); err != nil || !k.Algo.Algorithm.Equal(oidEd25519) {
+		return nil, nil
+	}
+	var seed []byte
+	if _, err := asn1.Unmarshal(k.PrivateKey, &seed); err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid Ed25519 private key length")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParseEd25519PublicKey decodes an Ed25519 SubjectPublicKeyInfo. It
+// returns nil without an error if der holds another kind of key.
+func ParseEd25519PublicKey(der []byte) (ed25519.PublicKey, error) {
+	var k publicKeyInfo
+	if _, err := asn1.Unmarshal(der, &k); err != nil || !k.Algo.Algorithm.Equal(oidEd25519) {
+		return nil, nil
+	}
+	if len(k.PublicKey.Bytes) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 public key length")
+	}
+	return ed25519.PublicKey(k.PublicKey.Bytes), nil
+}
@@ -0,0 +1,37 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keygen
+
+import (
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// ES256K is the JWS algorithm for ECDSA on secp256k1 (RFC 8812), which
+// go-jose doesn't know.
+const ES256K = "ES256K"
+
+// Secp256k1 generates a secp256k1 keypair for ES256K. x and y are the
+// public point's coordinates and d the private scalar, each 32 bytes as in
+// a JWK. go-jose can't hold secp256k1 keys, so they are returned raw.
+func Secp256k1() (x, y, d []byte, err error) {
+	key, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pub := key.PubKey().SerializeUncompressed()
+	return pub[1:33], pub[33:], key.Serialize(), nil
+}
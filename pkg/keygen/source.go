@@ -0,0 +1,111 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keygen
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Clock tells the time. Embedders and tests pass their own to control the
+// times recorded in key sets and when rotations happen.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a function to a Clock.
+type ClockFunc func() time.Time
+
+// Now returns f().
+func (f ClockFunc) Now() time.Time { return f() }
+
+// SystemClock is the Clock of time.Now.
+var SystemClock Clock = ClockFunc(time.Now)
+
+// IDSource makes key IDs. Embedders and tests pass their own to control
+// the kid of generated keys.
+type IDSource interface {
+	NewID() (string, error)
+}
+
+// IDFunc adapts a function to an IDSource.
+type IDFunc func() (string, error)
+
+// NewID returns f().
+func (f IDFunc) NewID() (string, error) { return f() }
+
+// RandomIDs is the IDSource of RandomKeyID.
+var RandomIDs IDSource = IDFunc(RandomKeyID)
+
+// UUIDs is an IDSource of random (version 4) UUIDs.
+var UUIDs IDSource = IDFunc(func() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+})
+
+// ulidAlphabet is Crockford's base32, which ULIDs are written in.
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULIDs returns an IDSource of ULIDs: 48 bits of the millisecond of clock
+// and 80 random bits, so that they sort by when they were made.
+func ULIDs(clock Clock) IDSource {
+	return IDFunc(func() (string, error) {
+		var b [16]byte
+		ms := uint64(clock.Now().UnixNano() / int64(time.Millisecond))
+		binary.BigEndian.PutUint64(b[:8], ms<<16)
+		if _, err := rand.Read(b[6:]); err != nil {
+			return "", err
+		}
+		hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+		var s [26]byte
+		for i := len(s) - 1; i >= 0; i-- {
+			s[i] = ulidAlphabet[lo&31]
+			lo = lo>>5 | hi<<59
+			hi >>= 5
+		}
+		return string(s[:]), nil
+	})
+}
+
+// Timestamps returns an IDSource of the UTC second of clock, such as
+// 20190601T120000Z. Keys made within the same second get the same ID.
+func Timestamps(clock Clock) IDSource {
+	return IDFunc(func() (string, error) {
+		return clock.Now().UTC().Format("20060102T150405Z"), nil
+	})
+}
+
+// SequenceIDs is an IDSource of consecutive decimal numbers, starting at
+// Next. It is not safe for concurrent use.
+type SequenceIDs struct {
+	Next uint64
+}
+
+// NewID returns Next and increments it.
+func (s *SequenceIDs) NewID() (string, error) {
+	id := strconv.FormatUint(s.Next, 10)
+	s.Next++
+	return id, nil
+}
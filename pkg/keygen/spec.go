@@ -0,0 +1,179 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keygen
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// The reasons a Spec can be invalid. Validate returns them wrapped in a
+// *SpecError, whose Err field holds one of them.
+var (
+	ErrUnknownUse       = errors.New("unknown use")
+	ErrUnknownAlg       = errors.New("unknown alg")
+	ErrAlgUseMismatch   = errors.New("alg doesn't fit use")
+	ErrBitsUnsupported  = errors.New("unsupported key length")
+	ErrCurveUnsupported = errors.New("unsupported curve")
+)
+
+// SpecError is why a Spec is invalid.
+type SpecError struct {
+	// Err is one of the Err* values above.
+	Err error
+	// Reason describes the problem for people.
+	Reason string
+}
+
+func (e *SpecError) Error() string { return e.Reason }
+
+// Unwrap returns Err, so that errors.Is can match it.
+func (e *SpecError) Unwrap() error { return e.Err }
+
+func specError(err error, format string, args ...interface{}) *SpecError {
+	return &SpecError{Err: err, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Spec describes a key to generate, without generating it.
+type Spec struct {
+	// Use is "sig" or "enc".
+	Use string
+	// Alg is the JWS algorithm for "sig" keys, or the JWE key management
+	// algorithm for "enc" keys.
+	Alg string
+	// Bits is the key size; 0 picks the default. See Sig and Enc.
+	Bits int
+	// Curve is the curve of EC and OKP keys: P-256, P-384, P-521,
+	// secp256k1, Ed25519 or X25519. It is implied by the alg, except for ECDH-ES, where it
+	// picks the curve instead of Bits. "" picks the default.
+	Curve string
+}
+
+// algUse is the use of each supported alg.
+var algUse = map[string]string{
+	string(jose.ES256): "sig", string(jose.ES384): "sig", string(jose.ES512): "sig", string(jose.EdDSA): "sig", ES256K: "sig",
+	string(jose.RS256): "sig", string(jose.RS384): "sig", string(jose.RS512): "sig",
+	string(jose.PS256): "sig", string(jose.PS384): "sig", string(jose.PS512): "sig",
+	string(jose.HS256): "sig", string(jose.HS384): "sig", string(jose.HS512): "sig",
+	string(jose.RSA1_5): "enc", string(jose.RSA_OAEP): "enc", string(jose.RSA_OAEP_256): "enc",
+	string(jose.ECDH_ES): "enc", string(jose.ECDH_ES_A128KW): "enc", string(jose.ECDH_ES_A192KW): "enc", string(jose.ECDH_ES_A256KW): "enc",
+	string(jose.A128KW): "enc", string(jose.A192KW): "enc", string(jose.A256KW): "enc",
+	string(jose.A128GCMKW): "enc", string(jose.A256GCMKW): "enc", string(jose.DIRECT): "enc",
+}
+
+// algCurve is the curve each curve-bound alg implies.
+var algCurve = map[string]string{
+	string(jose.ES256): "P-256", string(jose.ES384): "P-384", string(jose.ES512): "P-521", string(jose.EdDSA): "Ed25519",
+	ES256K: "secp256k1",
+}
+
+// ecdhCurveBits maps the NIST curves ECDH-ES keys can be on to the Bits
+// that select them.
+var ecdhCurveBits = map[string]int{"P-256": 256, "P-384": 384, "P-521": 521}
+
+// Validate checks that s describes a key Sig, Enc, X25519 or Secp256k1 can
+// generate.
+// It is cheap, so embedders can check specs submitted to them before
+// spending any time on key generation.
+func (s Spec) Validate() error {
+	if s.Use != "sig" && s.Use != "enc" {
+		return specError(ErrUnknownUse, "unknown `use` %q, must be sig or enc", s.Use)
+	}
+	use, ok := algUse[s.Alg]
+	if !ok {
+		return specError(ErrUnknownAlg, "unknown `alg` for `use` = `%s`", s.Use)
+	}
+	if use != s.Use {
+		return specError(ErrAlgUseMismatch, "`alg` %s is for `use` = `%s`, not `%s`", s.Alg, use, s.Use)
+	}
+
+	switch alg := s.Alg; alg {
+	case string(jose.ES256), string(jose.ES384), string(jose.ES512), string(jose.EdDSA), ES256K:
+		if s.Curve != "" && s.Curve != algCurve[alg] {
+			return specError(ErrCurveUnsupported, "`alg` %s needs curve %s", alg, algCurve[alg])
+		}
+		keylen := map[string]int{
+			string(jose.ES256): 256,
+			string(jose.ES384): 384,
+			string(jose.ES512): 521, // sic!
+			string(jose.EdDSA): 256,
+			ES256K:             256,
+		}
+		if s.Bits != 0 && s.Bits != keylen[alg] {
+			return specError(ErrBitsUnsupported, "this `alg` does not support arbitrary key length")
+		}
+		return nil
+	case string(jose.ECDH_ES), string(jose.ECDH_ES_A128KW), string(jose.ECDH_ES_A192KW), string(jose.ECDH_ES_A256KW):
+		switch s.Curve {
+		case "":
+			switch s.Bits {
+			case 0, 256, 384, 521:
+				return nil
+			}
+			return specError(ErrBitsUnsupported, "unknown elliptic curve bit length, use one of 256, 384, 521")
+		case "X25519":
+			if s.Bits != 0 {
+				return specError(ErrBitsUnsupported, "X25519 keys have a fixed length")
+			}
+			return nil
+		}
+		bits, ok := ecdhCurveBits[s.Curve]
+		if !ok {
+			return specError(ErrCurveUnsupported, "unknown curve %q, use one of P-256, P-384, P-521, X25519", s.Curve)
+		}
+		if s.Bits != 0 && s.Bits != bits {
+			return specError(ErrBitsUnsupported, "%d bits don't match curve %s", s.Bits, s.Curve)
+		}
+		return nil
+	}
+
+	if s.Curve != "" {
+		return specError(ErrCurveUnsupported, "`alg` %s takes no curve", s.Alg)
+	}
+	switch alg := s.Alg; alg {
+	case string(jose.RS256), string(jose.RS384), string(jose.RS512), string(jose.PS256), string(jose.PS384), string(jose.PS512),
+		string(jose.RSA1_5), string(jose.RSA_OAEP), string(jose.RSA_OAEP_256):
+		if s.Bits != 0 && s.Bits < 2048 {
+			return specError(ErrBitsUnsupported, "too short key for RSA `alg`, 2048+ is required")
+		}
+	case string(jose.HS256), string(jose.HS384), string(jose.HS512):
+		// RFC 7518, section 3.2: the key must be at least as long as the hash.
+		minBits := map[string]int{
+			string(jose.HS256): 256,
+			string(jose.HS384): 384,
+			string(jose.HS512): 512,
+		}
+		if s.Bits != 0 && (s.Bits < minBits[alg] || s.Bits%8 != 0) {
+			return specError(ErrBitsUnsupported, "HMAC keys for this `alg` must be a multiple of 8 bits and %d+ long", minBits[alg])
+		}
+	case string(jose.A128KW), string(jose.A192KW), string(jose.A256KW), string(jose.A128GCMKW), string(jose.A256GCMKW):
+		if s.Bits != 0 && s.Bits != wrapKeyBits[jose.KeyAlgorithm(alg)] {
+			return specError(ErrBitsUnsupported, "this `alg` does not support arbitrary key length")
+		}
+	case string(jose.DIRECT):
+		// The key is the content encryption key, so its size depends on
+		// the `enc` it will be used with.
+		switch s.Bits {
+		case 0, 128, 192, 256, 384, 512:
+		default:
+			return specError(ErrBitsUnsupported, "unknown content encryption key length, use one of 128, 192, 256, 384, 512")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keygen
+
+import (
+	"crypto/rand"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// X25519 generates an X25519 keypair for ECDH-ES (RFC 8037). Both keys are
+// 32 bytes: the public key is the u-coordinate, the private key the scalar
+// before clamping. go-jose can't hold X25519 keys, so they are returned raw.
+func X25519() (pub, priv []byte, err error) {
+	var d, x [32]byte
+	if _, err := rand.Read(d[:]); err != nil {
+		return nil, nil, err
+	}
+	curve25519.ScalarBaseMult(&x, &d)
+	return x[:], d[:], nil
+}
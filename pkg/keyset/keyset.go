@@ -0,0 +1,275 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package keyset manages JSON Web Key Sets: adding keys, rotating to a new
+// key while the old ones stay published for a grace period, pruning old
+// keys and finding keys by their RFC 7638 thumbprint. A Set is safe for
+// concurrent use, so a server can rotate keys while serving them.
+package keyset
+
+import (
+	"crypto"
+	_ "crypto/sha1" // SHA-1 thumbprints
+	_ "crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"golang.org/x/crypto/ed25519"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// The reasons a key can't be added to a Set. Add and Rotate return them
+// wrapped in a *KeyError.
+var (
+	ErrDuplicateKeyID = errors.New("kid is already in the key set")
+	ErrDuplicateKey   = errors.New("key is already in the key set")
+)
+
+// KeyError is why a key couldn't be added.
+type KeyError struct {
+	// KeyID is the kid of the key already in the set.
+	KeyID string
+	// Err is ErrDuplicateKeyID or ErrDuplicateKey.
+	Err error
+}
+
+func (e *KeyError) Error() string { return fmt.Sprintf("%q: %s", e.KeyID, e.Err) }
+
+// Unwrap returns Err, so that errors.Is can match it.
+func (e *KeyError) Unwrap() error { return e.Err }
+
+// Entry is a key of a Set with its rotation history, which is what
+// Entries returns and Restore takes to persist a Set.
+type Entry struct {
+	Key   jose.JSONWebKey `json:"key"`
+	Added time.Time       `json:"added"`
+	// Retired is when a rotation replaced the key, zero if it is current.
+	Retired time.Time `json:"retired"`
+	// Expires is when a retired key is due to be pruned.
+	Expires time.Time `json:"expires"`
+}
+
+type entry struct {
+	Entry
+	// thumbprint is the SHA-256 thumbprint of the key.
+	thumbprint string
+}
+
+// Set is a JSON Web Key Set that remembers when each key was added and
+// retired.
+type Set struct {
+	mu      sync.RWMutex
+	entries []entry
+	// Clock tells when keys are added and retired, keygen.SystemClock if
+	// nil.
+	Clock keygen.Clock
+}
+
+// New returns a Set holding keys, as added now.
+func New(keys ...jose.JSONWebKey) (*Set, error) {
+	s := &Set{}
+	for _, k := range keys {
+		if err := s.Add(k); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Set) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock.Now()
+	}
+	return time.Now()
+}
+
+// Restore returns a Set holding entries, as returned by Entries.
+func Restore(entries ...Entry) (*Set, error) {
+	s := &Set{}
+	for _, e := range entries {
+		if err := s.add(e); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// add appends e, whose key must not be in the set. s.mu must be held.
+func (s *Set) add(e Entry) error {
+	tp, err := Thumbprint(&e.Key, crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	for _, have := range s.entries {
+		if e.Key.KeyID != "" && have.Key.KeyID == e.Key.KeyID {
+			return &KeyError{KeyID: e.Key.KeyID, Err: ErrDuplicateKeyID}
+		}
+		if have.thumbprint == tp {
+			return &KeyError{KeyID: have.Key.KeyID, Err: ErrDuplicateKey}
+		}
+	}
+	s.entries = append(s.entries, entry{Entry: e, thumbprint: tp})
+	return nil
+}
+
+// Add adds a key to the set. A private key is compared to the other keys
+// by its public half, so a key can't be added both as private and public
+// key.
+func (s *Set) Add(k jose.JSONWebKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(Entry{Key: k, Added: s.now()})
+}
+
+// Rotate adds next and retires the current keys with the same `use`: they
+// stay in the set for grace, so that tokens they signed can still be
+// verified and cached copies of the set still hold next once they expire,
+// and are then removed by Prune.
+func (s *Set) Rotate(next jose.JSONWebKey, grace time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.entries)
+	now := s.now()
+	if err := s.add(Entry{Key: next, Added: now}); err != nil {
+		return err
+	}
+	for i := range s.entries[:n] {
+		e := &s.entries[i]
+		if e.Retired.IsZero() && e.Key.Use == next.Use {
+			e.Retired, e.Expires = now, now.Add(grace)
+		}
+	}
+	return nil
+}
+
+// Prune removes retired keys whose grace period is over, and keys added
+// more than maxAge ago, except for the newest current key of each `use`,
+// so that the set is never left without a key to sign or encrypt with. A
+// maxAge of 0 only removes retired keys. It returns the removed keys.
+func (s *Set) Prune(maxAge time.Duration) []jose.JSONWebKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	newest := map[string]int{}
+	for i, e := range s.entries {
+		if j, ok := newest[e.Key.Use]; e.Retired.IsZero() && (!ok || !e.Added.Before(s.entries[j].Added)) {
+			newest[e.Key.Use] = i
+		}
+	}
+	var removed []jose.JSONWebKey
+	kept := s.entries[:0]
+	for i, e := range s.entries {
+		j, ok := newest[e.Key.Use]
+		tooOld := maxAge > 0 && now.Sub(e.Added) > maxAge && !(ok && j == i)
+		if (!e.Retired.IsZero() && !now.Before(e.Expires)) || tooOld {
+			removed = append(removed, e.Key)
+			continue
+		}
+		kept = append(kept, e)
+	}
+	s.entries = kept
+	return removed
+}
+
+// Find returns the key with the given base64url SHA-256 thumbprint.
+func (s *Set) Find(thumbprint string) (jose.JSONWebKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, e := range s.entries {
+		if e.thumbprint == thumbprint {
+			return e.Key, true
+		}
+	}
+	return jose.JSONWebKey{}, false
+}
+
+// Current returns the keys that are not retired.
+func (s *Set) Current() []jose.JSONWebKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []jose.JSONWebKey
+	for _, e := range s.entries {
+		if e.Retired.IsZero() {
+			keys = append(keys, e.Key)
+		}
+	}
+	return keys
+}
+
+// Entries returns a copy of every key in the set with its rotation
+// history, for Restore to pick up from.
+func (s *Set) Entries() []Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := make([]Entry, len(s.entries))
+	for i, e := range s.entries {
+		entries[i] = e.Entry
+	}
+	return entries
+}
+
+// KeySet returns a copy of every key in the set, retired ones included.
+func (s *Set) KeySet() jose.JSONWebKeySet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	set := jose.JSONWebKeySet{Keys: make([]jose.JSONWebKey, len(s.entries))}
+	for i, e := range s.entries {
+		set.Keys[i] = e.Key
+	}
+	return set
+}
+
+// Public returns a copy of the public halves of the keys in the set,
+// leaving out symmetric keys, which have none.
+func (s *Set) Public() jose.JSONWebKeySet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var set jose.JSONWebKeySet
+	for _, e := range s.entries {
+		if pub := e.Key.Public(); pub.Key != nil {
+			set.Keys = append(set.Keys, pub)
+		}
+	}
+	return set
+}
+
+// Thumbprint returns the base64url JWK thumbprint (RFC 7638) of a key
+// using hash. go-jose builds a malformed thumbprint input for Ed25519 keys
+// and none for symmetric keys, so those are done here.
+func Thumbprint(k *jose.JSONWebKey, hash crypto.Hash) (string, error) {
+	enc := base64.RawURLEncoding
+	var input string
+	switch key := k.Key.(type) {
+	case []byte:
+		input = fmt.Sprintf(`{"k":"%s","kty":"oct"}`, enc.EncodeToString(key))
+	case ed25519.PublicKey, ed25519.PrivateKey:
+		input = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`,
+			enc.EncodeToString(k.Public().Key.(ed25519.PublicKey)))
+	default:
+		sum, err := k.Thumbprint(hash)
+		if err != nil {
+			return "", err
+		}
+		return enc.EncodeToString(sum), nil
+	}
+	h := hash.New()
+	h.Write([]byte(input))
+	return enc.EncodeToString(h.Sum(nil)), nil
+}
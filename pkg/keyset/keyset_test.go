@@ -0,0 +1,92 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keyset
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestPrune(t *testing.T) {
+	start := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	tests := []struct {
+		name   string
+		maxAge time.Duration
+		// b and c are how many days after start the keys "b" and "c" are
+		// rotated to, -1 for not at all.
+		b, c  int
+		grace time.Duration
+		at    int
+		want  []string
+	}{
+		{"only key past max age", 30 * day, -1, -1, 0, 100, []string{"a"}},
+		{"current key past max age", 30 * day, 10, -1, 90 * day, 100, []string{"b"}},
+		{"every key past max age", 30 * day, 10, 20, 90 * day, 100, []string{"c"}},
+		{"grace over", 0, 10, -1, 5 * day, 16, []string{"b"}},
+		{"in grace", 0, 10, -1, 5 * day, 14, []string{"a", "b"}},
+		{"no max age", 0, -1, -1, 0, 1000, []string{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := start
+			s := &Set{Clock: keygen.ClockFunc(func() time.Time { return now })}
+			key := func(kid string) jose.JSONWebKey {
+				k, _, err := keygen.Generate(keygen.Options{Use: "sig", Alg: "ES256", KeyID: kid})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return k
+			}
+			if err := s.Add(key("a")); err != nil {
+				t.Fatal(err)
+			}
+			rotations := []struct {
+				kid  string
+				days int
+			}{{"b", tt.b}, {"c", tt.c}}
+			for _, r := range rotations {
+				if r.days < 0 {
+					continue
+				}
+				now = start.Add(time.Duration(r.days) * day)
+				if err := s.Rotate(key(r.kid), tt.grace); err != nil {
+					t.Fatal(err)
+				}
+			}
+			now = start.Add(time.Duration(tt.at) * day)
+			s.Prune(tt.maxAge)
+			var got []string
+			for _, e := range s.Entries() {
+				got = append(got, e.Key.KeyID)
+			}
+			sort.Strings(got)
+			if len(got) != len(tt.want) {
+				t.Fatalf("kept %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("kept %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
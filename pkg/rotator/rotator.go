@@ -0,0 +1,227 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package rotator keeps a key set rotated: it generates a new key once
+// the current one is due for rotation, keeps the old keys published for a
+// grace period and prunes them afterwards. Where the key set lives is up
+// to a Storage, so that the same logic can keep keys in a file, a
+// key-value store or a Kubernetes Secret, and RunLeaderElected lets
+// several replicas share the work without racing each other.
+package rotator
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"github.com/nicksherron/jwk-keygen/pkg/keyset"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// DefaultInterval is how often Run checks the key set if the Rotator has
+// no Interval.
+const DefaultInterval = time.Minute
+
+// releaseTimeout bounds how long WhileLeader waits for a lock to be
+// released.
+const releaseTimeout = 10 * time.Second
+
+// Storage holds the key set between checks.
+type Storage interface {
+	// Load returns the stored keys, none if nothing was saved yet.
+	Load(ctx context.Context) ([]keyset.Entry, error)
+	// Save replaces the stored keys.
+	Save(ctx context.Context, entries []keyset.Entry) error
+}
+
+// Lock is a leader election lock, such as a Kubernetes Lease.
+type Lock interface {
+	// Acquire blocks until the lock is held or ctx is done. The returned
+	// context is derived from ctx and is done once the lock is lost.
+	Acquire(ctx context.Context) (context.Context, error)
+	// Release gives the lock up.
+	Release(ctx context.Context) error
+}
+
+// Policy describes the keys to keep and when to rotate them.
+type Policy struct {
+	// Use, Alg, Bits and Curve describe the keys as keygen.Options do.
+	Use   string
+	Alg   string
+	Bits  int
+	Curve string
+	// RotateAfter is the age at which the current key is replaced.
+	RotateAfter time.Duration
+	// Grace is how long replaced keys stay in the set.
+	Grace time.Duration
+	// MaxAge removes keys older than this, if set, whether or not they
+	// were replaced, except for the current key, see keyset.Set.Prune.
+	MaxAge time.Duration
+}
+
+// Rotator applies a Policy to the key set in a Storage.
+type Rotator struct {
+	Storage Storage
+	Policy  Policy
+	// Interval is how often Run checks the key set, DefaultInterval if 0.
+	Interval time.Duration
+	// Clock tells when keys are due and is recorded in the key set,
+	// keygen.SystemClock if nil.
+	Clock keygen.Clock
+	// IDs makes the kid of new keys, keygen.RandomIDs if nil.
+	IDs keygen.IDSource
+	// OnRotate, if set, is called with the new key after each rotation
+	// has been saved.
+	OnRotate func(key jose.JSONWebKey)
+	// Logf, if set, is called with the errors Run carries on after.
+	Logf func(format string, args ...interface{})
+}
+
+// New returns a Rotator for storage and policy, checking that keygen can
+// generate the keys policy asks for.
+func New(storage Storage, policy Policy) (*Rotator, error) {
+	if storage == nil {
+		return nil, errors.New("rotator: no storage")
+	}
+	if policy.RotateAfter <= 0 {
+		return nil, errors.New("rotator: RotateAfter must be positive")
+	}
+	spec := keygen.Spec{Use: policy.Use, Alg: policy.Alg, Bits: policy.Bits, Curve: policy.Curve}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return &Rotator{Storage: storage, Policy: policy}, nil
+}
+
+func (r *Rotator) now() time.Time {
+	if r.Clock != nil {
+		return r.Clock.Now()
+	}
+	return time.Now()
+}
+
+// due reports whether the set has no current key for the policy's `use`,
+// or only ones older than RotateAfter.
+func (r *Rotator) due(set *keyset.Set) bool {
+	now := r.now()
+	for _, e := range set.Entries() {
+		if e.Retired.IsZero() && e.Key.Use == r.Policy.Use && now.Sub(e.Added) < r.Policy.RotateAfter {
+			return false
+		}
+	}
+	return true
+}
+
+// RotateOnce loads the key set, prunes it, rotates it if it is due and
+// saves it if anything changed. It reports whether a new key was added.
+func (r *Rotator) RotateOnce(ctx context.Context) (bool, error) {
+	entries, err := r.Storage.Load(ctx)
+	if err != nil {
+		return false, err
+	}
+	set, err := keyset.Restore(entries...)
+	if err != nil {
+		return false, err
+	}
+	set.Clock = keygen.ClockFunc(r.now)
+
+	changed := len(set.Prune(r.Policy.MaxAge)) > 0
+	var next jose.JSONWebKey
+	rotated := r.due(set)
+	if rotated {
+		next, _, err = keygen.Generate(keygen.Options{
+			Use:         r.Policy.Use,
+			Alg:         r.Policy.Alg,
+			Bits:        r.Policy.Bits,
+			Curve:       r.Policy.Curve,
+			RandomKeyID: true,
+			IDs:         r.IDs,
+		})
+		if err != nil {
+			return false, err
+		}
+		if err := set.Rotate(next, r.Policy.Grace); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+	if err := r.Storage.Save(ctx, set.Entries()); err != nil {
+		return false, err
+	}
+	if rotated && r.OnRotate != nil {
+		r.OnRotate(next)
+	}
+	return rotated, nil
+}
+
+// Run calls RotateOnce every Interval until ctx is done, which is the
+// error it returns. Failed checks are passed to Logf and retried at the
+// next interval.
+func (r *Rotator) Run(ctx context.Context) error {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.RotateOnce(ctx); err != nil && ctx.Err() == nil && r.Logf != nil {
+			r.Logf("rotator: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunLeaderElected runs the Rotator only while lock is held, so that of
+// several replicas only one rotates at a time. When the lock is lost it
+// waits to acquire it again. It returns when ctx is done or Acquire
+// fails.
+func (r *Rotator) RunLeaderElected(ctx context.Context, lock Lock) error {
+	return WhileLeader(ctx, lock, r.Logf, r.Run)
+}
+
+// WhileLeader calls run with the context Acquire returns each time lock
+// is acquired, and releases lock once run returns, for programs that do
+// more than run one Rotator while they lead. Errors releasing the lock
+// are passed to logf, if set. It returns when ctx is done or Acquire
+// fails.
+func WhileLeader(ctx context.Context, lock Lock, logf func(format string, args ...interface{}), run func(context.Context) error) error {
+	for {
+		lead, err := lock.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		run(lead)
+
+		rctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+		err = lock.Release(rctx)
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && logf != nil {
+			logf("rotator: can't release lock: %s", err)
+		}
+	}
+}
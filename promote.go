@@ -0,0 +1,147 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+)
+
+var (
+	promoteCmd     = app.Command("promote", "Copy public keys from one environment's key set to another's, renaming their kid")
+	promoteFrom    = promoteCmd.Flag("from", "Key set to copy keys from").Required().String()
+	promoteTo      = promoteCmd.Flag("to", "Key set to copy keys to").Required().String()
+	promoteKids    = promoteCmd.Flag("kid", "Only copy the key with this kid (repeatable; default all)").Strings()
+	promoteRekid   = promoteCmd.Flag("rekid", "Template for the new kid: {kid} is the old kid, {n} the next free number").Default("{kid}").String()
+	promotePrefix  = promoteCmd.Flag("strip-prefix", "Remove this prefix from the old kid before it is used as {kid}").String()
+	promoteInPlace = promoteCmd.Flag("in-place", "Update --to instead of printing the result").Bool()
+	promoteFormat  = promoteCmd.Flag("format", "Out JSON with format").Bool()
+)
+
+// publicMembers identify the key material of a public key, regardless of
+// its kid and other metadata.
+var publicMembers = []string{"kty", "crv", "x", "y", "n", "e"}
+
+func sameKeyMaterial(a, b safeio.RawKey) bool {
+	for _, m := range publicMembers {
+		if !bytes.Equal(a[m], b[m]) {
+			return false
+		}
+	}
+	return true
+}
+
+// rekid renders the --rekid template for one key, picking the lowest {n}
+// that gives a kid not in taken.
+func rekid(template, oldKid string, taken map[string]bool) string {
+	name := strings.Replace(template, "{kid}", strings.TrimPrefix(oldKid, *promotePrefix), -1)
+	if !strings.Contains(name, "{n}") {
+		return name
+	}
+	for n := 1; ; n++ {
+		candidate := strings.Replace(name, "{n}", strconv.Itoa(n), -1)
+		if !taken[candidate] {
+			return candidate
+		}
+	}
+}
+
+func promote() {
+	from, err := readRawJWKS(*promoteFrom, false)
+	app.FatalIfError(err, "can't read key set %s", *promoteFrom)
+	to, err := readRawJWKS(*promoteTo, false)
+	app.FatalIfError(err, "can't read key set %s", *promoteTo)
+
+	wanted := map[string]bool{}
+	for _, k := range *promoteKids {
+		wanted[k] = true
+	}
+	found := map[string]bool{}
+	taken := map[string]bool{}
+	for _, k := range to.Keys {
+		taken[k.Kid()] = true
+	}
+
+	existing := to.Keys
+	var promoted []string
+	var done []safeio.RawKey
+next:
+	for _, k := range from.Keys {
+		if len(*promoteKids) > 0 && !wanted[k.Kid()] {
+			continue
+		}
+		found[k.Kid()] = true
+		// Only the public half ever leaves the source environment.
+		pub, ok := k.Public()
+		if !ok {
+			app.Fatalf("key %q is symmetric and can't be promoted without moving its secret", k.Kid())
+		}
+		// A private key set usually holds each key's public half as well.
+		for _, d := range done {
+			if sameKeyMaterial(pub, d) {
+				continue next
+			}
+		}
+		for _, e := range existing {
+			if sameKeyMaterial(pub, e) {
+				app.Fatalf("key %q is already in %s as %q", k.Kid(), *promoteTo, e.Kid())
+			}
+		}
+		newKid := rekid(*promoteRekid, k.Kid(), taken)
+		if newKid == "" || taken[newKid] {
+			app.Fatalf("kid %q is already used in %s", newKid, *promoteTo)
+		}
+		taken[newKid] = true
+		kidJS, err := json.Marshal(newKid)
+		app.FatalIfError(err, "can't Marshal kid")
+		pub["kid"] = kidJS
+		to.Keys = append(to.Keys, pub)
+		done = append(done, pub)
+		promoted = append(promoted, fmt.Sprintf("Promoted %q as %q", k.Kid(), newKid))
+	}
+	for _, k := range *promoteKids {
+		if !found[k] {
+			app.Fatalf("no key with kid %q in %s", k, *promoteFrom)
+		}
+	}
+	if len(promoted) == 0 {
+		app.Fatalf("%s holds no keys to promote", *promoteFrom)
+	}
+	for _, msg := range promoted {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+
+	if !*promoteInPlace {
+		printRawJWKS(to, *promoteFormat)
+		return
+	}
+	out, err := json.Marshal(to)
+	app.FatalIfError(err, "can't Marshal key set to JSON")
+	if *promoteFormat {
+		out = formatJSON(out)
+	}
+	fi, err := os.Stat(*promoteTo)
+	app.FatalIfError(err, "can't stat %s", *promoteTo)
+	fatalIfStaged(pending.replace(*promoteTo, "key set", out, fi.Mode().Perm()), "can't write %s", *promoteTo)
+	app.FatalIfError(pending.commit(), "can't write %s", *promoteTo)
+}
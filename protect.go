@@ -0,0 +1,156 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	passphrase     = app.Flag("passphrase", "Passphrase protecting private keys; visible to other users in the process list, prefer --passphrase-file").String()
+	passphraseFile = app.Flag("passphrase-file", "Read the passphrase protecting private keys from FILE").PlaceHolder("FILE").String()
+	p12PassFile    = app.Flag("p12-passphrase-file", "Read the passphrase protecting --p12 bundles from FILE, if not that of the private keys").PlaceHolder("FILE").String()
+	passphraseAlg  = generateCmd.Flag("passphrase-alg", "PBES2 algorithm to protect private keys with, with --passphrase or --passphrase-file").Default(string(jose.PBES2_HS256_A128KW)).Enum(
+		string(jose.PBES2_HS256_A128KW), string(jose.PBES2_HS384_A192KW), string(jose.PBES2_HS512_A256KW))
+)
+
+const (
+	// pbes2Count is the PBKDF2 iteration count protected keys are
+	// written with.
+	pbes2Count = 600000
+	// maxPBES2Count bounds the iteration count of protected keys being
+	// read, which is otherwise up to whoever wrote them.
+	maxPBES2Count = 10 * pbes2Count
+)
+
+// outputPassphrase, when set, makes generate write private JWKs and JWKSs
+// as JWEs encrypted with it.
+var outputPassphrase string
+
+// p12Passphrase protects --p12 bundles, which can't be written without one.
+var p12Passphrase string
+
+// readP12Passphrase sets p12Passphrase to the one of --p12-passphrase-file,
+// or else that of the other outputs, or else the one given at the prompt.
+func readP12Passphrase() error {
+	if *p12PassFile == "" && outputPassphrase != "" {
+		p12Passphrase = outputPassphrase
+		return nil
+	}
+	var pass string
+	var err error
+	if *p12PassFile != "" {
+		pass, err = readSecretFile(*p12PassFile)
+	} else {
+		pass, err = readPassphrase()
+	}
+	if err != nil {
+		return err
+	}
+	if pass == "" {
+		return errors.New("empty passphrase")
+	}
+	p12Passphrase = pass
+	return nil
+}
+
+// readPassphrase returns the passphrase given with --passphrase or
+// --passphrase-file, prompting for it if neither is.
+func readPassphrase() (string, error) {
+	switch {
+	case *passphrase != "" && *passphraseFile != "":
+		return "", errors.New("can't combine --passphrase and --passphrase-file")
+	case *passphrase != "":
+		warnArgvSecret("--passphrase", "--passphrase-file or the prompt")
+		return *passphrase, nil
+	case *passphraseFile != "":
+		return readSecretFile(*passphraseFile)
+	}
+	return promptSecret("Passphrase")
+}
+
+// protectKey encrypts a private JWK or JWKS as a compact JWE (RFC 7517,
+// section 7) with a PBES2 key derived from pass.
+func protectKey(plaintext []byte, cty, pass string) ([]byte, error) {
+	rcpt := jose.Recipient{Algorithm: jose.KeyAlgorithm(*passphraseAlg), Key: []byte(pass), PBES2Count: pbes2Count}
+	opts := (&jose.EncrypterOptions{}).WithContentType(jose.ContentType(cty))
+	enc, err := jose.NewEncrypter(jose.A256GCM, rcpt, opts)
+	if err != nil {
+		return nil, err
+	}
+	jwe, err := enc.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	s, err := jwe.CompactSerialize()
+	return []byte(s), err
+}
+
+// pbes2Header returns the protected header of b if it is a compact JWE
+// encrypted with a passphrase.
+func pbes2Header(b []byte) (map[string]interface{}, bool) {
+	b = bytes.TrimSpace(b)
+	if bytes.Count(b, []byte(".")) != 4 {
+		return nil, false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(string(b[:bytes.IndexByte(b, '.')]))
+	if err != nil {
+		return nil, false
+	}
+	var header map[string]interface{}
+	if json.Unmarshal(raw, &header) != nil {
+		return nil, false
+	}
+	alg, _ := header["alg"].(string)
+	return header, strings.HasPrefix(alg, "PBES2-")
+}
+
+// unprotectKey decrypts b if it is a passphrase-protected key, and returns
+// it unchanged otherwise.
+func unprotectKey(b []byte, filename string) ([]byte, error) {
+	header, ok := pbes2Header(b)
+	if !ok {
+		return b, nil
+	}
+	if p2c, _ := header["p2c"].(float64); p2c > maxPBES2Count {
+		return nil, fmt.Errorf("%s is protected with %.0f PBES2 iterations, more than the %d allowed", filename, p2c, maxPBES2Count)
+	}
+	pass, err := readPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	if pass == "" {
+		return nil, fmt.Errorf("%s is passphrase-protected, pass --passphrase-file", filename)
+	}
+	jwe, err := jose.ParseEncrypted(string(bytes.TrimSpace(b)))
+	if err != nil {
+		return nil, err
+	}
+	debugf("decrypting %s", filename)
+	plaintext, err := jwe.Decrypt([]byte(pass))
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt %s, wrong passphrase?", filename)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,183 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	provisionCmd      = app.Command("provision", "Generate per-device EC keys and CA-signed certificates for a device fleet")
+	provisionDevices  = provisionCmd.Arg("devices", "Device IDs").Strings()
+	provisionFile     = provisionCmd.Flag("devices-file", "Read device IDs from FILE, one per line").PlaceHolder("FILE").String()
+	provisionCACert   = provisionCmd.Flag("ca-cert", "PEM certificate of the issuing CA").Required().String()
+	provisionCAKey    = provisionCmd.Flag("ca-key", "PEM private key of the issuing CA").Required().String()
+	provisionAlg      = provisionCmd.Flag("alg", "Device key algorithm").Default(string(jose.ES256)).Enum(string(jose.ES256), string(jose.ES384))
+	provisionValidity = provisionCmd.Flag("validity", "Lifetime of the device certificates, e.g. 365d").Default("365d").String()
+	provisionOutDir   = provisionCmd.Flag("out-dir", "Directory to write the device files and manifest to").Default(".").String()
+	provisionFormat   = provisionCmd.Flag("format", "Out JSON with format").Bool()
+)
+
+// deviceID keeps device IDs usable as file names.
+var deviceID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ProvisionedDevice is a manifest entry mapping a device to its key.
+type ProvisionedDevice struct {
+	DeviceID      string    `json:"device_id"`
+	KeyID         string    `json:"kid"`
+	Algorithm     string    `json:"alg"`
+	Serial        string    `json:"serial"`
+	NotAfter      time.Time `json:"not_after"`
+	PublicKeyFile string    `json:"public_key_file"`
+	KeyFile       string    `json:"key_file"`
+	CertFile      string    `json:"cert_file"`
+}
+
+// provisionDevice generates a key for one device and a certificate for it
+// signed by the CA, returning the private JWK with the chain in x5c.
+func provisionDevice(id string, ca *x509.Certificate, caKey interface{}, validity time.Duration) (jose.JSONWebKey, *x509.Certificate, error) {
+	curve := elliptic.P256()
+	if *provisionAlg == string(jose.ES384) {
+		curve = elliptic.P384()
+	}
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return jose.JSONWebKey{}, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return jose.JSONWebKey{}, nil, err
+	}
+	now := timestamp()
+	notAfter := now.Add(validity)
+	if notAfter.After(ca.NotAfter) {
+		// Outliving the CA would only make the chain invalid earlier than
+		// the certificate says.
+		notAfter = ca.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: id},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+	if err != nil {
+		return jose.JSONWebKey{}, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return jose.JSONWebKey{}, nil, err
+	}
+	jwk := jose.JSONWebKey{
+		Key:          key,
+		KeyID:        id,
+		Algorithm:    *provisionAlg,
+		Use:          "sig",
+		Certificates: []*x509.Certificate{cert, ca},
+	}
+	return jwk, cert, nil
+}
+
+func provision() {
+	ids := *provisionDevices
+	if *provisionFile != "" {
+		fromFile, err := readLines(*provisionFile)
+		app.FatalIfError(err, "can't read --devices-file")
+		ids = append(ids, fromFile...)
+	}
+	if len(ids) == 0 {
+		app.FatalUsage("no device IDs given")
+	}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if !deviceID.MatchString(id) {
+			app.Fatalf("invalid device ID %q: use letters, digits, '.', '_' and '-'", id)
+		}
+		if seen[id] {
+			app.Fatalf("device ID %q is given twice", id)
+		}
+		seen[id] = true
+	}
+
+	validity, err := parseDuration(*provisionValidity)
+	app.FatalIfError(err, "invalid --validity")
+	caCerts, err := readCertificatesPEM(*provisionCACert)
+	app.FatalIfError(err, "can't read CA certificate")
+	caKey, err := readPrivateKeyPEM(*provisionCAKey)
+	app.FatalIfError(err, "can't read CA key")
+
+	var manifest []ProvisionedDevice
+	for _, id := range ids {
+		priv, cert, err := provisionDevice(id, caCerts[0], caKey, validity)
+		fatalIfStaged(err, "can't provision device %s", id)
+		pub := priv.Public()
+
+		name := filepath.Join(*provisionOutDir, "device_"+id)
+		pubJS, err := pub.MarshalJSON()
+		fatalIfStaged(err, "can't Marshal public key to JSON")
+		privJS, err := priv.MarshalJSON()
+		fatalIfStaged(err, "can't Marshal private key to JSON")
+		if *provisionFormat {
+			pubJS = formatJSON(pubJS)
+			privJS = formatJSON(privJS)
+		}
+		var chain []byte
+		for _, c := range priv.Certificates {
+			chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+		}
+
+		fatalIfStaged(pending.add(name+"-pub.json", "public key with JWK", pubJS, 0444), "can't write %s-pub.json", name)
+		fatalIfStaged(pending.add(name+".json", "private key with JWK", privJS, 0400), "can't write %s.json", name)
+		fatalIfStaged(pending.add(name+".crt", "certificate chain", chain, 0444), "can't write %s.crt", name)
+		manifest = append(manifest, ProvisionedDevice{
+			DeviceID:      id,
+			KeyID:         priv.KeyID,
+			Algorithm:     priv.Algorithm,
+			Serial:        fmt.Sprintf("%x", cert.SerialNumber),
+			NotAfter:      cert.NotAfter.UTC(),
+			PublicKeyFile: name + "-pub.json",
+			KeyFile:       name + ".json",
+			CertFile:      name + ".crt",
+		})
+	}
+
+	b, err := json.Marshal(manifest)
+	fatalIfStaged(err, "can't Marshal manifest to JSON")
+	if *provisionFormat {
+		b = formatJSON(b)
+	}
+	manifestFile := filepath.Join(*provisionOutDir, "manifest.json")
+	fatalIfStaged(pending.add(manifestFile, "device manifest", b, 0444), "can't write %s", manifestFile)
+	// Either every device is provisioned or none is.
+	app.FatalIfError(pending.commit(), "can't write device files")
+}
@@ -0,0 +1,224 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+)
+
+var (
+	publishCmd         = app.Command("publish", "Publish the public keys of a JWK or JWKS")
+	publishIn          = publishCmd.Arg("keys", "JWK or JWKS to publish (- for stdin); private members are dropped").Required().String()
+	publishIssuer      = publishCmd.Flag("issuer", "Issuer the keys belong to").String()
+	publishRegion      = publishCmd.Flag("region", "AWS region").Envar("AWS_REGION").String()
+	publishS3          = publishCmd.Flag("s3", "Upload .well-known/jwks.json and .well-known/openid-configuration under s3://BUCKET/PREFIX").PlaceHolder("s3://BUCKET/PREFIX").String()
+	publishS3Endpnt    = publishCmd.Flag("s3-endpoint", "Endpoint of an S3-compatible store, addressed path-style").String()
+	publishCFKV        = publishCmd.Flag("cloudflare-kv", "Write the key set to Workers KV under NAMESPACE_ID:KEY").PlaceHolder("NAMESPACE_ID:KEY").String()
+	publishCFAccount   = publishCmd.Flag("cloudflare-account", "Cloudflare account ID").Envar("CLOUDFLARE_ACCOUNT_ID").String()
+	publishCFTokenFile = publishCmd.Flag("cloudflare-token-file", "Read the Cloudflare API token from FILE instead of CLOUDFLARE_API_TOKEN").PlaceHolder("FILE").String()
+	publishCFAPI       = publishCmd.Flag("cloudflare-api", "Cloudflare API base URL").Default("https://api.cloudflare.com/client/v4").String()
+	publishRedis       = publishCmd.Flag("redis", "Write the key set to Redis at redis://[:PASSWORD@]HOST[:PORT][/DB] or rediss://").String()
+	publishEtcd        = publishCmd.Flag("etcd", "Write the key set to etcd through the gateway at http(s)://HOST:PORT").String()
+	publishConsul      = publishCmd.Flag("consul", "Write the key set to Consul KV through the agent at http(s)://HOST:PORT").String()
+	publishKVKey       = publishCmd.Flag("kv-key", "Key to write the key set under in Redis, etcd or Consul").Default("jwks").String()
+	publishTTL         = publishCmd.Flag("ttl", "Expire the key set in Redis or etcd after this long, e.g. 24h or 7d").String()
+	publishMerge       = publishCmd.Flag("merge", "Keep keys of the set already in S3, Redis, etcd or Consul whose kid is not being published").Bool()
+	publishLambdaEnv   = publishCmd.Flag("lambda-env", "Print the keys as Lambda authorizer environment config").Bool()
+	publishFormat      = publishCmd.Flag("format", "Out JSON with format").Bool()
+)
+
+// lambdaEnvLimit is the most Lambda allows for all environment variables
+// of a function together.
+const lambdaEnvLimit = 4096
+
+// publicKeySet reads a JWK or JWKS and returns the key set to publish,
+// without private members or symmetric keys.
+func publicKeySet(filename string) (*safeio.RawKeySet, error) {
+	b, err := readInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := safeio.ParseRawKeys(b, inputLimits())
+	if err != nil {
+		return nil, err
+	}
+	set := &safeio.RawKeySet{}
+	for _, k := range keys {
+		if pub, ok := k.Public(); ok {
+			set.Keys = append(set.Keys, pub)
+		}
+	}
+	if len(set.Keys) == 0 {
+		return nil, errors.New("no public keys found")
+	}
+	return set, nil
+}
+
+// openIDConfiguration is the subset of OpenID Provider Metadata that JWT
+// authorizers (API Gateway, Cognito-style consumers) need to find the keys.
+func openIDConfiguration(issuer string, set *safeio.RawKeySet) ([]byte, error) {
+	algs := []string{}
+	for _, k := range set.Keys {
+		if k.Use() != "enc" && k.Alg() != "" {
+			algs = append(algs, k.Alg())
+		}
+	}
+	return json.Marshal(map[string]interface{}{
+		"issuer":                                issuer,
+		"jwks_uri":                              strings.TrimSuffix(issuer, "/") + "/.well-known/jwks.json",
+		"id_token_signing_alg_values_supported": algs,
+		"response_types_supported":              []string{"id_token"},
+		"subject_types_supported":               []string{"public"},
+	})
+}
+
+// publishToS3 lays the keys out under the prefix the way Cognito user pools
+// serve theirs, so the prefix URL works as the issuer of an API Gateway JWT
+// authorizer. The key set is written like those of Redis, etcd and Consul,
+// with the ETag of the object as the version its compare-and-set checks.
+func publishToS3(target string, set *safeio.RawKeySet) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return "", fmt.Errorf("invalid S3 target %q, want s3://BUCKET/PREFIX", target)
+	}
+	if *publishRegion == "" {
+		return "", errors.New("--region (or AWS_REGION) is required for S3")
+	}
+	creds, err := awsCredentialsFromEnv()
+	if err != nil {
+		return "", err
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	obj := func(name string) s3Object {
+		return s3Object{Region: *publishRegion, Endpoint: *publishS3Endpnt, Bucket: u.Host, Key: prefix + name}
+	}
+
+	issuer := *publishIssuer
+	if issuer == "" {
+		issuer = strings.TrimSuffix(obj("").URL(), "/")
+	}
+	config, err := openIDConfiguration(issuer, set)
+	if err != nil {
+		return "", err
+	}
+	store := &s3Store{obj: obj, creds: creds}
+	if err := publishToKV(store, ".well-known/jwks.json", set, *publishMerge, 0); err != nil {
+		return "", err
+	}
+	if err := s3Put(obj(".well-known/openid-configuration"), config, "application/json", creds); err != nil {
+		return "", err
+	}
+	return issuer, nil
+}
+
+func lambdaEnv(jwks []byte, issuer string) ([]byte, error) {
+	vars := map[string]string{"JWKS": string(jwks)}
+	if issuer != "" {
+		vars["JWT_ISSUER"] = issuer
+	}
+	if *publishRegion != "" {
+		// AWS_REGION is reserved inside Lambda.
+		vars["JWT_REGION"] = *publishRegion
+	}
+	size := 0
+	for k, v := range vars {
+		size += len(k) + len(v)
+	}
+	if size > lambdaEnvLimit {
+		return nil, fmt.Errorf("the keys take %d bytes, more than the %d Lambda allows for environment variables; publish to S3 and pass the issuer instead", size, lambdaEnvLimit)
+	}
+	return json.Marshal(map[string]interface{}{"Variables": vars})
+}
+
+func publish() {
+	set, err := publicKeySet(*publishIn)
+	app.FatalIfError(err, "can't read keys")
+	jwks, err := json.Marshal(set)
+	app.FatalIfError(err, "can't Marshal key set to JSON")
+
+	if *publishMerge && *publishS3 == "" && *publishRedis == "" && *publishEtcd == "" && *publishConsul == "" {
+		app.FatalUsage("--merge only applies to --s3, --redis, --etcd and --consul")
+	}
+	published := false
+	issuer := *publishIssuer
+	if *publishS3 != "" {
+		issuer, err = publishToS3(*publishS3, set)
+		app.FatalIfError(err, "can't publish to S3")
+		fmt.Printf("Published key set to %s with issuer %s\n", *publishS3, issuer)
+		published = true
+	}
+	if *publishCFKV != "" {
+		app.FatalIfError(publishToCloudflareKV(*publishCFKV, jwks), "can't publish to Workers KV")
+		fmt.Printf("Published key set to Workers KV %s\n", *publishCFKV)
+		published = true
+	}
+	if *publishRedis != "" || *publishEtcd != "" || *publishConsul != "" {
+		var ttl time.Duration
+		if *publishTTL != "" {
+			ttl, err = parseDuration(*publishTTL)
+			app.FatalIfError(err, "invalid --ttl")
+		}
+		if *publishRedis != "" {
+			if u, err := url.Parse(*publishRedis); err == nil {
+				if _, ok := u.User.Password(); ok {
+					warnArgvSecret("--redis", "REDIS_PASSWORD")
+				}
+			}
+			store, err := dialRedis(*publishRedis)
+			app.FatalIfError(err, "can't connect to Redis")
+			app.FatalIfError(publishToKV(store, *publishKVKey, set, *publishMerge, ttl), "can't publish to Redis")
+			fmt.Printf("Published key set to Redis key %s\n", *publishKVKey)
+		}
+		if *publishEtcd != "" {
+			store, err := dialEtcd(*publishEtcd)
+			app.FatalIfError(err, "can't connect to etcd")
+			app.FatalIfError(publishToKV(store, *publishKVKey, set, *publishMerge, ttl), "can't publish to etcd")
+			fmt.Printf("Published key set to etcd key %s\n", *publishKVKey)
+		}
+		if *publishConsul != "" {
+			store := dialConsul(*publishConsul)
+			app.FatalIfError(publishToKV(store, *publishKVKey, set, *publishMerge, ttl), "can't publish to Consul")
+			fmt.Printf("Published key set to Consul key %s\n", *publishKVKey)
+		}
+		published = true
+	}
+	if *publishLambdaEnv {
+		out, err := lambdaEnv(jwks, issuer)
+		app.FatalIfError(err, "can't build Lambda environment")
+		if *publishFormat {
+			out = formatJSON(out)
+		}
+		fmt.Println(string(out))
+		published = true
+	}
+	if !published {
+		if *publishFormat {
+			jwks = formatJSON(jwks)
+		}
+		fmt.Println(string(jwks))
+	}
+}
@@ -0,0 +1,205 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+)
+
+var (
+	purgeCmd        = app.Command("purge", "Quarantine or securely delete old private key files")
+	purgeDirs       = purgeCmd.Arg("dirs", "Directories holding key files").Default(".").Strings()
+	purgeOlderThan  = purgeCmd.Flag("older-than", "Only purge key files last modified longer ago than this, e.g. 180d").Required().String()
+	purgeShred      = purgeCmd.Flag("shred", "Overwrite and delete the files instead of moving them to quarantine").Bool()
+	purgeQuarantine = purgeCmd.Flag("quarantine", "Directory retired key files are moved to").Default(filepath.Join(".jwk-keygen", "quarantine")).String()
+	purgeManifest   = purgeCmd.Flag("manifest", "File every purged key is recorded in, one JSON object per line").Default(filepath.Join(".jwk-keygen", "purged.jsonl")).String()
+	purgeDryRun     = purgeCmd.Flag("dry-run", "Only list the files that would be purged").Bool()
+)
+
+// privateKeyFile matches the names jwk-keygen gives files holding private
+// key material, as opposed to -pub files, certificates and notes.
+var privateKeyFile = regexp.MustCompile(`^(jwks?|pem|pem-body|pem-one-line|frost|device)_.*\.(json|pem)$`)
+
+var publicKeyFile = regexp.MustCompile(`-pub\.(json|pem)$`)
+
+// PurgedKey is a manifest entry for one purged file.
+type PurgedKey struct {
+	File        string    `json:"file"`
+	KeyIDs      []string  `json:"kids,omitempty"`
+	Action      string    `json:"action"`
+	Destination string    `json:"destination,omitempty"`
+	Modified    time.Time `json:"modified"`
+	Purged      time.Time `json:"purged"`
+}
+
+// shredFile overwrites a file with random data, wipes its size and times
+// and renames it before removing it. This is best effort: copy-on-write
+// and journaling filesystems, SSD wear levelling and backups may all keep
+// older copies of the data.
+func shredFile(name string) error {
+	if err := os.Chmod(name, 0600); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		_, err = io.CopyN(f, rand.Reader, fi.Size())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chtimes(name, time.Unix(0, 0), time.Unix(0, 0)); err != nil {
+		return err
+	}
+	// Don't leave the key's name behind in the directory either.
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	anon := filepath.Join(filepath.Dir(name), "."+hex.EncodeToString(random))
+	if err := os.Rename(name, anon); err != nil {
+		return err
+	}
+	return os.Remove(anon)
+}
+
+// quarantineFile moves a file into the quarantine directory, refusing to
+// overwrite an earlier file of the same name.
+func quarantineFile(name string) (string, error) {
+	if err := os.MkdirAll(*purgeQuarantine, 0700); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(*purgeQuarantine, filepath.Base(name))
+	if _, err := os.Lstat(dest); err == nil {
+		return "", fmt.Errorf("%s already exists", dest)
+	}
+	return dest, os.Rename(name, dest)
+}
+
+// keyIDs lists the kids in a JWK or JWKS file, if it is one.
+func keyIDs(name string) []string {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+	keys, err := safeio.ParseRawKeys(b, inputLimits())
+	if err != nil {
+		return nil
+	}
+	var kids []string
+	for _, k := range keys {
+		if k.Kid() != "" {
+			kids = append(kids, k.Kid())
+		}
+	}
+	return kids
+}
+
+func purge() {
+	age, err := parseDuration(*purgeOlderThan)
+	app.FatalIfError(err, "invalid --older-than")
+	cutoff := time.Now().Add(-age)
+
+	var manifest *os.File
+	if !*purgeDryRun {
+		err := os.MkdirAll(filepath.Dir(*purgeManifest), 0700)
+		app.FatalIfError(err, "can't create directory for %s", *purgeManifest)
+		manifest, err = os.OpenFile(*purgeManifest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		app.FatalIfError(err, "can't open manifest %s", *purgeManifest)
+		defer manifest.Close()
+	}
+
+	purged := 0
+	for _, dir := range *purgeDirs {
+		entries, err := ioutil.ReadDir(dir)
+		app.FatalIfError(err, "can't list %s", dir)
+		for _, fi := range entries {
+			if !fi.Mode().IsRegular() || !privateKeyFile.MatchString(fi.Name()) || publicKeyFile.MatchString(fi.Name()) {
+				continue
+			}
+			if !fi.ModTime().Before(cutoff) {
+				continue
+			}
+			name := filepath.Join(dir, fi.Name())
+			if *purgeDryRun {
+				fmt.Printf("Would purge %s (last modified %s)\n", name, fi.ModTime().UTC().Format(time.RFC3339))
+				continue
+			}
+
+			entry := PurgedKey{
+				File:     name,
+				KeyIDs:   keyIDs(name),
+				Modified: fi.ModTime().UTC(),
+				Purged:   timestamp().UTC().Truncate(time.Second),
+			}
+			// Record the entry first, so that no file disappears untracked.
+			if *purgeShred {
+				entry.Action = "shredded"
+			} else {
+				entry.Action = "quarantined"
+				entry.Destination = filepath.Join(*purgeQuarantine, fi.Name())
+			}
+			// The entry and the file it records go together, even when
+			// interrupted.
+			release := holdSignals()
+			b, err := json.Marshal(entry)
+			app.FatalIfError(err, "can't Marshal manifest entry to JSON")
+			_, err = manifest.Write(append(b, '\n'))
+			if err == nil {
+				err = manifest.Sync()
+			}
+			app.FatalIfError(err, "can't write manifest %s", *purgeManifest)
+
+			if *purgeShred {
+				app.FatalIfError(shredFile(name), "can't shred %s", name)
+				fmt.Printf("Shredded %s\n", name)
+			} else {
+				dest, err := quarantineFile(name)
+				app.FatalIfError(err, "can't quarantine %s", name)
+				fmt.Printf("Moved %s to %s\n", name, dest)
+			}
+			release()
+			purged++
+		}
+	}
+	if !*purgeDryRun {
+		fmt.Printf("Purged %d key files, see %s\n", purged, *purgeManifest)
+	}
+}
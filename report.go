@@ -0,0 +1,368 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+	"github.com/nicksherron/jwk-keygen/pkg/keyset"
+)
+
+var (
+	reportCmd        = app.Command("report", "List keys with their expiry and optionally notify about expiring ones")
+	reportIn         = reportCmd.Arg("keys", "JWK or JWKS files to report on (- for stdin)").Required().Strings()
+	reportWarnWithin = reportCmd.Flag("warn-within", "Flag keys expiring within this period, e.g. 30d or 72h").Default("30d").String()
+	reportNotify     = reportCmd.Flag("notify", "Notify about expiring keys: slack://hooks.slack.com/services/... or mailto:ops@example.com (repeatable)").Strings()
+	reportNotifyFile = reportCmd.Flag("notify-file", "Read notification targets from FILE, one per line, to keep webhook secrets off the command line").PlaceHolder("FILE").String()
+	reportSMTPPass   = reportCmd.Flag("smtp-password-file", "Read the SMTP password from FILE (or /dev/fd/N) instead of SMTP_PASSWORD").PlaceHolder("FILE").String()
+	reportSMTPAddr   = reportCmd.Flag("smtp-addr", "SMTP server for mailto: notifications").Default("localhost:25").String()
+	reportSMTPFrom   = reportCmd.Flag("smtp-from", "Sender address for mailto: notifications").Default("jwk-keygen@localhost").String()
+	reportFormat     = reportCmd.Flag("format", "Output a table, CSV for spreadsheets, or a diagram of the keys, their certificates and endpoints: dot (Graphviz) or mermaid").Default("table").Enum("table", "csv", "dot", "mermaid")
+	reportPublished  = reportCmd.Flag("published-at", "Endpoint a key file is published at, shown in diagrams (repeatable)").PlaceHolder("FILE=URL").StringMap()
+)
+
+// ReportEntry describes one key found by the report command.
+type ReportEntry struct {
+	Source    string    `json:"source"`
+	KeyID     string    `json:"kid"`
+	KeyType   string    `json:"kty"`
+	Algorithm string    `json:"alg,omitempty"`
+	Use       string    `json:"use,omitempty"`
+	Expires   time.Time `json:"expires,omitempty"`
+	Status    string    `json:"status"`
+	// Created is the `iat` member, or the NotBefore of the first x5c
+	// certificate.
+	Created        time.Time `json:"created,omitempty"`
+	Thumbprint     string    `json:"thumbprint,omitempty"`
+	ThumbprintSHA1 string    `json:"thumbprint_sha1,omitempty"`
+
+	// chain holds the x5c certificates, for diagrams.
+	chain []*x509.Certificate
+}
+
+// parseDuration accepts time.ParseDuration syntax plus a plain number of
+// days, e.g. "30d", which is how key lifetimes are usually expressed.
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// keyExpiry returns when a key stops being usable: the `exp` member if set,
+// otherwise the earliest NotAfter in its x5c chain, since the chain stops
+// validating as soon as any certificate in it expires.
+func keyExpiry(k safeio.RawKey) (time.Time, error) {
+	if v, ok := k["exp"]; ok {
+		var exp int64
+		if err := json.Unmarshal(v, &exp); err != nil {
+			return time.Time{}, fmt.Errorf("key %q: invalid exp: %v", k.Kid(), err)
+		}
+		return time.Unix(exp, 0).UTC(), nil
+	}
+	if v, ok := k["x5c"]; ok {
+		var chain []string
+		if err := json.Unmarshal(v, &chain); err != nil || len(chain) == 0 {
+			return time.Time{}, fmt.Errorf("key %q: invalid x5c", k.Kid())
+		}
+		var expires time.Time
+		for _, c := range chain {
+			der, err := base64.StdEncoding.DecodeString(c)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("key %q: invalid x5c: %v", k.Kid(), err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("key %q: invalid x5c: %v", k.Kid(), err)
+			}
+			if expires.IsZero() || cert.NotAfter.Before(expires) {
+				expires = cert.NotAfter
+			}
+		}
+		return expires.UTC(), nil
+	}
+	return time.Time{}, nil
+}
+
+// keyCreated returns when a key was made: the `iat` member if set,
+// otherwise the NotBefore of the first x5c certificate.
+func keyCreated(k safeio.RawKey, chain []*x509.Certificate) (time.Time, error) {
+	if v, ok := k["iat"]; ok {
+		var iat int64
+		if err := json.Unmarshal(v, &iat); err != nil {
+			return time.Time{}, fmt.Errorf("key %q: invalid iat: %v", k.Kid(), err)
+		}
+		return time.Unix(iat, 0).UTC(), nil
+	}
+	if len(chain) > 0 {
+		return chain[0].NotBefore.UTC(), nil
+	}
+	return time.Time{}, nil
+}
+
+func reportEntries(files []string, warnWithin time.Duration, now time.Time) ([]ReportEntry, error) {
+	var entries []ReportEntry
+	for _, filename := range files {
+		b, err := readInput(filename)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := safeio.ParseRawKeys(b, inputLimits())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		for _, k := range keys {
+			expires, err := keyExpiry(k)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", filename, err)
+			}
+			e := ReportEntry{
+				Source:    filename,
+				KeyID:     k.Kid(),
+				KeyType:   k.Kty(),
+				Algorithm: k.Alg(),
+				Use:       k.Use(),
+				Expires:   expires,
+				chain:     keyChain(k),
+			}
+			if e.Created, err = keyCreated(k, e.chain); err != nil {
+				return nil, fmt.Errorf("%s: %v", filename, err)
+			}
+			// Keys go-jose can't parse are still listed, without thumbprints.
+			if key, err := k.Decode(); err == nil {
+				e.Thumbprint, _ = keyset.Thumbprint(key, crypto.SHA256)
+				e.ThumbprintSHA1, _ = keyset.Thumbprint(key, crypto.SHA1)
+			}
+			switch {
+			case expires.IsZero():
+				e.Status = "no expiry"
+			case !now.Before(expires):
+				e.Status = "expired"
+			case !now.Add(warnWithin).Before(expires):
+				e.Status = "expiring"
+			default:
+				e.Status = "ok"
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func formatExpiry(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func notifyText(entries []ReportEntry) string {
+	var buf bytes.Buffer
+	buf.WriteString("jwk-keygen: keys need rotation\n")
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "- %s key %q (%s, %s) in %s expires %s\n",
+			e.Status, e.KeyID, e.KeyType, e.Algorithm, e.Source, formatExpiry(e.Expires))
+	}
+	return buf.String()
+}
+
+// smtpPassword takes the SMTP password from --smtp-password-file, then
+// SMTP_PASSWORD, and finally prompts for it on a terminal.
+func smtpPassword() (string, error) {
+	if *reportSMTPPass != "" {
+		return readSecretFile(*reportSMTPPass)
+	}
+	if pass, ok := os.LookupEnv("SMTP_PASSWORD"); ok {
+		return pass, nil
+	}
+	return promptSecret("SMTP password")
+}
+
+func notify(target, text string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	// Webhook URLs carry their credentials in the path, so only log the scheme.
+	debugf("notifying %s target", u.Scheme)
+	switch u.Scheme {
+	case "slack":
+		u.Scheme = "https"
+		body, err := json.Marshal(map[string]string{"text": text})
+		if err != nil {
+			return err
+		}
+		resp, err := hookClient.Post(u.String(), "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("slack responded with %s", resp.Status)
+		}
+		return nil
+	case "mailto":
+		var auth smtp.Auth
+		if user := os.Getenv("SMTP_USERNAME"); user != "" {
+			host := strings.Split(*reportSMTPAddr, ":")[0]
+			pass, err := smtpPassword()
+			if err != nil {
+				return err
+			}
+			auth = smtp.PlainAuth("", user, pass, host)
+		}
+		msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Expiring JSON Web Keys\r\n\r\n%s",
+			*reportSMTPFrom, u.Opaque, strings.Replace(text, "\n", "\r\n", -1))
+		return smtp.SendMail(*reportSMTPAddr, auth, *reportSMTPFrom, strings.Split(u.Opaque, ","), []byte(msg))
+	default:
+		return fmt.Errorf("unsupported notification target %q", target)
+	}
+}
+
+func report() {
+	targets := *reportNotify
+	for _, target := range targets {
+		if strings.HasPrefix(target, "slack:") {
+			warnArgvSecret("--notify "+safeTarget(target), "--notify-file")
+		}
+	}
+	if *reportNotifyFile != "" {
+		fromFile, err := readLines(*reportNotifyFile)
+		app.FatalIfError(err, "can't read --notify-file")
+		targets = append(targets, fromFile...)
+	}
+
+	warnWithin, err := parseDuration(*reportWarnWithin)
+	app.FatalIfError(err, "invalid --warn-within")
+
+	entries, err := reportEntries(*reportIn, warnWithin, time.Now())
+	app.FatalIfError(err, "can't read keys")
+
+	var due []ReportEntry
+	for _, e := range entries {
+		if e.Status == "expired" || e.Status == "expiring" {
+			due = append(due, e)
+		}
+	}
+	switch *reportFormat {
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KID\tKTY\tALG\tUSE\tEXPIRES\tSTATUS\tSOURCE")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				e.KeyID, e.KeyType, e.Algorithm, e.Use, formatExpiry(e.Expires), e.Status, e.Source)
+		}
+		w.Flush()
+	case "csv":
+		app.FatalIfError(writeReportCSV(os.Stdout, entries, *reportPublished), "can't write CSV")
+	default:
+		os.Stdout.Write(reportGraph(entries, *reportFormat, *reportPublished))
+	}
+
+	if len(due) == 0 {
+		return
+	}
+	text := notifyText(due)
+	for _, target := range targets {
+		app.FatalIfError(notify(target, text), "can't notify %s", safeTarget(target))
+	}
+}
+
+// writeReportCSV writes one row per key for auditors. A key found in
+// several files, going by its thumbprint, is listed once with all its
+// locations: the files and the endpoints they are published at.
+func writeReportCSV(out io.Writer, entries []ReportEntry, publishedAt map[string]string) error {
+	type row struct {
+		ReportEntry
+		locations []string
+	}
+	var rows []*row
+	byThumbprint := map[string]*row{}
+	for _, e := range entries {
+		r, ok := byThumbprint[e.Thumbprint]
+		if !ok || e.Thumbprint == "" {
+			r = &row{ReportEntry: e}
+			rows = append(rows, r)
+			if e.Thumbprint != "" {
+				byThumbprint[e.Thumbprint] = r
+			}
+		}
+		r.locations = appendNew(r.locations, e.Source)
+		if u, ok := publishedAt[e.Source]; ok {
+			r.locations = appendNew(r.locations, u)
+		}
+	}
+
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	w := csv.NewWriter(out)
+	w.Write([]string{"kid", "kty", "alg", "use", "created", "expires", "status", "locations", "thumbprint_sha256", "thumbprint_sha1"})
+	for _, r := range rows {
+		record := []string{r.KeyID, r.KeyType, r.Algorithm, r.Use, formatTime(r.Created), formatTime(r.Expires),
+			r.Status, strings.Join(r.locations, "; "), r.Thumbprint, r.ThumbprintSHA1}
+		for i := range record {
+			record[i] = csvCell(record[i])
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// csvCell keeps spreadsheets from evaluating a cell taken from a key file,
+// such as a kid of "=HYPERLINK(...)", by prefixing a quote to anything a
+// spreadsheet would read as a formula.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// appendNew appends s to list unless it already holds it.
+func appendNew(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
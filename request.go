@@ -0,0 +1,213 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// requestParams are the flags that must match for a request ID to be
+// replayed rather than rejected: every flag that changes what is output or
+// where. Flags with a default are only recorded when what they configure
+// is asked for, so records from before a flag existed still match runs
+// that don't use it.
+type requestParams struct {
+	Use           string `json:"use"`
+	Alg           string `json:"alg"`
+	Bits          int    `json:"bits,omitempty"`
+	KeyID         string `json:"kid,omitempty"`
+	KeyIDRand     bool   `json:"kid_rand,omitempty"`
+	KeyIDStrategy string `json:"kid_strategy,omitempty"`
+	KeyIDPrefix   string `json:"kid_prefix,omitempty"`
+	JWKS          bool   `json:"jwks,omitempty"`
+	PEM           bool   `json:"pem,omitempty"`
+	PEMBody       bool   `json:"pem_body,omitempty"`
+	PEMOneLine    bool   `json:"pem_one_line,omitempty"`
+	Format        bool   `json:"format,omitempty"`
+	Curve         string `json:"crv,omitempty"`
+	KeyOps        string `json:"key_ops,omitempty"`
+	ExtraClaims   string `json:"extra_claims,omitempty"`
+	SelfSigned    bool   `json:"self_signed_cert,omitempty"`
+	CertSubject   string `json:"cert_subject,omitempty"`
+	CertSANs      string `json:"cert_sans,omitempty"`
+	CertValidity  string `json:"cert_validity,omitempty"`
+	RestrictIss   string `json:"restrict_iss,omitempty"`
+	RestrictAud   string `json:"restrict_aud,omitempty"`
+	DER           bool   `json:"der,omitempty"`
+	PKCS8         bool   `json:"pkcs8,omitempty"`
+	P12           bool   `json:"p12,omitempty"`
+	COSE          bool   `json:"cose,omitempty"`
+	COSESet       bool   `json:"cose_set,omitempty"`
+	COSEHex       bool   `json:"cose_hex,omitempty"`
+	SSH           bool   `json:"ssh,omitempty"`
+	SQL           string `json:"sql,omitempty"`
+	K8sSecret     string `json:"k8s_secret,omitempty"`
+	Notes         bool   `json:"emit_notes,omitempty"`
+	Audience      string `json:"audience,omitempty"`
+	RotateAfter   string `json:"rotate_after,omitempty"`
+	Protected     bool   `json:"passphrase,omitempty"`
+	PassphraseAlg string `json:"passphrase_alg,omitempty"`
+	OutDir        string `json:"out_dir,omitempty"`
+	PubOut        string `json:"pub_out,omitempty"`
+	PrivOut       string `json:"priv_out,omitempty"`
+	Stdout        bool   `json:"stdout,omitempty"`
+	JWKSAppend    string `json:"jwks_append,omitempty"`
+	SELinux       string `json:"selinux_label,omitempty"`
+	Ephemeral     string `json:"ephemeral,omitempty"`
+}
+
+// recordedOutput remembers one emitted output. Data is only kept for public
+// keys that went to stdout, Bare if they were printed without a header;
+// written files are referenced by name.
+type recordedOutput struct {
+	Name string `json:"name"`
+	File string `json:"file,omitempty"`
+	What string `json:"what"`
+	Data []byte `json:"data,omitempty"`
+	Bare bool   `json:"bare,omitempty"`
+}
+
+type requestRecord struct {
+	RequestID string           `json:"request_id"`
+	Params    requestParams    `json:"params"`
+	KeyID     string           `json:"kid,omitempty"`
+	Created   time.Time        `json:"created"`
+	Outputs   []recordedOutput `json:"outputs"`
+}
+
+// emitted collects outputs while a request ID is being recorded.
+var emitted []recordedOutput
+
+func currentRequestParams() requestParams {
+	p := requestParams{
+		Use: *use, Alg: *alg, Bits: *bits, KeyIDPrefix: *kidPrefix,
+		JWKS: *jwks, PEM: *pemOut, PEMBody: *pemBody, PEMOneLine: *pemOneLine, Format: *format,
+	}
+	// Random kids are recorded as --kid-rand was, so its records still
+	// match.
+	switch *kidStrategy {
+	case "":
+		p.KeyID = *kid
+	case "random":
+		p.KeyIDRand = true
+	default:
+		p.KeyIDStrategy = *kidStrategy
+	}
+	p.Curve, p.KeyOps, p.ExtraClaims = *crv, *keyOperations, strings.Join(*extraClaims, "\n")
+	if *selfSignedCert {
+		p.SelfSigned, p.CertSubject, p.CertValidity = true, *certSubject, *certValidity
+		p.CertSANs = strings.Join(*certSANs, "\n")
+	}
+	p.RestrictIss, p.RestrictAud = *restrictIss, strings.Join(*restrictAud, "\n")
+	p.DER, p.PKCS8, p.P12, p.SSH = *derOut, *pkcs8Out, *p12Out, *sshOut
+	p.COSE, p.COSESet, p.COSEHex = *coseOut, *coseSet, *coseHex
+	p.SQL, p.K8sSecret = *sqlOut, *k8sSecretOut
+	if *emitNotes {
+		p.Notes, p.Audience, p.RotateAfter = true, *audience, *rotateAfter
+	}
+	if *passphrase != "" || *passphraseFile != "" {
+		p.Protected, p.PassphraseAlg = true, *passphraseAlg
+	}
+	if *outDir != "." {
+		p.OutDir = *outDir
+	}
+	p.PubOut, p.PrivOut, p.Stdout, p.JWKSAppend = *pubOut, *privOut, *toStdout, *jwksAppend
+	p.SELinux = *selinux
+	if *ephemeral > 0 {
+		p.Ephemeral = ephemeral.String()
+	}
+	return p
+}
+
+func requestPath(id string) string {
+	// Request IDs come from pipelines and may hold anything, so never use
+	// them as file names directly.
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(*stateDir, "requests", hex.EncodeToString(sum[:])+".json")
+}
+
+// loadRequest returns the record for a request ID, or nil if it has not
+// been seen before.
+func loadRequest(id string) (*requestRecord, error) {
+	b, err := ioutil.ReadFile(requestPath(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec requestRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func saveRequest(id string) error {
+	rec := requestRecord{
+		RequestID: id,
+		Params:    currentRequestParams(),
+		KeyID:     *kid,
+		Created:   timestamp().UTC(),
+		Outputs:   emitted,
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(requestPath(id)), 0700); err != nil {
+		return err
+	}
+	// The record may hold private keys that were only ever printed. It is
+	// staged with the key files so that it only exists if they do.
+	return pending.add(requestPath(id), "", b, 0600)
+}
+
+// replayRequest emits a previously recorded request again instead of
+// generating a new key.
+func replayRequest(rec *requestRecord) {
+	debugf("replaying request %q from %s", rec.RequestID, rec.Created.Format(time.RFC3339))
+	if rec.Params != currentRequestParams() {
+		app.Fatalf("request ID %q was already used with different parameters", rec.RequestID)
+	}
+	// Records from before private keys were refused may still hold some.
+	for _, o := range rec.Outputs {
+		refusePrivateStdout(o.Data)
+	}
+	status := pending.statusWriter()
+	for _, o := range rec.Outputs {
+		if o.File == "" {
+			if !o.Bare {
+				fmt.Printf("==> %s <==\n", o.Name)
+			}
+			fmt.Println(string(o.Data))
+			continue
+		}
+		if _, err := os.Stat(o.File); err != nil {
+			app.Fatalf("request ID %q was already served, but %s is gone: %s", rec.RequestID, o.File, err)
+		}
+		fmt.Fprintf(status, "Already written %s to %s\n", o.What, o.File)
+	}
+}
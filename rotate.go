@@ -0,0 +1,232 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"github.com/nicksherron/jwk-keygen/pkg/keyset"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	rotateCmd    = app.Command("rotate", "Add a new key to the front of a JWKS, retire old ones and write the private key of only the new one")
+	rotateJWKS   = rotateCmd.Flag("jwks", "Public key set to rotate; created if it doesn't exist").Required().String()
+	rotateUse    = rotateCmd.Flag("use", "Desrired key use").Required().Enum("enc", "sig")
+	rotateAlg    = rotateCmd.Flag("alg", "Generate key to be used for ALG").Required().String()
+	rotateBits   = rotateCmd.Flag("bits", "Key size in bits").Int()
+	rotateKid    = rotateCmd.Flag("kid", "Key ID of the new key; random if not given").String()
+	rotateKeep   = rotateCmd.Flag("keep", "How many keys, the new one included, to keep in the set").Default("3").Int()
+	rotateMaxAge = rotateCmd.Flag("max-age", "Also retire keys created longer ago than this, e.g. 180d").String()
+	rotateGrace  = rotateCmd.Flag("grace", "Retire the keys the new one replaces after this long, e.g. 7d; by default only --keep and --max-age retire keys").String()
+	rotateOutDir = rotateCmd.Flag("out-dir", "Directory to write the new private key to").Default(".").String()
+	rotateFormat = rotateCmd.Flag("format", "Out JSON with format").Bool()
+	onRotate     = rotateCmd.Flag("on-rotate", "Run a command, or POST to an http(s) URL, with the new public key once the set is rotated (repeatable)").Strings()
+	onRevoke     = rotateCmd.Flag("on-revoke", "Run a command, or POST to an http(s) URL, with each public key retired from the set (repeatable)").Strings()
+)
+
+// rotateSet adds key, the public JWK next as it goes into the key set, to
+// the front of set and drops old keys the way the Kubernetes controller
+// does, through keyset.Set: with a grace period the current keys of the
+// same `use` are retired and get an `exp` member for when it is over, and
+// Prune drops keys past their `exp` or older than maxAge, but never the
+// newest current one. --keep then drops the keys beyond the first keep. A
+// key's `iat`, or the start of its certificate, tells its age; keys with
+// neither are never too old, and keys go-jose can't parse are only dropped
+// by count. It returns the dropped keys.
+func rotateSet(set *safeio.RawKeySet, next jose.JSONWebKey, key safeio.RawKey, grace, maxAge time.Duration, keep int, now time.Time) ([]safeio.RawKey, error) {
+	unix := func(k safeio.RawKey, member string) (time.Time, error) {
+		v, ok := k[member]
+		if !ok {
+			return time.Time{}, nil
+		}
+		var t int64
+		if err := json.Unmarshal(v, &t); err != nil {
+			return time.Time{}, fmt.Errorf("key %q: invalid %s: %v", k.Kid(), member, err)
+		}
+		return time.Unix(t, 0), nil
+	}
+	// thumbprints are those of the keys of set, "" for the ones go-jose
+	// can't parse.
+	thumbprints := make([]string, len(set.Keys))
+	var entries []keyset.Entry
+	for i, k := range set.Keys {
+		jwk, err := k.Decode()
+		if err != nil {
+			continue
+		}
+		if thumbprints[i], err = keyset.Thumbprint(jwk, crypto.SHA256); err != nil {
+			continue
+		}
+		e := keyset.Entry{Key: *jwk, Added: now}
+		created, err := keyCreated(k, keyChain(k))
+		if err != nil {
+			return nil, err
+		}
+		if !created.IsZero() {
+			e.Added = created
+		}
+		if e.Expires, err = unix(k, "exp"); err != nil {
+			return nil, err
+		}
+		e.Retired = e.Expires
+		entries = append(entries, e)
+	}
+	ks, err := keyset.Restore(entries...)
+	if err != nil {
+		return nil, err
+	}
+	ks.Clock = keygen.ClockFunc(func() time.Time { return now })
+	if grace > 0 {
+		err = ks.Rotate(next, grace)
+	} else {
+		err = ks.Add(next)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ks.Prune(maxAge)
+
+	kept := map[string]keyset.Entry{}
+	for _, e := range ks.Entries() {
+		tp, err := keyset.Thumbprint(&e.Key, crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		kept[tp] = e
+	}
+	keys := []safeio.RawKey{key}
+	var dropped []safeio.RawKey
+	for i, k := range set.Keys {
+		if tp := thumbprints[i]; tp != "" {
+			e, ok := kept[tp]
+			if !ok {
+				dropped = append(dropped, k)
+				continue
+			}
+			if !e.Retired.IsZero() {
+				k["exp"], _ = json.Marshal(e.Expires.Unix())
+			}
+		}
+		if len(keys) >= keep {
+			dropped = append(dropped, k)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	set.Keys = keys
+	return dropped, nil
+}
+
+func rotate() {
+	if *rotateKeep < 1 {
+		app.FatalUsage("--keep must be at least 1")
+	}
+	var maxAge time.Duration
+	if *rotateMaxAge != "" {
+		var err error
+		maxAge, err = parseDuration(*rotateMaxAge)
+		if err != nil || maxAge <= 0 {
+			app.FatalUsage("--max-age must be a positive duration, e.g. 180d")
+		}
+	}
+	var grace time.Duration
+	if *rotateGrace != "" {
+		var err error
+		grace, err = parseDuration(*rotateGrace)
+		if err != nil || grace <= 0 {
+			app.FatalUsage("--grace must be a positive duration, e.g. 7d")
+		}
+	}
+	if keygen.IsSymmetric(*rotateAlg) {
+		app.FatalUsage("symmetric keys can't be published in a JWKS")
+	}
+
+	set := &safeio.RawKeySet{}
+	perm := os.FileMode(0444)
+	old, err := ioutil.ReadFile(*rotateJWKS)
+	switch {
+	case err == nil:
+		set, err = readRawJWKS(*rotateJWKS, false)
+		app.FatalIfError(err, "can't read key set %s", *rotateJWKS)
+		fi, err := os.Stat(*rotateJWKS)
+		app.FatalIfError(err, "can't read key set %s", *rotateJWKS)
+		perm = fi.Mode().Perm()
+	case !os.IsNotExist(err):
+		app.FatalIfError(err, "can't read key set %s", *rotateJWKS)
+	}
+
+	opts := keygen.Options{Use: *rotateUse, Alg: *rotateAlg, Bits: *rotateBits, KeyID: *rotateKid, RandomKeyID: *rotateKid == ""}
+	priv, pub, err := keygen.Generate(opts)
+	app.FatalIfError(err, "unable to generate key")
+	for _, k := range set.Keys {
+		if k.Kid() == pub.KeyID {
+			app.Fatalf("kid %q is already used in %s", pub.KeyID, *rotateJWKS)
+		}
+	}
+
+	// The key set records when each key was made, as the iat member, so
+	// that --max-age can tell how old it is next time.
+	now := timestamp()
+	iat, _ := json.Marshal(now.Unix())
+	pubJS, err := marshalJWK(pub)
+	app.FatalIfError(err, "can't Marshal public key to JSON")
+	var key safeio.RawKey
+	app.FatalIfError(json.Unmarshal(pubJS, &key), "can't Marshal public key to JSON")
+	key["iat"] = iat
+	retired, err := rotateSet(set, pub, key, grace, maxAge, *rotateKeep, now)
+	app.FatalIfError(err, "can't rotate key set %s", *rotateJWKS)
+
+	out, err := json.Marshal(set)
+	app.FatalIfError(err, "can't Marshal key set to JSON")
+	privJS, err := marshalJWK(priv)
+	app.FatalIfError(err, "can't Marshal private key to JSON")
+	if *rotateFormat {
+		out, privJS = formatJSON(out), formatJSON(privJS)
+	}
+	privFile := filepath.Join(*rotateOutDir, fmt.Sprintf("jwk_%s_%s_%s.json", *rotateUse, *rotateAlg, pub.KeyID))
+	fatalIfStaged(pending.add(privFile, "private key with JWK", privJS, 0400), "can't write private key to %s", privFile)
+	if old != nil {
+		fatalIfStaged(pending.replace(*rotateJWKS+".bak", "", old, perm), "can't back up %s", *rotateJWKS)
+		fatalIfStaged(pending.replace(*rotateJWKS, "key set", out, perm), "can't write %s", *rotateJWKS)
+	} else {
+		fatalIfStaged(pending.add(*rotateJWKS, "key set", out, perm), "can't write %s", *rotateJWKS)
+	}
+	app.FatalIfError(pending.commit(), "can't write keys")
+
+	fmt.Printf("Added key %q\n", pub.KeyID)
+	for _, k := range retired {
+		fmt.Printf("Retired key %q\n", k.Kid())
+	}
+	runHooks(*onRotate, keyEvent("rotate", pub))
+	for _, k := range retired {
+		ev := HookEvent{Event: "revoke", KeyID: k.Kid(), Algorithm: k.Alg(), Use: k.Use()}
+		if k, ok := k.Public(); ok {
+			ev.PublicKey, err = json.Marshal(k)
+			app.FatalIfError(err, "can't Marshal public key to JSON")
+		}
+		runHooks(*onRevoke, ev)
+	}
+}
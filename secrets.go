@@ -0,0 +1,70 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// readSecretFile reads a secret from a file, which may also be a file
+// descriptor such as /dev/fd/3. A single trailing newline is dropped.
+func readSecretFile(filename string) (string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r"), nil
+}
+
+// readLines reads the non-empty lines of a file that don't start with #.
+func readLines(filename string) ([]string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, s.Err()
+}
+
+// warnArgvSecret tells the user that a secret was given on the command
+// line, where any local user can read it with ps.
+func warnArgvSecret(flag, instead string) {
+	fmt.Fprintf(os.Stderr, "jwk-keygen: warning: %s holds a secret visible to other users in ps and shell history; use %s instead\n", flag, instead)
+}
+
+// safeTarget shortens a notification target for messages, dropping the
+// credentials webhook URLs carry in their path.
+func safeTarget(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme == "mailto" {
+		return target
+	}
+	return u.Scheme + "://" + u.Host + "/..."
+}
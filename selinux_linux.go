@@ -0,0 +1,25 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import "syscall"
+
+// setSELinuxLabel sets the SELinux context of a file, as chcon does. The
+// kernel expects the label NUL-terminated.
+func setSELinuxLabel(filename, label string) error {
+	return syscall.Setxattr(filename, "security.selinux", append([]byte(label), 0), 0)
+}
@@ -0,0 +1,508 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+	"github.com/nicksherron/jwk-keygen/pkg/keyset"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	serveCmd        = app.Command("serve", "Serve the public keys of a key set and verify tokens against them")
+	serveKeys       = serveCmd.Flag("keys", "JWK or JWKS to serve; only public keys are ever used").String()
+	serveListen     = serveCmd.Flag("listen", "Address to listen on").Default("127.0.0.1:8080").String()
+	serveLeeway     = serveCmd.Flag("leeway", "Clock skew allowed when checking exp and nbf").Default("1m").Duration()
+	serveReload     = serveCmd.Flag("reload", "How often to check the key file for changes, 0 to never reload it").Default("1s").Duration()
+	serveIssuer     = serveCmd.Flag("issuer", "Also serve OpenID Connect discovery for this issuer URL").PlaceHolder("URL").String()
+	serveIssMap     = serveCmd.Flag("issuer-map", "YAML or JSON map of issuers to the kids or thumbprints of their keys, scoping the keys like iss members").PlaceHolder("FILE").String()
+	serveTLSCert    = serveCmd.Flag("tls-cert", "Serve HTTPS with this PEM certificate (chain)").PlaceHolder("FILE").String()
+	serveTLSKey     = serveCmd.Flag("tls-key", "PEM private key of --tls-cert").PlaceHolder("FILE").String()
+	serveSelfSigned = serveCmd.Flag("tls-self-signed", "Serve HTTPS with a new self-signed certificate for localhost, written to FILE for clients to trust").PlaceHolder("FILE").String()
+	serveConsul     = serveCmd.Flag("consul", "Register a jwks service checked on /readyz with the Consul agent at http(s)://HOST:PORT").PlaceHolder("URL").String()
+
+	// Aliases of --keys and --listen, as other JWKS servers name them.
+	serveJWKS = serveCmd.Flag("jwks", "Same as --keys").Hidden().String()
+	serveAddr = serveCmd.Flag("addr", "Same as --listen").Hidden().String()
+)
+
+// VerifyResult is the response of /verify.
+type VerifyResult struct {
+	Valid     bool            `json:"valid"`
+	Issuer    string          `json:"iss,omitempty"`
+	KeyID     string          `json:"kid,omitempty"`
+	Algorithm string          `json:"alg,omitempty"`
+	Claims    json.RawMessage `json:"claims,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// keyServer holds the public keys it serves and verifies with.
+type keyServer struct {
+	// mu guards keys and issuers, which serve replaces when the key file
+	// changes.
+	mu   sync.RWMutex
+	keys *keyset.Set
+	// issuers, if set, holds the keys by the issuer they are scoped to,
+	// and tokens are only verified with the keys of their iss.
+	issuers map[string]*keyset.Set
+	// leeway is the clock skew allowed when checking exp and nbf.
+	leeway time.Duration
+}
+
+// publicKey decodes r and returns its public half, or r itself if it is
+// symmetric and symmetric is set. Keys that can't be used are reported and
+// skipped.
+func publicKey(r safeio.RawKey, symmetric bool) (jose.JSONWebKey, bool) {
+	k, err := r.Decode()
+	if err != nil {
+		fmt.Fprintf(logw, "jwk-keygen: warning: skipping key %q: %s\n", r.Kid(), err)
+		return jose.JSONWebKey{}, false
+	}
+	pub := k.Public()
+	if pub.Key == nil && symmetric {
+		pub = *k
+	} else if pub.Key == nil {
+		fmt.Fprintf(logw, "jwk-keygen: warning: skipping symmetric key %q\n", r.Kid())
+		return jose.JSONWebKey{}, false
+	}
+	return pub, true
+}
+
+// checkTimes checks the exp and nbf claims of a JWT payload, if it is one.
+func checkTimes(payload []byte, now time.Time, leeway time.Duration) error {
+	var claims struct {
+		Exp *float64 `json:"exp"`
+		Nbf *float64 `json:"nbf"`
+	}
+	if json.Unmarshal(payload, &claims) != nil {
+		return nil
+	}
+	unix := func(f float64) time.Time {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9))
+	}
+	if claims.Exp != nil && now.Add(-leeway).After(unix(*claims.Exp)) {
+		return fmt.Errorf("token expired at %s", unix(*claims.Exp).UTC().Format(time.RFC3339))
+	}
+	if claims.Nbf != nil && now.Add(leeway).Before(unix(*claims.Nbf)) {
+		return fmt.Errorf("token not valid before %s", unix(*claims.Nbf).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// keySet returns the keys currently served.
+func (s *keyServer) keySet() *keyset.Set {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys
+}
+
+func (s *keyServer) issuerKeys() map[string]*keyset.Set {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.issuers
+}
+
+// loadServedKeys loads the keys of serve from filename, scoped by the
+// issuer map in mapFile, if set, as well as by their iss members.
+func loadServedKeys(filename, mapFile string) (*keyset.Set, map[string]*keyset.Set, error) {
+	var issuerMap map[string][]string
+	if mapFile != "" {
+		var err error
+		if issuerMap, err = readIssuerMap(mapFile); err != nil {
+			return nil, nil, fmt.Errorf("can't read issuer map %s: %s", mapFile, err)
+		}
+	}
+	return loadIssuerKeys(filename, issuerMap, false)
+}
+
+// watchKeys reloads the served keys from filename, and the issuer map from
+// mapFile, whenever either changes, checking every interval until ctx is
+// done. Files that can't be loaded leave the keys as they were.
+func (s *keyServer) watchKeys(ctx context.Context, filename, mapFile string, interval time.Duration) {
+	files := []string{filename}
+	if mapFile != "" {
+		files = append(files, mapFile)
+	}
+	last := make([]os.FileInfo, len(files))
+	for i, f := range files {
+		last[i], _ = os.Stat(f)
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		changed := false
+		for i, f := range files {
+			fi, err := os.Stat(f)
+			if err != nil {
+				continue
+			}
+			// Replacing the file, as jwk-keygen does, makes it a new one.
+			if last[i] != nil && os.SameFile(fi, last[i]) && fi.ModTime().Equal(last[i].ModTime()) && fi.Size() == last[i].Size() {
+				continue
+			}
+			last[i], changed = fi, true
+		}
+		if !changed {
+			continue
+		}
+		keys, issuers, err := loadServedKeys(filename, mapFile)
+		if err != nil {
+			fmt.Fprintf(logw, "jwk-keygen: warning: can't reload %s, keeping the keys served: %s\n", filename, err)
+			continue
+		}
+		s.mu.Lock()
+		s.keys, s.issuers = keys, issuers
+		s.mu.Unlock()
+		fmt.Fprintf(logw, "Reloaded %d public keys from %s\n", len(keys.Current()), filename)
+	}
+}
+
+// verify checks a JWS against the served keys: the one named by its kid,
+// or each of them if it has none. With issuer-scoped keys only those of
+// the token's iss are considered, so no issuer can verify with another's
+// key, and unscoped keys only verify tokens without iss. Tokens with a cnf claim must be bound to
+// what the client presented.
+func (s *keyServer) verify(token []byte, presented Confirmation) VerifyResult {
+	jws, err := safeio.ParseJWS(token, inputLimits())
+	if err != nil {
+		return VerifyResult{Error: "malformed token: " + err.Error()}
+	}
+	if len(jws.Signatures) != 1 {
+		return VerifyResult{Error: "tokens must have exactly one signature"}
+	}
+	header := jws.Signatures[0].Header
+	res := VerifyResult{KeyID: header.KeyID, Algorithm: header.Algorithm}
+
+	set, issuers := s.keySet(), s.issuerKeys()
+	if issuers != nil {
+		res.Issuer = tokenIssuer(jws)
+		if set = issuers[res.Issuer]; set == nil {
+			res.Error = fmt.Sprintf("no keys for issuer %q", res.Issuer)
+			return res
+		}
+	}
+	keys := set.KeySet()
+	candidates := keys.Keys
+	if header.KeyID != "" {
+		candidates = keys.Key(header.KeyID)
+		if len(candidates) == 0 && issuers != nil {
+			res.Error = fmt.Sprintf("no key with kid %q for issuer %q", header.KeyID, res.Issuer)
+			return res
+		}
+		if len(candidates) == 0 {
+			res.Error = fmt.Sprintf("no key with kid %q", header.KeyID)
+			return res
+		}
+	}
+	for _, k := range candidates {
+		// A key bound to an algorithm must not verify any other.
+		if k.Algorithm != "" && k.Algorithm != header.Algorithm {
+			continue
+		}
+		payload, err := jws.Verify(k)
+		if err != nil {
+			continue
+		}
+		res.KeyID = k.KeyID
+		if json.Valid(payload) && bytes.HasPrefix(bytes.TrimSpace(payload), []byte("{")) {
+			res.Claims = payload
+		}
+		if err := checkTimes(payload, time.Now(), s.leeway); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		if err := checkConfirmation(payload, presented); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		res.Valid = true
+		return res
+	}
+	res.Error = "signature does not verify with any matching key"
+	return res
+}
+
+func (s *keyServer) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jwks, err := json.Marshal(s.keySet().Public())
+	if err != nil {
+		http.Error(w, "can't Marshal key set to JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Write(jwks)
+}
+
+// handleVerify takes the token as the request body, either as is or as the
+// `token` member of a JSON object. A JSON body can also carry the client
+// certificate (`cert`) and key thumbprint (`jkt`) to check cnf against.
+func (s *keyServer) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, *maxInputSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	token := bytes.TrimSpace(body)
+	var presented Confirmation
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req struct {
+			Token string `json:"token"`
+			Cert  string `json:"cert"`
+			JKT   string `json:"jkt"`
+		}
+		if err := json.Unmarshal(body, &req); err == nil && req.Token != "" {
+			token = []byte(req.Token)
+			presented.JKT = req.JKT
+			if req.Cert != "" {
+				cert, err := parseCertificate(req.Cert)
+				if err != nil {
+					http.Error(w, "invalid cert: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+				presented.X5tS256 = certThumbprint(cert)
+			}
+		}
+	}
+
+	res := s.verify(token, presented)
+	debugf("verified token for kid %q: valid=%t %s", res.KeyID, res.Valid, res.Error)
+	status := http.StatusOK
+	if !res.Valid {
+		status = http.StatusUnprocessableEntity
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// handleDiscovery serves the OpenID Provider metadata of issuer (OpenID
+// Connect Discovery 1.0): just enough for relying parties to find the key
+// set and which algorithms ID tokens are signed with.
+func (s *keyServer) handleDiscovery(issuer string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var algs []string
+		seen := map[string]bool{}
+		for _, k := range s.keySet().Current() {
+			if k.Use != "enc" && k.Algorithm != "" && !seen[k.Algorithm] {
+				seen[k.Algorithm] = true
+				algs = append(algs, k.Algorithm)
+			}
+		}
+		if len(algs) == 0 {
+			// Which every provider has to support.
+			algs = []string{"RS256"}
+		}
+		sort.Strings(algs)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                issuer,
+			"jwks_uri":                              strings.TrimSuffix(issuer, "/") + "/.well-known/jwks.json",
+			"response_types_supported":              []string{"id_token"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": algs,
+		})
+	}
+}
+
+// issuerPath returns the path of an issuer URL, under which its discovery
+// document and key set are served.
+func issuerPath(issuer string) (string, error) {
+	u, err := url.Parse(issuer)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", errors.New("must be an http(s) URL without query or fragment")
+	}
+	return strings.TrimSuffix(u.Path, "/"), nil
+}
+
+// selfSignedTLS issues a short-lived self-signed certificate for localhost
+// and host, and returns it along with its PEM.
+func selfSignedTLS(host string) (tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "jwk-keygen serve"},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(7 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+	} else if ip == nil && host != "" && host != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// ready is the readiness check of serve: it has keys to serve. The key
+// file is only ever read, so there is nothing to check writing.
+func (s *keyServer) ready(ctx context.Context) error {
+	if len(s.keySet().Current()) == 0 {
+		return errors.New("no keys loaded")
+	}
+	return nil
+}
+
+func serve() {
+	if *serveJWKS != "" {
+		if *serveKeys != "" {
+			app.FatalUsage("--jwks is the same as --keys, pass only one")
+		}
+		*serveKeys = *serveJWKS
+	}
+	if *serveKeys == "" {
+		app.FatalUsage("required flag --keys not provided")
+	}
+	if *serveAddr != "" {
+		*serveListen = *serveAddr
+	}
+	if (*serveTLSCert == "") != (*serveTLSKey == "") {
+		app.FatalUsage("--tls-cert and --tls-key go together")
+	}
+	if *serveTLSCert != "" && *serveSelfSigned != "" {
+		app.FatalUsage("--tls-self-signed can't be combined with --tls-cert")
+	}
+	host, _, err := net.SplitHostPort(*serveListen)
+	app.FatalIfError(err, "invalid --listen %q", *serveListen)
+
+	keys, issuers, err := loadServedKeys(*serveKeys, *serveIssMap)
+	app.FatalIfError(err, "can't load keys from %s", *serveKeys)
+	s := &keyServer{keys: keys, issuers: issuers, leeway: *serveLeeway}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jwks.json", s.handleJWKS)
+	mux.HandleFunc("/.well-known/jwks.json", s.handleJWKS)
+	mux.HandleFunc("/verify", s.handleVerify)
+	if *serveIssuer != "" {
+		base, err := issuerPath(*serveIssuer)
+		app.FatalIfError(err, "invalid --issuer %q", *serveIssuer)
+		mux.HandleFunc(base+"/.well-known/openid-configuration", s.handleDiscovery(*serveIssuer))
+		if base != "" {
+			mux.HandleFunc(base+"/.well-known/jwks.json", s.handleJWKS)
+		}
+	}
+	ctx := signalContext()
+	(&healthChecker{ready: s.ready, done: ctx.Done()}).register(mux)
+	srv := &http.Server{
+		Addr:              *serveListen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}
+	scheme := "http"
+	switch {
+	case *serveTLSCert != "":
+		cert, err := tls.LoadX509KeyPair(*serveTLSCert, *serveTLSKey)
+		app.FatalIfError(err, "can't load --tls-cert")
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	case *serveSelfSigned != "":
+		cert, certPEM, err := selfSignedTLS(host)
+		app.FatalIfError(err, "can't issue certificate")
+		pending.status = logw
+		fatalIfStaged(pending.replace(*serveSelfSigned, "self-signed certificate", certPEM, 0644), "can't write %s", *serveSelfSigned)
+		fatalIfStaged(pending.commit(), "can't write %s", *serveSelfSigned)
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	default:
+		// HTTP/2 with TLS needs no help.
+		allowH2C(srv)
+	}
+	if srv.TLSConfig != nil {
+		srv.TLSConfig.MinVersion = tls.VersionTLS12
+		scheme = "https"
+	}
+	if *serveReload > 0 && *serveKeys != "-" {
+		go s.watchKeys(ctx, *serveKeys, *serveIssMap, *serveReload)
+	}
+	var agent *consulStore
+	var svc consulService
+	if *serveConsul != "" {
+		agent = dialConsul(*serveConsul)
+		svc, err = jwksService(*serveListen, scheme, *serveSelfSigned != "")
+		app.FatalIfError(err, "invalid --listen %q", *serveListen)
+		app.FatalIfError(agent.register(svc), "can't register with Consul")
+	}
+	fmt.Fprintf(os.Stderr, "Serving %d public keys on %s://%s\n", len(keys.Current()), scheme, *serveListen)
+	err = serveUntil(ctx, srv)
+	if agent != nil {
+		if err := agent.deregister(svc.ID); err != nil {
+			fmt.Fprintf(logw, "jwk-keygen: warning: can't deregister from Consul: %v\n", err)
+		}
+	}
+	app.FatalIfError(err, "can't serve")
+}
@@ -0,0 +1,126 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// signals tracks the SIGINT or SIGTERM a batch command got while it was
+// in a step that must not be cut short, such as moving files into place.
+var signals struct {
+	sync.Mutex
+	// held counts the steps in progress.
+	held int
+	got  os.Signal
+}
+
+// stopOnSignal makes SIGINT and SIGTERM end the command cleanly: staged
+// files are removed and the process exits with 128 plus the signal
+// number. A signal arriving during a step holding signals takes effect
+// when the step is over.
+func stopOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		signals.Lock()
+		if signals.held > 0 {
+			signals.got = s
+			signals.Unlock()
+			return
+		}
+		// Left locked: no step may start while exiting.
+		stopNow(s)
+	}()
+}
+
+// holdSignals holds back SIGINT and SIGTERM until the returned function
+// is called.
+func holdSignals() (release func()) {
+	signals.Lock()
+	signals.held++
+	signals.Unlock()
+	return func() {
+		signals.Lock()
+		signals.held--
+		if signals.held == 0 && signals.got != nil {
+			stopNow(signals.got)
+		}
+		signals.Unlock()
+	}
+}
+
+// stopNow removes the staged files and exits for signal s. It is called
+// with signals locked.
+func stopNow(s os.Signal) {
+	if len(pending.files) > 0 {
+		fmt.Fprintf(logw, "jwk-keygen: %s, no files written\n", s)
+	} else {
+		fmt.Fprintf(logw, "jwk-keygen: %s\n", s)
+	}
+	pending.abort()
+	code := 1
+	if n, ok := s.(syscall.Signal); ok {
+		code = 128 + int(n)
+	}
+	exit(code)
+}
+
+// signalContext returns a context canceled by SIGINT or SIGTERM, for the
+// commands that run until stopped.
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		fmt.Fprintf(logw, "jwk-keygen: %s, shutting down\n", s)
+		cancel()
+	}()
+	return ctx
+}
+
+// serveUntil runs srv until ctx is done, then shuts it down, letting
+// requests in flight finish for up to 25 seconds, within the 30 seconds
+// Kubernetes waits before killing a pod.
+func serveUntil(ctx context.Context, srv *http.Server) error {
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// The certificates are in TLSConfig.
+			errc <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		errc <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), 25*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdown)
+}
@@ -0,0 +1,82 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+var (
+	signCmd      = app.Command("sign", "Sign a payload as a compact JWS, or as a JWT if it is a JSON object")
+	signKey      = signCmd.Flag("key", "Private JWK to sign with").Required().String()
+	signPayload  = signCmd.Flag("payload", "File holding the payload or claims, - for stdin").Required().String()
+	signAlg      = signCmd.Flag("alg", "Algorithm to sign with, if the key has no alg").String()
+	signTyp      = signCmd.Flag("typ", "typ header; JWT for JSON object payloads unless given").String()
+	signLifetime = signCmd.Flag("lifetime", "Set the iat claim, and exp this long after it").Duration()
+)
+
+// claimsObject returns payload as JSON object members, or nil if it is
+// not a JSON object.
+func claimsObject(payload []byte) map[string]json.RawMessage {
+	if !bytes.HasPrefix(bytes.TrimSpace(payload), []byte("{")) {
+		return nil
+	}
+	var claims map[string]json.RawMessage
+	if json.Unmarshal(payload, &claims) != nil {
+		return nil
+	}
+	return claims
+}
+
+func sign() {
+	if *signKey == "-" && *signPayload == "-" {
+		app.FatalUsage("only one of --key and --payload can be read from stdin")
+	}
+	key, alg, constraints, err := readSigningKey(*signKey, *signAlg)
+	app.FatalIfError(err, "can't use key %s", *signKey)
+	payload, err := readFile(*signPayload)
+	app.FatalIfError(err, "can't read payload")
+
+	claims := claimsObject(payload)
+	typ := *signTyp
+	if typ == "" && claims != nil {
+		typ = "JWT"
+	}
+	if *signLifetime != 0 {
+		if claims == nil {
+			app.FatalUsage("--lifetime needs a JSON object payload to add iat and exp to")
+		}
+		if *signLifetime < 0 {
+			app.FatalUsage("--lifetime must be positive")
+		}
+		now := timestamp()
+		claims["iat"] = json.RawMessage(fmt.Sprint(now.Unix()))
+		claims["exp"] = json.RawMessage(fmt.Sprint(now.Add(*signLifetime).Unix()))
+		payload, err = json.Marshal(claims)
+		app.FatalIfError(err, "can't Marshal claims to JSON")
+	} else if claims != nil {
+		// Signed as given, but without the trailing newline of the file.
+		payload = bytes.TrimSpace(payload)
+	}
+
+	app.FatalIfError(constraints.check(payload), "refusing to sign with %s", *signKey)
+	token, err := signJWS(key, alg, typ, nil, payload)
+	app.FatalIfError(err, "can't sign payload")
+	fmt.Println(token)
+}
@@ -0,0 +1,236 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	simulateCmd  = app.Command("simulate-rotation", "Walk through a key rotation plan and flag steps that would break token verification")
+	simulateJWKS = simulateCmd.Flag("jwks", "Key set published today").Required().String()
+	simulatePlan = simulateCmd.Flag("plan", "Rotation plan, as YAML").Required().String()
+)
+
+// RotationPlan is a proposed rotation schedule. Durations take
+// time.ParseDuration syntax or a number of days, e.g. "7d".
+type RotationPlan struct {
+	// Start is when the plan begins, as RFC 3339 (default now).
+	Start string `yaml:"start"`
+	// Active is the kid signing tokens at the start. It can be left out if
+	// the key set holds a single key.
+	Active string `yaml:"active"`
+	// CacheTTL is how long verifiers may keep using a fetched key set.
+	CacheTTL string `yaml:"cache_ttl"`
+	// TokenTTL is how long tokens stay valid after they are signed.
+	TokenTTL string         `yaml:"token_ttl"`
+	Steps    []RotationStep `yaml:"steps"`
+}
+
+// RotationStep happens either at a fixed time or some time after the
+// previous step. Its keys are published first, then the signing key is
+// switched, then keys are retired.
+type RotationStep struct {
+	At       string   `yaml:"at"`
+	After    string   `yaml:"after"`
+	Publish  []string `yaml:"publish"`
+	Activate string   `yaml:"activate"`
+	Retire   []string `yaml:"retire"`
+}
+
+// rotationState is what verifiers and signers see between two steps.
+type rotationState struct {
+	// published holds when each key was published; keys published before
+	// the plan starts are zero, as every cache already has them.
+	published map[string]time.Time
+	// signedUntil holds when former signing keys stopped signing.
+	signedUntil map[string]time.Time
+	active      string
+	retired     []string
+}
+
+func (s *rotationState) publishedKids() []string {
+	var kids []string
+	for k := range s.published {
+		kids = append(kids, k)
+	}
+	sort.Strings(kids)
+	return kids
+}
+
+// stepTime resolves when a step happens, given the previous step's time.
+func stepTime(step RotationStep, prev time.Time) (time.Time, error) {
+	switch {
+	case step.At != "" && step.After != "":
+		return time.Time{}, errors.New("a step can't have both at and after")
+	case step.At != "":
+		return time.Parse(time.RFC3339, step.At)
+	case step.After != "":
+		d, err := parseDuration(step.After)
+		return prev.Add(d), err
+	}
+	return time.Time{}, errors.New("a step needs at or after")
+}
+
+// simulate runs plan against the kids published today and returns the
+// table rows and the problems found.
+func simulate(plan RotationPlan, kids []string) ([][]string, []string, error) {
+	start := timestamp().UTC().Truncate(time.Second)
+	if plan.Start != "" {
+		var err error
+		if start, err = time.Parse(time.RFC3339, plan.Start); err != nil {
+			return nil, nil, fmt.Errorf("invalid start: %s", err)
+		}
+	}
+	var cacheTTL, tokenTTL time.Duration
+	for _, d := range []struct {
+		name, value string
+		dst         *time.Duration
+	}{{"cache_ttl", plan.CacheTTL, &cacheTTL}, {"token_ttl", plan.TokenTTL, &tokenTTL}} {
+		if d.value == "" {
+			return nil, nil, fmt.Errorf("the plan needs %s", d.name)
+		}
+		v, err := parseDuration(d.value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s: %s", d.name, err)
+		}
+		*d.dst = v
+	}
+
+	s := rotationState{published: map[string]time.Time{}, signedUntil: map[string]time.Time{}, active: plan.Active}
+	for _, k := range kids {
+		s.published[k] = time.Time{}
+	}
+	if s.active == "" && len(kids) == 1 {
+		s.active = kids[0]
+	}
+	if _, ok := s.published[s.active]; !ok {
+		return nil, nil, fmt.Errorf("the initial signing key %q is not in the key set", s.active)
+	}
+
+	const layout = "2006-01-02 15:04"
+	var rows [][]string
+	var problems []string
+	row := func(at time.Time, change string) {
+		rows = append(rows, []string{at.Format(layout), change,
+			strings.Join(s.publishedKids(), ","), s.active, strings.Join(s.retired, ",")})
+	}
+	row(start, "start")
+
+	prev := start
+	for i, step := range plan.Steps {
+		at, err := stepTime(step, prev)
+		if err != nil {
+			return nil, nil, fmt.Errorf("step %d: %s", i+1, err)
+		}
+		if at.Before(prev) {
+			return nil, nil, fmt.Errorf("step %d happens before the one before it", i+1)
+		}
+		prev = at
+		problem := func(format string, args ...interface{}) {
+			problems = append(problems, fmt.Sprintf("%s: ", at.Format(layout))+fmt.Sprintf(format, args...))
+		}
+
+		var changes []string
+		for _, k := range step.Publish {
+			if _, ok := s.published[k]; ok {
+				problem("%s is already published", k)
+				continue
+			}
+			s.published[k] = at
+			changes = append(changes, "publish "+k)
+		}
+		if k := step.Activate; k != "" && k != s.active {
+			published, ok := s.published[k]
+			switch {
+			case !ok:
+				problem("signing with %s, which is not published", k)
+			case at.Before(published.Add(cacheTTL)):
+				problem("signing with %s, but verifiers with a cached key set lack it until %s",
+					k, published.Add(cacheTTL).Format(layout))
+			}
+			s.signedUntil[s.active] = at
+			delete(s.signedUntil, k)
+			s.active = k
+			changes = append(changes, "activate "+k)
+		}
+		for _, k := range step.Retire {
+			if _, ok := s.published[k]; !ok {
+				problem("retiring %s, which is not published", k)
+				continue
+			}
+			if k == s.active {
+				problem("retiring %s while it is still signing", k)
+			} else if until, ok := s.signedUntil[k]; ok && at.Before(until.Add(tokenTTL)) {
+				problem("retiring %s while tokens it signed stay valid until %s", k, until.Add(tokenTTL).Format(layout))
+			}
+			delete(s.published, k)
+			s.retired = append(s.retired, k)
+			changes = append(changes, "retire "+k)
+		}
+		if len(changes) == 0 {
+			changes = append(changes, "nothing")
+		}
+		row(at, strings.Join(changes, ", "))
+	}
+	return rows, problems, nil
+}
+
+func simulateRotation() {
+	set, err := readRawJWKS(*simulateJWKS, false)
+	app.FatalIfError(err, "can't read key set %s", *simulateJWKS)
+	var kids []string
+	for _, k := range set.Keys {
+		if k.Kid() == "" {
+			app.Fatalf("%s holds a key without a kid, which a rotation can't refer to", *simulateJWKS)
+		}
+		kids = append(kids, k.Kid())
+	}
+
+	b, err := readInput(*simulatePlan)
+	app.FatalIfError(err, "can't read %s", *simulatePlan)
+	var plan RotationPlan
+	app.FatalIfError(yaml.UnmarshalStrict(b, &plan), "can't parse %s", *simulatePlan)
+
+	rows, problems, err := simulate(plan, kids)
+	app.FatalIfError(err, "invalid plan %s", *simulatePlan)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "AT\tCHANGE\tPUBLISHED\tSIGNING\tRETIRED")
+	for _, r := range rows {
+		for i := range r {
+			r[i] = dash(r[i])
+		}
+		fmt.Fprintln(w, strings.Join(r, "\t"))
+	}
+	w.Flush()
+
+	for _, p := range problems {
+		fmt.Fprintln(logw, p)
+	}
+	if len(problems) > 0 {
+		app.Fatalf("%d problems found in the plan", len(problems))
+	}
+}
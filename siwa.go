@@ -0,0 +1,88 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"fmt"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	siwaCmd      = app.Command("siwa-secret", "Mint the client secret JWT for Sign in with Apple")
+	siwaKey      = siwaCmd.Flag("key", "ES256 private key, as a JWK or the .p8 file Apple hands out").Required().String()
+	siwaTeamID   = siwaCmd.Flag("team-id", "Apple Developer team ID, used as iss").Required().String()
+	siwaKeyID    = siwaCmd.Flag("key-id", "Key ID Apple assigned to the key, used as kid (defaults to the JWK's kid)").String()
+	siwaClientID = siwaCmd.Flag("client-id", "Services ID or bundle ID, used as sub").Required().String()
+	siwaLifetime = siwaCmd.Flag("lifetime", "How long the secret is valid, at most 180 days").Default("4320h").Duration()
+)
+
+const (
+	// siwaAudience is the aud Apple requires of client secrets.
+	siwaAudience = "https://appleid.apple.com"
+	// siwaMaxLifetime is the longest exp Apple accepts: 15777000 seconds,
+	// about six months.
+	siwaMaxLifetime = 15777000 * time.Second
+)
+
+// SIWAClientSecret holds the claims of a Sign in with Apple client secret.
+type SIWAClientSecret struct {
+	Issuer   string `json:"iss"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+	Audience string `json:"aud"`
+	Subject  string `json:"sub"`
+}
+
+func siwaSecret() {
+	if *siwaLifetime <= 0 || *siwaLifetime > siwaMaxLifetime {
+		app.FatalUsage("--lifetime must be positive and at most 180 days")
+	}
+	priv, _, err := readKey(*siwaKey)
+	app.FatalIfError(err, "can't read key %s", *siwaKey)
+	ec, ok := priv.(*ecdsa.PrivateKey)
+	if !ok || ec.Curve != elliptic.P256() {
+		app.Fatalf("%s is not a P-256 private key, Sign in with Apple keys are ES256", *siwaKey)
+	}
+
+	keyID := *siwaKeyID
+	if keyID == "" {
+		if jwk, err := readJWK(*siwaKey); err == nil {
+			keyID = jwk.KeyID
+		}
+	}
+	if keyID == "" {
+		app.FatalUsage("--key-id is required unless the JWK has a kid")
+	}
+
+	now := timestamp()
+	claims := SIWAClientSecret{
+		Issuer:   *siwaTeamID,
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(*siwaLifetime).Unix(),
+		Audience: siwaAudience,
+		Subject:  *siwaClientID,
+	}
+	// Apple documents the header as alg and kid only.
+	key := &jose.JSONWebKey{Key: ec, KeyID: keyID}
+	token, err := signJWT(key, jose.ES256, "", nil, claims)
+	app.FatalIfError(err, "can't sign client secret")
+	fmt.Println(token)
+}
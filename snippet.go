@@ -0,0 +1,215 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"text/template"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	snippetCmd  = app.Command("snippet", "Print code that verifies or encrypts with a public key using a popular JOSE library")
+	snippetLang = snippetCmd.Flag("lang", "Language: go (go-jose), node (jose), python (jwcrypto) or java (Nimbus JOSE+JWT)").Required().Enum("go", "node", "python", "java")
+	snippetKey  = snippetCmd.Flag("key", "JWK to write the snippet for (- for stdin); only its public part is used").Required().String()
+	snippetEnc  = snippetCmd.Flag("enc", "Content encryption algorithm, for encryption keys").Default(string(jose.A256GCM)).Enum(
+		string(jose.A128CBC_HS256), string(jose.A192CBC_HS384), string(jose.A256CBC_HS512),
+		string(jose.A128GCM), string(jose.A192GCM), string(jose.A256GCM),
+	)
+)
+
+// snippetData is what the snippet templates are rendered with.
+type snippetData struct {
+	JWK string
+	Alg string
+	Enc string
+	Kty string
+	Sig bool
+}
+
+var snippetFuncs = template.FuncMap{
+	// bt is a backtick, which can't appear in the raw strings below.
+	"bt":    func() string { return "`" },
+	"quote": strconv.Quote,
+}
+
+var snippetTemplates = map[string]*template.Template{
+	"go": template.Must(template.New("go").Funcs(snippetFuncs).Parse(`package main
+
+import (
+	"gopkg.in/square/go-jose.v2"
+)
+
+const jwk = {{bt}}{{.JWK}}{{bt}}
+{{if .Sig}}
+func verify(token string) ([]byte, error) {
+	var key jose.JSONWebKey
+	if err := key.UnmarshalJSON([]byte(jwk)); err != nil {
+		return nil, err
+	}
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		return nil, err
+	}
+	return jws.Verify(&key)
+}
+{{else}}
+func encrypt(plaintext []byte) (string, error) {
+	var key jose.JSONWebKey
+	if err := key.UnmarshalJSON([]byte(jwk)); err != nil {
+		return "", err
+	}
+	enc, err := jose.NewEncrypter(jose.ContentEncryption("{{.Enc}}"),
+		jose.Recipient{Algorithm: jose.KeyAlgorithm("{{.Alg}}"), Key: &key}, nil)
+	if err != nil {
+		return "", err
+	}
+	jwe, err := enc.Encrypt(plaintext)
+	if err != nil {
+		return "", err
+	}
+	return jwe.CompactSerialize()
+}
+{{end}}`)),
+
+	"node": template.Must(template.New("node").Funcs(snippetFuncs).Parse(`import * as jose from 'jose';
+
+const jwk = {{.JWK}};
+{{if .Sig}}
+export async function verify(token) {
+  const key = await jose.importJWK(jwk, '{{.Alg}}');
+  const { payload } = await jose.compactVerify(token, key);
+  return payload;
+}
+{{else}}
+export async function encrypt(plaintext) {
+  const key = await jose.importJWK(jwk, '{{.Alg}}');
+  return new jose.CompactEncrypt(new TextEncoder().encode(plaintext))
+    .setProtectedHeader({ alg: '{{.Alg}}', enc: '{{.Enc}}' })
+    .encrypt(key);
+}
+{{end}}`)),
+
+	"python": template.Must(template.New("python").Funcs(snippetFuncs).Parse(`from jwcrypto import jwe, jwk, jws
+from jwcrypto.common import json_encode
+
+KEY = jwk.JWK.from_json(r'''{{.JWK}}''')
+{{if .Sig}}
+
+def verify(token):
+    sig = jws.JWS()
+    sig.deserialize(token)
+    sig.verify(KEY, alg="{{.Alg}}")
+    return sig.payload
+{{else}}
+
+def encrypt(plaintext):
+    token = jwe.JWE(plaintext.encode(), json_encode({"alg": "{{.Alg}}", "enc": "{{.Enc}}"}))
+    token.add_recipient(KEY)
+    return token.serialize(compact=True)
+{{end}}`)),
+
+	"java": template.Must(template.New("java").Funcs(snippetFuncs).Parse(`import com.nimbusds.jose.*;
+import com.nimbusds.jose.crypto.*;
+import com.nimbusds.jose.jwk.*;
+
+public class Keys {
+    static final String KEY = {{quote .JWK}};
+{{if .Sig}}
+    public static String verify(String token) throws Exception {
+        JWK jwk = JWK.parse(KEY);
+        JWSObject jws = JWSObject.parse(token);
+{{- if eq .Kty "OKP"}}
+        JWSVerifier verifier = new Ed25519Verifier(jwk.toOctetKeyPair());
+{{- else if eq .Kty "EC"}}
+        JWSVerifier verifier = new ECDSAVerifier(jwk.toECKey());
+{{- else}}
+        JWSVerifier verifier = new RSASSAVerifier(jwk.toRSAKey());
+{{- end}}
+        if (!jws.verify(verifier)) {
+            throw new JOSEException("invalid signature");
+        }
+        return jws.getPayload().toString();
+    }
+{{else}}
+    public static String encrypt(String plaintext) throws Exception {
+        JWK jwk = JWK.parse(KEY);
+{{- if eq .Kty "EC"}}
+        JWEEncrypter encrypter = new ECDHEncrypter(jwk.toECKey());
+{{- else}}
+        JWEEncrypter encrypter = new RSAEncrypter(jwk.toRSAKey());
+{{- end}}
+        JWEObject jwe = new JWEObject(
+            new JWEHeader(JWEAlgorithm.parse("{{.Alg}}"), EncryptionMethod.parse("{{.Enc}}")),
+            new Payload(plaintext));
+        jwe.encrypt(encrypter);
+        return jwe.serialize();
+    }
+{{end}}}
+`)),
+}
+
+// keyIsSig tells signing keys from encryption keys by their use or, if
+// that is missing, their algorithm.
+func keyIsSig(k *jose.JSONWebKey) (bool, error) {
+	switch k.Use {
+	case "sig":
+		return true, nil
+	case "enc":
+		return false, nil
+	}
+	switch k.Algorithm {
+	case string(jose.ES256), string(jose.ES384), string(jose.ES512), string(jose.EdDSA),
+		string(jose.RS256), string(jose.RS384), string(jose.RS512),
+		string(jose.PS256), string(jose.PS384), string(jose.PS512):
+		return true, nil
+	case "":
+		return false, errors.New("key has neither `use` nor `alg`")
+	default:
+		return false, nil
+	}
+}
+
+func snippet() {
+	k, err := readJWK(*snippetKey)
+	app.FatalIfError(err, "can't read key")
+	if k.Algorithm == "" {
+		app.Fatalf("the key has no `alg`, which the snippet needs")
+	}
+	sig, err := keyIsSig(k)
+	app.FatalIfError(err, "can't tell how the key is used")
+
+	// Never paste private keys into code.
+	pub := k.Public()
+	if !pub.Valid() {
+		app.Fatalf("the key has no public part")
+	}
+	pubJS, err := pub.MarshalJSON()
+	app.FatalIfError(err, "can't Marshal public key to JSON")
+
+	err = snippetTemplates[*snippetLang].Execute(os.Stdout, snippetData{
+		JWK: string(pubJS),
+		Alg: k.Algorithm,
+		Enc: *snippetEnc,
+		Kty: keyType(pub.Key),
+		Sig: sig,
+	})
+	app.FatalIfError(err, "can't render snippet")
+}
@@ -0,0 +1,79 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// sqlString quotes s as an SQL string literal. MySQL also treats
+// backslashes as escapes by default, so they are doubled for it.
+func sqlString(dialect, s string) string {
+	s = strings.Replace(s, "'", "''", -1)
+	if dialect == "mysql" {
+		s = strings.Replace(s, `\`, `\\`, -1)
+	}
+	return "'" + s + "'"
+}
+
+func sqlNullable(dialect, s string) string {
+	if s == "" {
+		return "NULL"
+	}
+	return sqlString(dialect, s)
+}
+
+// renderSQL returns, for MySQL, statements loading the public key into a
+// jwt_keys table and, for PostgreSQL, one setting the HMAC key PostgREST
+// and pgjwt-based functions read from the database. That is the only
+// private key that goes into SQL, where it would end up in logs and
+// replicas, as the database is where those look for it.
+func renderSQL(priv, pub jose.JSONWebKey) ([]byte, error) {
+	var sql string
+	switch *sqlOut {
+	case "pgjwt":
+		b, err := priv.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		sql = fmt.Sprintf(`DO $$
+BEGIN
+    EXECUTE format('ALTER DATABASE %%I SET app.settings.jwt_secret = %%L', current_database(), %s);
+END
+$$;
+`, sqlString("pg", string(b)))
+	case "mysql":
+		b, err := pub.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		jwk := string(b)
+		sql = fmt.Sprintf("CREATE TABLE IF NOT EXISTS jwt_keys (\n"+
+			"    kid VARCHAR(255) UNIQUE,\n"+
+			"    alg VARCHAR(32) NOT NULL,\n"+
+			"    `use` VARCHAR(8) NOT NULL,\n"+
+			"    jwk JSON NOT NULL,\n"+
+			"    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP\n"+
+			");\n"+
+			"INSERT IGNORE INTO jwt_keys (kid, alg, `use`, jwk) VALUES (%s, %s, %s, %s);\n",
+			sqlNullable("mysql", pub.KeyID), sqlString("mysql", pub.Algorithm), sqlString("mysql", pub.Use), sqlString("mysql", jwk))
+	}
+	return []byte(sql), nil
+}
@@ -0,0 +1,115 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+var sshOut = generateCmd.Flag("ssh", "Generate as OpenSSH private key and authorized_keys line too").Bool()
+
+// sshCurves are the OpenSSH names of the ECDSA curves.
+var sshCurves = map[string]string{"P-256": "nistp256", "P-384": "nistp384", "P-521": "nistp521"}
+
+// marshalSSHPublicKey returns pub as an authorized_keys line, with the
+// comment, if any, at the end.
+func marshalSSHPublicKey(pub crypto.PublicKey, comment string) ([]byte, error) {
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	line := ssh.MarshalAuthorizedKey(sshPub)
+	if comment != "" {
+		line = append(line[:len(line)-1], " "+comment+"\n"...)
+	}
+	return line, nil
+}
+
+// marshalSSHPrivateKey returns priv in the unencrypted openssh-key-v1
+// format of ssh-keygen, which x/crypto/ssh can read but not write.
+func marshalSSHPrivateKey(priv crypto.PrivateKey, comment string) ([]byte, error) {
+	var pub crypto.PublicKey
+	var fields []byte
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		if len(k.Primes) != 2 {
+			return nil, fmt.Errorf("OpenSSH only takes RSA keys with two primes")
+		}
+		k.Precompute()
+		pub = &k.PublicKey
+		fields = ssh.Marshal(struct {
+			N, E, D, Iqmp, P, Q *big.Int
+		}{k.N, big.NewInt(int64(k.E)), k.D, k.Precomputed.Qinv, k.Primes[0], k.Primes[1]})
+	case *ecdsa.PrivateKey:
+		curve, ok := sshCurves[k.Curve.Params().Name]
+		if !ok {
+			return nil, fmt.Errorf("OpenSSH doesn't take keys on curve %s", k.Curve.Params().Name)
+		}
+		pub = &k.PublicKey
+		fields = ssh.Marshal(struct {
+			Curve string
+			Q     []byte
+			D     *big.Int
+		}{curve, elliptic.Marshal(k.Curve, k.X, k.Y), k.D})
+	case ed25519.PrivateKey:
+		pub = k.Public()
+		fields = ssh.Marshal(struct {
+			Pub, Priv []byte
+		}{[]byte(pub.(ed25519.PublicKey)), []byte(k)})
+	default:
+		return nil, fmt.Errorf("OpenSSH doesn't take %T keys", priv)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	// The check integers only tell a wrong passphrase, so they are taken
+	// from the public key rather than at random to keep output
+	// reproducible.
+	sum := sha256.Sum256(sshPub.Marshal())
+	check := binary.BigEndian.Uint32(sum[:4])
+	block := ssh.Marshal(struct {
+		Check1, Check2 uint32
+		Type           string
+		Fields         []byte `ssh:"rest"`
+	}{check, check, sshPub.Type(), fields})
+	block = append(block, ssh.Marshal(struct{ Comment string }{comment})...)
+	for i := byte(1); len(block)%8 != 0; i++ {
+		block = append(block, i)
+	}
+	key := ssh.Marshal(struct {
+		Cipher, KDF, KDFOptions string
+		Keys                    uint32
+		Public, Private         []byte
+	}{"none", "none", "", 1, sshPub.Marshal(), block})
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: append([]byte("openssh-key-v1\x00"), key...),
+	}), nil
+}
@@ -0,0 +1,250 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// stagedFile is an output written under a temporary name, waiting to be
+// linked into place.
+type stagedFile struct {
+	tmp, file, what string
+	// replace renames the file over an existing one instead of linking it.
+	replace bool
+}
+
+// staging collects file writes so that either all of them appear or none
+// do. Files are first written to temporary names in a private directory
+// next to their final location, then hard linked into place, which fails
+// rather than overwriting an existing file. SIGINT and SIGTERM wait for
+// each step to finish, see stopOnSignal.
+type staging struct {
+	files []stagedFile
+	// dirs are the private directories files are staged in, by the
+	// directory they are for.
+	dirs map[string]string
+	// status is where written files are reported, stdout if nil.
+	status io.Writer
+	// locks are lock files held until the files are committed or
+	// aborted, see lockKidSequence.
+	locks []string
+}
+
+// pending holds the files staged by the current command.
+var pending staging
+
+func (s *staging) add(file, what string, data []byte, perm os.FileMode) error {
+	return s.stage(file, what, data, perm, false)
+}
+
+// replace stages a new version of an existing file, such as a key set that
+// is being updated. Replacements are renamed into place after all new
+// files are linked, so a conflict leaves them untouched, and a failed
+// rename puts back the files already replaced.
+func (s *staging) replace(file, what string, data []byte, perm os.FileMode) error {
+	return s.stage(file, what, data, perm, true)
+}
+
+func (s *staging) stage(file, what string, data []byte, perm os.FileMode, replace bool) error {
+	defer holdSignals()()
+	dir, base := filepath.Split(file)
+	if dir == "" {
+		dir = "."
+	}
+	tmpDir, err := s.privateDir(dir)
+	if err != nil {
+		return err
+	}
+	tmp, err := writeTemp(tmpDir, base+".tmp", data, perm)
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, stagedFile{tmp: tmp, file: file, what: what, replace: replace})
+	// The label travels with the inode, so the final name gets it too.
+	return labelFile(tmp)
+}
+
+// privateDir returns the directory files for dir are staged in: a 0700
+// directory of this run inside dir, so that staged files can be linked
+// into place, yet nobody else can open them before they are.
+func (s *staging) privateDir(dir string) (string, error) {
+	if tmpDir, ok := s.dirs[dir]; ok {
+		return tmpDir, nil
+	}
+	tmpDir, err := ioutil.TempDir(dir, stagingDirPrefix)
+	if err != nil {
+		return "", err
+	}
+	if s.dirs == nil {
+		s.dirs = map[string]string{}
+	}
+	s.dirs[dir] = tmpDir
+	return tmpDir, nil
+}
+
+// stagingDirPrefix starts the names of the private staging directories.
+const stagingDirPrefix = ".jwk-keygen-"
+
+// writeNamedTemp writes data to a new temporary file in dir, named after
+// pattern as ioutil.TempFile does, and gives it perm once it is complete.
+// The file is synced, as a journaled commit may be finished from it after
+// a crash.
+func writeNamedTemp(dir, pattern string, data []byte, perm os.FileMode) (string, error) {
+	f, err := ioutil.TempFile(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// backupName is where commit keeps the file a staged replacement tmp
+// replaces, until the commit is done.
+func backupName(tmp string) string {
+	return tmp + ".old"
+}
+
+// commit moves every staged file into place. If any of them fails, the
+// new files already in place are removed again and the replaced files
+// restored from the links commit keeps to them. When there is more than
+// one file, the move is journaled, so that a crash half way is finished or
+// undone on the next run, see recoverJournal.
+func (s *staging) commit() error {
+	defer holdSignals()()
+	defer s.abort()
+	if len(s.files) > 1 {
+		closeJournal, err := openJournal(s.files)
+		if err != nil {
+			return fmt.Errorf("can't write journal: %s", err)
+		}
+		defer closeJournal()
+	}
+	var linked []string
+	for _, f := range s.files {
+		if f.replace {
+			continue
+		}
+		debugf("moving %s into place as %s", f.tmp, f.file)
+		if err := os.Link(f.tmp, f.file); err != nil {
+			for _, done := range linked {
+				os.Remove(done)
+			}
+			if os.IsExist(err) {
+				err = fmt.Errorf("%s already exists", f.file)
+			}
+			return err
+		}
+		linked = append(linked, f.file)
+	}
+	// backups are the replaced files, "" for those that didn't exist.
+	var replaced, backups []string
+	undo := func() {
+		for i := len(replaced) - 1; i >= 0; i-- {
+			if backups[i] == "" {
+				os.Remove(replaced[i])
+			} else {
+				os.Rename(backups[i], replaced[i])
+			}
+		}
+		for _, done := range linked {
+			os.Remove(done)
+		}
+	}
+	for _, f := range s.files {
+		if !f.replace {
+			continue
+		}
+		debugf("replacing %s with %s", f.file, f.tmp)
+		backup := backupName(f.tmp)
+		if err := os.Link(f.file, backup); os.IsNotExist(err) {
+			backup = ""
+		} else if err != nil {
+			undo()
+			return err
+		}
+		if err := os.Rename(f.tmp, f.file); err != nil {
+			if backup != "" {
+				os.Remove(backup)
+			}
+			undo()
+			return err
+		}
+		replaced, backups = append(replaced, f.file), append(backups, backup)
+	}
+	for _, backup := range backups {
+		if backup != "" {
+			os.Remove(backup)
+		}
+	}
+	status := s.statusWriter()
+	for _, f := range s.files {
+		if f.what != "" {
+			fmt.Fprintf(status, "Written %s to %s\n", f.what, f.file)
+		}
+	}
+	return nil
+}
+
+// statusWriter returns where to report written files.
+func (s *staging) statusWriter() io.Writer {
+	if s.status == nil {
+		return os.Stdout
+	}
+	return s.status
+}
+
+// abort removes the temporary files and their directories without
+// touching the final names, and releases the locks.
+func (s *staging) abort() {
+	for _, f := range s.files {
+		os.Remove(f.tmp)
+	}
+	for _, tmpDir := range s.dirs {
+		os.Remove(tmpDir)
+	}
+	for _, lock := range s.locks {
+		os.Remove(lock)
+	}
+	s.files, s.dirs, s.locks = nil, nil, nil
+}
+
+// fatalIfStaged is app.FatalIfError for errors raised while files are
+// staged, which would otherwise leave temporary files behind.
+func fatalIfStaged(err error, format string, args ...interface{}) {
+	if err != nil {
+		pending.abort()
+		app.FatalIfError(err, format, args...)
+	}
+}
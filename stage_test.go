@@ -0,0 +1,170 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stagingTest returns a directory for the files of a test, with the
+// journal of multi-file commits kept in it too.
+func stagingTest(t *testing.T) (dir string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "jwk-keygen-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStateDir := *stateDir
+	*stateDir = filepath.Join(dir, "state")
+	return dir, func() {
+		*stateDir = oldStateDir
+		os.RemoveAll(dir)
+	}
+}
+
+// checkNoStaging fails if a staging directory or journal is left in dir.
+func checkNoStaging(t *testing.T, dir string) {
+	t.Helper()
+	left, _ := filepath.Glob(filepath.Join(dir, stagingDirPrefix+"*"))
+	if len(left) > 0 {
+		t.Errorf("staging directories left behind: %v", left)
+	}
+	if _, err := os.Stat(journalFile()); !os.IsNotExist(err) {
+		t.Errorf("journal left behind: %v", err)
+	}
+}
+
+func TestCommitPerms(t *testing.T) {
+	tests := []struct {
+		name    string
+		perm    os.FileMode
+		replace bool
+	}{
+		{"private key", 0400, false},
+		{"public key", 0444, false},
+		{"state", 0600, false},
+		{"replaced key set", 0444, true},
+		{"replaced private file", 0400, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, cleanup := stagingTest(t)
+			defer cleanup()
+			file := filepath.Join(dir, "out.json")
+			if tt.replace {
+				if err := ioutil.WriteFile(file, []byte("old"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s := staging{status: ioutil.Discard}
+			if err := s.stage(file, "output", []byte("new"), tt.perm, tt.replace); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.commit(); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fi.Mode().Perm(); got != tt.perm {
+				t.Errorf("mode = %v, want %v", got, tt.perm)
+			}
+			if b, _ := ioutil.ReadFile(file); string(b) != "new" {
+				t.Errorf("content = %q, want %q", b, "new")
+			}
+			checkNoStaging(t, dir)
+		})
+	}
+}
+
+func TestCommitRollback(t *testing.T) {
+	// Files are named relative to the test directory. Files set to ""
+	// mustn't exist.
+	tests := []struct {
+		name   string
+		before map[string]string
+		add    []string
+		repl   []string
+		// breakDir is removed after staging, so that moving the files
+		// staged for it fails.
+		breakDir string
+		after    map[string]string
+	}{
+		{
+			name:   "new file exists",
+			before: map[string]string{"set.json": "old set", "key.json": "other key"},
+			add:    []string{"new.json", "key.json"},
+			repl:   []string{"set.json"},
+			after:  map[string]string{"set.json": "old set", "key.json": "other key", "new.json": ""},
+		},
+		{
+			name:     "rename fails",
+			before:   map[string]string{"set.json": "old set", "sub/other.json": "old other"},
+			add:      []string{"key.json"},
+			repl:     []string{"set.json", "fresh.json", "sub/other.json"},
+			breakDir: "sub",
+			after:    map[string]string{"set.json": "old set", "fresh.json": "", "key.json": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, cleanup := stagingTest(t)
+			defer cleanup()
+			for name, content := range tt.before {
+				file := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s := staging{status: ioutil.Discard}
+			for _, name := range tt.add {
+				if err := s.add(filepath.Join(dir, name), "", []byte("new"), 0400); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, name := range tt.repl {
+				if err := s.replace(filepath.Join(dir, name), "", []byte("new"), 0444); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.breakDir != "" {
+				if err := os.RemoveAll(filepath.Join(dir, tt.breakDir)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.commit(); err == nil {
+				t.Fatal("commit succeeded")
+			}
+			for name, want := range tt.after {
+				b, err := ioutil.ReadFile(filepath.Join(dir, name))
+				switch {
+				case want == "" && !os.IsNotExist(err):
+					t.Errorf("%s exists after rollback", name)
+				case want != "" && string(b) != want:
+					t.Errorf("%s = %q after rollback, want %q (%v)", name, b, want, err)
+				}
+			}
+			checkNoStaging(t, dir)
+		})
+	}
+}
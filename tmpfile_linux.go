@@ -0,0 +1,81 @@
+//go:build linux
+// +build linux
+
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// openTmpfile and linkTmpfile are the system calls of writeTemp, which
+// tests replace to make them fail.
+var (
+	openTmpfile = func(dir string) (int, error) {
+		return unix.Open(dir, unix.O_TMPFILE|unix.O_WRONLY|unix.O_CLOEXEC, 0600)
+	}
+	linkTmpfile = func(fd int, name string) error {
+		return unix.Linkat(unix.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", fd), unix.AT_FDCWD, name, unix.AT_SYMLINK_FOLLOW)
+	}
+)
+
+// writeTemp is writeNamedTemp, but creates the file unnamed with O_TMPFILE
+// and only links it into dir once it is complete and has perm, so it is
+// never seen half written. Where the filesystem or /proc can't do that,
+// it falls back to writeNamedTemp.
+func writeTemp(dir, pattern string, data []byte, perm os.FileMode) (string, error) {
+	fd, err := openTmpfile(dir)
+	if err != nil {
+		debugf("can't use O_TMPFILE in %s: %s", dir, err)
+		return writeNamedTemp(dir, pattern, data, perm)
+	}
+	f := os.NewFile(uintptr(fd), dir)
+	defer f.Close()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err != nil {
+		return "", err
+	}
+	random := make([]byte, 6)
+	for {
+		if _, err := rand.Read(random); err != nil {
+			return "", err
+		}
+		name := filepath.Join(dir, pattern+hex.EncodeToString(random))
+		err := linkTmpfile(fd, name)
+		switch err {
+		case nil:
+			return name, nil
+		case unix.EEXIST:
+			continue
+		}
+		debugf("can't link O_TMPFILE file into %s: %s", dir, err)
+		return writeNamedTemp(dir, pattern, data, perm)
+	}
+}
@@ -0,0 +1,81 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestWriteTemp(t *testing.T) {
+	realOpen, realLink := openTmpfile, linkTmpfile
+	defer func() { openTmpfile, linkTmpfile = realOpen, realLink }()
+
+	tests := []struct {
+		name string
+		open func(dir string) (int, error)
+		link func(fd int, name string) error
+	}{
+		{"O_TMPFILE", realOpen, realLink},
+		{"filesystem without O_TMPFILE", func(string) (int, error) { return -1, unix.EOPNOTSUPP }, realLink},
+		{"no /proc", realOpen, func(int, string) error { return unix.ENOENT }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "jwk-keygen-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			if tt.name == "O_TMPFILE" {
+				if fd, err := realOpen(dir); err != nil {
+					t.Skipf("%s doesn't support O_TMPFILE: %s", dir, err)
+				} else {
+					unix.Close(fd)
+				}
+			}
+			openTmpfile, linkTmpfile = tt.open, tt.link
+
+			name, err := writeTemp(dir, "key.json.tmp", []byte("data"), 0400)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filepath.Dir(name) != dir || !strings.HasPrefix(filepath.Base(name), "key.json.tmp") {
+				t.Errorf("name = %s, want key.json.tmp* in %s", name, dir)
+			}
+			fi, err := os.Stat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0400 {
+				t.Errorf("mode = %v, want 0400", fi.Mode().Perm())
+			}
+			if b, _ := ioutil.ReadFile(name); string(b) != "data" {
+				t.Errorf("content = %q, want %q", b, "data")
+			}
+			// A failed link mustn't leave a second file behind.
+			if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+				t.Errorf("%d files in %s, want 1", len(entries), dir)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+)
+
+var (
+	validateCmd    = app.Command("validate", "Check that keys can be imported by a given consumer")
+	validateTarget = validateCmd.Flag("target", "Consumer to check against").Required().Enum("webcrypto")
+	validateIn     = validateCmd.Arg("keys", "JWK or JWKS to check (- for stdin)").Required().String()
+)
+
+// validationIssue is a reason a key may not import. Errors make import
+// fail, warnings only limit how the imported key can be used.
+type validationIssue struct {
+	Fatal bool
+	Msg   string
+}
+
+func (i validationIssue) String() string {
+	if i.Fatal {
+		return "error: " + i.Msg
+	}
+	return "warning: " + i.Msg
+}
+
+// validators maps --target values to their checks.
+var validators = map[string]func(safeio.RawKey) []validationIssue{
+	"webcrypto": validateWebCrypto,
+}
+
+// webCryptoAlgs maps the JWK algorithms crypto.subtle.importKey accepts to
+// the use their WebCrypto algorithm implies. Per the WebCrypto spec, ECDH
+// and X25519 import ignore `alg`, so those are checked by curve instead.
+var webCryptoAlgs = map[string]string{
+	"RS256": "sig", "RS384": "sig", "RS512": "sig",
+	"PS256": "sig", "PS384": "sig", "PS512": "sig",
+	"ES256": "sig", "ES384": "sig", "ES512": "sig",
+	"HS256": "sig", "HS384": "sig", "HS512": "sig",
+	"EdDSA": "sig", "Ed25519": "sig",
+	"RSA-OAEP": "enc", "RSA-OAEP-256": "enc", "RSA-OAEP-384": "enc", "RSA-OAEP-512": "enc",
+	"ECDH-ES": "enc", "ECDH-ES+A128KW": "enc", "ECDH-ES+A192KW": "enc", "ECDH-ES+A256KW": "enc",
+	"A128KW": "enc", "A192KW": "enc", "A256KW": "enc",
+	"A128GCM": "enc", "A192GCM": "enc", "A256GCM": "enc",
+	"A128CBC": "enc", "A192CBC": "enc", "A256CBC": "enc",
+	"A128CTR": "enc", "A192CTR": "enc", "A256CTR": "enc",
+}
+
+// ecdsaCurves is the curve each ECDSA alg must be used with.
+var ecdsaCurves = map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}
+
+// keyOps are the registered key_ops values and the use they belong to.
+var keyOps = map[string]string{
+	"sign": "sig", "verify": "sig",
+	"encrypt": "enc", "decrypt": "enc", "wrapKey": "enc", "unwrapKey": "enc",
+	"deriveKey": "enc", "deriveBits": "enc",
+}
+
+// privateOps can't be performed with a public key.
+var privateOps = map[string]bool{"sign": true, "decrypt": true, "unwrapKey": true, "deriveKey": true, "deriveBits": true}
+
+// base64Members are decoded with base64url by importKey, which rejects
+// padding and the standard alphabet.
+var base64Members = []string{"n", "e", "d", "p", "q", "dp", "dq", "qi", "x", "y", "k"}
+
+func validateWebCrypto(k safeio.RawKey) []validationIssue {
+	var issues []validationIssue
+	fail := func(format string, args ...interface{}) {
+		issues = append(issues, validationIssue{true, fmt.Sprintf(format, args...)})
+	}
+	warn := func(format string, args ...interface{}) {
+		issues = append(issues, validationIssue{false, fmt.Sprintf(format, args...)})
+	}
+
+	kty, alg, use := k.Kty(), k.Alg(), k.Use()
+	crv := k.Member("crv")
+	_, private := k["d"]
+	switch kty {
+	case "RSA":
+		if private {
+			for _, m := range []string{"p", "q", "dp", "dq", "qi"} {
+				if _, ok := k[m]; !ok {
+					fail("private RSA key lacks %q, browsers require all CRT parameters", m)
+				}
+			}
+		}
+		if _, ok := k["oth"]; ok {
+			fail("multi-prime RSA keys (`oth`) are not supported")
+		}
+	case "EC":
+		switch crv {
+		case "P-256", "P-384", "P-521":
+		default:
+			fail("curve %q is not supported, only P-256, P-384 and P-521 are", crv)
+		}
+		if want, ok := ecdsaCurves[alg]; ok && crv != want {
+			fail("alg %s requires curve %s, not %s", alg, want, crv)
+		}
+	case "OKP":
+		switch crv {
+		case "Ed25519":
+			if alg != "" && alg != "EdDSA" && alg != "Ed25519" {
+				fail("alg %s can't be used with an Ed25519 key", alg)
+			}
+		case "X25519":
+		default:
+			fail("curve %q is not supported, only Ed25519 and X25519 are", crv)
+		}
+		warn("%s keys are not available in older browsers", crv)
+	case "oct":
+	default:
+		fail("key type %q is not supported", kty)
+	}
+
+	if alg != "" {
+		algUse, ok := webCryptoAlgs[alg]
+		switch {
+		case !ok:
+			fail("alg %s has no WebCrypto equivalent", alg)
+		case use != "" && use != algUse:
+			fail("alg %s can't be imported with use %q", alg, use)
+		case strings.HasPrefix(alg, "ECDH-ES") && kty != "EC" && crv != "X25519":
+			fail("alg %s requires an EC or X25519 key", alg)
+		}
+	}
+	if use != "" && use != "sig" && use != "enc" {
+		fail("use %q is neither \"sig\" nor \"enc\"", use)
+	}
+
+	if raw, ok := k["key_ops"]; ok {
+		var ops []string
+		if err := json.Unmarshal(raw, &ops); err != nil {
+			fail("key_ops is not an array of strings")
+		}
+		seen := map[string]bool{}
+		for _, op := range ops {
+			opUse, ok := keyOps[op]
+			switch {
+			case !ok:
+				fail("key_ops holds unknown operation %q", op)
+			case seen[op]:
+				fail("key_ops lists %q twice", op)
+			case use != "" && opUse != use:
+				fail("key_ops %q contradicts use %q", op, use)
+			case !private && kty != "oct" && privateOps[op]:
+				warn("key_ops %q needs the private key", op)
+			}
+			seen[op] = true
+		}
+	}
+	if raw, ok := k["ext"]; ok {
+		var ext bool
+		if err := json.Unmarshal(raw, &ext); err != nil {
+			fail("ext is not a boolean")
+		}
+	}
+
+	for _, m := range base64Members {
+		if v := k.Member(m); strings.ContainsAny(v, "=+/") {
+			fail("member %q is not unpadded base64url", m)
+		}
+	}
+	return issues
+}
+
+func validate() {
+	b, err := readInput(*validateIn)
+	app.FatalIfError(err, "can't read %s", *validateIn)
+	keys, err := safeio.ParseRawKeys(b, inputLimits())
+	app.FatalIfError(err, "can't parse %s", *validateIn)
+
+	check := validators[*validateTarget]
+	failed := 0
+	for i, k := range keys {
+		name := fmt.Sprintf("key %d", i)
+		if kid := k.Kid(); kid != "" {
+			name = fmt.Sprintf("key %q", kid)
+		}
+		issues := check(k)
+		sort.SliceStable(issues, func(a, b int) bool { return issues[a].Fatal && !issues[b].Fatal })
+		if len(issues) == 0 {
+			fmt.Printf("%s: ok\n", name)
+			continue
+		}
+		if issues[0].Fatal {
+			failed++
+		}
+		for _, issue := range issues {
+			fmt.Printf("%s: %s\n", name, issue)
+		}
+	}
+	if failed > 0 {
+		app.Fatalf("%d of %d keys can't be imported by %s", failed, len(keys), *validateTarget)
+	}
+}
@@ -0,0 +1,158 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	vaultPath      = generateCmd.Flag("vault-path", "Write the private key to this Vault KV path instead of to a file, e.g. secret/data/myapp/jwk").String()
+	vaultAddr      = generateCmd.Flag("vault-addr", "Vault server").Envar("VAULT_ADDR").Default("https://127.0.0.1:8200").String()
+	vaultTokenFile = generateCmd.Flag("vault-token-file", "Read the Vault token from FILE instead of VAULT_TOKEN or ~/.vault-token").PlaceHolder("FILE").String()
+)
+
+// vaultToken takes the token from --vault-token-file, VAULT_TOKEN or the
+// ~/.vault-token the vault CLI logs in to, like the vault CLI does; it is
+// never accepted on the command line.
+func vaultToken() (string, error) {
+	if *vaultTokenFile != "" {
+		return readSecretFile(*vaultTokenFile)
+	}
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		if token, err := readSecretFile(filepath.Join(home, ".vault-token")); err == nil && token != "" {
+			return token, nil
+		}
+	}
+	return "", errors.New("VAULT_TOKEN, ~/.vault-token or --vault-token-file is required")
+}
+
+// vaultKVv2 reports whether path is in a KV version 2 engine, whose paths
+// have `data` after the mount.
+func vaultKVv2(path string) bool {
+	parts := strings.SplitN(path, "/", 3)
+	return len(parts) == 3 && parts[1] == "data"
+}
+
+func vaultRequest(method, path string, body []byte) (int, []byte, error) {
+	token, err := vaultToken()
+	if err != nil {
+		return 0, nil, err
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(*vaultAddr, "/")+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, b, err
+}
+
+// vaultError turns the errors of a Vault response into an error.
+func vaultError(status int, b []byte) error {
+	var resp struct {
+		Errors []string `json:"errors"`
+	}
+	if json.Unmarshal(b, &resp) == nil && len(resp.Errors) > 0 {
+		return fmt.Errorf("Vault responded with %d: %s", status, strings.Join(resp.Errors, "; "))
+	}
+	return fmt.Errorf("Vault responded with %d: %s", status, bytes.TrimSpace(b))
+}
+
+// writeToVault stores the private key under --vault-path: the JWK as
+// `jwk`, the JWKS as `jwks` with --jwks and the PEM as `pem` with --pem,
+// along with its kid, alg and use. Like key files, a secret that is
+// already there is never overwritten: KV version 2 writes are
+// check-and-set, version 1 paths are checked first.
+func writeToVault(priv jose.JSONWebKey) error {
+	data := map[string]string{"kid": priv.KeyID, "alg": priv.Algorithm, "use": priv.Use}
+	b, err := renderJWK(priv)
+	if err != nil {
+		return err
+	}
+	data["jwk"] = string(b)
+	if *jwks {
+		if b, err = renderJWKS(priv); err != nil {
+			return err
+		}
+		data["jwks"] = string(b)
+	}
+	if *pemOut {
+		if b, err = keygen.MarshalPrivateKeyPEM(priv.Key); err != nil {
+			return err
+		}
+		data["pem"] = string(b)
+	}
+
+	path := strings.Trim(*vaultPath, "/")
+	var body interface{} = data
+	if vaultKVv2(path) {
+		body = map[string]interface{}{"data": data, "options": map[string]int{"cas": 0}}
+	} else {
+		status, b, err := vaultRequest("GET", path, nil)
+		if err != nil {
+			return err
+		}
+		if status == http.StatusOK {
+			return fmt.Errorf("%s already exists in Vault", path)
+		}
+		if status != http.StatusNotFound {
+			return vaultError(status, b)
+		}
+	}
+	req, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	status, b, err := vaultRequest("POST", path, req)
+	if err != nil {
+		return err
+	}
+	if status/100 != 2 {
+		if vaultKVv2(path) && status == http.StatusBadRequest && bytes.Contains(b, []byte("check-and-set")) {
+			return fmt.Errorf("%s already exists in Vault", path)
+		}
+		return vaultError(status, b)
+	}
+	fmt.Fprintf(pending.statusWriter(), "Written private key to Vault at %s\n", path)
+	return nil
+}
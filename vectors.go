@@ -0,0 +1,165 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	vectorsCmd = app.Command("vectors", "Emit a JWE test vector set for an alg/enc pair")
+
+	vectorsAlg = vectorsCmd.Flag("alg", "Key management algorithm").Required().Enum(
+		string(jose.RSA1_5), string(jose.RSA_OAEP), string(jose.RSA_OAEP_256),
+		string(jose.ECDH_ES), string(jose.ECDH_ES_A128KW), string(jose.ECDH_ES_A192KW), string(jose.ECDH_ES_A256KW),
+	)
+	vectorsEnc = vectorsCmd.Flag("enc", "Content encryption algorithm").Required().Enum(
+		string(jose.A128CBC_HS256), string(jose.A192CBC_HS384), string(jose.A256CBC_HS512),
+		string(jose.A128GCM), string(jose.A192GCM), string(jose.A256GCM),
+	)
+	vectorsBits          = vectorsCmd.Flag("bits", "Key size in bits").Int()
+	vectorsKey           = vectorsCmd.Flag("key", "Use this private JWK (or - for stdin) instead of generating one").String()
+	vectorsPlaintext     = vectorsCmd.Flag("plaintext", "Plaintext to encrypt").Default("The true sign of intelligence is not knowledge but imagination.").String()
+	vectorsPlaintextFile = vectorsCmd.Flag("plaintext-file", "Read plaintext to encrypt from file").ExistingFile()
+	vectorsSeed          = vectorsCmd.Flag("seed", "Hex seed for the CEK/IV random stream, makes the vector reproducible").String()
+	vectorsFormat        = vectorsCmd.Flag("format", "Out JSON with format").Bool()
+)
+
+// TestVector is a self-contained JWE test case: everything another
+// implementation needs to decrypt the ciphertext and compare plaintexts.
+type TestVector struct {
+	Alg       string          `json:"alg"`
+	Enc       string          `json:"enc"`
+	Key       json.RawMessage `json:"key"`
+	PublicKey json.RawMessage `json:"public_key"`
+	Plaintext string          `json:"plaintext"`
+	Protected json.RawMessage `json:"protected"`
+	Compact   string          `json:"compact"`
+	JSON      json.RawMessage `json:"json"`
+}
+
+// seededReader is a deterministic SHA-256 counter mode stream. It is only
+// meant to make test vectors reproducible and must never back real keys.
+type seededReader struct {
+	seed    []byte
+	counter uint64
+	buf     []byte
+}
+
+func (r *seededReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			var ctr [8]byte
+			binary.BigEndian.PutUint64(ctr[:], r.counter)
+			r.counter++
+			sum := sha256.Sum256(append(append([]byte{}, r.seed...), ctr[:]...))
+			r.buf = sum[:]
+		}
+		c := copy(p[n:], r.buf)
+		r.buf = r.buf[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func vectors() {
+	keyAlg := jose.KeyAlgorithm(*vectorsAlg)
+	enc := jose.ContentEncryption(*vectorsEnc)
+
+	plaintext := []byte(*vectorsPlaintext)
+	if *vectorsPlaintextFile != "" {
+		var err error
+		plaintext, err = ioutil.ReadFile(*vectorsPlaintextFile)
+		app.FatalIfError(err, "can't read plaintext")
+	}
+
+	var privKey crypto.PrivateKey
+	var pubKey crypto.PublicKey
+	if *vectorsKey != "" {
+		key, err := readJWK(*vectorsKey)
+		app.FatalIfError(err, "can't read key %s", *vectorsKey)
+		if key.IsPublic() {
+			app.Fatalf("test vectors need a private key")
+		}
+		privKey = key.Key
+		pubKey = key.Public().Key
+	} else {
+		var err error
+		pubKey, privKey, err = keygen.Enc(keyAlg, *vectorsBits)
+		app.FatalIfError(err, "unable to generate key")
+	}
+
+	if *vectorsSeed != "" {
+		seed, err := hex.DecodeString(*vectorsSeed)
+		app.FatalIfError(err, "--seed must be hex encoded")
+		jose.RandReader = &seededReader{seed: seed}
+	}
+
+	encrypter, err := jose.NewEncrypter(enc, jose.Recipient{Algorithm: keyAlg, Key: pubKey}, nil)
+	app.FatalIfError(err, "can't create encrypter")
+	obj, err := encrypter.Encrypt(plaintext)
+	app.FatalIfError(err, "can't encrypt plaintext")
+
+	compact, err := obj.CompactSerialize()
+	app.FatalIfError(err, "can't serialize JWE")
+	protected, err := base64.RawURLEncoding.DecodeString(strings.SplitN(compact, ".", 2)[0])
+	app.FatalIfError(err, "can't decode protected header")
+
+	// Never hand out a vector we can't decrypt ourselves.
+	parsed, err := jose.ParseEncrypted(compact)
+	app.FatalIfError(err, "can't parse generated JWE")
+	decrypted, err := parsed.Decrypt(privKey)
+	app.FatalIfError(err, "can't decrypt generated JWE")
+	if string(decrypted) != string(plaintext) {
+		app.Fatalf("decrypted plaintext does not match")
+	}
+
+	priv := jose.JSONWebKey{Key: privKey, Algorithm: *vectorsAlg, Use: "enc"}
+	pub := jose.JSONWebKey{Key: pubKey, Algorithm: *vectorsAlg, Use: "enc"}
+	privJS, err := priv.MarshalJSON()
+	app.FatalIfError(err, "can't Marshal private key to JSON")
+	pubJS, err := pub.MarshalJSON()
+	app.FatalIfError(err, "can't Marshal public key to JSON")
+
+	out, err := json.Marshal(TestVector{
+		Alg:       *vectorsAlg,
+		Enc:       *vectorsEnc,
+		Key:       privJS,
+		PublicKey: pubJS,
+		Plaintext: base64.RawURLEncoding.EncodeToString(plaintext),
+		Protected: protected,
+		Compact:   compact,
+		JSON:      json.RawMessage(obj.FullSerialize()),
+	})
+	app.FatalIfError(err, "can't Marshal test vector to JSON")
+	if *vectorsFormat {
+		out = formatJSON(out)
+	}
+	fmt.Println(string(out))
+}
@@ -0,0 +1,112 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/nicksherron/jwk-keygen/internal/safeio"
+)
+
+var (
+	verifyCmd    = app.Command("verify", "Verify a JWS or JWT against a JWK or JWKS and print its header and claims")
+	verifyKeys   = verifyCmd.Flag("key", "JWK or JWKS to verify with; symmetric keys are used too").Required().String()
+	verifyToken  = verifyCmd.Flag("token", "Token to verify; read from stdin if not given").String()
+	verifyLeeway = verifyCmd.Flag("leeway", "Clock skew allowed when checking exp and nbf").Default("1m").Duration()
+	verifyCert   = verifyCmd.Flag("cert", "PEM client certificate a token with a cnf claim must be bound to").PlaceHolder("FILE").String()
+	verifyJKT    = verifyCmd.Flag("jkt", "Key thumbprint a token with a cnf claim must be bound to").String()
+	verifyIssMap = verifyCmd.Flag("issuer-map", "YAML or JSON map of issuers to the kids or thumbprints of their keys, scoping the keys like iss members").PlaceHolder("FILE").String()
+)
+
+// protectedHeader returns the protected header of a compact or JSON
+// serialized JWS, nil if there is none to decode.
+func protectedHeader(token []byte) json.RawMessage {
+	encoded := token
+	if i := bytes.IndexByte(token, '.'); i >= 0 {
+		encoded = token[:i]
+	} else {
+		var jws struct {
+			Protected  string `json:"protected"`
+			Signatures []struct {
+				Protected string `json:"protected"`
+			} `json:"signatures"`
+		}
+		if json.Unmarshal(token, &jws) != nil {
+			return nil
+		}
+		if jws.Protected == "" && len(jws.Signatures) > 0 {
+			jws.Protected = jws.Signatures[0].Protected
+		}
+		encoded = []byte(jws.Protected)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(string(encoded))
+	if err != nil || !json.Valid(b) {
+		return nil
+	}
+	return b
+}
+
+func verifyJWS() {
+	if *verifyKeys == "-" && *verifyToken == "" {
+		app.FatalUsage("the token is read from stdin, so --key can't be")
+	}
+	var issuerMap map[string][]string
+	if *verifyIssMap != "" {
+		var err error
+		issuerMap, err = readIssuerMap(*verifyIssMap)
+		app.FatalIfError(err, "can't read issuer map %s", *verifyIssMap)
+	}
+	keys, issuers, err := loadIssuerKeys(*verifyKeys, issuerMap, true)
+	app.FatalIfError(err, "can't load keys from %s", *verifyKeys)
+
+	token := []byte(*verifyToken)
+	if *verifyToken == "" {
+		token, err = safeio.ReadAll(os.Stdin, inputLimits())
+		app.FatalIfError(err, "can't read token")
+	}
+	token = bytes.TrimSpace(token)
+
+	if header := protectedHeader(token); header != nil {
+		fmt.Println("==> header <==")
+		fmt.Println(string(formatJSON(header)))
+	}
+	presented := Confirmation{JKT: *verifyJKT}
+	if *verifyCert != "" {
+		certs, err := readCertificatesPEM(*verifyCert)
+		app.FatalIfError(err, "can't read %s", *verifyCert)
+		presented.X5tS256 = certThumbprint(certs[0])
+	}
+
+	s := &keyServer{keys: keys, issuers: issuers, leeway: *verifyLeeway}
+	res := s.verify(token, presented)
+	if res.Claims != nil {
+		fmt.Println("==> claims <==")
+		fmt.Println(string(formatJSON(res.Claims)))
+	}
+	if !res.Valid {
+		app.Fatalf("%s", res.Error)
+	}
+	if issuers != nil {
+		fmt.Printf("Verified with kid %q of issuer %q (%s)\n", res.KeyID, res.Issuer, res.Algorithm)
+		return
+	}
+	fmt.Printf("Verified with kid %q (%s)\n", res.KeyID, res.Algorithm)
+}
@@ -0,0 +1,44 @@
+// Loads jwk-keygen.wasm, built with GOOS=js GOARCH=wasm, and returns its
+// generate, convert and inspect functions. Go's wasm_exec.js must be loaded
+// first, for globalThis.Go.
+//
+//   const kg = await loadJwkKeygen("jwk-keygen.wasm");
+//   const { private: priv, public: pub } = kg.generate({ use: "sig", alg: "ES256", randomKid: true });
+//
+// source is a URL, or the module's bytes as an ArrayBuffer or Uint8Array.
+export async function loadJwkKeygen(source) {
+  const go = new globalThis.Go();
+  let instance;
+  if (typeof source === "string" || source instanceof URL) {
+    const response = fetch(source);
+    if (WebAssembly.instantiateStreaming) {
+      ({ instance } = await WebAssembly.instantiateStreaming(response, go.importObject));
+    } else {
+      const bytes = await (await response).arrayBuffer();
+      ({ instance } = await WebAssembly.instantiate(bytes, go.importObject));
+    }
+  } else {
+    ({ instance } = await WebAssembly.instantiate(source, go.importObject));
+  }
+  // The Go program never exits: it registers jwkKeygen and then waits.
+  go.run(instance);
+  const api = globalThis.jwkKeygen;
+  if (!api) {
+    throw new Error("jwk-keygen.wasm didn't register jwkKeygen");
+  }
+  const call = (name) => (...args) => {
+    const r = api[name](...args);
+    if (r.error !== undefined) {
+      throw new Error(r.error);
+    }
+    return JSON.parse(r.result);
+  };
+  return {
+    // generate({use, alg, bits, crv, kid, randomKid}) returns {private, public}.
+    generate: call("generate"),
+    // convert(pemOrJwkOrDer, {use, alg, kid}) returns {private, public}.
+    convert: call("convert"),
+    // inspect(jwkOrJwks) returns the same objects as inspect --json.
+    inspect: call("inspect"),
+  };
+}
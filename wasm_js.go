@@ -0,0 +1,104 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"syscall/js"
+)
+
+// serveJS exposes the bindings to JavaScript as the jwkKeygen global,
+// which wasm/jwk-keygen.js wraps, and never returns: a browser has no
+// command line to run. Each function returns {result}, holding JSON, or
+// {error}.
+func serveJS() {
+	api := js.Global().Get("Object").New()
+	api.Set("generate", jsFunc(func(args []js.Value) (interface{}, error) {
+		return bindGenerate(jsOptions(jsArg(args, 0)))
+	}))
+	api.Set("convert", jsFunc(func(args []js.Value) (interface{}, error) {
+		b, err := jsBytes(jsArg(args, 0))
+		if err != nil {
+			return nil, err
+		}
+		return bindConvert(b, jsOptions(jsArg(args, 1)))
+	}))
+	api.Set("inspect", jsFunc(func(args []js.Value) (interface{}, error) {
+		b, err := jsBytes(jsArg(args, 0))
+		if err != nil {
+			return nil, err
+		}
+		return bindInspect(b)
+	}))
+	js.Global().Set("jwkKeygen", api)
+	select {}
+}
+
+func jsFunc(f func(args []js.Value) (interface{}, error)) js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		v, err := f(args)
+		if err == nil {
+			var b []byte
+			if b, err = json.Marshal(v); err == nil {
+				return map[string]interface{}{"result": string(b)}
+			}
+		}
+		return map[string]interface{}{"error": err.Error()}
+	})
+}
+
+// jsArg returns args[i], or undefined if there are fewer arguments.
+func jsArg(args []js.Value, i int) js.Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return js.Undefined()
+}
+
+// jsOptions reads an options object, ignoring members of the wrong type.
+func jsOptions(v js.Value) bindingOptions {
+	var o bindingOptions
+	if v.Type() != js.TypeObject {
+		return o
+	}
+	str := func(name string) string {
+		if m := v.Get(name); m.Type() == js.TypeString {
+			return m.String()
+		}
+		return ""
+	}
+	o.Use, o.Alg, o.Curve, o.KeyID = str("use"), str("alg"), str("crv"), str("kid")
+	if bits := v.Get("bits"); bits.Type() == js.TypeNumber {
+		o.Bits = bits.Int()
+	}
+	o.RandomKID = v.Get("randomKid").Truthy()
+	return o
+}
+
+// jsBytes takes a string or a Uint8Array, as DER can't be a string.
+func jsBytes(v js.Value) ([]byte, error) {
+	switch {
+	case v.Type() == js.TypeString:
+		return []byte(v.String()), nil
+	case v.InstanceOf(js.Global().Get("Uint8Array")):
+		b := make([]byte, v.Length())
+		js.CopyBytesToGo(b, v)
+		return b, nil
+	}
+	return nil, errors.New("expected a string or Uint8Array")
+}
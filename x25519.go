@@ -0,0 +1,44 @@
+/*-
+ * Copyright 2017 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+
+	"github.com/nicksherron/jwk-keygen/pkg/keygen"
+)
+
+// X25519 is the RFC 8037 curve name of X25519 ECDH keys.
+const X25519 = "X25519"
+
+// rawJWK reports whether the key asked for is one go-jose can't hold, so
+// that its JWK is built by hand: X25519 and ES256K keys.
+func rawJWK() bool {
+	return *crv == X25519 || *alg == keygen.ES256K
+}
+
+func runX25519() {
+	x, d, err := keygen.X25519()
+	app.FatalIfError(err, "unable to generate key")
+
+	enc := base64.RawURLEncoding
+	pub := okpJSONWebKey{Use: *use, Kty: "OKP", Kid: *kid, Crv: X25519, Alg: *alg, X: enc.EncodeToString(x)}
+	priv := pub
+	priv.D = enc.EncodeToString(d)
+	priv.KeyOps, pub.KeyOps = splitKeyOps()
+	emitRawJWK(priv, pub)
+}